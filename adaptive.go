@@ -0,0 +1,114 @@
+package s3
+
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+// aimdLimiter bounds in-flight requests with an additive-increase,
+// multiplicative-decrease limit: every successful request grows the limit
+// by 1/limit, i.e. by one per round of requests, and every throttled
+// response halves it.
+type aimdLimiter struct {
+	min, max float64
+
+	mu       sync.Mutex
+	limit    float64
+	inFlight int
+	waiters  []chan struct{}
+}
+
+func newAIMDLimiter(min, max int) *aimdLimiter {
+	if min <= 0 {
+		min = 1
+	}
+	if max < min {
+		max = min
+	}
+	return &aimdLimiter{min: float64(min), max: float64(max), limit: float64(min)}
+}
+
+func (l *aimdLimiter) acquire(ctx context.Context) error {
+	for {
+		l.mu.Lock()
+		if l.inFlight < int(l.limit) {
+			l.inFlight++
+			l.mu.Unlock()
+			return nil
+		}
+		wake := make(chan struct{})
+		l.waiters = append(l.waiters, wake)
+		l.mu.Unlock()
+
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// release ends a request; throttled reports whether the gateway asked us
+// to slow down.
+func (l *aimdLimiter) release(throttled bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.inFlight--
+	if throttled {
+		l.limit /= 2
+		if l.limit < l.min {
+			l.limit = l.min
+		}
+	} else {
+		l.limit += 1 / l.limit
+		if l.limit > l.max {
+			l.limit = l.max
+		}
+	}
+	for _, wake := range l.waiters {
+		close(wake)
+	}
+	l.waiters = nil
+}
+
+func (l *aimdLimiter) current() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int(l.limit)
+}
+
+type adaptiveTransport struct {
+	next    http.RoundTripper
+	limiter *aimdLimiter
+}
+
+func isThrottled(resp *http.Response) bool {
+	return resp.StatusCode == http.StatusServiceUnavailable || resp.StatusCode == http.StatusTooManyRequests
+}
+
+func (t *adaptiveTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if err := t.limiter.acquire(r.Context()); err != nil {
+		return nil, err
+	}
+	resp, err := t.next.RoundTrip(r)
+	if err != nil {
+		t.limiter.release(false)
+		return nil, err
+	}
+	throttled := isThrottled(resp)
+	resp.Body = &releaseOnClose{ReadCloser: resp.Body, release: func() {
+		t.limiter.release(throttled)
+	}}
+	return resp, nil
+}
+
+// Concurrency returns the number of requests currently allowed in flight:
+// the adaptive limit with AdaptiveConcurrency, Workers otherwise.
+func (s *S3Bucket) Concurrency() int {
+	if s.adaptive == nil {
+		return s.Workers
+	}
+	return s.adaptive.current()
+}
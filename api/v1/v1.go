@@ -0,0 +1,326 @@
+// Package v1 is the stable API of the s3ds datastore.
+//
+// Everything exported here keeps working, with the same meaning, for as
+// long as this package exists: fields, methods and constants are only
+// ever added. Breaking changes go into a new package next to it. The root
+// package is the implementation and may change between any two releases;
+// importers outside this repository should use this package instead.
+package v1
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+
+	s3ds "github.com/ipfs-s3c-storj-plugin"
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+)
+
+// Version is the version of the datastore.
+const Version = s3ds.Version
+
+// Configuration.
+type (
+	Config              = s3ds.Config
+	OpLimit             = s3ds.OpLimit
+	OpTimeouts          = s3ds.OpTimeouts
+	TransportConfig     = s3ds.TransportConfig
+	EndpointConfig      = s3ds.EndpointConfig
+	ReplicaConfig       = s3ds.ReplicaConfig
+	Grants              = s3ds.Grants
+	RouteConfig         = s3ds.RouteConfig
+	TenantConfig        = s3ds.TenantConfig
+	Codec               = s3ds.Codec
+	Interceptor         = s3ds.Interceptor
+	Call                = s3ds.Call
+	Logger              = s3ds.Logger
+	S3Client            = s3ds.S3Client
+	ClientOption        = s3ds.ClientOption
+	PriceTable          = s3ds.PriceTable
+	LifecycleConfig     = s3ds.LifecycleConfig
+	LifecycleTransition = s3ds.LifecycleTransition
+	TieringConfig       = s3ds.TieringConfig
+	ChaosConfig         = s3ds.ChaosConfig
+	NotificationConfig  = s3ds.NotificationConfig
+	BreakerConfig       = s3ds.BreakerConfig
+	LogLevel            = s3ds.LogLevel
+)
+
+// Values of Config fields.
+const (
+	KeyTransformRaw    = s3ds.KeyTransformRaw
+	KeyTransformFlatfs = s3ds.KeyTransformFlatfs
+
+	ExistenceCheckHead = s3ds.ExistenceCheckHead
+	ExistenceCheckList = s3ds.ExistenceCheckList
+
+	AddressingPath          = s3ds.AddressingPath
+	AddressingVirtualHosted = s3ds.AddressingVirtualHosted
+
+	SkipExistingHas         = s3ds.SkipExistingHas
+	SkipExistingConditional = s3ds.SkipExistingConditional
+
+	EndpointPolicyOrder    = s3ds.EndpointPolicyOrder
+	EndpointPolicyWeighted = s3ds.EndpointPolicyWeighted
+	EndpointPolicyLatency  = s3ds.EndpointPolicyLatency
+
+	CompressionGzip = s3ds.CompressionGzip
+
+	OpPutObject  = s3ds.OpPutObject
+	OpGetObject  = s3ds.OpGetObject
+	OpHead       = s3ds.OpHead
+	OpList       = s3ds.OpList
+	OpDeleteMany = s3ds.OpDeleteMany
+	OpCopyObject = s3ds.OpCopyObject
+
+	EventPut    = s3ds.EventPut
+	EventDelete = s3ds.EventDelete
+
+	FeaturePacking       = s3ds.FeaturePacking
+	FeatureCompression   = s3ds.FeatureCompression
+	FeatureNegativeCache = s3ds.FeatureNegativeCache
+	FeatureWriteDedup    = s3ds.FeatureWriteDedup
+	FeatureWriteBehind   = s3ds.FeatureWriteBehind
+
+	BucketEncryptionAES256 = s3ds.BucketEncryptionAES256
+	BucketEncryptionKMS    = s3ds.BucketEncryptionKMS
+
+	LevelDebug = s3ds.LevelDebug
+	LevelInfo  = s3ds.LevelInfo
+	LevelWarn  = s3ds.LevelWarn
+	LevelError = s3ds.LevelError
+	LevelOff   = s3ds.LevelOff
+
+	LogFormatText = s3ds.LogFormatText
+	LogFormatJSON = s3ds.LogFormatJSON
+
+	LogS3          = s3ds.LogS3
+	LogBatch       = s3ds.LogBatch
+	LogWriteBehind = s3ds.LogWriteBehind
+	LogFlags       = s3ds.LogFlags
+	LogHeatmap     = s3ds.LogHeatmap
+	LogReplica     = s3ds.LogReplica
+	LogCompact     = s3ds.LogCompact
+	LogAudit       = s3ds.LogAudit
+	LogLease       = s3ds.LogLease
+	LogGateway     = s3ds.LogGateway
+	LogNotify      = s3ds.LogNotify
+	LogChanges     = s3ds.LogChanges
+)
+
+// Errors. Compare with ==, or for BatchError and Error use a type
+// assertion. Errors from the bucket are classified by ErrorClass.
+var (
+	ErrReadOnly = s3ds.ErrReadOnly
+	ErrDryRun   = s3ds.ErrDryRun
+	ErrClosed   = s3ds.ErrClosed
+
+	ErrThrottled     = s3ds.ErrThrottled
+	ErrAuth          = s3ds.ErrAuth
+	ErrBucketMissing = s3ds.ErrBucketMissing
+	ErrTimeout       = s3ds.ErrTimeout
+	ErrArchived      = s3ds.ErrArchived
+
+	ErrDeadlineExceeded = s3ds.ErrDeadlineExceeded
+
+	ErrChecksumMismatch = s3ds.ErrChecksumMismatch
+	ErrLeaseHeld        = s3ds.ErrLeaseHeld
+
+	ErrBackendUnavailable = s3ds.ErrBackendUnavailable
+	ErrQuotaExceeded      = s3ds.ErrQuotaExceeded
+)
+
+type (
+	BatchError    = s3ds.BatchError
+	ShutdownError = s3ds.ShutdownError
+	Error         = s3ds.Error
+	DeadlineError = s3ds.DeadlineError
+)
+
+// Event is a put or delete delivered to Subscribe callbacks.
+type Event = s3ds.Event
+
+// Results of operations.
+type (
+	MigrateOptions  = s3ds.MigrateOptions
+	MigrateProgress = s3ds.MigrateProgress
+	PrefixStats     = s3ds.PrefixStats
+	AuditManifest   = s3ds.AuditManifest
+	AuditFailure    = s3ds.AuditFailure
+	PackStats       = s3ds.PackStats
+	CompactResult   = s3ds.CompactResult
+	GCResult        = s3ds.GCResult
+	PreloadResult   = s3ds.PreloadResult
+	VerifyResult    = s3ds.VerifyResult
+	CostReport      = s3ds.CostReport
+	SnapshotResult  = s3ds.SnapshotResult
+	PurgeResult     = s3ds.PurgeResult
+	Tombstone       = s3ds.Tombstone
+	Change          = s3ds.Change
+	Stats           = s3ds.Stats
+	OpStats         = s3ds.OpStats
+	CacheStats      = s3ds.CacheStats
+	HotPrefix       = s3ds.HotPrefix
+	IAMPolicy       = s3ds.IAMPolicy
+	IAMStatement    = s3ds.IAMStatement
+	StorjShare      = s3ds.StorjShare
+	RepairProgress  = s3ds.RepairProgress
+	SegmentStats    = s3ds.SegmentStats
+	QuotaStats      = s3ds.QuotaStats
+	ListingDigest   = s3ds.ListingDigest
+)
+
+// Blockstore is a boxo blockstore.Blockstore of the datastore's blocks.
+type Blockstore = s3ds.Blockstore
+
+// Datastore is the datastore as returned by New.
+type Datastore interface {
+	ds.Batching
+
+	// Flush blocks until every Put accepted so far is in the bucket.
+	Flush() error
+
+	GetRange(ctx context.Context, k ds.Key, offset, length int64) ([]byte, error)
+	GetMany(ctx context.Context, keys []ds.Key) ([][]byte, error)
+	HasMany(ctx context.Context, keys []ds.Key) ([]bool, error)
+	GetSizeMany(ctx context.Context, keys []ds.Key) ([]int, error)
+	PresignGet(ctx context.Context, k ds.Key, expiry time.Duration) (string, error)
+
+	DeletePrefix(ctx context.Context, prefix string, progress func(deleted int)) (int, error)
+	Copy(ctx context.Context, src, dst ds.Key) error
+	Rename(ctx context.Context, src, dst ds.Key) error
+	Blockstore() *Blockstore
+	Keys(ctx context.Context, prefix string) (<-chan ds.Key, error)
+	Preload(ctx context.Context, keys []ds.Key) (PreloadResult, error)
+	PreloadPrefix(ctx context.Context, prefix string) (PreloadResult, error)
+	Reprovide(ctx context.Context, prefix string, interval time.Duration, announce func([]cid.Cid) error) (int, error)
+	Subscribe(fn func(Event)) (unsubscribe func())
+
+	Export(ctx context.Context, w io.Writer, prefix string) error
+	ImportCAR(ctx context.Context, r io.Reader) (int, error)
+	Migrate(ctx context.Context, src ds.Datastore, opts MigrateOptions) (MigrateProgress, error)
+
+	CaptureManifest(ctx context.Context, name string) (int, error)
+	ListSince(ctx context.Context, name, prefix string, fn func([]ds.Key) error) (int, error)
+	Snapshot(ctx context.Context, label string) (SnapshotResult, error)
+	RestoreSnapshot(ctx context.Context, label string) (SnapshotResult, error)
+	Undelete(ctx context.Context, k ds.Key) error
+	Purge(ctx context.Context, retention time.Duration) (PurgeResult, error)
+	ListTombstones(ctx context.Context, prefix string) ([]Tombstone, error)
+	ReadChangeLog(ctx context.Context, since time.Time) ([]Change, error)
+	ApplyGrants(ctx context.Context, prefix string) (int, error)
+	ApplyLifecycle(ctx context.Context, conf LifecycleConfig) (int, error)
+	WriteAuditManifest(ctx context.Context, name string, keys []ds.Key) (AuditManifest, error)
+	ReadAuditReport(ctx context.Context, bucket, prefix string) ([]AuditFailure, error)
+
+	FeatureEnabled(feature string, k ds.Key) bool
+	SetFeatureRollout(rollout map[string]float64) error
+
+	Compact(ctx context.Context) (CompactResult, error)
+	PackStats() PackStats
+	GC(ctx context.Context) (GCResult, error)
+	Verify(ctx context.Context, prefix string) (VerifyResult, error)
+	Repair(ctx context.Context, prefix string, progress func(RepairProgress)) (RepairProgress, error)
+	UpdateDigest(ctx context.Context) (ListingDigest, error)
+	ReadDigest(ctx context.Context) (ListingDigest, error)
+	ReplicaDivergence(ctx context.Context) ([]string, error)
+
+	Heatmap() map[string]PrefixStats
+	Costs() CostReport
+	Stats() Stats
+	Concurrency() int
+	SmallValueThreshold() int
+
+	DumpState(reason string) error
+	RecoverAndDump()
+}
+
+// New opens the datastore described by conf.
+func New(conf Config) (Datastore, error) {
+	d, err := s3ds.NewS3Datastore(conf)
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// ParseLogLevel parses "debug", "info", "warn", "error" or "off".
+func ParseLogLevel(name string) (LogLevel, error) {
+	return s3ds.ParseLogLevel(name)
+}
+
+// SlogLogger adapts l to Logger.
+func SlogLogger(l *slog.Logger) Logger {
+	return s3ds.SlogLogger(l)
+}
+
+// RegisterCodec makes c available by name to Config.CodecNames and the
+// "codecs" of a datastore spec.
+func RegisterCodec(c Codec) error {
+	return s3ds.RegisterCodec(c)
+}
+
+// Tenant returns the datastore of the tenant called name in d's Tenants.
+// It is closed with d.
+func Tenant(d Datastore, name string) (Datastore, error) {
+	b, ok := d.(*s3ds.S3Bucket)
+	if !ok {
+		return nil, fmt.Errorf("s3ds: %T has no tenants", d)
+	}
+	t, err := b.Tenant(name)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// ScopedPolicy returns the least-privilege IAM policy for a datastore
+// opened with conf.
+func ScopedPolicy(conf Config) (IAMPolicy, error) {
+	return s3ds.ScopedPolicy(conf)
+}
+
+// StorjShareCommand returns the uplink command creating an access grant
+// for a datastore opened with conf.
+func StorjShareCommand(conf Config) (string, error) {
+	return s3ds.StorjShareCommand(conf)
+}
+
+// RestrictedStorjShareCommandLine returns the uplink command, quoted for a
+// shell, creating an access grant for a datastore opened with conf,
+// restricted by share.
+func RestrictedStorjShareCommandLine(conf Config, share StorjShare) (string, error) {
+	return s3ds.RestrictedStorjShareCommandLine(conf, share)
+}
+
+// DiffDigests returns the shards whose keys differ between a and b.
+func DiffDigests(a, b ListingDigest) []string {
+	return s3ds.DiffDigests(a, b)
+}
+
+// ErrorClass returns ErrThrottled, ErrAuth, ErrBucketMissing, ErrTimeout,
+// ErrDeadlineExceeded, ErrArchived, ErrChecksumMismatch or ds.ErrNotFound
+// for an error in one of these classes, and nil otherwise.
+func ErrorClass(err error) error {
+	return s3ds.ErrorClass(err)
+}
+
+// WriteHeatmapJSON writes stats as JSON.
+func WriteHeatmapJSON(w io.Writer, stats map[string]PrefixStats) error {
+	return s3ds.WriteHeatmapJSON(w, stats)
+}
+
+// WriteHeatmapPrometheus writes stats in the Prometheus text format.
+func WriteHeatmapPrometheus(w io.Writer, stats map[string]PrefixStats) error {
+	return s3ds.WriteHeatmapPrometheus(w, stats)
+}
+
+// WriteCostPrometheus writes a cost report in the Prometheus text format.
+func WriteCostPrometheus(w io.Writer, r CostReport) error {
+	return s3ds.WriteCostPrometheus(w, r)
+}
+
+var _ Datastore = (*s3ds.S3Bucket)(nil)
@@ -0,0 +1,212 @@
+package s3
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	ds "github.com/ipfs/go-datastore"
+)
+
+// ErrDryRun is returned by maintenance operations, which cannot be
+// simulated, on a datastore in DryRun mode.
+var ErrDryRun = errors.New("s3ds: datastore is in dry-run mode")
+
+const (
+	// auditDirectory holds the audit stream under the bookkeeping
+	// directory.
+	auditDirectory = "audit"
+
+	defaultAuditInterval = time.Minute
+
+	// auditFlushSize uploads the buffered records early once they reach
+	// this many bytes.
+	auditFlushSize = 1 << 20
+)
+
+// Mutating operations named in audit records.
+const (
+	auditPut    = "put"
+	auditDelete = "delete"
+)
+
+// auditRecord is one line of the audit log.
+type auditRecord struct {
+	Time   time.Time `json:"time"`
+	Op     string    `json:"op"`
+	Key    string    `json:"key,omitempty"`
+	Size   int       `json:"size,omitempty"`
+	Caller string    `json:"caller"`
+	DryRun bool      `json:"dryRun,omitempty"`
+}
+
+// auditor records mutating operations before they are executed.
+type auditor struct {
+	s      *S3Bucket
+	dryRun bool
+	log    *subLogger
+
+	mu     sync.Mutex
+	file   *os.File
+	bucket bool
+	buf    bytes.Buffer
+}
+
+func newAuditor(s *S3Bucket) (*auditor, error) {
+	a := &auditor{
+		s:      s,
+		dryRun: s.DryRun,
+		log:    s.logs.get(LogAudit),
+		bucket: s.AuditToBucket,
+	}
+	if s.AuditLog != "" {
+		f, err := os.OpenFile(s.AuditLog, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("s3ds: opening audit log: %s", err)
+		}
+		a.file = f
+	}
+	if a.bucket {
+		interval := s.AuditInterval
+		if interval <= 0 {
+			interval = defaultAuditInterval
+		}
+		go a.flushLoop(interval)
+	}
+	return a, nil
+}
+
+// record logs an operation. It reports whether the operation should go
+// ahead, which it does unless the datastore is in DryRun mode.
+func (a *auditor) record(caller, op string, k ds.Key, size int) bool {
+	r := auditRecord{
+		Time:   time.Now().UTC(),
+		Op:     op,
+		Size:   size,
+		Caller: caller,
+		DryRun: a.dryRun,
+	}
+	if k.String() != "/" {
+		r.Key = k.String()
+	}
+	if a.file == nil && !a.bucket {
+		// Only DryRun gets here; without a sink the log is the record.
+		a.log.Warnf("dry run: %s %s (%d bytes) from %s", op, r.Key, size, caller)
+		return false
+	}
+
+	line, err := json.Marshal(r)
+	if err != nil {
+		a.log.Errorf("encoding audit record: %s", err)
+		return !a.dryRun
+	}
+	line = append(line, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file != nil {
+		if _, err := a.file.Write(line); err != nil {
+			a.log.Errorf("writing audit log: %s", err)
+		}
+	}
+	if a.bucket {
+		a.buf.Write(line)
+		if a.buf.Len() >= auditFlushSize {
+			a.flushLocked()
+		}
+	}
+	return !a.dryRun
+}
+
+// flushLocked uploads the buffered records as a new object of the audit
+// stream. Records that could not be uploaded are kept for the next flush.
+func (a *auditor) flushLocked() {
+	if a.buf.Len() == 0 {
+		return
+	}
+	now := time.Now().UTC()
+	name := a.s.metaPath(path.Join(auditDirectory, now.Format("2006/01/02"),
+		fmt.Sprintf("%s-%08x.jsonl", now.Format("150405.000000000"), rand.Uint32())))
+	_, err := a.s.S3.PutObject(&s3.PutObjectInput{
+		Bucket:      aws.String(a.s.Bucket),
+		Key:         aws.String(name),
+		Body:        bytes.NewReader(a.buf.Bytes()),
+		ContentType: aws.String("application/x-ndjson"),
+	})
+	if err != nil {
+		a.log.Errorf("uploading audit records: %s", err)
+		return
+	}
+	a.buf.Reset()
+}
+
+func (a *auditor) flushLoop(interval time.Duration) {
+	defer a.s.RecoverAndDump()
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-a.s.done:
+			return
+		}
+		a.mu.Lock()
+		a.flushLocked()
+		a.mu.Unlock()
+	}
+}
+
+func (a *auditor) close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.bucket {
+		a.flushLocked()
+	}
+	if a.file != nil {
+		return a.file.Close()
+	}
+	return nil
+}
+
+// audit records a mutating operation if auditing is on, and reports
+// whether it should be executed.
+func (s *S3Bucket) audit(caller, op string, k ds.Key, size int) bool {
+	if s.auditor == nil {
+		return true
+	}
+	return s.auditor.record(caller, op, k, size)
+}
+
+// auditMaintenance records a maintenance operation, which is refused in
+// DryRun mode.
+func (s *S3Bucket) auditMaintenance(caller, op, prefix string) error {
+	if s.auditor == nil {
+		return nil
+	}
+	if !s.auditor.record(caller, op, ds.NewKey(prefix), 0) {
+		return ErrDryRun
+	}
+	return nil
+}
+
+// auditOps records the operations of a batch about to be committed.
+func (b *s3Batch) auditOps(a *auditor) bool {
+	run := true
+	for _, op := range b.sortedOps() {
+		if op.delete {
+			run = a.record("Batch", auditDelete, op.key, 0) && run
+		} else {
+			run = a.record("Batch", auditPut, op.key, len(op.val)) && run
+		}
+	}
+	return run
+}
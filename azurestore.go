@@ -0,0 +1,281 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/streaming"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blockblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+	ds "github.com/ipfs/go-datastore"
+)
+
+// providerAzure selects Azure Blob Storage. Bucket names the container.
+const providerAzure = "azure"
+
+// azureBatchMax is the largest number of sub-requests in a blob batch.
+const azureBatchMax = 256
+
+// azureStore is the ObjectStore of an Azure Blob Storage container. Object
+// names are used as blob names unchanged.
+type azureStore struct {
+	container *container.Client
+	checksums bool
+}
+
+// newAzureStore opens the container conf.Bucket of conf.AzureAccount,
+// authenticated with the shared key conf.AzureKey, or the managed identity
+// of the host if that is empty. Endpoint, if set, replaces the account's
+// blob service URL, e.g. for Azurite.
+func newAzureStore(conf *Config) (*azureStore, error) {
+	service := conf.Endpoint
+	if service == "" {
+		service = fmt.Sprintf("https://%s.blob.core.windows.net", conf.AzureAccount)
+	}
+	containerURL, err := url.JoinPath(service, conf.Bucket)
+	if err != nil {
+		return nil, fmt.Errorf("s3ds: azure container url: %s", err)
+	}
+
+	var client *container.Client
+	if conf.AzureKey != "" {
+		cred, cerr := container.NewSharedKeyCredential(conf.AzureAccount, conf.AzureKey)
+		if cerr != nil {
+			return nil, fmt.Errorf("s3ds: azure shared key: %s", cerr)
+		}
+		client, err = container.NewClientWithSharedKeyCredential(containerURL, cred, nil)
+	} else {
+		opts := &azidentity.ManagedIdentityCredentialOptions{}
+		if conf.AzureClientID != "" {
+			opts.ID = azidentity.ClientID(conf.AzureClientID)
+		}
+		cred, cerr := azidentity.NewManagedIdentityCredential(opts)
+		if cerr != nil {
+			return nil, fmt.Errorf("s3ds: azure managed identity: %s", cerr)
+		}
+		client, err = container.NewClient(containerURL, cred, nil)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("s3ds: creating azure client: %s", err)
+	}
+	return &azureStore{container: client, checksums: conf.Checksums}, nil
+}
+
+var _ ObjectStore = (*azureStore)(nil)
+
+func (st *azureStore) PutObject(ctx context.Context, name string, body []byte, opts PutOptions) error {
+	upload := &blockblob.UploadOptions{}
+	if len(opts.Metadata) > 0 {
+		upload.Metadata = make(map[string]*string, len(opts.Metadata))
+		for k, v := range opts.Metadata {
+			upload.Metadata[strings.ReplaceAll(k, "-", "_")] = to.Ptr(v)
+		}
+	}
+	if opts.Tags != "" {
+		tags, err := url.ParseQuery(opts.Tags)
+		if err != nil {
+			return fmt.Errorf("s3ds: invalid tags %q: %s", opts.Tags, err)
+		}
+		upload.Tags = make(map[string]string, len(tags))
+		for k, v := range tags {
+			upload.Tags[k] = v[0]
+		}
+	}
+	if opts.StorageClass != "" {
+		upload.Tier = to.Ptr(blob.AccessTier(opts.StorageClass))
+	}
+	if opts.IfAbsent {
+		upload.AccessConditions = &blob.AccessConditions{
+			ModifiedAccessConditions: &blob.ModifiedAccessConditions{
+				IfNoneMatch: to.Ptr(azcore.ETagAny),
+			},
+		}
+	}
+
+	if st.checksums {
+		sum := md5.Sum(body)
+		upload.TransactionalValidation = blob.TransferValidationTypeMD5(sum[:])
+	}
+
+	blobClient := st.container.NewBlockBlobClient(name)
+	_, err := blobClient.Upload(ctx, streaming.NopCloser(bytes.NewReader(body)), upload)
+	if opts.IfAbsent && bloberror.HasCode(err, bloberror.BlobAlreadyExists, bloberror.ConditionNotMet) {
+		return ErrObjectExists
+	}
+	if bloberror.HasCode(err, bloberror.MD5Mismatch) {
+		return checksumError(name, "md5")
+	}
+	return azureError(err)
+}
+
+func (st *azureStore) GetObject(ctx context.Context, name string) ([]byte, ObjectInfo, error) {
+	data, info, err := st.getObject(ctx, name)
+	if ErrorClass(err) == ErrChecksumMismatch {
+		data, info, err = st.getObject(ctx, name)
+	}
+	return data, info, err
+}
+
+func (st *azureStore) getObject(ctx context.Context, name string) ([]byte, ObjectInfo, error) {
+	resp, err := st.container.NewBlobClient(name).DownloadStream(ctx, nil)
+	if err != nil {
+		return nil, ObjectInfo{}, azureError(err)
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, ObjectInfo{}, azureError(err)
+	}
+	// Blobs uploaded in one request have the MD5 of their content.
+	if st.checksums && len(resp.ContentMD5) == md5.Size {
+		if sum := md5.Sum(data); !bytes.Equal(sum[:], resp.ContentMD5) {
+			return nil, ObjectInfo{}, checksumError(name, "md5")
+		}
+	}
+	return data, ObjectInfo{
+		Name:     name,
+		Size:     int64(len(data)),
+		Metadata: azureMetadata(resp.Metadata),
+	}, nil
+}
+
+func (st *azureStore) Head(ctx context.Context, name string) (ObjectInfo, error) {
+	resp, err := st.container.NewBlobClient(name).GetProperties(ctx, nil)
+	if err != nil {
+		return ObjectInfo{}, azureError(err)
+	}
+	var size int64
+	if resp.ContentLength != nil {
+		size = *resp.ContentLength
+	}
+	return ObjectInfo{
+		Name:     name,
+		Size:     size,
+		Metadata: azureMetadata(resp.Metadata),
+	}, nil
+}
+
+func (st *azureStore) List(ctx context.Context, prefix, token string, max int) ([]ObjectInfo, string, error) {
+	if max <= 0 || max > listMax {
+		max = listMax
+	}
+	opts := &container.ListBlobsFlatOptions{
+		Prefix:     to.Ptr(prefix),
+		MaxResults: to.Ptr(int32(max)),
+	}
+	if token != "" {
+		opts.Marker = to.Ptr(token)
+	}
+	resp, err := st.container.NewListBlobsFlatPager(opts).NextPage(ctx)
+	if err != nil {
+		return nil, "", azureError(err)
+	}
+
+	var objs []ObjectInfo
+	if resp.Segment != nil {
+		objs = make([]ObjectInfo, 0, len(resp.Segment.BlobItems))
+		for _, item := range resp.Segment.BlobItems {
+			obj := ObjectInfo{Name: *item.Name}
+			if item.Properties != nil && item.Properties.ContentLength != nil {
+				obj.Size = *item.Properties.ContentLength
+			}
+			if item.Properties != nil && item.Properties.LastModified != nil {
+				obj.LastModified = *item.Properties.LastModified
+			}
+			objs = append(objs, obj)
+		}
+	}
+	var next string
+	if resp.NextMarker != nil {
+		next = *resp.NextMarker
+	}
+	return objs, next, nil
+}
+
+// DeleteMany deletes the blobs with blob batch requests of up to 256
+// deletes each.
+func (st *azureStore) DeleteMany(ctx context.Context, names []string) error {
+	var errs []string
+	for i := 0; i < len(names); i += azureBatchMax {
+		end := i + azureBatchMax
+		if end > len(names) {
+			end = len(names)
+		}
+		bb, err := st.container.NewBatchBuilder()
+		if err != nil {
+			return err
+		}
+		for _, name := range names[i:end] {
+			if err := bb.Delete(name, nil); err != nil {
+				return err
+			}
+		}
+		resp, err := st.container.SubmitBatch(ctx, bb, nil)
+		if err != nil {
+			return azureError(err)
+		}
+		for _, item := range resp.Responses {
+			if item.Error != nil && !bloberror.HasCode(item.Error, bloberror.BlobNotFound) {
+				errs = append(errs, item.Error.Error())
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to delete objects: %s", errs)
+	}
+	return nil
+}
+
+// azureMetadata converts blob metadata to the keys of ObjectInfo. Metadata
+// names have to be C# identifiers, so PutObject stores dashes as
+// underscores.
+func azureMetadata(meta map[string]*string) map[string]string {
+	m := objectMetadata(meta)
+	for k, v := range m {
+		if name := strings.ReplaceAll(k, "_", "-"); name != k {
+			delete(m, k)
+			m[name] = v
+		}
+	}
+	return m
+}
+
+// azureError classifies an error of the Azure client like parseError does
+// those of the S3 SDK.
+func azureError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if bloberror.HasCode(err, bloberror.BlobNotFound) {
+		return ds.ErrNotFound
+	}
+
+	var class error
+	var rerr *azcore.ResponseError
+	switch {
+	case bloberror.HasCode(err, bloberror.ContainerNotFound):
+		class = ErrBucketMissing
+	case bloberror.HasCode(err, bloberror.ServerBusy):
+		class = ErrThrottled
+	case errors.Is(err, context.DeadlineExceeded):
+		class = ErrTimeout
+	case errors.As(err, &rerr):
+		class = statusClass(rerr.StatusCode)
+	}
+	if class == nil {
+		return err
+	}
+	return &Error{Class: class, Err: err}
+}
@@ -0,0 +1,64 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrObjectExists is returned by ObjectStore.PutObject with IfAbsent set
+// when the object already exists.
+var ErrObjectExists = errors.New("s3ds: object exists")
+
+// ObjectStore is the object storage the datastore keeps its values in.
+// Names are full object names, RootDirectory included. Missing objects are
+// reported as ds.ErrNotFound.
+//
+// Reads and writes of values go through the ObjectStore; bookkeeping that
+// relies on S3 features, such as packs, snapshots and grants, uses the
+// S3Client directly.
+type ObjectStore interface {
+	PutObject(ctx context.Context, name string, body []byte, opts PutOptions) error
+	GetObject(ctx context.Context, name string) ([]byte, ObjectInfo, error)
+	Head(ctx context.Context, name string) (ObjectInfo, error)
+
+	// List returns up to max objects whose names start with prefix, in
+	// lexical order, from the page named by token ("" for the first). The
+	// returned token is "" after the last page.
+	List(ctx context.Context, prefix, token string, max int) ([]ObjectInfo, string, error)
+
+	// DeleteMany deletes the named objects. Names that do not exist are
+	// not an error.
+	DeleteMany(ctx context.Context, names []string) error
+}
+
+// ObjectInfo describes a stored object. Metadata keys are lower case and
+// only set by GetObject and Head; LastModified and ETag are only set by
+// List, ETag not on Azure.
+type ObjectInfo struct {
+	Name         string
+	Size         int64
+	Metadata     map[string]string
+	LastModified time.Time
+	ETag         string
+}
+
+// PutOptions are the optional parts of an upload.
+type PutOptions struct {
+	Metadata map[string]string
+
+	// Tags is a URL-encoded tag set, for stores that support tagging.
+	Tags string
+
+	// StorageClass is the store's name of the storage class or access
+	// tier to write to, or "" for the default.
+	StorageClass string
+
+	// IfAbsent makes the upload fail with ErrObjectExists instead of
+	// replacing an existing object.
+	IfAbsent bool
+
+	// SourceBucket is the bucket CopyObject copies src from, if not the
+	// store's own, e.g. the cold bucket of tiering. Only S3 has it.
+	SourceBucket string
+}
@@ -0,0 +1,69 @@
+package s3
+
+import (
+	"context"
+	"io"
+	"net/http"
+
+	"golang.org/x/time/rate"
+)
+
+// bandwidthTransport limits the bytes per second sent in request bodies
+// and received in response bodies. Its limiters are shared by every
+// request, so the limits hold for the datastore as a whole.
+type bandwidthTransport struct {
+	next     http.RoundTripper
+	upload   *rate.Limiter
+	download *rate.Limiter
+}
+
+// newBandwidthTransport limits next to upload and download bytes per
+// second, zero meaning unlimited.
+func newBandwidthTransport(next http.RoundTripper, upload, download int) http.RoundTripper {
+	if upload <= 0 && download <= 0 {
+		return next
+	}
+	return &bandwidthTransport{next: next, upload: newByteLimiter(upload), download: newByteLimiter(download)}
+}
+
+// newByteLimiter allows bursts of one second's worth of bytes.
+func newByteLimiter(perSecond int) *rate.Limiter {
+	if perSecond <= 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(perSecond), perSecond)
+}
+
+func (t *bandwidthTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	ctx := r.Context()
+	if t.upload != nil && r.Body != nil && r.Body != http.NoBody {
+		r = r.Clone(ctx)
+		r.Body = &limitedBody{ReadCloser: r.Body, ctx: ctx, limiter: t.upload}
+	}
+	resp, err := t.next.RoundTrip(r)
+	if err != nil || t.download == nil {
+		return resp, err
+	}
+	resp.Body = &limitedBody{ReadCloser: resp.Body, ctx: ctx, limiter: t.download}
+	return resp, nil
+}
+
+// limitedBody reads no faster than its limiter allows.
+type limitedBody struct {
+	io.ReadCloser
+	ctx     context.Context
+	limiter *rate.Limiter
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if burst := b.limiter.Burst(); len(p) > burst {
+		p = p[:burst]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		if werr := b.limiter.WaitN(b.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
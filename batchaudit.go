@@ -0,0 +1,168 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	ds "github.com/ipfs/go-datastore"
+)
+
+// AuditManifest describes a manifest uploaded by WriteAuditManifest. Its
+// location and ETag are what an S3 Batch Operations job needs, e.g.
+//
+//	aws s3control create-job --manifest \
+//	  'Spec={Format=S3BatchOperations_CSV_20180820,Fields=[Bucket,Key]},Location={ObjectArn=arn:aws:s3:::BUCKET/KEY,ETag=ETAG}' ...
+//
+// Any per-object operation works as an existence audit, since missing
+// objects fail their task; the job's completion report is then read back
+// with ReadAuditReport.
+type AuditManifest struct {
+	Bucket string
+	Key    string
+	ETag   string
+	Count  int
+}
+
+// AuditFailure is a failed task from an S3 Batch Operations report.
+type AuditFailure struct {
+	Key        ds.Key
+	ErrorCode  string
+	HTTPStatus int
+	Message    string
+}
+
+// WriteAuditManifest uploads a CSV manifest naming the objects of keys to
+// the bookkeeping area of the bucket under name.
+func (s *S3Bucket) WriteAuditManifest(ctx context.Context, name string, keys []ds.Key) (AuditManifest, error) {
+	if err := s.needS3(); err != nil {
+		return AuditManifest{}, err
+	}
+	if err := s.auditMaintenance("WriteAuditManifest", "manifest", ""); err != nil {
+		return AuditManifest{}, err
+	}
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	for _, k := range keys {
+		// Batch Operations expects URL-encoded object keys.
+		if err := w.Write([]string{s.Bucket, url.PathEscape(s.s3Path(k))}); err != nil {
+			return AuditManifest{}, err
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return AuditManifest{}, err
+	}
+
+	manifest := AuditManifest{
+		Bucket: s.Bucket,
+		Key:    s.metaPath(path.Join("audit", name+".csv")),
+		Count:  len(keys),
+	}
+	resp, err := s.S3.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(manifest.Bucket),
+		Key:         aws.String(manifest.Key),
+		Body:        bytes.NewReader(buf.Bytes()),
+		ContentType: aws.String("text/csv"),
+	})
+	if err != nil {
+		return AuditManifest{}, err
+	}
+	manifest.ETag = aws.StringValue(resp.ETag)
+	return manifest, nil
+}
+
+// batchReportManifest is the manifest.json written next to a completion
+// report.
+type batchReportManifest struct {
+	Results []struct {
+		TaskExecutionStatus string
+		Bucket              string
+		Key                 string
+	}
+}
+
+// ReadAuditReport reads the completion report of a Batch Operations job
+// whose report prefix (ending in job-<id>) lives in bucket, and returns
+// the failed tasks mapped back to datastore keys.
+func (s *S3Bucket) ReadAuditReport(ctx context.Context, bucket, prefix string) ([]AuditFailure, error) {
+	if err := s.needS3(); err != nil {
+		return nil, err
+	}
+	body, err := s.getObject(ctx, bucket, path.Join(prefix, "manifest.json"))
+	if err != nil {
+		return nil, err
+	}
+	var manifest batchReportManifest
+	err = json.NewDecoder(body).Decode(&manifest)
+	body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("s3ds: invalid batch report manifest: %s", err)
+	}
+
+	var failures []AuditFailure
+	for _, result := range manifest.Results {
+		if result.TaskExecutionStatus != "failed" {
+			continue
+		}
+		body, err := s.getObject(ctx, result.Bucket, result.Key)
+		if err != nil {
+			return nil, err
+		}
+		failures, err = s.readReportCSV(body, failures)
+		body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return failures, nil
+}
+
+// readReportCSV parses report rows of the form
+// Bucket,Key,VersionId,TaskStatus,ErrorCode,HTTPStatusCode,ResultMessage.
+func (s *S3Bucket) readReportCSV(r io.Reader, failures []AuditFailure) ([]AuditFailure, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	for {
+		row, err := cr.Read()
+		if err == io.EOF {
+			return failures, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("s3ds: invalid batch report: %s", err)
+		}
+		if len(row) < 7 || row[3] != "failed" {
+			continue
+		}
+		name, err := url.PathUnescape(row[1])
+		if err != nil {
+			name = row[1]
+		}
+		status, _ := strconv.Atoi(row[5])
+		failures = append(failures, AuditFailure{
+			Key:        s.fromS3Path(name),
+			ErrorCode:  row[4],
+			HTTPStatus: status,
+			Message:    row[6],
+		})
+	}
+}
+
+func (s *S3Bucket) getObject(ctx context.Context, bucket, key string) (io.ReadCloser, error) {
+	resp, err := s.S3.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
@@ -0,0 +1,83 @@
+package s3
+
+import (
+	"context"
+	"sync"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// batchPipeline uploads the blocks put into a batch as they are put, with
+// up to Workers uploads in flight, instead of leaving all of them to
+// Commit. A Put waits for a free worker, so a batch filled faster than it
+// uploads slows down its writer rather than buffering without bound.
+//
+// Only blocks are pipelined: their values never change, so one showing up
+// before Commit is harmless. Other puts and all deletes still wait for
+// Commit, which applies them once the uploads are done and puts the
+// blocks whose upload failed again.
+type batchPipeline struct {
+	s      *S3Bucket
+	ctx    context.Context
+	cancel context.CancelFunc
+	slots  chan struct{}
+	wg     sync.WaitGroup
+
+	// uploaded holds the operations, by sequence number, whose upload
+	// succeeded since the last wait; failed counts the others.
+	mu       sync.Mutex
+	uploaded map[int]bool
+	failed   int
+}
+
+func newBatchPipeline(s *S3Bucket, workers int) *batchPipeline {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &batchPipeline{
+		s:        s,
+		ctx:      ctx,
+		cancel:   cancel,
+		slots:    make(chan struct{}, workers),
+		uploaded: make(map[int]bool),
+	}
+}
+
+// upload starts the upload of the block k, put by the operation numbered
+// seq, once a worker is free, or fails if ctx is done first.
+func (p *batchPipeline) upload(ctx context.Context, k ds.Key, value []byte, seq int) error {
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		defer func() { <-p.slots }()
+		ctx, end := p.s.beginWrite(p.ctx)
+		defer end()
+		err := p.s.put(ctx, k, value)
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if err != nil {
+			p.s.logs.get(LogBatch).Debugf("pipelined upload of %s failed: %s", k, err)
+			p.failed++
+		} else {
+			p.uploaded[seq] = true
+		}
+	}()
+	return nil
+}
+
+// wait waits for the uploads started, cancelling them if ctx is done
+// first. It returns the operations whose upload succeeded and how many
+// failed, and starts counting afresh.
+func (p *batchPipeline) wait(ctx context.Context) (map[int]bool, int) {
+	stop := context.AfterFunc(ctx, p.cancel)
+	defer stop()
+	p.wg.Wait()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	uploaded, failed := p.uploaded, p.failed
+	p.uploaded, p.failed = make(map[int]bool), 0
+	return uploaded, failed
+}
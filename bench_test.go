@@ -0,0 +1,15 @@
+package s3_test
+
+import (
+	"testing"
+
+	s3ds "github.com/ipfs-s3c-storj-plugin"
+	"github.com/ipfs-s3c-storj-plugin/s3test"
+)
+
+// BenchmarkFake measures the datastore alone, against an in-memory S3.
+func BenchmarkFake(b *testing.B) { s3test.BenchmarkFake(b, s3ds.Config{}) }
+
+// BenchmarkEndpoints measures the gateways configured through
+// S3TEST_<PROVIDER>_* environment variables, and skips if none is.
+func BenchmarkEndpoints(b *testing.B) { s3test.BenchmarkEndpoints(b) }
@@ -0,0 +1,102 @@
+package s3
+
+import (
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+const (
+	cidV1     = 0x01
+	codecRaw  = 0x55
+	mhSha2256 = 0x12
+)
+
+// blockKeyEncoding is the encoding the go-ipfs blockstore uses for the base
+// namespace of block keys.
+var blockKeyEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// keyToCid returns the binary CID of the block stored under k. Older
+// blockstores key blocks by CID, newer ones by multihash; the latter are
+// returned as CIDv1 with the raw codec.
+func keyToCid(k ds.Key) ([]byte, error) {
+	b, err := blockKeyEncoding.DecodeString(k.BaseNamespace())
+	if err != nil {
+		return nil, fmt.Errorf("s3ds: %s is not a block key: %s", k, err)
+	}
+
+	switch {
+	case isCidV0(b):
+		// CIDv0 is a bare sha2-256 multihash.
+		return b, nil
+	case isCidV1(b):
+		return b, nil
+	case isMultihash(b):
+		return append([]byte{cidV1, codecRaw}, b...), nil
+	default:
+		return nil, fmt.Errorf("s3ds: %s is not a block key", k)
+	}
+}
+
+func isCidV1(b []byte) bool {
+	version, n := binary.Uvarint(b)
+	if n <= 0 || version != cidV1 {
+		return false
+	}
+	_, m := binary.Uvarint(b[n:])
+	if m <= 0 {
+		return false
+	}
+	return isMultihash(b[n+m:])
+}
+
+func isMultihash(b []byte) bool {
+	_, n := binary.Uvarint(b)
+	if n <= 0 {
+		return false
+	}
+	length, m := binary.Uvarint(b[n:])
+	if m <= 0 {
+		return false
+	}
+	return uint64(len(b)-n-m) == length
+}
+
+// cidToKey returns the key the CID-keyed blockstore stores c under.
+func cidToKey(c []byte) (ds.Key, error) {
+	if !isCidV0(c) && !isCidV1(c) {
+		return ds.Key{}, fmt.Errorf("s3ds: invalid cid")
+	}
+	return ds.NewKey(blockKeyEncoding.EncodeToString(c)), nil
+}
+
+func isCidV0(b []byte) bool {
+	return len(b) == 34 && b[0] == mhSha2256 && b[1] == 32
+}
+
+// cidLen returns the length of the binary CID at the front of b.
+func cidLen(b []byte) (int, error) {
+	if len(b) >= 34 && isCidV0(b[:34]) {
+		return 34, nil
+	}
+	version, n := binary.Uvarint(b)
+	if n <= 0 || version != cidV1 {
+		return 0, fmt.Errorf("s3ds: unsupported cid version")
+	}
+	_, m := binary.Uvarint(b[n:])
+	if m <= 0 {
+		return 0, fmt.Errorf("s3ds: invalid cid codec")
+	}
+	off := n + m
+	_, c := binary.Uvarint(b[off:])
+	if c <= 0 {
+		return 0, fmt.Errorf("s3ds: invalid multihash")
+	}
+	length, l := binary.Uvarint(b[off+c:])
+	if l <= 0 || uint64(len(b)-off-c-l) < length {
+		return 0, fmt.Errorf("s3ds: invalid multihash")
+	}
+	return off + c + l + int(length), nil
+}
@@ -0,0 +1,126 @@
+package s3
+
+import (
+	"context"
+
+	"github.com/ipfs/boxo/blockstore"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// Blockstore is a go-ipfs blockstore on top of the datastore. It keys
+// blocks by multihash the way the kubo blockstore does with the datastore
+// mounted at /blocks, as in the default configuration, so both see the
+// same blocks.
+type Blockstore struct {
+	s *S3Bucket
+}
+
+// Blockstore returns a blockstore of the datastore's blocks.
+func (s *S3Bucket) Blockstore() *Blockstore {
+	return &Blockstore{s: s}
+}
+
+// blockKey returns the key of the block with CID c.
+func blockKey(c cid.Cid) ds.Key {
+	return ds.RawKey("/" + blockKeyEncoding.EncodeToString(c.Hash()))
+}
+
+func (bs *Blockstore) Get(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	if !c.Defined() {
+		return nil, ipld.ErrNotFound{Cid: c}
+	}
+	data, err := bs.s.Get(ctx, blockKey(c))
+	if err == ds.ErrNotFound {
+		return nil, ipld.ErrNotFound{Cid: c}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return blocks.NewBlockWithCid(data, c)
+}
+
+func (bs *Blockstore) Has(ctx context.Context, c cid.Cid) (bool, error) {
+	return bs.s.Has(ctx, blockKey(c))
+}
+
+func (bs *Blockstore) GetSize(ctx context.Context, c cid.Cid) (int, error) {
+	size, err := bs.s.GetSize(ctx, blockKey(c))
+	if err == ds.ErrNotFound {
+		return -1, ipld.ErrNotFound{Cid: c}
+	}
+	return size, err
+}
+
+// Put stores b. Blocks already in the bucket are skipped as configured by
+// SkipExisting.
+func (bs *Blockstore) Put(ctx context.Context, b blocks.Block) error {
+	return bs.s.Put(ctx, blockKey(b.Cid()), b.RawData())
+}
+
+// PutMany stores blks in a single batch.
+func (bs *Blockstore) PutMany(ctx context.Context, blks []blocks.Block) error {
+	b, err := bs.s.Batch(ctx)
+	if err != nil {
+		return err
+	}
+	for _, blk := range blks {
+		if err := b.Put(ctx, blockKey(blk.Cid()), blk.RawData()); err != nil {
+			return err
+		}
+	}
+	return b.Commit(ctx)
+}
+
+func (bs *Blockstore) DeleteBlock(ctx context.Context, c cid.Cid) error {
+	return bs.s.Delete(ctx, blockKey(c))
+}
+
+// AllKeysChan lists the CIDs of every block. Object names are turned into
+// CIDs as Keys lists them, without going through a datastore query; blocks
+// stored by multihash are returned with the raw codec. Listing errors are
+// logged and close the channel early, as with the kubo blockstore.
+//
+// Blocks moved to a tiering Bucket are not listed, as in queries.
+func (bs *Blockstore) AllKeysChan(ctx context.Context) (<-chan cid.Cid, error) {
+	keys, err := bs.s.Keys(ctx, "/")
+	if err != nil {
+		return nil, err
+	}
+	out := make(chan cid.Cid, dsq.KeysOnlyBufSize)
+	go func() {
+		defer bs.s.RecoverAndDump()
+		defer close(out)
+		for k := range keys {
+			c, ok := blockCid(k)
+			if !ok {
+				continue
+			}
+			select {
+			case out <- c:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+// blockCid returns the CID of the block stored under k, if k is a block
+// key at the top level.
+func blockCid(k ds.Key) (cid.Cid, bool) {
+	if len(k.Namespaces()) != 1 || !isBase32Chars(k.BaseNamespace()) {
+		return cid.Undef, false
+	}
+	b, err := keyToCid(k)
+	if err != nil {
+		return cid.Undef, false
+	}
+	c, err := cid.Cast(b)
+	return c, err == nil
+}
+
+var _ blockstore.Blockstore = (*Blockstore)(nil)
@@ -0,0 +1,300 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// ErrBackendUnavailable is returned without calling the bucket while the
+// circuit breaker is open.
+var ErrBackendUnavailable = errors.New("s3ds: backend unavailable")
+
+// Defaults of BreakerConfig.
+const (
+	defaultBreakerWindow   = 30 * time.Second
+	defaultBreakerMinCalls = 20
+	defaultBreakerCooldown = 30 * time.Second
+	defaultBreakerProbes   = 3
+)
+
+// BreakerConfig configures the circuit breaker in front of the bucket.
+// Once too many calls fail, every call fails at once with
+// ErrBackendUnavailable for Cooldown, instead of each waiting for its
+// timeouts while the gateway is down. Then a few probe calls go through:
+// if they all succeed, calls resume, otherwise the breaker stays open for
+// another Cooldown.
+//
+// Missing objects, refused credentials and other errors the gateway
+// answers deliberately do not count as failures; errors from the
+// transport, server errors, throttling and timeouts do.
+type BreakerConfig struct {
+	// ErrorRate opens the breaker once this share of the calls in a
+	// Window failed, between 0 and 1.
+	ErrorRate float64
+
+	// SlowCall, if set, counts calls that take longer than this as
+	// failed, even if they succeed.
+	SlowCall time.Duration
+
+	// Window is the period the error rate is taken over. Defaults to 30
+	// seconds.
+	Window time.Duration
+
+	// MinCalls is the number of calls in a Window below which the
+	// breaker does not open, however many fail. Defaults to 20.
+	MinCalls int
+
+	// Cooldown is how long the breaker stays open before probing.
+	// Defaults to 30 seconds.
+	Cooldown time.Duration
+
+	// Probes is the number of calls let through to probe the gateway,
+	// all of which have to succeed to close the breaker. Defaults to 3.
+	Probes int
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+var breakerStateNames = map[breakerState]string{
+	breakerClosed:   "closed",
+	breakerOpen:     "open",
+	breakerHalfOpen: "half-open",
+}
+
+func (st breakerState) String() string {
+	return breakerStateNames[st]
+}
+
+// breakerSnapshot is the state of a breaker in a state dump.
+type breakerSnapshot struct {
+	State     string    `json:"state"`
+	OpenUntil time.Time `json:"openUntil,omitzero"`
+	Calls     int       `json:"calls"`
+	Failures  int       `json:"failures"`
+}
+
+// breaker implements BreakerConfig. The error rate is counted over
+// consecutive windows, starting afresh in each.
+type breaker struct {
+	conf BreakerConfig
+	log  *subLogger
+
+	mu    sync.Mutex
+	state breakerState
+
+	// windowStart, calls and failures count the current window while
+	// closed.
+	windowStart time.Time
+	calls       int
+	failures    int
+
+	// openUntil is the end of the cooldown while open.
+	openUntil time.Time
+
+	// probing and probed count the probes in flight and succeeded while
+	// half-open.
+	probing int
+	probed  int
+}
+
+func newBreaker(conf BreakerConfig, log *subLogger) (*breaker, error) {
+	if conf.ErrorRate <= 0 || conf.ErrorRate > 1 {
+		return nil, fmt.Errorf("s3ds: breaker: errorRate %f is not above 0 and at most 1", conf.ErrorRate)
+	}
+	if conf.Window <= 0 {
+		conf.Window = defaultBreakerWindow
+	}
+	if conf.MinCalls <= 0 {
+		conf.MinCalls = defaultBreakerMinCalls
+	}
+	if conf.Cooldown <= 0 {
+		conf.Cooldown = defaultBreakerCooldown
+	}
+	if conf.Probes <= 0 {
+		conf.Probes = defaultBreakerProbes
+	}
+	return &breaker{conf: conf, log: log, windowStart: time.Now()}, nil
+}
+
+func (b *breaker) snapshot() breakerSnapshot {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	snap := breakerSnapshot{State: b.state.String(), Calls: b.calls, Failures: b.failures}
+	if b.state != breakerClosed {
+		snap.OpenUntil = b.openUntil
+	}
+	return snap
+}
+
+// allow reports whether a call may be made, and whether it is a probe.
+func (b *breaker) allow() (ok, probe bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if time.Now().Before(b.openUntil) {
+			return false, false
+		}
+		b.state = breakerHalfOpen
+		b.probing, b.probed = 0, 0
+		fallthrough
+	case breakerHalfOpen:
+		if b.probing+b.probed >= b.conf.Probes {
+			return false, false
+		}
+		b.probing++
+		return true, true
+	}
+	return true, false
+}
+
+// done records the outcome of a call allow let through.
+func (b *breaker) done(probe, failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	if probe {
+		if b.state != breakerHalfOpen {
+			return
+		}
+		b.probing--
+		if failed {
+			b.open(now, "a probe failed")
+			return
+		}
+		if b.probed++; b.probed >= b.conf.Probes {
+			b.log.Infof("circuit breaker closed: %d probes succeeded", b.probed)
+			b.state = breakerClosed
+			b.windowStart, b.calls, b.failures = now, 0, 0
+		}
+		return
+	}
+	if b.state != breakerClosed {
+		return
+	}
+	if now.Sub(b.windowStart) >= b.conf.Window {
+		b.windowStart, b.calls, b.failures = now, 0, 0
+	}
+	b.calls++
+	if failed {
+		b.failures++
+	}
+	if b.calls >= b.conf.MinCalls && float64(b.failures) >= b.conf.ErrorRate*float64(b.calls) {
+		b.open(now, fmt.Sprintf("%d of %d calls failed", b.failures, b.calls))
+	}
+}
+
+func (b *breaker) open(now time.Time, reason string) {
+	b.log.Warnf("circuit breaker open for %s: %s", b.conf.Cooldown, reason)
+	b.state = breakerOpen
+	b.openUntil = now.Add(b.conf.Cooldown)
+}
+
+// failed reports whether the outcome of a call counts against the
+// gateway.
+func (b *breaker) failed(ctx context.Context, err error, took time.Duration) bool {
+	if b.conf.SlowCall > 0 && took > b.conf.SlowCall {
+		return true
+	}
+	switch {
+	case err == nil, err == ErrObjectExists, err == errInvalidRange, ctx.Err() == context.Canceled:
+		return false
+	}
+	switch ErrorClass(err) {
+	case ds.ErrNotFound, ErrAuth, ErrBucketMissing, ErrArchived, ErrChecksumMismatch:
+		return false
+	}
+	return true
+}
+
+// call runs fn unless the breaker is open.
+func (b *breaker) call(ctx context.Context, fn func() error) error {
+	ok, probe := b.allow()
+	if !ok {
+		return ErrBackendUnavailable
+	}
+	start := time.Now()
+	err := fn()
+	b.done(probe, b.failed(ctx, err, time.Since(start)))
+	return err
+}
+
+// breakerStore runs the calls to an ObjectStore through a breaker.
+type breakerStore struct {
+	ObjectStore
+	breaker *breaker
+}
+
+func (t *breakerStore) PutObject(ctx context.Context, name string, body []byte, opts PutOptions) error {
+	return t.breaker.call(ctx, func() error {
+		return t.ObjectStore.PutObject(ctx, name, body, opts)
+	})
+}
+
+func (t *breakerStore) GetObject(ctx context.Context, name string) ([]byte, ObjectInfo, error) {
+	var (
+		data []byte
+		info ObjectInfo
+	)
+	err := t.breaker.call(ctx, func() (err error) {
+		data, info, err = t.ObjectStore.GetObject(ctx, name)
+		return err
+	})
+	return data, info, err
+}
+
+func (t *breakerStore) Head(ctx context.Context, name string) (ObjectInfo, error) {
+	var info ObjectInfo
+	err := t.breaker.call(ctx, func() (err error) {
+		info, err = t.ObjectStore.Head(ctx, name)
+		return err
+	})
+	return info, err
+}
+
+func (t *breakerStore) List(ctx context.Context, prefix, token string, max int) ([]ObjectInfo, string, error) {
+	var (
+		objs []ObjectInfo
+		next string
+	)
+	err := t.breaker.call(ctx, func() (err error) {
+		objs, next, err = t.ObjectStore.List(ctx, prefix, token, max)
+		return err
+	})
+	return objs, next, err
+}
+
+func (t *breakerStore) DeleteMany(ctx context.Context, names []string) error {
+	return t.breaker.call(ctx, func() error {
+		return t.ObjectStore.DeleteMany(ctx, names)
+	})
+}
+
+func (t *breakerStore) GetObjectRange(ctx context.Context, name string, offset, length int64) ([]byte, ObjectInfo, error) {
+	var (
+		data []byte
+		info ObjectInfo
+	)
+	err := t.breaker.call(ctx, func() (err error) {
+		data, info, err = getObjectRange(ctx, t.ObjectStore, name, offset, length)
+		return err
+	})
+	return data, info, err
+}
+
+func (t *breakerStore) CopyObject(ctx context.Context, src, dst string, size int64, opts PutOptions) error {
+	return t.breaker.call(ctx, func() error {
+		return copyObject(ctx, t.ObjectStore, src, dst, size, opts)
+	})
+}
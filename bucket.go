@@ -0,0 +1,87 @@
+package s3
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Values of Config.BucketEncryption.
+const (
+	BucketEncryptionAES256 = s3.ServerSideEncryptionAes256
+	BucketEncryptionKMS    = s3.ServerSideEncryptionAwsKms
+)
+
+// bucketCheckTimeout bounds the startup requests to the bucket.
+const bucketCheckTimeout = 30 * time.Second
+
+// bucketClient is what prepareBucket needs of the SDK client.
+type bucketClient interface {
+	// headBucket reports whether the bucket exists and, if the gateway
+	// says, the region it is in. A bucket in another region answers with
+	// a redirect, which is not an error here.
+	headBucket(ctx context.Context, bucket string) (bool, string, error)
+
+	// createBucket creates the bucket of conf with its versioning and
+	// encryption settings. A bucket created by someone else in the
+	// meantime is configured the same way.
+	createBucket(ctx context.Context, conf *Config) error
+
+	// inRegion returns a client for region.
+	inRegion(region string) bucketClient
+}
+
+// prepareBucket runs the startup checks enabled in conf: it moves the
+// client to the bucket's region with AutoDetectRegion and creates the
+// bucket with CreateBucketIfMissing. It returns the client to use, which
+// is a new one when the region changed, and updates conf.Region.
+func prepareBucket(client bucketClient, conf *Config, log *subLogger) (bucketClient, error) {
+	if !conf.AutoDetectRegion && !conf.CreateBucketIfMissing {
+		return client, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), bucketCheckTimeout)
+	defer cancel()
+
+	exists, region, err := client.headBucket(ctx, conf.Bucket)
+	if conf.AutoDetectRegion && region != "" && region != conf.Region {
+		log.Infof("bucket %s is in region %s, not %s", conf.Bucket, region, conf.Region)
+		conf.Region = region
+		client = client.inRegion(region)
+		exists, _, err = client.headBucket(ctx, conf.Bucket)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("s3ds: checking bucket %s: %s", conf.Bucket, parseError(err))
+	}
+	if region != "" && region != conf.Region && !conf.AutoDetectRegion {
+		return nil, fmt.Errorf("s3ds: bucket %s is in region %s, not %s; set region or autoDetectRegion", conf.Bucket, region, conf.Region)
+	}
+	if exists {
+		return client, nil
+	}
+	if !conf.CreateBucketIfMissing {
+		return nil, &Error{Class: ErrBucketMissing, Err: fmt.Errorf("no bucket %s in region %s", conf.Bucket, conf.Region)}
+	}
+	if err := client.createBucket(ctx, conf); err != nil {
+		return nil, fmt.Errorf("s3ds: creating bucket %s: %s", conf.Bucket, parseError(err))
+	}
+	log.Infof("created bucket %s in region %s", conf.Bucket, conf.Region)
+	return client, nil
+}
+
+// bucketStatus interprets the status of a HeadBucket request that failed
+// with err: a missing bucket is not an error, and one in another region
+// exists if the redirect names the region.
+func bucketStatus(status int, region string, err error) (bool, string, error) {
+	switch status {
+	case http.StatusNotFound:
+		return false, region, nil
+	case http.StatusMovedPermanently:
+		if region != "" {
+			return true, region, nil
+		}
+	}
+	return err == nil, region, err
+}
@@ -0,0 +1,137 @@
+package s3
+
+import (
+	"context"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// bulkListMin is the smallest number of keys for which GetSizeMany tries a
+// listing of their common prefix before falling back to HEAD requests.
+const bulkListMin = 50
+
+// HasMany reports for each key whether it exists, as Has would.
+func (s *S3Bucket) HasMany(ctx context.Context, keys []ds.Key) ([]bool, error) {
+	sizes, err := s.GetSizeMany(ctx, keys)
+	if err != nil {
+		return nil, err
+	}
+	exists := make([]bool, len(sizes))
+	for i, size := range sizes {
+		exists[i] = size >= 0
+	}
+	return exists, nil
+}
+
+// GetSizeMany returns the size of each key, or -1 if it does not exist,
+// as GetSize would. When the keys cluster under a common prefix it answers
+// from a listing of that prefix, as long as the listing takes fewer
+// requests than one HEAD per key; otherwise the HEAD requests are spread
+// over the worker pool.
+func (s *S3Bucket) GetSizeMany(ctx context.Context, keys []ds.Key) ([]int, error) {
+	names := make([]string, len(keys))
+	for i, k := range keys {
+		names[i] = s.s3Path(k)
+	}
+	sizes := make([]int, len(keys))
+
+	// Listings report stored sizes, which differ from value sizes for
+	// compressed or encoded objects.
+	if len(keys) >= bulkListMin && s.storesValues() && len(s.routes) == 0 && s.snapshot == nil {
+		found, ok, err := s.listSizes(ctx, commonPrefix(names), len(keys)/listMax+1)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			// Keys moved to tiering's cold bucket are not listed.
+			var rest []int
+			for i, name := range names {
+				size, ok := found[name]
+				if !ok {
+					size = -1
+				}
+				if s.packs != nil {
+					if loc, ok := s.packs.lookup(keys[i]); ok {
+						size = int(loc.length)
+					}
+				}
+				if s.writeBehind != nil {
+					if value, ok := s.writeBehind.get(keys[i]); ok {
+						size = len(value)
+					}
+				}
+				if size < 0 && s.tiering != nil && s.tiering.elsewhere(keys[i]) {
+					rest = append(rest, i)
+				}
+				sizes[i] = size
+			}
+			if err := s.getSizes(ctx, keys, sizes, rest); err != nil {
+				return nil, err
+			}
+			return sizes, nil
+		}
+	}
+
+	all := make([]int, len(keys))
+	for i := range all {
+		all[i] = i
+	}
+	if err := s.getSizes(ctx, keys, sizes, all); err != nil {
+		return nil, err
+	}
+	return sizes, nil
+}
+
+// getSizes sets the sizes of the keys at the indexes given as GetSize
+// would, spreading the requests over the worker pool.
+func (s *S3Bucket) getSizes(ctx context.Context, keys []ds.Key, sizes []int, indexes []int) error {
+	return forEach(ctx, len(indexes), s.Workers, func(ctx context.Context, i int) error {
+		i = indexes[i]
+		size, err := s.getSizeCached(ctx, keys[i])
+		switch err {
+		case nil:
+			sizes[i] = size
+		case ds.ErrNotFound:
+			sizes[i] = -1
+		default:
+			return err
+		}
+		return nil
+	})
+}
+
+// listSizes lists prefix and returns the size of every object under it.
+// It gives up, returning false, once more than maxPages pages are needed.
+func (s *S3Bucket) listSizes(ctx context.Context, prefix string, maxPages int) (map[string]int, bool, error) {
+	sizes := make(map[string]int)
+	var token string
+	for page := 0; page < maxPages; page++ {
+		objs, next, err := s.store.List(ctx, prefix, token, listMax)
+		if err != nil {
+			return nil, false, err
+		}
+		for _, obj := range objs {
+			sizes[obj.Name] = int(obj.Size)
+		}
+		if next == "" {
+			return sizes, true, nil
+		}
+		token = next
+	}
+	return nil, false, nil
+}
+
+func commonPrefix(names []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	prefix := names[0]
+	for _, name := range names[1:] {
+		i := 0
+		for i < len(prefix) && i < len(name) && prefix[i] == name[i] {
+			i++
+		}
+		prefix = prefix[:i]
+	}
+	return prefix
+}
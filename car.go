@@ -0,0 +1,71 @@
+package s3
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+// carV1Header is the dag-cbor encoding of {"roots": [], "version": 1}.
+var carV1Header = []byte{
+	0xa2,
+	0x65, 'r', 'o', 'o', 't', 's', 0x80,
+	0x67, 'v', 'e', 'r', 's', 'i', 'o', 'n', 0x01,
+}
+
+// Export writes every block stored under prefix to w as a CARv1 archive
+// without roots. Keys that are not block keys, such as pins or the MFS
+// root, are skipped.
+func (s *S3Bucket) Export(ctx context.Context, w io.Writer, prefix string) error {
+	res, err := s.Query(ctx, dsq.Query{Prefix: prefix})
+	if err != nil {
+		return err
+	}
+	defer res.Close()
+
+	bw := bufio.NewWriter(w)
+	if err := writeCarSection(bw, carV1Header); err != nil {
+		return err
+	}
+
+	for r := range res.Next() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if r.Error != nil {
+			return r.Error
+		}
+		c, err := keyToCid(ds.NewKey(r.Key))
+		if err != nil {
+			continue
+		}
+		if err := writeCarSection(bw, c, r.Value); err != nil {
+			return err
+		}
+	}
+
+	return bw.Flush()
+}
+
+func writeCarSection(w io.Writer, parts ...[]byte) error {
+	var size int
+	for _, p := range parts {
+		size += len(p)
+	}
+
+	buf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(buf, uint64(size))
+	if _, err := w.Write(buf[:n]); err != nil {
+		return err
+	}
+	for _, p := range parts {
+		if _, err := w.Write(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package s3
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+const (
+	carV2HeaderSize = 40
+
+	// maxCarSection bounds a single CAR section; blocks are limited to a
+	// few MiB by IPFS, anything bigger is a corrupt length prefix.
+	maxCarSection = 32 << 20
+)
+
+// carV2Pragma is the fixed 11 byte prefix of a CARv2 file, including its
+// length varint.
+var carV2Pragma = []byte{0x0a, 0xa1, 0x67, 'v', 'e', 'r', 's', 'i', 'o', 'n', 0x02}
+
+// ImportCAR writes every block of the CARv1 or CARv2 archive read from r
+// into the bucket, using the worker pool and key layout of the datastore.
+// It returns the number of blocks written.
+func (s *S3Bucket) ImportCAR(ctx context.Context, r io.Reader) (int, error) {
+	br := bufio.NewReader(r)
+
+	header, err := readCarSection(br)
+	if err != nil {
+		return 0, fmt.Errorf("s3ds: invalid car header: %s", err)
+	}
+
+	var payload *bufio.Reader
+	switch {
+	case bytes.Equal(append(uvarint(len(header)), header...), carV2Pragma):
+		var v2 [carV2HeaderSize]byte
+		if _, err := io.ReadFull(br, v2[:]); err != nil {
+			return 0, fmt.Errorf("s3ds: invalid car v2 header: %s", err)
+		}
+		dataOffset := binary.LittleEndian.Uint64(v2[16:24])
+		dataSize := binary.LittleEndian.Uint64(v2[24:32])
+		skip := int64(dataOffset) - int64(len(carV2Pragma)+carV2HeaderSize)
+		if skip < 0 {
+			return 0, fmt.Errorf("s3ds: invalid car v2 data offset")
+		}
+		if _, err := io.CopyN(ioutil.Discard, br, skip); err != nil {
+			return 0, err
+		}
+		payload = bufio.NewReader(io.LimitReader(br, int64(dataSize)))
+		if header, err = readCarSection(payload); err != nil {
+			return 0, fmt.Errorf("s3ds: invalid car header: %s", err)
+		}
+		if carVersion(header) != 1 {
+			return 0, fmt.Errorf("s3ds: car v2 does not wrap a car v1 payload")
+		}
+	case carVersion(header) == 1:
+		payload = br
+	default:
+		return 0, fmt.Errorf("s3ds: unsupported car version")
+	}
+
+	type block struct {
+		key  ds.Key
+		data []byte
+	}
+	jobs := make(chan block)
+	errc := make(chan error, s.Workers)
+
+	var wg sync.WaitGroup
+	wg.Add(s.Workers)
+	for w := 0; w < s.Workers; w++ {
+		go func() {
+			defer wg.Done()
+			for b := range jobs {
+				if err := s.putFrom(ctx, "ImportCAR", b.key, b.data); err != nil {
+					select {
+					case errc <- fmt.Errorf("%s: %s", b.key, err):
+					default:
+					}
+				}
+			}
+		}()
+	}
+
+	count := 0
+	err = func() error {
+		defer close(jobs)
+		for {
+			section, err := readCarSection(payload)
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			n, err := cidLen(section)
+			if err != nil {
+				return err
+			}
+			k, err := cidToKey(section[:n])
+			if err != nil {
+				return err
+			}
+			select {
+			case jobs <- block{key: k, data: section[n:]}:
+				count++
+			case err := <-errc:
+				return err
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}()
+	wg.Wait()
+
+	if err != nil {
+		return count, err
+	}
+	close(errc)
+	var errs []string
+	for err := range errc {
+		errs = append(errs, err.Error())
+	}
+	if len(errs) > 0 {
+		return count, fmt.Errorf("s3ds: car import failed:\n%s", strings.Join(errs, "\n"))
+	}
+	return count, nil
+}
+
+// readCarSection reads one varint length prefixed section. It returns
+// io.EOF only if r is exhausted before the section starts.
+func readCarSection(r *bufio.Reader) ([]byte, error) {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if size > maxCarSection {
+		return nil, fmt.Errorf("section of %d bytes is too large", size)
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return buf, nil
+}
+
+// carVersion extracts the version from a dag-cbor CAR header without a
+// full cbor decoder: it is the small integer following the "version" key.
+func carVersion(header []byte) int {
+	i := bytes.Index(header, []byte("\x67version"))
+	if i < 0 || i+8 >= len(header) || header[i+8] > 0x17 {
+		return -1
+	}
+	return int(header[i+8])
+}
+
+func uvarint(n int) []byte {
+	buf := make([]byte, binary.MaxVarintLen64)
+	return buf[:binary.PutUvarint(buf, uint64(n))]
+}
@@ -0,0 +1,257 @@
+package s3
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+const (
+	// changeDirectory holds the change log under the metadata directory.
+	changeDirectory = "changes"
+
+	// changeSegment is the period the entries of a directory of the change
+	// log were written in, so polls only list the latest directories.
+	changeSegment = time.Minute
+
+	// changeSkew is how far back each poll lists again, for entries
+	// written late or by nodes whose clocks are behind.
+	changeSkew = time.Minute
+
+	// maxPendingChanges bounds the changes waiting to be written while
+	// the bucket is failing; older ones are dropped.
+	maxPendingChanges = 100000
+)
+
+// Change is a key put or deleted by a node, as recorded in the change
+// log.
+type Change struct {
+	Time time.Time `json:"time"`
+
+	// Node identifies the datastore that made the change, Host is the
+	// host name it runs on.
+	Node string `json:"node"`
+	Host string `json:"host,omitempty"`
+
+	// Op is EventPut or EventDelete.
+	Op  string `json:"op"`
+	Key string `json:"key"`
+}
+
+// changeLog lets nodes sharing a bucket keep their caches coherent. Every
+// interval each node writes the keys it changed since the last time as one
+// entry under the change log, and lists the entries of the others written
+// since its last poll, dropping their keys from its caches. Entries are
+// grouped in a directory per minute, so a poll lists a few small
+// directories whatever the size of the log.
+type changeLog struct {
+	s        *S3Bucket
+	node     string
+	host     string
+	interval time.Duration
+	log      *subLogger
+
+	mu      sync.Mutex
+	pending []Change
+
+	// polled is when the last successful poll started, and seen holds the
+	// entries read since polled-changeSkew.
+	polled time.Time
+	seen   map[string]time.Time
+}
+
+func newChangeLog(s *S3Bucket, interval time.Duration) *changeLog {
+	host, _ := os.Hostname()
+	id := make([]byte, 8)
+	rand.Read(id)
+	return &changeLog{
+		s:        s,
+		node:     hex.EncodeToString(id),
+		host:     host,
+		interval: interval,
+		log:      s.logs.get(LogChanges),
+		polled:   time.Now(),
+		seen:     make(map[string]time.Time),
+	}
+}
+
+// changePath returns the directory of the change log entries written
+// during the segment starting at t.
+func (s *S3Bucket) changePath(t time.Time) string {
+	return s.metaPath(path.Join(changeDirectory, fmt.Sprintf("%010x", t.Unix()/int64(changeSegment/time.Second))))
+}
+
+func segmentStart(t time.Time) time.Time {
+	return t.Truncate(changeSegment)
+}
+
+// add records a change to be written by the next flush.
+func (c *changeLog) add(op string, k ds.Key, t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.pending) >= maxPendingChanges {
+		c.pending = c.pending[1:]
+	}
+	c.pending = append(c.pending, Change{Time: t.UTC(), Node: c.node, Host: c.host, Op: op, Key: k.String()})
+}
+
+// flush writes the pending changes as one entry. They are kept for the
+// next flush if it fails.
+func (c *changeLog) flush(ctx context.Context) error {
+	c.mu.Lock()
+	changes := c.pending
+	c.pending = nil
+	c.mu.Unlock()
+	if len(changes) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	body, err := json.Marshal(changes)
+	if err == nil {
+		name := path.Join(c.s.changePath(now), fmt.Sprintf("%016x-%s.json", now.UnixNano(), c.node))
+		err = c.s.store.PutObject(ctx, name, body, PutOptions{})
+	}
+	if err != nil {
+		c.mu.Lock()
+		c.pending = append(changes, c.pending...)
+		if n := len(c.pending) - maxPendingChanges; n > 0 {
+			c.log.Warnf("dropping %d changes not written", n)
+			c.pending = c.pending[n:]
+		}
+		c.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// poll reads the entries of other nodes written since the last poll and
+// drops their keys from the caches.
+func (c *changeLog) poll(ctx context.Context) error {
+	start := time.Now()
+	from := c.polled.Add(-changeSkew)
+	var (
+		keys int
+		err  error
+	)
+	for seg := segmentStart(from); !seg.After(start); seg = seg.Add(changeSegment) {
+		want := func(name string) bool {
+			_, ok := c.seen[name]
+			return !ok && !strings.HasSuffix(name, "-"+c.node+".json")
+		}
+		err = c.s.readChanges(ctx, c.s.changePath(seg), want, func(name string, changes []Change) error {
+			c.seen[name] = seg
+			for _, ch := range changes {
+				c.s.forgetRemote(ds.NewKey(ch.Key))
+			}
+			keys += len(changes)
+			return nil
+		})
+		if err != nil {
+			break
+		}
+	}
+	if keys > 0 {
+		c.log.Debugf("%d keys changed by other nodes", keys)
+	}
+	if err != nil {
+		return err
+	}
+	c.polled = start
+	for name, seg := range c.seen {
+		if seg.Before(segmentStart(start.Add(-changeSkew))) {
+			delete(c.seen, name)
+		}
+	}
+	return nil
+}
+
+// run flushes and polls every interval until Close.
+func (c *changeLog) run() {
+	defer c.s.RecoverAndDump()
+
+	t := time.NewTicker(c.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-c.s.done:
+			return
+		}
+		if err := c.flush(c.s.ctx); err != nil && c.s.ctx.Err() == nil {
+			c.log.Warnf("writing changes: %s", err)
+		}
+		if err := c.poll(c.s.ctx); err != nil && c.s.ctx.Err() == nil {
+			c.log.Warnf("reading changes: %s", err)
+		}
+	}
+}
+
+// readChanges calls fn with the name and changes of every entry in the
+// directory dir of the change log that want, if set, reports wanted.
+func (s *S3Bucket) readChanges(ctx context.Context, dir string, want func(name string) bool, fn func(name string, changes []Change) error) error {
+	var token string
+	for {
+		objs, next, err := s.store.List(ctx, dir+"/", token, listMax)
+		if err != nil {
+			return err
+		}
+		for _, obj := range objs {
+			if want != nil && !want(obj.Name) {
+				continue
+			}
+			data, _, err := s.store.GetObject(ctx, obj.Name)
+			if err == ds.ErrNotFound {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			var changes []Change
+			if err := json.Unmarshal(data, &changes); err != nil {
+				return fmt.Errorf("s3ds: reading change log %s: %s", obj.Name, err)
+			}
+			if err := fn(obj.Name, changes); err != nil {
+				return err
+			}
+		}
+		if next == "" {
+			return nil
+		}
+		token = next
+	}
+}
+
+// ReadChangeLog returns the changes of every node recorded in the change log
+// since the given time, oldest first, including those of this datastore
+// once written. It lists a directory per minute since then. The log is
+// kept until deleted from the bucket, e.g. by a lifecycle rule on the
+// changes directory.
+func (s *S3Bucket) ReadChangeLog(ctx context.Context, since time.Time) ([]Change, error) {
+	var all []Change
+	for seg := segmentStart(since.Add(-changeSkew)); !seg.After(time.Now()); seg = seg.Add(changeSegment) {
+		err := s.readChanges(ctx, s.changePath(seg), nil, func(_ string, changes []Change) error {
+			for _, ch := range changes {
+				if !ch.Time.Before(since) {
+					all = append(all, ch)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return all, err
+		}
+	}
+	sort.SliceStable(all, func(i, j int) bool { return all[i].Time.Before(all[j].Time) })
+	return all, nil
+}
@@ -0,0 +1,168 @@
+package s3
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ChaosConfig injects faults into the requests to the bucket, to test how
+// IPFS nodes and the datastore cope with a flaky gateway without needing
+// one. Rates are probabilities between 0 and 1, drawn for every request,
+// retries included. Never enable it in production.
+type ChaosConfig struct {
+	// Latency delays requests by up to this long, uniformly distributed,
+	// at LatencyRate.
+	Latency     time.Duration
+	LatencyRate float64
+
+	// ThrottleRate answers requests with 503 SlowDown without sending
+	// them.
+	ThrottleRate float64
+
+	// FailureRate fails requests with a connection reset. Half of them
+	// are sent first, so the request takes effect but its response is
+	// lost.
+	FailureRate float64
+
+	// TruncateRate cuts response bodies off halfway.
+	TruncateRate float64
+
+	// Seed seeds the faults, so that a run can be repeated. Zero picks
+	// a seed at random.
+	Seed int64
+}
+
+// errChaosReset is the connection reset chaos injects.
+var errChaosReset = errors.New("s3ds: chaos: connection reset by peer")
+
+const chaosSlowDown = `<?xml version="1.0" encoding="UTF-8"?>
+<Error><Code>SlowDown</Code><Message>Please reduce your request rate.</Message></Error>`
+
+// chaosTransport injects the faults of a ChaosConfig underneath the SDK,
+// where the gateway's own faults would show up.
+type chaosTransport struct {
+	next http.RoundTripper
+	conf ChaosConfig
+
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+func newChaosTransport(next http.RoundTripper, conf ChaosConfig) (http.RoundTripper, error) {
+	for name, rate := range map[string]float64{
+		"latencyRate":  conf.LatencyRate,
+		"throttleRate": conf.ThrottleRate,
+		"failureRate":  conf.FailureRate,
+		"truncateRate": conf.TruncateRate,
+	} {
+		if rate < 0 || rate > 1 {
+			return nil, fmt.Errorf("s3ds: chaos: %s %f is not between 0 and 1", name, rate)
+		}
+	}
+	seed := conf.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return &chaosTransport{next: next, conf: conf, rand: rand.New(rand.NewSource(seed))}, nil
+}
+
+// hit reports whether a fault of the given rate occurs.
+func (t *chaosTransport) hit(rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.rand.Float64() < rate
+}
+
+func (t *chaosTransport) delay() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return time.Duration(t.rand.Int63n(int64(t.conf.Latency) + 1))
+}
+
+func (t *chaosTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if t.conf.Latency > 0 && t.hit(t.conf.LatencyRate) {
+		timer := time.NewTimer(t.delay())
+		select {
+		case <-timer.C:
+		case <-r.Context().Done():
+			timer.Stop()
+			return nil, r.Context().Err()
+		}
+	}
+	if t.hit(t.conf.ThrottleRate) {
+		if r.Body != nil {
+			r.Body.Close()
+		}
+		return slowDown(r), nil
+	}
+	sendFirst := false
+	if t.hit(t.conf.FailureRate) {
+		if sendFirst = t.hit(0.5); !sendFirst {
+			if r.Body != nil {
+				r.Body.Close()
+			}
+			return nil, errChaosReset
+		}
+	}
+
+	resp, err := t.next.RoundTrip(r)
+	if err != nil {
+		return resp, err
+	}
+	if sendFirst {
+		resp.Body.Close()
+		return nil, errChaosReset
+	}
+	if t.hit(t.conf.TruncateRate) && resp.ContentLength > 1 {
+		resp.Body = &truncatedBody{ReadCloser: resp.Body, left: resp.ContentLength / 2}
+	}
+	return resp, nil
+}
+
+// slowDown is the response of a gateway throttling r.
+func slowDown(r *http.Request) *http.Response {
+	body := chaosSlowDown
+	if r.Method == http.MethodHead {
+		body = ""
+	}
+	return &http.Response{
+		Status:        "503 Slow Down",
+		StatusCode:    http.StatusServiceUnavailable,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"application/xml"}},
+		Body:          ioutil.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       r,
+	}
+}
+
+// truncatedBody fails once left bytes have been read, as a body does
+// whose connection broke.
+type truncatedBody struct {
+	io.ReadCloser
+	left int64
+}
+
+func (b *truncatedBody) Read(p []byte) (int, error) {
+	if b.left <= 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if int64(len(p)) > b.left {
+		p = p[:b.left]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.left -= int64(n)
+	return n, err
+}
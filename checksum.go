@@ -0,0 +1,57 @@
+package s3
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrChecksumMismatch is the class of errors for data that does not match
+// its checksum, on upload or download. Compare with ErrorClass.
+var ErrChecksumMismatch = errors.New("s3ds: checksum mismatch")
+
+// checksumError reports that the named object does not match its
+// checksum.
+func checksumError(name, kind string) error {
+	return &Error{Class: ErrChecksumMismatch, Err: fmt.Errorf("%s of %s", kind, name)}
+}
+
+func md5Base64(data []byte) string {
+	sum := md5.Sum(data)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func sha256Base64(data []byte) string {
+	sum := sha256.Sum256(data)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// verifyS3Object checks data downloaded as name against the SHA-256
+// checksum the gateway returned, or else its ETag. ETags of multipart
+// uploads and of objects encrypted with KMS (sse) are not MD5 sums and
+// are not checked.
+func verifyS3Object(name string, data []byte, etag, checksumSHA256, sse string) error {
+	if checksumSHA256 != "" && !strings.Contains(checksumSHA256, "-") {
+		if sha256Base64(data) != checksumSHA256 {
+			return checksumError(name, "sha256")
+		}
+		return nil
+	}
+	etag = strings.Trim(etag, `"`)
+	if len(etag) != 2*md5.Size || strings.HasPrefix(sse, "aws:kms") {
+		return nil
+	}
+	want, err := hex.DecodeString(etag)
+	if err != nil {
+		return nil
+	}
+	if sum := md5.Sum(data); !bytes.Equal(sum[:], want) {
+		return checksumError(name, "etag")
+	}
+	return nil
+}
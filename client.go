@@ -0,0 +1,167 @@
+package s3
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// S3Client is the part of the S3 API the datastore uses, expressed in the
+// request and response types of aws-sdk-go v1. The client built from the
+// connection settings sends them with aws-sdk-go-v2, or with aws-sdk-go v1
+// when built with -tags s3v1; other implementations can add their own
+// HTTP handling or checksums, or fake the bucket in tests.
+type S3Client interface {
+	GetObject(*s3.GetObjectInput) (*s3.GetObjectOutput, error)
+	GetObjectWithContext(aws.Context, *s3.GetObjectInput, ...request.Option) (*s3.GetObjectOutput, error)
+	HeadObjectWithContext(aws.Context, *s3.HeadObjectInput, ...request.Option) (*s3.HeadObjectOutput, error)
+	// PresignGetObject returns a URL downloading the object for expiry.
+	PresignGetObject(*s3.GetObjectInput, time.Duration) (string, error)
+
+	PutObject(*s3.PutObjectInput) (*s3.PutObjectOutput, error)
+	PutObjectWithContext(aws.Context, *s3.PutObjectInput, ...request.Option) (*s3.PutObjectOutput, error)
+	// PutObjectIfAbsentWithContext uploads with If-None-Match: *, failing
+	// with status 412 if the object exists.
+	PutObjectIfAbsentWithContext(aws.Context, *s3.PutObjectInput, ...request.Option) (*s3.PutObjectOutput, error)
+	PutObjectAclWithContext(aws.Context, *s3.PutObjectAclInput, ...request.Option) (*s3.PutObjectAclOutput, error)
+	RestoreObjectWithContext(aws.Context, *s3.RestoreObjectInput, ...request.Option) (*s3.RestoreObjectOutput, error)
+	CopyObjectWithContext(aws.Context, *s3.CopyObjectInput, ...request.Option) (*s3.CopyObjectOutput, error)
+
+	CreateMultipartUploadWithContext(aws.Context, *s3.CreateMultipartUploadInput, ...request.Option) (*s3.CreateMultipartUploadOutput, error)
+	UploadPartWithContext(aws.Context, *s3.UploadPartInput, ...request.Option) (*s3.UploadPartOutput, error)
+	UploadPartCopyWithContext(aws.Context, *s3.UploadPartCopyInput, ...request.Option) (*s3.UploadPartCopyOutput, error)
+	CompleteMultipartUploadWithContext(aws.Context, *s3.CompleteMultipartUploadInput, ...request.Option) (*s3.CompleteMultipartUploadOutput, error)
+	AbortMultipartUploadWithContext(aws.Context, *s3.AbortMultipartUploadInput, ...request.Option) (*s3.AbortMultipartUploadOutput, error)
+
+	DeleteObject(*s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error)
+	DeleteObjectWithContext(aws.Context, *s3.DeleteObjectInput, ...request.Option) (*s3.DeleteObjectOutput, error)
+	DeleteObjectsWithContext(aws.Context, *s3.DeleteObjectsInput, ...request.Option) (*s3.DeleteObjectsOutput, error)
+
+	ListObjectsV2(*s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, error)
+	ListObjectsV2WithContext(aws.Context, *s3.ListObjectsV2Input, ...request.Option) (*s3.ListObjectsV2Output, error)
+	ListObjectsV2PagesWithContext(aws.Context, *s3.ListObjectsV2Input, func(*s3.ListObjectsV2Output, bool) bool, ...request.Option) error
+	ListObjectVersionsPagesWithContext(aws.Context, *s3.ListObjectVersionsInput, func(*s3.ListObjectVersionsOutput, bool) bool, ...request.Option) error
+
+	GetBucketLifecycleConfigurationWithContext(aws.Context, *s3.GetBucketLifecycleConfigurationInput, ...request.Option) (*s3.GetBucketLifecycleConfigurationOutput, error)
+	PutBucketLifecycleConfigurationWithContext(aws.Context, *s3.PutBucketLifecycleConfigurationInput, ...request.Option) (*s3.PutBucketLifecycleConfigurationOutput, error)
+	DeleteBucketLifecycleWithContext(aws.Context, *s3.DeleteBucketLifecycleInput, ...request.Option) (*s3.DeleteBucketLifecycleOutput, error)
+	GetBucketVersioningWithContext(aws.Context, *s3.GetBucketVersioningInput, ...request.Option) (*s3.GetBucketVersioningOutput, error)
+}
+
+// ErrUnsupported is returned by operations that need the S3 API when the
+// datastore uses a provider with its own API, such as "gcs" or "azure".
+var ErrUnsupported = errors.New("s3ds: not supported by provider")
+
+// needS3 fails with ErrUnsupported if there is no S3 client.
+func (s *S3Bucket) needS3() error {
+	if s.S3 == nil {
+		return ErrUnsupported
+	}
+	return nil
+}
+
+// clientTransport is what newClient builds the SDK client on.
+type clientTransport struct {
+	// http is the bottom of the stack, rt the top.
+	http *http.Transport
+	rt   http.RoundTripper
+
+	adaptive  *aimdLimiter
+	endpoints *endpointSet
+}
+
+// newClientTransport builds the transport stack of injected faults,
+// bandwidth and rate limits, adaptive concurrency and endpoint failover
+// in front of the SDK client of conf, counting requests in costs.
+func newClientTransport(conf *Config, log *subLogger, costs *costCounter) (*clientTransport, error) {
+	httpTransport, err := newHTTPTransport(conf.Transport, conf.Workers)
+	if err != nil {
+		return nil, err
+	}
+	if conf.Transport.TLSInsecureSkipVerify {
+		log.Warnf("TLS certificate verification is off: connections to the bucket can be intercepted")
+	}
+	var transport http.RoundTripper = httpTransport
+	if conf.Chaos != nil {
+		if transport, err = newChaosTransport(transport, *conf.Chaos); err != nil {
+			return nil, err
+		}
+		log.Warnf("chaos mode is on: requests to the bucket will fail on purpose")
+	}
+	transport = newBandwidthTransport(transport, conf.UploadRate, conf.DownloadRate)
+	transport = &costTransport{next: transport, costs: costs}
+	transport = newLimitedTransport(transport, conf.ReadLimit, conf.WriteLimit, conf.ListLimit)
+	t := &clientTransport{http: httpTransport}
+	if conf.AdaptiveConcurrency {
+		t.adaptive = newAIMDLimiter(conf.MinConcurrency, conf.Workers)
+		transport = &adaptiveTransport{next: transport, limiter: t.adaptive}
+	}
+	t.rt = transport
+
+	if len(conf.Endpoints) > 0 {
+		if t.endpoints, err = newEndpointSet(conf.Endpoints, conf.EndpointPolicy, conf.Bucket, conf.Secure); err != nil {
+			return nil, err
+		}
+		if conf.Endpoint == "" {
+			conf.Endpoint = conf.Endpoints[0].URL
+		}
+	}
+	return t, nil
+}
+
+// maxRetries is conf.MaxRetries as the SDKs take it.
+func maxRetries(conf *Config) int {
+	if conf.MaxRetries < 0 {
+		return 0
+	}
+	return conf.MaxRetries
+}
+
+// logSlowRequest warns of a request that took longer than threshold, from
+// the first attempt until the last one completed.
+func logSlowRequest(log *subLogger, threshold time.Duration, op, path string, took time.Duration, retries int) {
+	if took > threshold {
+		log.Warnf("slow request: %s %s took %s with %d retries",
+			op, path, took.Round(time.Millisecond), retries)
+	}
+}
+
+// watchDNS returns the watcher of the host names of endpoint and the other
+// endpoints of conf, if conf asks for one. Behind a SOCKS proxy the proxy
+// resolves the endpoint, and lookups of our own would leak it.
+func watchDNS(conf *Config, endpoint string, t *clientTransport, log *subLogger) *dnsWatcher {
+	if conf.Transport.ResolveInterval <= 0 || conf.Transport.socks() {
+		return nil
+	}
+	urls := []string{endpoint}
+	for _, e := range conf.Endpoints {
+		urls = append(urls, e.URL)
+	}
+	var hosts []string
+	for _, u := range urls {
+		host := endpointHost(u)
+		if conf.Addressing == AddressingVirtualHosted && net.ParseIP(host) == nil {
+			host = conf.Bucket + "." + host
+		}
+		hosts = append(hosts, host)
+	}
+	return newDNSWatcher(hosts, t.http, log)
+}
+
+// endpointURL adds the scheme to an endpoint given as a bare host name,
+// as the SDKs do: https, or http with disableSSL.
+func endpointURL(endpoint string, disableSSL bool) string {
+	if endpoint == "" || strings.Contains(endpoint, "://") {
+		return endpoint
+	}
+	if disableSSL {
+		return "http://" + endpoint
+	}
+	return "https://" + endpoint
+}
@@ -0,0 +1,749 @@
+// Command s3ds operates on a bucket used by the s3ds datastore through the
+// datastore's own key layout.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	s3ds "github.com/ipfs-s3c-storj-plugin/api/v1"
+	"github.com/ipfs-s3c-storj-plugin/s3test"
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+type command struct {
+	usage string
+	run   func(ctx context.Context, d s3ds.Datastore, args []string) error
+
+	// offline commands do not open the bucket; run gets a nil datastore.
+	offline bool
+}
+
+var commands = map[string]command{
+	"bench": {
+		usage:   "bench [-fake] [-run regexp] [-json]\n\tbenchmark Put, Get, Batch and Query in a scratch directory of the bucket, or an in-memory fake",
+		run:     runBench,
+		offline: true,
+	},
+	"changes": {
+		usage: "changes -checkpoint name [prefix]\n\tlist the keys under prefix written since the last run with the same checkpoint",
+		run:   runChanges,
+	},
+	"compact": {
+		usage: "compact\n\tpack small blocks and rewrite sparse packs (requires -packing)",
+		run:   runCompact,
+	},
+	"cp": {
+		usage: "cp src dst\n\tcopy the value of key src to key dst inside the bucket",
+		run:   runCp,
+	},
+	"del": {
+		usage: "del [-r] key...\n\tdelete keys, or with -r everything under them",
+		run:   runDel,
+	},
+	"digest": {
+		usage: "digest [-update] [-shards]\n\tprint the listing digest stored in the bucket, or compute and store a new one",
+		run:   runDigest,
+	},
+	"export": {
+		usage: "export [-o file] [prefix]\n\twrite the blocks under prefix to a CAR file (default stdout)",
+		run:   runExport,
+	},
+	"gc": {
+		usage: "gc\n\tdelete objects shadowed by packs and packs without an index (requires -packing)",
+		run:   runGC,
+	},
+	"get": {
+		usage: "get [-o file] key\n\twrite the value of key to a file (default stdout)",
+		run:   runGet,
+	},
+	"grant": {
+		usage: "grant [prefix]\n\tapply the configured grants to the objects under prefix",
+		run:   runGrant,
+	},
+	"import": {
+		usage: "import [file]\n\twrite the blocks of a CAR file (default stdin) to the bucket",
+		run:   runImport,
+	},
+	"lifecycle": {
+		usage: "lifecycle [-expire prefix]... [-expire-days n] [-abort-multipart-days n] [-transition prefix=days:class]...\n\tinstall bucket lifecycle rules, replacing those installed before",
+		run:   runLifecycle,
+	},
+	"ls": {
+		usage: "ls [-l] [prefix]\n\tlist the keys under prefix, with -l also their sizes",
+		run:   runLs,
+	},
+	"migrate": {
+		usage: "migrate -from-bucket bucket [-from-root dir] [-from-endpoint url] [-resume] [-verify]\n\tcopy every key of another bucket into this one",
+		run:   runMigrate,
+	},
+	"preload": {
+		usage: "preload [-r] key...\n\tread keys, or with -r everything under them, ahead of requests for them",
+		run:   runPreload,
+	},
+	"purge": {
+		usage: "purge [-retention duration]\n\tdelete versions overwritten or deleted longer ago than retention (requires -soft-delete)",
+		run:   runPurge,
+	},
+	"policy": {
+		usage:   "policy [-prefix prefix] [-read-only] [-expires duration]\n\tprint the least-privilege IAM policy, or Storj share command, for the flags",
+		run:     runPolicy,
+		offline: true,
+	},
+	"mv": {
+		usage: "mv src dst\n\tmove the value of key src to key dst inside the bucket",
+		run:   runMv,
+	},
+	"put": {
+		usage: "put key [file]\n\tstore the contents of a file (default stdin) under key",
+		run:   runPut,
+	},
+	"tombstones": {
+		usage: "tombstones [prefix]\n\tlist the keys under prefix that were deleted, with when, why and by which host",
+		run:   runTombstones,
+	},
+	"changelog": {
+		usage: "changelog [-since 1h]\n\tlist the keys every node put or deleted, as recorded in the change log",
+		run:   runChangeLog,
+	},
+	"restore": {
+		usage: "restore label\n\troll the bucket back to a snapshot",
+		run:   runRestore,
+	},
+	"snapshot": {
+		usage: "snapshot label\n\trecord the current state of the bucket to restore later",
+		run:   runSnapshot,
+	},
+	"stat": {
+		usage: "stat key...\n\tprint the size of each key",
+		run:   runStat,
+	},
+	"undelete": {
+		usage: "undelete key...\n\tbring back deleted keys (requires -soft-delete)",
+		run:   runUndelete,
+	},
+	"url": {
+		usage: "url [-expiry duration] key\n\tprint a presigned URL to download the value of key",
+		run:   runURL,
+	},
+	"verify": {
+		usage: "verify [prefix]\n\tcheck that the blocks under prefix hash to their keys",
+		run:   runVerify,
+	},
+}
+
+// config is the datastore configuration from the global flags.
+var config s3ds.Config
+
+func main() {
+	cfg := &config
+	flag.StringVar(&cfg.Bucket, "bucket", "", "bucket name")
+	flag.StringVar(&cfg.Region, "region", "", "bucket region (default from -provider)")
+	flag.StringVar(&cfg.Endpoint, "endpoint", "", "S3 endpoint, e.g. http://localhost:7777")
+	flag.StringVar(&cfg.RootDirectory, "root", "", "root directory inside the bucket")
+	flag.StringVar(&cfg.KeyTransform, "key-transform", "", "key layout: raw or flatfs")
+	flag.StringVar(&cfg.Provider, "provider", "", "provider profile: aws, minio, b2, wasabi, filebase, storj, gcs or azure")
+	flag.StringVar(&cfg.Addressing, "addressing", "", "bucket addressing: path or virtual-hosted (default from -provider)")
+	flag.StringVar(&cfg.Transport.Proxy, "proxy", "", "HTTP or SOCKS5 proxy, e.g. socks5://127.0.0.1:9050 for Tor")
+	flag.StringVar(&cfg.Transport.TLSCAFile, "tls-ca-file", "", "PEM file of CA certificates to trust besides the system's")
+	flag.StringVar(&cfg.Transport.TLSCertFile, "tls-cert-file", "", "PEM client certificate for gateways requiring mutual TLS")
+	flag.StringVar(&cfg.Transport.TLSKeyFile, "tls-key-file", "", "PEM key of the client certificate")
+	flag.BoolVar(&cfg.Transport.TLSInsecureSkipVerify, "tls-insecure-skip-verify", false, "accept any certificate; for lab deployments only")
+	flag.IntVar(&cfg.MaxRetries, "max-retries", 0, "retries of failed requests; provider default if 0, none if negative")
+	flag.StringVar(&cfg.GCSCredentials, "gcs-credentials", "", "service account key file for provider gcs")
+	flag.StringVar(&cfg.AzureAccount, "azure-account", "", "storage account for provider azure")
+	flag.StringVar(&cfg.AzureKey, "azure-key", "", "shared key of the storage account; managed identity if empty")
+	flag.StringVar(&cfg.AzureClientID, "azure-client-id", "", "client ID of a user-assigned managed identity")
+	flag.IntVar(&cfg.Workers, "workers", 0, "number of parallel requests")
+	flag.StringVar(&cfg.AccessKey, "access-key", os.Getenv("AWS_ACCESS_KEY_ID"), "access key (default $AWS_ACCESS_KEY_ID)")
+	flag.StringVar(&cfg.SecretKey, "secret-key", os.Getenv("AWS_SECRET_ACCESS_KEY"), "secret key (default $AWS_SECRET_ACCESS_KEY)")
+	flag.StringVar(&cfg.Grants.ACL, "acl", "", "canned ACL for written objects, e.g. bucket-owner-full-control")
+	flag.StringVar(&cfg.Grants.Read, "grant-read", "", "grantees allowed to read written objects, e.g. id=\"...\"")
+	flag.StringVar(&cfg.Grants.FullControl, "grant-full-control", "", "grantees with full control of written objects")
+	flag.BoolVar(&cfg.Packing, "packing", false, "the bucket uses packing")
+	flag.DurationVar(&cfg.LeaseTTL, "lease-ttl", 0, "take the writer lease of a shared bucket before gc and compact")
+	flag.StringVar(&cfg.StorageClass, "storage-class", "", "storage class of written objects, e.g. STANDARD_IA")
+	flag.BoolVar(&cfg.SoftDelete, "soft-delete", false, "delete with delete markers in a versioned bucket")
+	flag.BoolVar(&cfg.SkipManifestCheck, "skip-manifest-check", false, "open the bucket even if its layout manifest disagrees")
+	flag.StringVar(&cfg.AuditLog, "audit-log", "", "append a JSON line for every write to this file")
+	flag.BoolVar(&cfg.DryRun, "dry-run", false, "log writes instead of executing them")
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "s3ds: unknown command %q\n", flag.Arg(0))
+		usage()
+		os.Exit(2)
+	}
+	if cfg.Bucket == "" {
+		fmt.Fprintln(os.Stderr, "s3ds: -bucket is required")
+		os.Exit(2)
+	}
+
+	var d s3ds.Datastore
+	if !cmd.offline {
+		var err error
+		if d, err = s3ds.New(config); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		defer d.Close()
+	}
+
+	if err := cmd.run(context.Background(), d, flag.Args()[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: s3ds [flags] command [args]\n\ncommands:\n")
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %s\n", commands[name].usage)
+	}
+	fmt.Fprintf(os.Stderr, "\nflags:\n")
+	flag.PrintDefaults()
+}
+
+func runDigest(ctx context.Context, d s3ds.Datastore, args []string) error {
+	fs := flag.NewFlagSet("digest", flag.ExitOnError)
+	update := fs.Bool("update", false, "list the bucket and store a new digest")
+	shards := fs.Bool("shards", false, "print the digest of every shard too")
+	fs.Parse(args)
+
+	var digest s3ds.ListingDigest
+	var err error
+	if *update {
+		digest, err = d.UpdateDigest(ctx)
+	} else {
+		digest, err = d.ReadDigest(ctx)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s\t%s\n", digest.Root, digest.Created.Format(time.RFC3339))
+	if *shards {
+		names := make([]string, 0, len(digest.Shards))
+		for name := range digest.Shards {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Printf("%s\t%s\n", digest.Shards[name], name)
+		}
+	}
+	return nil
+}
+
+func runExport(ctx context.Context, d s3ds.Datastore, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	out := fs.String("o", "", "output file")
+	fs.Parse(args)
+
+	prefix := "/"
+	if fs.NArg() > 0 {
+		prefix = fs.Arg(0)
+	}
+
+	if *out == "" {
+		return d.Export(ctx, os.Stdout, prefix)
+	}
+
+	f, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	if err := d.Export(ctx, f, prefix); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func runPolicy(ctx context.Context, d s3ds.Datastore, args []string) error {
+	fs := flag.NewFlagSet("policy", flag.ExitOnError)
+	prefix := fs.String("prefix", "/", "with -provider storj, share only the keys under this prefix")
+	readOnly := fs.Bool("read-only", false, "with -provider storj, share read access only")
+	expires := fs.Duration("expires", 0, "with -provider storj, let the access grant expire after this long")
+	fs.Parse(args)
+
+	if config.Provider == "storj" {
+		share := s3ds.StorjShare{Prefix: *prefix, ReadOnly: *readOnly}
+		if *expires > 0 {
+			share.NotAfter = time.Now().Add(*expires)
+		}
+		cmd, err := s3ds.RestrictedStorjShareCommandLine(config, share)
+		if err != nil {
+			return err
+		}
+		fmt.Println(cmd)
+		return nil
+	}
+	policy, err := s3ds.ScopedPolicy(config)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(policy)
+}
+
+func runImport(ctx context.Context, d s3ds.Datastore, args []string) error {
+	in := os.Stdin
+	if len(args) > 0 {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	n, err := d.ImportCAR(ctx, in)
+	fmt.Fprintf(os.Stderr, "imported %d blocks\n", n)
+	return err
+}
+
+func runGrant(ctx context.Context, d s3ds.Datastore, args []string) error {
+	prefix := "/"
+	if len(args) > 0 {
+		prefix = args[0]
+	}
+	n, err := d.ApplyGrants(ctx, prefix)
+	fmt.Fprintf(os.Stderr, "updated %d objects\n", n)
+	return err
+}
+
+func runChanges(ctx context.Context, d s3ds.Datastore, args []string) error {
+	fs := flag.NewFlagSet("changes", flag.ExitOnError)
+	checkpoint := fs.String("checkpoint", "", "name of the checkpoint kept in the bucket")
+	fs.Parse(args)
+	if *checkpoint == "" {
+		return fmt.Errorf("s3ds: changes requires -checkpoint")
+	}
+
+	prefix := "/"
+	if fs.NArg() > 0 {
+		prefix = fs.Arg(0)
+	}
+	_, err := d.ListSince(ctx, *checkpoint, prefix, func(keys []ds.Key) error {
+		for _, k := range keys {
+			if _, err := fmt.Println(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return err
+}
+
+func runLs(ctx context.Context, d s3ds.Datastore, args []string) error {
+	fs := flag.NewFlagSet("ls", flag.ExitOnError)
+	long := fs.Bool("l", false, "print sizes")
+	fs.Parse(args)
+
+	prefix := "/"
+	if fs.NArg() > 0 {
+		prefix = fs.Arg(0)
+	}
+	res, err := d.Query(ctx, dsq.Query{Prefix: prefix, KeysOnly: true})
+	if err != nil {
+		return err
+	}
+	defer res.Close()
+
+	// Sizes are looked up a page of keys at a time.
+	var page []ds.Key
+	flush := func() error {
+		sizes, err := d.GetSizeMany(ctx, page)
+		if err != nil {
+			return err
+		}
+		for i, k := range page {
+			if sizes[i] >= 0 {
+				fmt.Printf("%d\t%s\n", sizes[i], k)
+			}
+		}
+		page = page[:0]
+		return nil
+	}
+	for r := range res.Next() {
+		if r.Error != nil {
+			return r.Error
+		}
+		if !*long {
+			fmt.Println(r.Key)
+			continue
+		}
+		page = append(page, ds.NewKey(r.Key))
+		if len(page) == 1000 {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if len(page) > 0 {
+		return flush()
+	}
+	return nil
+}
+
+func runGet(ctx context.Context, d s3ds.Datastore, args []string) error {
+	fs := flag.NewFlagSet("get", flag.ExitOnError)
+	out := fs.String("o", "", "output file")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("s3ds: get takes one key")
+	}
+
+	value, err := d.Get(ctx, ds.NewKey(fs.Arg(0)))
+	if err != nil {
+		return fmt.Errorf("s3ds: %s: %s", fs.Arg(0), err)
+	}
+	if *out == "" {
+		_, err = os.Stdout.Write(value)
+		return err
+	}
+	return ioutil.WriteFile(*out, value, 0644)
+}
+
+func runPut(ctx context.Context, d s3ds.Datastore, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return fmt.Errorf("s3ds: put takes a key and an optional file")
+	}
+	var in io.Reader = os.Stdin
+	if len(args) == 2 {
+		f, err := os.Open(args[1])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	value, err := ioutil.ReadAll(in)
+	if err != nil {
+		return err
+	}
+	if err := d.Put(ctx, ds.NewKey(args[0]), value); err != nil {
+		return err
+	}
+	return d.Flush()
+}
+
+func runCp(ctx context.Context, d s3ds.Datastore, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("s3ds: cp takes a source and a destination key")
+	}
+	if err := d.Copy(ctx, ds.NewKey(args[0]), ds.NewKey(args[1])); err != nil {
+		return err
+	}
+	return d.Flush()
+}
+
+func runMv(ctx context.Context, d s3ds.Datastore, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("s3ds: mv takes a source and a destination key")
+	}
+	if err := d.Rename(ctx, ds.NewKey(args[0]), ds.NewKey(args[1])); err != nil {
+		return err
+	}
+	return d.Flush()
+}
+
+func runURL(ctx context.Context, d s3ds.Datastore, args []string) error {
+	fs := flag.NewFlagSet("url", flag.ExitOnError)
+	expiry := fs.Duration("expiry", time.Hour, "how long the URL stays valid")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("s3ds: url takes a key")
+	}
+	url, err := d.PresignGet(ctx, ds.NewKey(fs.Arg(0)), *expiry)
+	if err != nil {
+		return err
+	}
+	fmt.Println(url)
+	return nil
+}
+
+func runDel(ctx context.Context, d s3ds.Datastore, args []string) error {
+	fs := flag.NewFlagSet("del", flag.ExitOnError)
+	recursive := fs.Bool("r", false, "delete every key under the given prefixes")
+	fs.Parse(args)
+
+	for _, k := range fs.Args() {
+		if !*recursive {
+			if err := d.Delete(ctx, ds.NewKey(k)); err != nil {
+				return fmt.Errorf("s3ds: %s: %s", k, err)
+			}
+			continue
+		}
+		n, err := d.DeletePrefix(ctx, k, func(deleted int) {
+			fmt.Fprintf(os.Stderr, "\rdeleted %d keys under %s", deleted, k)
+		})
+		fmt.Fprintf(os.Stderr, "\rdeleted %d keys under %s\n", n, k)
+		if err != nil {
+			return fmt.Errorf("s3ds: %s: %s", k, err)
+		}
+	}
+	return d.Flush()
+}
+
+func runPreload(ctx context.Context, d s3ds.Datastore, args []string) error {
+	fs := flag.NewFlagSet("preload", flag.ExitOnError)
+	recursive := fs.Bool("r", false, "preload every key under the given prefixes")
+	fs.Parse(args)
+
+	var (
+		res s3ds.PreloadResult
+		err error
+	)
+	if *recursive {
+		for _, prefix := range fs.Args() {
+			var r s3ds.PreloadResult
+			r, err = d.PreloadPrefix(ctx, prefix)
+			res.Loaded += r.Loaded
+			res.Missing += r.Missing
+			res.Archived += r.Archived
+			if err != nil {
+				break
+			}
+		}
+	} else {
+		keys := make([]ds.Key, fs.NArg())
+		for i, k := range fs.Args() {
+			keys[i] = ds.NewKey(k)
+		}
+		res, err = d.Preload(ctx, keys)
+	}
+	fmt.Fprintf(os.Stderr, "loaded %d keys, %d missing, %d still being restored\n", res.Loaded, res.Missing, res.Archived)
+	return err
+}
+
+func runTombstones(ctx context.Context, d s3ds.Datastore, args []string) error {
+	prefix := "/"
+	if len(args) > 0 {
+		prefix = args[0]
+	}
+	tombstones, err := d.ListTombstones(ctx, prefix)
+	for _, t := range tombstones {
+		fmt.Printf("%s\t%s\t%s\t%s\n", t.Deleted.Format(time.RFC3339), t.Reason, t.Host, t.Key)
+	}
+	return err
+}
+
+func runChangeLog(ctx context.Context, d s3ds.Datastore, args []string) error {
+	fs := flag.NewFlagSet("changelog", flag.ExitOnError)
+	since := fs.Duration("since", time.Hour, "list the changes made this long ago or later")
+	fs.Parse(args)
+	changes, err := d.ReadChangeLog(ctx, time.Now().Add(-*since))
+	for _, c := range changes {
+		fmt.Printf("%s\t%s\t%s\t%s\t%s\n", c.Time.Format(time.RFC3339), c.Op, c.Node, c.Host, c.Key)
+	}
+	return err
+}
+
+func runUndelete(ctx context.Context, d s3ds.Datastore, args []string) error {
+	for _, k := range args {
+		if err := d.Undelete(ctx, ds.NewKey(k)); err != nil {
+			return fmt.Errorf("s3ds: %s: %s", k, err)
+		}
+	}
+	return nil
+}
+
+func runPurge(ctx context.Context, d s3ds.Datastore, args []string) error {
+	fs := flag.NewFlagSet("purge", flag.ExitOnError)
+	retention := fs.Duration("retention", 30*24*time.Hour, "keep versions deleted or overwritten more recently")
+	fs.Parse(args)
+	res, err := d.Purge(ctx, *retention)
+	fmt.Fprintf(os.Stderr, "purged %d versions, %d keys for good\n", res.Versions, res.Keys)
+	return err
+}
+
+func runStat(ctx context.Context, d s3ds.Datastore, args []string) error {
+	keys := make([]ds.Key, len(args))
+	for i, k := range args {
+		keys[i] = ds.NewKey(k)
+	}
+	sizes, err := d.GetSizeMany(ctx, keys)
+	if err != nil {
+		return err
+	}
+	missing := 0
+	for i, k := range keys {
+		if sizes[i] < 0 {
+			fmt.Fprintf(os.Stderr, "%s: not found\n", k)
+			missing++
+			continue
+		}
+		fmt.Printf("%d\t%s\n", sizes[i], k)
+	}
+	if missing > 0 {
+		return fmt.Errorf("s3ds: %d keys not found", missing)
+	}
+	return nil
+}
+
+func runVerify(ctx context.Context, d s3ds.Datastore, args []string) error {
+	prefix := "/"
+	if len(args) > 0 {
+		prefix = args[0]
+	}
+	res, err := d.Verify(ctx, prefix)
+	for _, k := range res.Corrupt {
+		fmt.Println(k)
+	}
+	fmt.Fprintf(os.Stderr, "checked %d blocks, %d corrupt, %d not verifiable\n",
+		res.Checked, len(res.Corrupt), res.Unverifiable)
+	if err != nil {
+		return err
+	}
+	if len(res.Corrupt) > 0 {
+		return fmt.Errorf("s3ds: %d corrupt blocks", len(res.Corrupt))
+	}
+	return nil
+}
+
+func runCompact(ctx context.Context, d s3ds.Datastore, args []string) error {
+	res, err := d.Compact(ctx)
+	stats := d.PackStats()
+	fmt.Fprintf(os.Stderr, "packed %d objects, repacked %d packs reclaiming %d bytes; %d packs at %.0f%% utilization\n",
+		res.Packed, res.Repacked, res.Reclaimed, stats.Packs, stats.Utilization*100)
+	return err
+}
+
+func runSnapshot(ctx context.Context, d s3ds.Datastore, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("s3ds: snapshot takes a label")
+	}
+	res, err := d.Snapshot(ctx, args[0])
+	fmt.Fprintf(os.Stderr, "recorded %d keys, copied %d objects\n", res.Keys, res.Copied)
+	return err
+}
+
+func runRestore(ctx context.Context, d s3ds.Datastore, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("s3ds: restore takes a label")
+	}
+	res, err := d.RestoreSnapshot(ctx, args[0])
+	fmt.Fprintf(os.Stderr, "restored %d of %d keys, deleted %d\n", res.Copied, res.Keys, res.Deleted)
+	return err
+}
+
+func runLifecycle(ctx context.Context, d s3ds.Datastore, args []string) error {
+	var conf s3ds.LifecycleConfig
+	fs := flag.NewFlagSet("lifecycle", flag.ExitOnError)
+	fs.Func("expire", "delete objects under this prefix after -expire-days (repeatable)", func(prefix string) error {
+		conf.ExpirePrefixes = append(conf.ExpirePrefixes, prefix)
+		return nil
+	})
+	fs.IntVar(&conf.ExpireDays, "expire-days", 0, "days after which objects under -expire prefixes are deleted")
+	fs.IntVar(&conf.AbortMultipartDays, "abort-multipart-days", 0, "days after which incomplete multipart uploads are aborted")
+	fs.Func("transition", "move objects under prefix to class after days, as prefix=days:class (repeatable)", func(v string) error {
+		var t s3ds.LifecycleTransition
+		prefix, rule, ok := strings.Cut(v, "=")
+		days, class, ok2 := strings.Cut(rule, ":")
+		n, err := strconv.Atoi(days)
+		if !ok || !ok2 || err != nil {
+			return fmt.Errorf("want prefix=days:class")
+		}
+		t.Prefix, t.Days, t.StorageClass = prefix, n, class
+		conf.Transitions = append(conf.Transitions, t)
+		return nil
+	})
+	fs.Parse(args)
+	n, err := d.ApplyLifecycle(ctx, conf)
+	fmt.Fprintf(os.Stderr, "installed %d lifecycle rules\n", n)
+	return err
+}
+
+func runGC(ctx context.Context, d s3ds.Datastore, args []string) error {
+	res, err := d.GC(ctx)
+	fmt.Fprintf(os.Stderr, "deleted %d shadowed objects and %d orphaned packs, %d bytes\n",
+		res.Objects, res.Packs, res.Bytes)
+	return err
+}
+
+func runMigrate(ctx context.Context, d s3ds.Datastore, args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	// The source shares the credentials and settings of the destination.
+	src := config
+	fs.StringVar(&src.Bucket, "from-bucket", "", "bucket to copy from")
+	fs.StringVar(&src.RootDirectory, "from-root", "", "root directory inside the source bucket")
+	fs.StringVar(&src.Endpoint, "from-endpoint", config.Endpoint, "S3 endpoint of the source bucket")
+	fs.StringVar(&src.KeyTransform, "from-key-transform", config.KeyTransform, "key layout of the source bucket")
+	resume := fs.Bool("resume", false, "continue an interrupted migration")
+	verify := fs.Bool("verify", false, "compare sizes once the copy is done")
+	fs.Parse(args)
+	if src.Bucket == "" {
+		return fmt.Errorf("s3ds: -from-bucket is required")
+	}
+	src.ReadOnly = true
+	src.Grants = s3ds.Grants{}
+
+	from, err := s3ds.New(src)
+	if err != nil {
+		return err
+	}
+	defer from.Close()
+
+	p, err := d.Migrate(ctx, from, s3ds.MigrateOptions{Resume: *resume, Verify: *verify})
+	fmt.Fprintf(os.Stderr, "copied %d of %d keys, skipped %d\n", p.Copied, p.Total, p.Skipped)
+	return err
+}
+
+func runBench(ctx context.Context, _ s3ds.Datastore, args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	fake := fs.Bool("fake", false, "benchmark against an in-memory fake instead of the bucket")
+	run := fs.String("run", "", "only run the benchmarks matching this regexp, e.g. Put/block")
+	asJSON := fs.Bool("json", false, "print a JSON line per benchmark")
+	fs.Parse(args)
+
+	var match func(string) bool
+	if *run != "" {
+		re, err := regexp.Compile(*run)
+		if err != nil {
+			return err
+		}
+		match = re.MatchString
+	}
+	conf := config
+	if *fake {
+		conf.Client = s3test.New().Config(conf.Bucket).Client
+	}
+
+	results, err := s3test.Benchmark(conf, match)
+	enc := json.NewEncoder(os.Stdout)
+	for _, r := range results {
+		if *asJSON {
+			if err := enc.Encode(r); err != nil {
+				return err
+			}
+			continue
+		}
+		fmt.Printf("%-14s %8d %14d ns/op %10.2f MB/s %10d B/op %8d allocs/op\n",
+			r.Name, r.N, r.NsPerOp, r.MBPerSec, r.BytesPerOp, r.AllocsPerOp)
+	}
+	return err
+}
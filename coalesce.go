@@ -0,0 +1,54 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+
+	ds "github.com/ipfs/go-datastore"
+	"golang.org/x/sync/singleflight"
+)
+
+// errGetAbandoned is the result of a shared download cancelled by the
+// caller that started it.
+var errGetAbandoned = errors.New("s3ds: download abandoned")
+
+// getCoalesced is get, except that concurrent calls for the same key share
+// a single download. Bitswap asks for the same block from many sessions at
+// once, and every one of them would otherwise cost a GET.
+func (s *S3Bucket) getCoalesced(ctx context.Context, k ds.Key) ([]byte, error) {
+	ch := s.gets.DoChan(k.String(), func() (interface{}, error) {
+		atomic.AddInt64(&s.coalescedGets, 1)
+		defer atomic.AddInt64(&s.coalescedGets, -1)
+		value, err := s.get(ctx, k)
+		if err != nil && ctx.Err() != nil {
+			// The caller gave up; whoever else waits has to try again.
+			return nil, errGetAbandoned
+		}
+		return value, err
+	})
+
+	var res singleflight.Result
+	select {
+	case res = <-ch:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	s.stats.lookup(cacheCoalesced, res.Shared)
+	if res.Err == errGetAbandoned {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return s.get(ctx, k)
+	}
+	if res.Err != nil {
+		return nil, res.Err
+	}
+
+	value := res.Val.([]byte)
+	if res.Shared {
+		// Callers own the returned slice and may modify it.
+		value = append([]byte(nil), value...)
+	}
+	return value, nil
+}
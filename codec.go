@@ -0,0 +1,146 @@
+package s3
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// metaCodecs records the codecs an object was encoded with, in the order
+// they were applied.
+const metaCodecs = "s3ds-codecs"
+
+// Codec is a transform of values on their way to and from the bucket,
+// such as encryption or chunking for deduplication. Decode must undo
+// Encode. Objects record the names of the codecs they were encoded with,
+// so a codec must keep its name, and its encoding, for as long as objects
+// encoded with it exist.
+type Codec struct {
+	Name   string
+	Encode func([]byte) ([]byte, error)
+	Decode func([]byte) ([]byte, error)
+}
+
+var registry = struct {
+	sync.Mutex
+	codecs map[string]Codec
+}{codecs: make(map[string]Codec)}
+
+// RegisterCodec makes c available to Config.CodecNames, and so to the
+// "codecs" of a datastore spec. Programs register their codecs before
+// opening a datastore, typically from an init function.
+func RegisterCodec(c Codec) error {
+	if err := checkCodec(c); err != nil {
+		return err
+	}
+	registry.Lock()
+	defer registry.Unlock()
+	if _, ok := registry.codecs[c.Name]; ok {
+		return fmt.Errorf("s3ds: codec %s is already registered", c.Name)
+	}
+	registry.codecs[c.Name] = c
+	return nil
+}
+
+func registeredCodec(name string) (Codec, bool) {
+	registry.Lock()
+	defer registry.Unlock()
+	c, ok := registry.codecs[name]
+	return c, ok
+}
+
+func checkCodec(c Codec) error {
+	switch {
+	case c.Name == "" || strings.Contains(c.Name, ","):
+		return fmt.Errorf("s3ds: invalid codec name %q", c.Name)
+	case c.Encode == nil || c.Decode == nil:
+		return fmt.Errorf("s3ds: codec %s needs both Encode and Decode", c.Name)
+	}
+	return nil
+}
+
+// newCodecs returns the pipeline of conf: the registered codecs named by
+// CodecNames, then Codecs.
+func newCodecs(conf Config) ([]Codec, error) {
+	var pipeline []Codec
+	for _, name := range conf.CodecNames {
+		c, ok := registeredCodec(name)
+		if !ok {
+			return nil, fmt.Errorf("s3ds: unknown codec %q", name)
+		}
+		pipeline = append(pipeline, c)
+	}
+	for _, c := range conf.Codecs {
+		if err := checkCodec(c); err != nil {
+			return nil, err
+		}
+		pipeline = append(pipeline, c)
+	}
+	seen := make(map[string]bool, len(pipeline))
+	for _, c := range pipeline {
+		if seen[c.Name] {
+			return nil, fmt.Errorf("s3ds: codec %s is used twice", c.Name)
+		}
+		seen[c.Name] = true
+	}
+	return pipeline, nil
+}
+
+// encodeCodecs runs body, which encodes a value of size bytes, through
+// the pipeline and records it in meta, which it returns.
+func (s *S3Bucket) encodeCodecs(body []byte, size int, meta map[string]string) ([]byte, map[string]string, error) {
+	if len(s.codecs) == 0 {
+		return body, meta, nil
+	}
+	names := make([]string, len(s.codecs))
+	for i, c := range s.codecs {
+		var err error
+		if body, err = c.Encode(body); err != nil {
+			return nil, nil, fmt.Errorf("s3ds: codec %s: %s", c.Name, err)
+		}
+		names[i] = c.Name
+	}
+	out := make(map[string]string, len(meta)+2)
+	for k, v := range meta {
+		out[k] = v
+	}
+	out[metaCodecs] = strings.Join(names, ",")
+	out[metaSize] = strconv.Itoa(size)
+	return body, out, nil
+}
+
+// decodeCodecs undoes the codecs recorded in meta, last first. Codecs
+// that are no longer configured are looked up in the registry.
+func (s *S3Bucket) decodeCodecs(data []byte, meta map[string]string) ([]byte, error) {
+	if meta[metaCodecs] == "" {
+		return data, nil
+	}
+	names := strings.Split(meta[metaCodecs], ",")
+	for i := len(names) - 1; i >= 0; i-- {
+		c, ok := s.codec(names[i])
+		if !ok {
+			return nil, fmt.Errorf("s3ds: unknown codec %q", names[i])
+		}
+		var err error
+		if data, err = c.Decode(data); err != nil {
+			return nil, fmt.Errorf("s3ds: codec %s: %s", c.Name, err)
+		}
+	}
+	return data, nil
+}
+
+func (s *S3Bucket) codec(name string) (Codec, bool) {
+	for _, c := range s.codecs {
+		if c.Name == name {
+			return c, true
+		}
+	}
+	return registeredCodec(name)
+}
+
+// storesValues reports whether objects hold their values as they are, so
+// that listed sizes are value sizes.
+func (s *S3Bucket) storesValues() bool {
+	return s.compressor == nil && len(s.codecs) == 0
+}
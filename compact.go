@@ -0,0 +1,298 @@
+package s3
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	ds "github.com/ipfs/go-datastore"
+)
+
+// defaultCompactUtilization is the share of live bytes below which a pack
+// is rewritten.
+const defaultCompactUtilization = 0.5
+
+// PackStats describes how well the packs use their storage.
+type PackStats struct {
+	Packs     int
+	Keys      int
+	Bytes     int64
+	LiveBytes int64
+
+	// Utilization is LiveBytes/Bytes, or 1 without packs.
+	Utilization float64
+}
+
+// CompactResult reports what a compaction did.
+type CompactResult struct {
+	// Packed is the number of small objects moved into packs.
+	Packed int
+
+	// Repacked is the number of packs rewritten because most of their
+	// values were deleted or overwritten.
+	Repacked int
+
+	// Reclaimed is the number of bytes of dead values freed by Repacked.
+	Reclaimed int64
+}
+
+// PackStats returns the current pack utilization. It is zero unless
+// Packing is enabled.
+func (s *S3Bucket) PackStats() PackStats {
+	stats := PackStats{Utilization: 1}
+	if s.packs == nil {
+		return stats
+	}
+	p := s.packs
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	stats.Packs = len(p.sizes)
+	stats.Keys = len(p.locs)
+	for _, size := range p.sizes {
+		stats.Bytes += size
+	}
+	for _, loc := range p.locs {
+		stats.LiveBytes += loc.length
+	}
+	if stats.Bytes > 0 {
+		stats.Utilization = float64(stats.LiveBytes) / float64(stats.Bytes)
+	}
+	return stats
+}
+
+// Compact moves blocks stored as objects smaller than SmallValueThreshold
+// into packs and rewrites packs whose utilization fell below
+// CompactUtilization. Only blocks are moved: their values never change,
+// so a concurrent Put cannot be lost. It requires Packing, and the writer
+// lease if LeaseTTL is set.
+func (s *S3Bucket) Compact(ctx context.Context) (CompactResult, error) {
+	var res CompactResult
+	if s.packs == nil {
+		return res, fmt.Errorf("s3ds: compaction requires packing")
+	}
+	if s.readOnly() {
+		return res, ErrReadOnly
+	}
+	if err := s.requireLease(); err != nil {
+		return res, err
+	}
+	if err := s.auditMaintenance("Compact", "compact", ""); err != nil {
+		return res, err
+	}
+	log := s.logs.get(LogCompact)
+
+	packed, err := s.packSmallObjects(ctx)
+	res.Packed = packed
+	if err != nil {
+		return res, err
+	}
+
+	minUtil := s.CompactUtilization
+	if minUtil <= 0 {
+		minUtil = defaultCompactUtilization
+	}
+	for _, id := range s.sparsePacks(minUtil) {
+		reclaimed, err := s.repack(ctx, id)
+		if err != nil {
+			return res, err
+		}
+		res.Repacked++
+		res.Reclaimed += reclaimed
+	}
+
+	stats := s.PackStats()
+	log.Infof("packed %d objects, repacked %d packs reclaiming %d bytes; %d packs at %.0f%% utilization",
+		res.Packed, res.Repacked, res.Reclaimed, stats.Packs, stats.Utilization*100)
+	return res, nil
+}
+
+// packSmallObjects moves small block objects into packs, one pack at a
+// time so that a failure loses no more than one pack's worth of work.
+func (s *S3Bucket) packSmallObjects(ctx context.Context) (int, error) {
+	threshold := int64(s.SmallValueThreshold())
+	packSize := s.PackSize
+	if packSize <= 0 {
+		packSize = defaultPackSize
+	}
+
+	listPrefix, _ := s.keys.listPrefix("/")
+	var (
+		candidates []*s3.Object
+		size       int64
+		packed     int
+		packErr    error
+	)
+	flush := func() error {
+		if len(candidates) == 0 {
+			return nil
+		}
+		n, err := s.packObjects(ctx, candidates)
+		packed += n
+		candidates, size = nil, 0
+		return err
+	}
+
+	err := s.S3.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.Bucket),
+		Prefix: aws.String(path.Join(s.RootDirectory, listPrefix)),
+	}, func(page *s3.ListObjectsV2Output, last bool) bool {
+		for _, obj := range page.Contents {
+			name := aws.StringValue(obj.Key)
+			if s.isMetaPath(name) || aws.Int64Value(obj.Size) >= threshold {
+				continue
+			}
+			k := s.fromS3Path(name)
+			if !immutable(k) {
+				continue
+			}
+			if _, ok := s.packs.lookup(k); ok {
+				// Shadowed by a packed value; leave it to garbage
+				// collection.
+				continue
+			}
+			if size+aws.Int64Value(obj.Size) > int64(packSize) {
+				if packErr = flush(); packErr != nil {
+					return false
+				}
+			}
+			candidates = append(candidates, obj)
+			size += aws.Int64Value(obj.Size)
+		}
+		return true
+	})
+	if packErr != nil {
+		return packed, packErr
+	}
+	if err != nil {
+		return packed, fmt.Errorf("s3ds: listing objects to pack: %s", err)
+	}
+	return packed, flush()
+}
+
+// packObjects writes the values of objs to a pack, then deletes the
+// objects.
+func (s *S3Bucket) packObjects(ctx context.Context, objs []*s3.Object) (int, error) {
+	// Deletes wait for the pack to be indexed before unpacking, so a key
+	// deleted while it is being packed does not come back.
+	s.packs.rewrite.Lock()
+	keys := make([]ds.Key, len(objs))
+	values := make([][]byte, len(objs))
+	err := forEach(ctx, len(objs), s.Workers, func(ctx context.Context, i int) error {
+		keys[i] = s.fromS3Path(aws.StringValue(objs[i].Key))
+		var err error
+		values[i], err = s.get(ctx, keys[i])
+		if err == ds.ErrNotFound {
+			err = nil
+		}
+		return err
+	})
+	var packed []ObjectInfo
+	var found []ds.Key
+	var foundValues [][]byte
+	for i, obj := range objs {
+		if values[i] != nil {
+			packed = append(packed, ObjectInfo{Name: aws.StringValue(obj.Key), Size: aws.Int64Value(obj.Size)})
+			found = append(found, keys[i])
+			foundValues = append(foundValues, values[i])
+		}
+	}
+	if err == nil && len(found) > 0 {
+		err = s.writePack(ctx, found, foundValues)
+	}
+	s.packs.rewrite.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	if err := deleteObjects(ctx, s.store, packed); err != nil {
+		// The values are packed; the objects are only shadowed.
+		return len(packed), fmt.Errorf("s3ds: deleting packed objects: %s", err)
+	}
+	return len(packed), nil
+}
+
+// sparsePacks returns the packs whose live bytes are below minUtil of
+// their size.
+func (s *S3Bucket) sparsePacks(minUtil float64) []string {
+	p := s.packs
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	var sparse []string
+	for id, size := range p.sizes {
+		var live int64
+		for k := range p.members[id] {
+			live += p.locs[k].length
+		}
+		if size > 0 && float64(live)/float64(size) < minUtil {
+			sparse = append(sparse, id)
+		}
+	}
+	return sparse
+}
+
+// repack moves the live values of a pack into a new one and deletes it,
+// returning the bytes freed.
+func (s *S3Bucket) repack(ctx context.Context, id string) (int64, error) {
+	p := s.packs
+	// Hold off deletes until the values moved, as in packObjects.
+	p.rewrite.Lock()
+	defer p.rewrite.Unlock()
+
+	p.mu.RLock()
+	size := p.sizes[id]
+	var keys []ds.Key
+	var locs []packLoc
+	for k := range p.members[id] {
+		keys = append(keys, ds.NewKey(k))
+		locs = append(locs, p.locs[k])
+	}
+	p.mu.RUnlock()
+
+	var live int64
+	if len(keys) > 0 {
+		values := make([][]byte, len(keys))
+		err := forEach(ctx, len(keys), s.Workers, func(ctx context.Context, i int) error {
+			var err error
+			values[i], err = s.getPacked(ctx, locs[i])
+			return err
+		})
+		if err != nil {
+			return 0, err
+		}
+		for _, v := range values {
+			live += int64(len(v))
+		}
+		// Adding the new pack moves the keys out of the old one.
+		if err := s.writePack(ctx, keys, values); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := s.deletePack(ctx, id); err != nil {
+		return 0, err
+	}
+	return size - live, nil
+}
+
+// compactLoop runs Compact every interval until the datastore is closed.
+func (s *S3Bucket) compactLoop(interval time.Duration) {
+	defer s.RecoverAndDump()
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-s.done:
+			return
+		}
+		// Nodes without the writer lease leave compaction to its holder.
+		if _, err := s.Compact(context.Background()); err != nil && err != ErrLeaseHeld {
+			s.logs.get(LogCompact).Warnf("%s", err)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package s3
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"runtime"
+	"strconv"
+	"sync"
+)
+
+// CompressionGzip compresses values with gzip before upload.
+const CompressionGzip = "gzip"
+
+// Object metadata written alongside compressed values. The encoding is not
+// sent as Content-Encoding, which would make Go's HTTP client decompress
+// behind the SDK's back and break length checks.
+const (
+	metaEncoding = "s3ds-encoding"
+	metaSize     = "s3ds-size"
+)
+
+// compressor compresses values with pooled gzip writers. Compression is
+// CPU bound, so at most one value per CPU is compressed at a time however
+// many upload workers there are; the rest of the workers keep the network
+// busy meanwhile.
+type compressor struct {
+	level   int
+	writers sync.Pool
+	readers sync.Pool
+	cpu     chan struct{}
+}
+
+func newCompressor(algorithm string, level int) (*compressor, error) {
+	if algorithm != CompressionGzip {
+		return nil, fmt.Errorf("s3ds: unknown compression %q", algorithm)
+	}
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	if _, err := gzip.NewWriterLevel(nil, level); err != nil {
+		return nil, fmt.Errorf("s3ds: compression level: %s", err)
+	}
+	return &compressor{
+		level: level,
+		cpu:   make(chan struct{}, runtime.NumCPU()),
+	}, nil
+}
+
+// compress returns the compressed value and its metadata, or the value
+// itself and nil if compression does not make it smaller.
+func (c *compressor) compress(value []byte) ([]byte, map[string]string) {
+	c.cpu <- struct{}{}
+	defer func() { <-c.cpu }()
+
+	var buf bytes.Buffer
+	zw, ok := c.writers.Get().(*gzip.Writer)
+	if ok {
+		zw.Reset(&buf)
+	} else {
+		zw, _ = gzip.NewWriterLevel(&buf, c.level)
+	}
+	defer c.writers.Put(zw)
+
+	if _, err := zw.Write(value); err != nil {
+		return value, nil
+	}
+	if err := zw.Close(); err != nil || buf.Len() >= len(value) {
+		return value, nil
+	}
+	return buf.Bytes(), map[string]string{
+		metaEncoding: CompressionGzip,
+		metaSize:     strconv.Itoa(len(value)),
+	}
+}
+
+func (c *compressor) decompress(data []byte) ([]byte, error) {
+	zr, ok := c.readers.Get().(*gzip.Reader)
+	if ok {
+		if err := zr.Reset(bytes.NewReader(data)); err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		if zr, err = gzip.NewReader(bytes.NewReader(data)); err != nil {
+			return nil, err
+		}
+	}
+	defer c.readers.Put(zr)
+	return ioutil.ReadAll(zr)
+}
+
+// decodeValue undoes the encoding recorded in an object's metadata.
+func (s *S3Bucket) decodeValue(data []byte, meta map[string]string) ([]byte, error) {
+	data, err := s.decodeCodecs(data, meta)
+	if err != nil {
+		return nil, err
+	}
+	switch encoding := meta[metaEncoding]; encoding {
+	case "":
+		return data, nil
+	case CompressionGzip:
+		c := s.compressor
+		if c == nil {
+			// Written by a node with compression on; decoding needs no
+			// configuration.
+			c, _ = newCompressor(CompressionGzip, 0)
+		}
+		return c.decompress(data)
+	default:
+		return nil, fmt.Errorf("s3ds: unknown object encoding %q", encoding)
+	}
+}
@@ -0,0 +1,275 @@
+package s3
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	ds "github.com/ipfs/go-datastore"
+)
+
+const (
+	// maxCopySize is the largest object a single CopyObject request
+	// copies; larger ones are copied in parts.
+	maxCopySize = 5 << 30
+
+	// defaultCopyPartSize is the part size of multipart copies when
+	// PartSize is not set.
+	defaultCopyPartSize = 512 << 20
+)
+
+// objectCopier is implemented by ObjectStores that copy objects within
+// the bucket without downloading them. Metadata, if not nil, replaces that
+// of the source.
+type objectCopier interface {
+	CopyObject(ctx context.Context, src, dst string, size int64, opts PutOptions) error
+}
+
+// copyObject copies src to dst in store, server-side if it can, or else by
+// downloading and uploading it again.
+func copyObject(ctx context.Context, store ObjectStore, src, dst string, size int64, opts PutOptions) error {
+	if c, ok := store.(objectCopier); ok {
+		return c.CopyObject(ctx, src, dst, size, opts)
+	}
+	if opts.SourceBucket != "" {
+		return fmt.Errorf("s3ds: copying from bucket %s needs S3", opts.SourceBucket)
+	}
+	data, info, err := store.GetObject(ctx, src)
+	if err != nil {
+		return err
+	}
+	if opts.Metadata == nil {
+		opts.Metadata = info.Metadata
+	}
+	return store.PutObject(ctx, dst, data, opts)
+}
+
+func (st *s3Store) CopyObject(ctx context.Context, src, dst string, size int64, opts PutOptions) error {
+	if size > maxCopySize {
+		return st.copyMultipart(ctx, src, dst, size, opts)
+	}
+	input := &s3.CopyObjectInput{
+		Bucket:     aws.String(st.bucket),
+		Key:        aws.String(dst),
+		CopySource: aws.String(copySource(st.sourceBucket(opts), src, "")),
+	}
+	st.grants.applyCopy(input)
+	if opts.Metadata != nil {
+		input.Metadata = aws.StringMap(opts.Metadata)
+		input.MetadataDirective = aws.String(s3.MetadataDirectiveReplace)
+	}
+	if opts.Tags != "" {
+		input.Tagging = aws.String(opts.Tags)
+		input.TaggingDirective = aws.String(s3.TaggingDirectiveReplace)
+	}
+	if opts.StorageClass != "" {
+		input.StorageClass = aws.String(opts.StorageClass)
+	}
+	_, err := st.client.CopyObjectWithContext(ctx, input)
+	return parseError(err)
+}
+
+func (st *s3Store) sourceBucket(opts PutOptions) string {
+	if opts.SourceBucket != "" {
+		return opts.SourceBucket
+	}
+	return st.bucket
+}
+
+// copyMultipart copies objects too large for CopyObject a range at a time.
+func (st *s3Store) copyMultipart(ctx context.Context, src, dst string, size int64, opts PutOptions) error {
+	create := &s3.CreateMultipartUploadInput{
+		Bucket:   aws.String(st.bucket),
+		Key:      aws.String(dst),
+		Metadata: aws.StringMap(opts.Metadata),
+	}
+	if opts.Metadata == nil {
+		// Unlike CopyObject, a multipart copy does not carry the
+		// metadata over.
+		info, err := st.head(ctx, st.sourceBucket(opts), src)
+		if err != nil {
+			return err
+		}
+		create.Metadata = aws.StringMap(info.Metadata)
+	}
+	if st.grants.ACL != "" {
+		create.ACL = aws.String(st.grants.ACL)
+	}
+	if st.grants.Read != "" {
+		create.GrantRead = aws.String(st.grants.Read)
+	}
+	if st.grants.FullControl != "" {
+		create.GrantFullControl = aws.String(st.grants.FullControl)
+	}
+	if opts.Tags != "" {
+		create.Tagging = aws.String(opts.Tags)
+	}
+	if opts.StorageClass != "" {
+		create.StorageClass = aws.String(opts.StorageClass)
+	}
+	upload, err := st.client.CreateMultipartUploadWithContext(ctx, create)
+	if err != nil {
+		return parseError(err)
+	}
+
+	partSize := int64(st.partSize)
+	if partSize <= 0 {
+		partSize = defaultCopyPartSize
+	}
+	var parts []*s3.CompletedPart
+	for off, n := int64(0), int64(1); off < size; off, n = off+partSize, n+1 {
+		end := off + partSize
+		if end > size {
+			end = size
+		}
+		resp, err := st.client.UploadPartCopyWithContext(ctx, &s3.UploadPartCopyInput{
+			Bucket:          aws.String(st.bucket),
+			Key:             aws.String(dst),
+			UploadId:        upload.UploadId,
+			PartNumber:      aws.Int64(n),
+			CopySource:      aws.String(copySource(st.sourceBucket(opts), src, "")),
+			CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", off, end-1)),
+		})
+		if err != nil {
+			st.abortMultipart(dst, upload.UploadId)
+			return parseError(err)
+		}
+		parts = append(parts, &s3.CompletedPart{ETag: resp.CopyPartResult.ETag, PartNumber: aws.Int64(n)})
+	}
+
+	_, err = st.client.CompleteMultipartUploadWithContext(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(st.bucket),
+		Key:             aws.String(dst),
+		UploadId:        upload.UploadId,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		st.abortMultipart(dst, upload.UploadId)
+	}
+	return parseError(err)
+}
+
+func (st *gcsStore) CopyObject(ctx context.Context, src, dst string, size int64, opts PutOptions) error {
+	if opts.SourceBucket != "" {
+		return fmt.Errorf("s3ds: copying from bucket %s needs S3", opts.SourceBucket)
+	}
+	c := st.bucket.Object(dst).CopierFrom(st.bucket.Object(src))
+	c.Metadata = opts.Metadata
+	c.StorageClass = opts.StorageClass
+	_, err := c.Run(ctx)
+	return gcsError(err)
+}
+
+func (t *timeoutStore) CopyObject(ctx context.Context, src, dst string, size int64, opts PutOptions) error {
+	ctx, cancel := withTimeout(ctx, t.timeouts.Put)
+	defer cancel()
+	return copyObject(ctx, t.ObjectStore, src, dst, size, opts)
+}
+
+// Copy stores the value of src under dst as well. On S3 and GCS the object
+// is copied by the provider, without passing through this node; values
+// that are packed, live in another route or in the cold bucket of tiering,
+// or need replicating, are read and written again.
+func (s *S3Bucket) Copy(ctx context.Context, src, dst ds.Key) error {
+	if s.readOnly() {
+		return ErrReadOnly
+	}
+	if !s.audit("Copy", auditPut, dst, 0) {
+		return nil
+	}
+	r := s.route(src)
+	if r != s.route(dst) {
+		return s.copyValue(ctx, src, dst)
+	}
+	if r != s {
+		return r.Copy(ctx, src, dst)
+	}
+	if s.writeBehind != nil {
+		// The source may still be queued, and a queued upload of the
+		// destination must not land on top of the copy.
+		if err := s.writeBehind.wait(ctx, src); err != nil {
+			return err
+		}
+		if err := s.writeBehind.wait(ctx, dst); err != nil {
+			return err
+		}
+	}
+	if s.replica != nil || (s.tiering != nil && s.tiering.elsewhere(src)) {
+		return s.copyValue(ctx, src, dst)
+	}
+	if s.packs != nil {
+		if _, ok := s.packs.lookup(src); ok {
+			return s.copyValue(ctx, src, dst)
+		}
+	}
+
+	info, err := s.store.Head(ctx, s.s3Path(src))
+	if err != nil {
+		return err
+	}
+	// The multihash recorded with a block is that of its key.
+	meta := make(map[string]string, len(info.Metadata)+1)
+	for k, v := range info.Metadata {
+		if k != metaMultihash {
+			meta[k] = v
+		}
+	}
+	size := int(info.Size)
+	if n, err := strconv.Atoi(meta[metaSize]); err == nil {
+		size = n
+	}
+	opts := PutOptions{
+		Metadata:     withMultihash(meta, dst),
+		Tags:         s.objectTags(dst, size),
+		StorageClass: s.storageClass(dst),
+	}
+
+	s.forgetMissing(dst)
+	err = copyObject(ctx, s.store, s.s3Path(src), s.s3Path(dst), info.Size, opts)
+	if ErrorClass(err) == ErrArchived {
+		// Get restores archived values.
+		return s.copyValue(ctx, src, dst)
+	}
+	if err != nil {
+		return err
+	}
+	s.gets.Forget(dst.String())
+	s.forgetMissing(dst)
+	s.record(opPut, dst, size)
+	s.events.emit(EventPut, dst, size)
+	if s.packs != nil {
+		if _, ok := s.packs.lookup(dst); ok {
+			err = s.unpack(ctx, []ds.Key{dst})
+		}
+	}
+	if err == nil && s.tiering != nil && immutable(dst) {
+		s.tiering.touch(dst)
+	}
+	if err == nil && s.unverified != nil {
+		s.unverified.add(dst)
+	}
+	return err
+}
+
+// copyValue copies src to dst through this node.
+func (s *S3Bucket) copyValue(ctx context.Context, src, dst ds.Key) error {
+	value, err := s.Get(ctx, src)
+	if err != nil {
+		return err
+	}
+	return s.putFrom(ctx, "Copy", dst, value)
+}
+
+// Rename moves the value of src to dst: it copies it like Copy and then
+// deletes src. A failure in between leaves both keys.
+func (s *S3Bucket) Rename(ctx context.Context, src, dst ds.Key) error {
+	if src.Equal(dst) {
+		return nil
+	}
+	if err := s.Copy(ctx, src, dst); err != nil {
+		return err
+	}
+	return s.Delete(ctx, src)
+}
@@ -0,0 +1,166 @@
+package s3
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// PriceTable is what a provider charges, in any currency, for requests and
+// transfer. Storage itself is billed on the size of the bucket, which the
+// datastore does not track, and is not part of the estimate.
+type PriceTable struct {
+	// Per 1000 requests of each kind. Lists include version listings;
+	// gets include HEAD requests.
+	PutPer1000    float64
+	GetPer1000    float64
+	ListPer1000   float64
+	DeletePer1000 float64
+
+	// Per GB (10^9 bytes) uploaded and downloaded.
+	IngressPerGB float64
+	EgressPerGB  float64
+}
+
+// Request kinds counted for cost accounting.
+const (
+	costPut = iota
+	costGet
+	costList
+	costDelete
+	numCostKinds
+)
+
+// costCounter counts the requests sent to the bucket and the bytes
+// transferred.
+type costCounter struct {
+	since    time.Time
+	requests [numCostKinds]int64
+	bytesIn  int64
+	bytesOut int64
+}
+
+func newCostCounter() *costCounter {
+	return &costCounter{since: time.Now()}
+}
+
+func costKind(r *http.Request) int {
+	q := r.URL.Query()
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		if q.Get("list-type") != "" || q.Has("versions") || q.Has("uploads") {
+			return costList
+		}
+		return costGet
+	case http.MethodDelete:
+		// Aborting a multipart upload is free like a delete.
+		return costDelete
+	case http.MethodPost:
+		if q.Has("delete") {
+			return costDelete
+		}
+	}
+	return costPut
+}
+
+// costTransport counts every request that reaches the network, retries
+// included, since those are billed too.
+type costTransport struct {
+	next  http.RoundTripper
+	costs *costCounter
+}
+
+func (t *costTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	atomic.AddInt64(&t.costs.requests[costKind(r)], 1)
+	if r.ContentLength > 0 {
+		atomic.AddInt64(&t.costs.bytesIn, r.ContentLength)
+	}
+	resp, err := t.next.RoundTrip(r)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = &countingBody{ReadCloser: resp.Body, n: &t.costs.bytesOut}
+	return resp, nil
+}
+
+type countingBody struct {
+	io.ReadCloser
+	n *int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	atomic.AddInt64(b.n, int64(n))
+	return n, err
+}
+
+// CostReport is the traffic since startup and what it would cost over a
+// month at the same rate.
+type CostReport struct {
+	Since    time.Time
+	Puts     int64
+	Gets     int64
+	Lists    int64
+	Deletes  int64
+	BytesIn  int64
+	BytesOut int64
+
+	// Cost is the price of the traffic so far; MonthlyCost extrapolates
+	// it to 30 days.
+	Cost        float64
+	MonthlyCost float64
+}
+
+// Costs reports the requests sent to the bucket since startup and
+// estimates their cost with Prices. Only providers reached through the S3
+// API are counted.
+func (s *S3Bucket) Costs() CostReport {
+	c := s.costs
+	r := CostReport{
+		Since:    c.since,
+		Puts:     atomic.LoadInt64(&c.requests[costPut]),
+		Gets:     atomic.LoadInt64(&c.requests[costGet]),
+		Lists:    atomic.LoadInt64(&c.requests[costList]),
+		Deletes:  atomic.LoadInt64(&c.requests[costDelete]),
+		BytesIn:  atomic.LoadInt64(&c.bytesIn),
+		BytesOut: atomic.LoadInt64(&c.bytesOut),
+	}
+	p := s.prices()
+	r.Cost = (float64(r.Puts)*p.PutPer1000+float64(r.Gets)*p.GetPer1000+
+		float64(r.Lists)*p.ListPer1000+float64(r.Deletes)*p.DeletePer1000)/1000 +
+		(float64(r.BytesIn)*p.IngressPerGB+float64(r.BytesOut)*p.EgressPerGB)/1e9
+	if elapsed := time.Since(c.since); elapsed > 0 {
+		r.MonthlyCost = r.Cost * float64(30*24*time.Hour) / float64(elapsed)
+	}
+	return r
+}
+
+// prices returns Prices, or the list prices of Provider.
+func (s *S3Bucket) prices() PriceTable {
+	if s.Prices != nil {
+		return *s.Prices
+	}
+	return providerProfiles[s.Provider].prices
+}
+
+// WriteCostPrometheus writes a cost report in the Prometheus text
+// exposition format.
+func WriteCostPrometheus(w io.Writer, r CostReport) error {
+	fmt.Fprintln(w, "# TYPE s3ds_requests_total counter")
+	for _, c := range []struct {
+		kind string
+		n    int64
+	}{{"put", r.Puts}, {"get", r.Gets}, {"list", r.Lists}, {"delete", r.Deletes}} {
+		fmt.Fprintf(w, "s3ds_requests_total{kind=%q} %d\n", c.kind, c.n)
+	}
+	fmt.Fprintln(w, "# TYPE s3ds_transfer_bytes_total counter")
+	fmt.Fprintf(w, "s3ds_transfer_bytes_total{direction=\"in\"} %d\n", r.BytesIn)
+	fmt.Fprintf(w, "s3ds_transfer_bytes_total{direction=\"out\"} %d\n", r.BytesOut)
+	fmt.Fprintln(w, "# TYPE s3ds_cost_total counter")
+	fmt.Fprintf(w, "s3ds_cost_total %g\n", r.Cost)
+	fmt.Fprintln(w, "# TYPE s3ds_cost_monthly_estimate gauge")
+	_, err := fmt.Fprintf(w, "s3ds_cost_monthly_estimate %g\n", r.MonthlyCost)
+	return err
+}
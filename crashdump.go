@@ -0,0 +1,195 @@
+package s3
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	ds "github.com/ipfs/go-datastore"
+)
+
+const journalSize = 1000
+
+// journalEntry is an operation remembered for post-mortems.
+type journalEntry struct {
+	Time time.Time `json:"time"`
+	Op   string    `json:"op"`
+	Key  string    `json:"key"`
+	Size int       `json:"size"`
+}
+
+// journal keeps the most recent operations in a ring buffer.
+type journal struct {
+	mu      sync.Mutex
+	entries []journalEntry
+	next    int
+}
+
+func newJournal() *journal {
+	return &journal{entries: make([]journalEntry, 0, journalSize)}
+}
+
+func (j *journal) add(op string, k ds.Key, size int) {
+	e := journalEntry{Time: time.Now(), Op: op, Key: k.String(), Size: size}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if len(j.entries) < journalSize {
+		j.entries = append(j.entries, e)
+		return
+	}
+	j.entries[j.next] = e
+	j.next = (j.next + 1) % journalSize
+}
+
+// recent returns the journal oldest first.
+func (j *journal) recent() []journalEntry {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	out := make([]journalEntry, 0, len(j.entries))
+	out = append(out, j.entries[j.next:]...)
+	return append(out, j.entries[:j.next]...)
+}
+
+// stateSnapshot is the datastore state written by DumpState.
+type stateSnapshot struct {
+	Time         time.Time              `json:"time"`
+	Reason       string                 `json:"reason"`
+	Bucket       string                 `json:"bucket"`
+	Endpoint     string                 `json:"endpoint"`
+	Concurrency  int                    `json:"concurrency"`
+	PendingPuts  int                    `json:"pendingPuts"`
+	FailedPuts   int                    `json:"failedPuts"`
+	FeatureFlags map[string]float64     `json:"featureFlags,omitempty"`
+	Breaker      *breakerSnapshot       `json:"breaker,omitempty"`
+	Heatmap      map[string]PrefixStats `json:"heatmap,omitempty"`
+	Journal      []journalEntry         `json:"journal"`
+
+	// NegativeCache is the number of keys known missing, CoalescedGets
+	// the number of downloads shared by concurrent Gets under way.
+	NegativeCache int `json:"negativeCache"`
+	CoalescedGets int `json:"coalescedGets"`
+}
+
+func (s *S3Bucket) snapshotState(reason string) stateSnapshot {
+	snap := stateSnapshot{
+		Time:        time.Now(),
+		Reason:      reason,
+		Bucket:      s.Bucket,
+		Endpoint:    s.Endpoint,
+		Concurrency: s.Concurrency(),
+		Heatmap:     s.Heatmap(),
+
+		CoalescedGets: int(atomic.LoadInt64(&s.coalescedGets)),
+	}
+	if s.breaker != nil {
+		b := s.breaker.snapshot()
+		snap.Breaker = &b
+	}
+	if s.negative != nil {
+		snap.NegativeCache = s.negative.size()
+	}
+	if s.journal != nil {
+		snap.Journal = s.journal.recent()
+	}
+	if s.writeBehind != nil {
+		s.writeBehind.mu.Lock()
+		snap.PendingPuts = len(s.writeBehind.pending)
+		snap.FailedPuts = len(s.writeBehind.failed)
+		s.writeBehind.mu.Unlock()
+	}
+	s.flags.mu.RLock()
+	snap.FeatureFlags = s.flags.rollout
+	s.flags.mu.RUnlock()
+	return snap
+}
+
+// DumpState writes a snapshot of the datastore's in-memory state to
+// CrashDumpFile and, with CrashDumpToBucket, to the bucket.
+func (s *S3Bucket) DumpState(reason string) error {
+	data, err := json.MarshalIndent(s.snapshotState(reason), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	if s.CrashDumpFile != "" {
+		if err := writeFileAtomic(s.CrashDumpFile, data); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if s.CrashDumpToBucket {
+		host, _ := os.Hostname()
+		name := fmt.Sprintf("%s-%s.json", host, time.Now().UTC().Format("20060102T150405Z"))
+		_, err := s.S3.PutObject(&s3.PutObjectInput{
+			Bucket:      aws.String(s.Bucket),
+			Key:         aws.String(s.metaPath(path.Join("crash", name))),
+			Body:        bytes.NewReader(data),
+			ContentType: aws.String("application/json"),
+		})
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("s3ds: writing state dump: %v", errs)
+	}
+	return nil
+}
+
+// RecoverAndDump dumps the datastore state when the calling goroutine
+// panics, then resumes panicking. Use it as
+//
+//	defer d.RecoverAndDump()
+//
+// at the top of main and of long-running goroutines using the datastore.
+func (s *S3Bucket) RecoverAndDump() {
+	if r := recover(); r != nil {
+		s.DumpState(fmt.Sprintf("panic: %v", r))
+		panic(r)
+	}
+}
+
+// persistState keeps CrashDumpFile fresh so that state survives crashes
+// that run no code, such as being killed for running out of memory.
+func (s *S3Bucket) persistState(interval time.Duration) {
+	defer s.RecoverAndDump()
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-s.done:
+			return
+		}
+		data, err := json.MarshalIndent(s.snapshotState("periodic"), "", "  ")
+		if err == nil {
+			writeFileAtomic(s.CrashDumpFile, data)
+		}
+	}
+}
+
+func writeFileAtomic(file string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(file), "."+filepath.Base(file))
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
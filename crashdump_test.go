@@ -0,0 +1,45 @@
+package s3_test
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	s3ds "github.com/ipfs-s3c-storj-plugin"
+)
+
+// TestDumpStateCaches checks that a state dump has the breaker and cache
+// state.
+func TestDumpStateCaches(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "dump.json")
+	d := newFakeDatastore(t, s3ds.Config{
+		CrashDumpFile:    file,
+		Breaker:          &s3ds.BreakerConfig{ErrorRate: 0.5},
+		NegativeCacheTTL: time.Minute,
+	})
+	if err := d.DumpState("test"); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dump struct {
+		Breaker *struct {
+			State string `json:"state"`
+		} `json:"breaker"`
+		NegativeCache *int `json:"negativeCache"`
+		CoalescedGets *int `json:"coalescedGets"`
+	}
+	if err := json.Unmarshal(data, &dump); err != nil {
+		t.Fatal(err)
+	}
+	if dump.Breaker == nil || dump.Breaker.State != "closed" {
+		t.Errorf("breaker %+v, want closed", dump.Breaker)
+	}
+	if dump.NegativeCache == nil || dump.CoalescedGets == nil {
+		t.Errorf("cache sizes missing from %s", data)
+	}
+}
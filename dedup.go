@@ -0,0 +1,94 @@
+package s3
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// defaultWriteDedupSize bounds the write deduplication window when
+// WriteDedupSize is not set.
+const defaultWriteDedupSize = 100000
+
+// recentWrites remembers the objects of blocks written in the last
+// window, so that a second Put of the same block, which has the same
+// value, is dropped. Entries are by object name, so that dedupStore can
+// forget deleted objects whatever deleted them.
+type recentWrites struct {
+	window time.Duration
+	max    int
+
+	mu      sync.Mutex
+	entries map[string]time.Time
+}
+
+func newRecentWrites(window time.Duration, max int) *recentWrites {
+	if max <= 0 {
+		max = defaultWriteDedupSize
+	}
+	return &recentWrites{window: window, max: max, entries: make(map[string]time.Time)}
+}
+
+func (w *recentWrites) seen(name string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	expires, ok := w.entries[name]
+	if ok && time.Now().After(expires) {
+		delete(w.entries, name)
+		return false
+	}
+	return ok
+}
+
+func (w *recentWrites) add(name string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	now := time.Now()
+	if len(w.entries) >= w.max {
+		for name, expires := range w.entries {
+			if now.After(expires) {
+				delete(w.entries, name)
+			}
+		}
+		if len(w.entries) >= w.max {
+			return
+		}
+	}
+	w.entries[name] = now.Add(w.window)
+}
+
+func (w *recentWrites) forget(names ...string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, name := range names {
+		delete(w.entries, name)
+	}
+}
+
+// dedupStore drops deleted and overwritten objects from the recent
+// writes, so that a block deleted and put again is uploaded again.
+type dedupStore struct {
+	ObjectStore
+	recent *recentWrites
+}
+
+func (t *dedupStore) DeleteMany(ctx context.Context, names []string) error {
+	// Forgotten again afterwards, as a put of one of the names may
+	// complete while the delete is in flight.
+	t.recent.forget(names...)
+	err := t.ObjectStore.DeleteMany(ctx, names)
+	t.recent.forget(names...)
+	return err
+}
+
+func (t *dedupStore) CopyObject(ctx context.Context, src, dst string, size int64, opts PutOptions) error {
+	// dst gets another value, so a put of its old one is not a duplicate.
+	t.recent.forget(dst)
+	err := copyObject(ctx, t.ObjectStore, src, dst, size, opts)
+	t.recent.forget(dst)
+	return err
+}
+
+func (t *dedupStore) GetObjectRange(ctx context.Context, name string, offset, length int64) ([]byte, ObjectInfo, error) {
+	return getObjectRange(ctx, t.ObjectStore, name, offset, length)
+}
@@ -0,0 +1,45 @@
+package s3_test
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+
+	s3ds "github.com/ipfs-s3c-storj-plugin"
+)
+
+// TestCopyWriteDedup checks that write deduplication leaves copies
+// server-side.
+func TestCopyWriteDedup(t *testing.T) {
+	ctx := context.Background()
+	var gets int64
+	d := newFakeDatastore(t, s3ds.Config{
+		WriteDedupWindow: time.Minute,
+		Interceptors: []s3ds.Interceptor{{
+			Before: func(_ context.Context, call *s3ds.Call) error {
+				if call.Op == s3ds.OpGetObject {
+					atomic.AddInt64(&gets, 1)
+				}
+				return nil
+			},
+		}},
+	})
+	if err := d.Put(ctx, ds.NewKey("/a"), []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	// Opening the datastore reads its manifest.
+	atomic.StoreInt64(&gets, 0)
+	if err := d.Copy(ctx, ds.NewKey("/a"), ds.NewKey("/b")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Rename(ctx, ds.NewKey("/b"), ds.NewKey("/c")); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt64(&gets); n != 0 {
+		t.Fatalf("%d GETs, want none", n)
+	}
+	checkValue(t, d, ds.NewKey("/c"), []byte("a"))
+}
@@ -0,0 +1,170 @@
+package s3
+
+import (
+	"context"
+	"path"
+	"sync"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// DeletePrefix deletes every key under prefix and returns how many it
+// deleted. Pages of the listing are deleted with up to Workers
+// DeleteObjects calls in flight while the listing goes on, so the caller
+// never has to enumerate the keys. progress, if set, is called with the
+// running total after every page; calls do not overlap.
+//
+// Keys written under prefix while it runs may or may not be deleted.
+func (s *S3Bucket) DeletePrefix(ctx context.Context, prefix string, progress func(deleted int)) (int, error) {
+	if s.readOnly() {
+		return 0, ErrReadOnly
+	}
+	if err := s.auditMaintenance("DeletePrefix", auditDelete, prefix); err != nil {
+		return 0, err
+	}
+	p := ds.NewKey(prefix)
+	if r := s.route(p); r != s {
+		return r.DeletePrefix(ctx, prefix, progress)
+	}
+	if s.writeBehind != nil {
+		// Queued uploads under prefix must not land after their keys
+		// were deleted.
+		if err := s.writeBehind.wait(ctx, p); err != nil {
+			return 0, err
+		}
+	}
+	ctx, end := s.beginWrite(ctx)
+	defer end()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		mu      sync.Mutex
+		deleted int
+	)
+	done := func(n int) {
+		mu.Lock()
+		defer mu.Unlock()
+		deleted += n
+		if progress != nil {
+			progress(deleted)
+		}
+	}
+
+	for _, r := range s.routes {
+		if hasKeyPrefix(ds.NewKey(r.prefix), p.String()) {
+			n, err := r.ds.DeletePrefix(ctx, r.prefix, nil)
+			done(n)
+			if err != nil {
+				return deleted, err
+			}
+		}
+	}
+	if s.packs != nil {
+		var packed []ds.Key
+		for _, k := range s.packs.keys(p.String()) {
+			packed = append(packed, ds.NewKey(k))
+		}
+		if err := s.unpack(ctx, packed); err != nil {
+			return 0, err
+		}
+		done(len(packed))
+	}
+
+	listPrefix, filter := s.keys.listPrefix(p.String())
+	objPrefix := path.Join(s.RootDirectory, listPrefix)
+	pages := make(chan []ObjectInfo)
+	var listErr error
+	go func() {
+		defer close(pages)
+		token := ""
+		for {
+			objs, next, err := s.store.List(ctx, objPrefix, token, 0)
+			if err != nil {
+				listErr = err
+				return
+			}
+			var page []ObjectInfo
+			for _, obj := range objs {
+				if s.isMetaPath(obj.Name) {
+					continue
+				}
+				if !filter || hasKeyPrefix(s.fromS3Path(obj.Name), p.String()) {
+					page = append(page, obj)
+				}
+			}
+			if len(page) > 0 {
+				select {
+				case pages <- page:
+				case <-ctx.Done():
+					listErr = ctx.Err()
+					return
+				}
+			}
+			if next == "" {
+				return
+			}
+			token = next
+		}
+	}()
+
+	var (
+		wg      sync.WaitGroup
+		errOnce sync.Once
+		delErr  error
+	)
+	for w := 0; w < s.Workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for objs := range pages {
+				if err := s.deletePage(ctx, objs); err != nil {
+					errOnce.Do(func() {
+						delErr = err
+						cancel()
+					})
+					continue
+				}
+				done(len(objs))
+			}
+		}()
+	}
+	wg.Wait()
+
+	if delErr != nil {
+		return deleted, delErr
+	}
+	return deleted, listErr
+}
+
+// deletePage deletes a page of listed objects and updates the
+// subsystems that keep track of their keys.
+func (s *S3Bucket) deletePage(ctx context.Context, objs []ObjectInfo) error {
+	keys := make([]ds.Key, len(objs))
+	for i, obj := range objs {
+		keys[i] = s.fromS3Path(obj.Name)
+	}
+	if err := s.writeTombstones(ctx, "DeletePrefix", keys); err != nil {
+		return err
+	}
+	if err := deleteObjects(ctx, s.store, objs); err != nil {
+		return err
+	}
+	for _, k := range keys {
+		s.gets.Forget(k.String())
+		s.record(opDelete, k, 0)
+		s.events.emit(EventDelete, k, 0)
+		s.forgetUnverified(k)
+		if s.tiering != nil {
+			if err := s.tiering.deleted(ctx, k); err != nil {
+				return err
+			}
+		}
+		if s.replica != nil {
+			if err := s.replica.write(ctx, replOpDelete, k, nil); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
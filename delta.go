@@ -0,0 +1,140 @@
+package s3
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// listSkew is subtracted from the start of the previous pass when
+// ListSince compares modification times, which the gateway sets by its own
+// clock. Keys written around the start of a pass are listed twice rather
+// than missed.
+const listSkew = 5 * time.Minute
+
+// listCheckpoint is where the ListSince passes of one checkpoint stand.
+type listCheckpoint struct {
+	Prefix string `json:"prefix"`
+
+	// Since is the start of the last complete pass; keys modified before
+	// it were listed then.
+	Since time.Time `json:"since,omitempty"`
+
+	// Started is the start of the pass in progress, and Token the
+	// continuation of its listing.
+	Started time.Time `json:"started,omitempty"`
+	Token   string    `json:"token,omitempty"`
+}
+
+func checkCheckpointName(name string) error {
+	if name == "" || strings.ContainsAny(name, "/\\") || name == "." || name == ".." {
+		return fmt.Errorf("s3ds: invalid checkpoint name %q", name)
+	}
+	return nil
+}
+
+func (s *S3Bucket) checkpointPath(name string) string {
+	return s.metaPath(path.Join("checkpoints", name+".json"))
+}
+
+func (s *S3Bucket) readListCheckpoint(ctx context.Context, name string) (listCheckpoint, error) {
+	var cp listCheckpoint
+	data, _, err := s.store.GetObject(ctx, s.checkpointPath(name))
+	if err == ds.ErrNotFound {
+		return cp, nil
+	}
+	if err != nil {
+		return cp, err
+	}
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return cp, fmt.Errorf("s3ds: invalid checkpoint %s: %s", name, err)
+	}
+	return cp, nil
+}
+
+func (s *S3Bucket) writeListCheckpoint(ctx context.Context, name string, cp listCheckpoint) error {
+	if s.DryRun {
+		return nil
+	}
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	return s.store.PutObject(ctx, s.checkpointPath(name), data, PutOptions{})
+}
+
+// ListSince calls fn with the keys under prefix written since the last
+// complete pass of the checkpoint called name, a page at a time, and
+// returns how many keys it passed. The first pass lists every key.
+//
+// The position in the listing is saved in the bucket after every page fn
+// accepts, so a pass that fails or is interrupted resumes where it
+// stopped; fn sees every new key at least once, and keys written around
+// the start of a pass twice. Overwritten keys count as written. Packed
+// values are not objects of their own and are not listed.
+func (s *S3Bucket) ListSince(ctx context.Context, name, prefix string, fn func([]ds.Key) error) (int, error) {
+	if err := checkCheckpointName(name); err != nil {
+		return 0, err
+	}
+	if s.Packing {
+		return 0, fmt.Errorf("s3ds: ListSince cannot list packed values")
+	}
+	prefix = ds.NewKey(prefix).String()
+	cp, err := s.readListCheckpoint(ctx, name)
+	if err != nil {
+		return 0, err
+	}
+	if cp.Prefix != "" && cp.Prefix != prefix {
+		return 0, fmt.Errorf("s3ds: checkpoint %s is for prefix %s", name, cp.Prefix)
+	}
+	cp.Prefix = prefix
+	if cp.Token == "" {
+		cp.Started = time.Now()
+	}
+	var cutoff time.Time
+	if !cp.Since.IsZero() {
+		cutoff = cp.Since.Add(-listSkew)
+	}
+
+	listPrefix, _ := s.keys.listPrefix(prefix)
+	objPrefix := path.Join(s.RootDirectory, listPrefix)
+	n := 0
+	for {
+		objs, next, err := s.store.List(ctx, objPrefix, cp.Token, 0)
+		if err != nil {
+			return n, err
+		}
+		var keys []ds.Key
+		for _, obj := range objs {
+			if s.isMetaPath(obj.Name) || !obj.LastModified.After(cutoff) {
+				continue
+			}
+			if k := s.fromS3Path(obj.Name); hasKeyPrefix(k, prefix) {
+				keys = append(keys, k)
+			}
+		}
+		if len(keys) > 0 {
+			if err := fn(keys); err != nil {
+				return n, err
+			}
+			n += len(keys)
+		}
+
+		cp.Token = next
+		if next == "" {
+			cp.Since = cp.Started
+			cp.Started = time.Time{}
+		}
+		if err := s.writeListCheckpoint(ctx, name, cp); err != nil {
+			return n, fmt.Errorf("s3ds: saving checkpoint %s: %s", name, err)
+		}
+		if next == "" {
+			return n, nil
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package s3
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// ListingDigest summarizes a listing of the datastore's objects, so that
+// two listings can be compared by comparing their digests. Every shard of
+// the key space, as cut by DigestShard, has a digest of the keys in it
+// with the size and ETag of their objects; Root is a digest of those.
+//
+// A shard digest is the XOR of the hashes of its objects, so it does not
+// depend on the order they were listed in. Buckets only produce equal
+// digests for the same objects if their gateways compute ETags alike.
+type ListingDigest struct {
+	Created time.Time         `json:"created"`
+	Root    string            `json:"root"`
+	Shards  map[string]string `json:"shards"`
+}
+
+// DiffDigests returns the shards whose keys differ between a and b,
+// sorted.
+func DiffDigests(a, b ListingDigest) []string {
+	var shards []string
+	for shard, d := range a.Shards {
+		if b.Shards[shard] != d {
+			shards = append(shards, shard)
+		}
+	}
+	for shard := range b.Shards {
+		if _, ok := a.Shards[shard]; !ok {
+			shards = append(shards, shard)
+		}
+	}
+	sort.Strings(shards)
+	return shards
+}
+
+func (s *S3Bucket) digestPath() string {
+	return s.metaPath("digest.json")
+}
+
+// UpdateDigest lists every object of the datastore, computes its
+// ListingDigest and, unless the datastore is read-only, stores it in the
+// bucket for ReadDigest. It costs a full listing; comparing stored
+// digests afterwards costs a GET.
+//
+// Packed values are not objects of their own and are left out.
+func (s *S3Bucket) UpdateDigest(ctx context.Context) (ListingDigest, error) {
+	shard, err := parseShardFunc(s.digestShard())
+	if err != nil {
+		return ListingDigest{}, err
+	}
+	d := ListingDigest{Created: time.Now(), Shards: make(map[string]string)}
+	sums := make(map[string][sha256.Size]byte)
+
+	listPrefix, _ := s.keys.listPrefix("/")
+	prefix := path.Join(s.RootDirectory, listPrefix)
+	token := ""
+	for {
+		objs, next, err := s.store.List(ctx, prefix, token, 0)
+		if err != nil {
+			return d, err
+		}
+		for _, obj := range objs {
+			if s.isMetaPath(obj.Name) {
+				continue
+			}
+			k := s.fromS3Path(obj.Name)
+			h := sha256.Sum256([]byte(k.String() + "\x00" + strconv.FormatInt(obj.Size, 10) + "\x00" + obj.ETag))
+			name := shardOf(shard, k)
+			sum := sums[name]
+			for i := range sum {
+				sum[i] ^= h[i]
+			}
+			sums[name] = sum
+		}
+		if next == "" {
+			break
+		}
+		token = next
+	}
+
+	names := make([]string, 0, len(sums))
+	for name, sum := range sums {
+		d.Shards[name] = hex.EncodeToString(sum[:])
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	root := sha256.New()
+	for _, name := range names {
+		fmt.Fprintf(root, "%s %s\n", name, d.Shards[name])
+	}
+	d.Root = hex.EncodeToString(root.Sum(nil))
+
+	if s.DryRun || s.readOnly() {
+		return d, nil
+	}
+	data, err := json.Marshal(d)
+	if err != nil {
+		return d, err
+	}
+	if err := s.store.PutObject(ctx, s.digestPath(), data, PutOptions{}); err != nil {
+		return d, fmt.Errorf("s3ds: saving digest: %s", err)
+	}
+	return d, nil
+}
+
+// ReadDigest returns the digest UpdateDigest last stored in the bucket,
+// or ds.ErrNotFound.
+func (s *S3Bucket) ReadDigest(ctx context.Context) (ListingDigest, error) {
+	var d ListingDigest
+	data, _, err := s.store.GetObject(ctx, s.digestPath())
+	if err != nil {
+		return d, err
+	}
+	if err := json.Unmarshal(data, &d); err != nil {
+		return d, fmt.Errorf("s3ds: invalid digest: %s", err)
+	}
+	return d, nil
+}
+
+// ReplicaDivergence compares the stored digests of the primary and the
+// replica and returns the shards that differ. Both digests are read from
+// the buckets, so it lists nothing; they are only as recent as the last
+// UpdateDigest of either.
+func (s *S3Bucket) ReplicaDivergence(ctx context.Context) ([]string, error) {
+	if s.replica == nil {
+		return nil, fmt.Errorf("s3ds: ReplicaDivergence needs a replica")
+	}
+	a, err := s.ReadDigest(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("s3ds: reading digest: %s", err)
+	}
+	b, err := s.replica.replica.ReadDigest(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("s3ds: reading digest of the replica: %s", err)
+	}
+	return DiffDigests(a, b), nil
+}
+
+func (s *S3Bucket) digestShard() string {
+	if s.DigestShard == "" {
+		return defaultHeatmapShard
+	}
+	return s.DigestShard
+}
+
+// digestLoop updates the digests of the datastore, and of its replica,
+// until it is closed.
+func (s *S3Bucket) digestLoop(interval time.Duration) {
+	defer s.RecoverAndDump()
+
+	log := s.logs.get(LogS3)
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-s.done:
+			return
+		}
+		if err := s.requireLease(); err != nil {
+			continue
+		}
+		if _, err := s.UpdateDigest(s.ctx); err != nil && s.ctx.Err() == nil {
+			log.Warnf("digest: %s", err)
+		}
+		if s.replica == nil {
+			continue
+		}
+		if _, err := s.replica.replica.UpdateDigest(s.ctx); err != nil && s.ctx.Err() == nil {
+			log.Warnf("digest of the replica: %s", err)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package s3
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// resolveTimeout bounds each lookup of dnsWatcher.
+const resolveTimeout = 10 * time.Second
+
+// dnsWatcher re-resolves the host names of the gateway and closes the idle
+// connections of the transport when an address they may have been dialled
+// to goes away. New requests then dial again, to the current addresses,
+// instead of staying pinned to a frontend that was rotated out until its
+// connections fail.
+type dnsWatcher struct {
+	hosts     []string
+	transport interface{ CloseIdleConnections() }
+	lookup    func(ctx context.Context, host string) ([]string, error)
+	log       *subLogger
+
+	// addrs are the addresses last resolved for each host.
+	addrs map[string][]string
+}
+
+// newDNSWatcher watches the host names the requests go to. IP addresses
+// are left out; it returns nil if no names are left.
+func newDNSWatcher(hosts []string, transport interface{ CloseIdleConnections() }, log *subLogger) *dnsWatcher {
+	w := &dnsWatcher{
+		transport: transport,
+		lookup:    net.DefaultResolver.LookupHost,
+		log:       log,
+		addrs:     make(map[string][]string),
+	}
+	seen := make(map[string]bool)
+	for _, host := range hosts {
+		if host == "" || net.ParseIP(host) != nil || seen[host] {
+			continue
+		}
+		seen[host] = true
+		w.hosts = append(w.hosts, host)
+	}
+	if len(w.hosts) == 0 {
+		return nil
+	}
+	return w
+}
+
+// endpointHost returns the host name of an endpoint URL, which may lack
+// its scheme.
+func endpointHost(endpoint string) string {
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "https://" + endpoint
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
+
+// check resolves the hosts again and closes idle connections if any
+// address resolved before is gone. Hosts that fail to resolve keep their
+// previous addresses.
+func (w *dnsWatcher) check(ctx context.Context) {
+	stale := false
+	for _, host := range w.hosts {
+		lookupCtx, cancel := context.WithTimeout(ctx, resolveTimeout)
+		addrs, err := w.lookup(lookupCtx, host)
+		cancel()
+		if err != nil {
+			w.log.Debugf("resolving %s: %s", host, err)
+			continue
+		}
+		sort.Strings(addrs)
+		old, ok := w.addrs[host]
+		w.addrs[host] = addrs
+		if !ok {
+			continue
+		}
+		for _, addr := range old {
+			if i := sort.SearchStrings(addrs, addr); i == len(addrs) || addrs[i] != addr {
+				w.log.Infof("%s no longer resolves to %s; reconnecting", host, addr)
+				stale = true
+				break
+			}
+		}
+	}
+	if stale {
+		w.transport.CloseIdleConnections()
+	}
+}
+
+// resolveLoop runs the dnsWatcher every interval until Close.
+func (s *S3Bucket) resolveLoop(interval time.Duration) {
+	defer s.RecoverAndDump()
+
+	s.dns.check(s.ctx)
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			s.dns.check(s.ctx)
+		case <-s.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package s3
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// Read policies for Config.EndpointPolicy.
+const (
+	// EndpointPolicyOrder reads from the first healthy endpoint.
+	EndpointPolicyOrder = "order"
+
+	// EndpointPolicyWeighted spreads reads over the healthy endpoints in
+	// proportion to their Weight.
+	EndpointPolicyWeighted = "weighted"
+
+	// EndpointPolicyLatency reads from the healthy endpoint that has been
+	// answering fastest.
+	EndpointPolicyLatency = "latency"
+)
+
+// endpointCooldown is how long a failed endpoint is skipped for.
+const endpointCooldown = 30 * time.Second
+
+// EndpointConfig is one of several gateways serving the same bucket.
+type EndpointConfig struct {
+	URL string
+
+	// Weight is the endpoint's share of reads under EndpointPolicyWeighted.
+	// Defaults to 1.
+	Weight int
+}
+
+type endpoint struct {
+	url    *url.URL
+	weight int
+
+	// Guarded by endpointSet.mu.
+	downUntil time.Time
+	latency   time.Duration
+}
+
+// endpointSet points each request attempt at one of the configured
+// endpoints. It runs before signing, so a retry after a failed attempt is
+// signed for, and sent to, the next healthy endpoint.
+type endpointSet struct {
+	policy string
+
+	// bucket is kept in the host name of requests that name it there, as
+	// virtual-hosted addressing does.
+	bucket string
+
+	mu        sync.Mutex
+	endpoints []*endpoint
+	byHost    map[string]*endpoint
+}
+
+func newEndpointSet(conf []EndpointConfig, policy, bucket string, disableSSL bool) (*endpointSet, error) {
+	switch policy {
+	case "":
+		policy = EndpointPolicyOrder
+	case EndpointPolicyOrder, EndpointPolicyWeighted, EndpointPolicyLatency:
+	default:
+		return nil, fmt.Errorf("s3ds: unknown endpoint policy %q", policy)
+	}
+
+	es := &endpointSet{policy: policy, bucket: bucket, byHost: make(map[string]*endpoint)}
+	for _, c := range conf {
+		u, err := url.Parse(c.URL)
+		if err != nil || u.Host == "" {
+			// Like the SDK, accept a bare host name.
+			if u, err = url.Parse("https://" + c.URL); err != nil {
+				return nil, fmt.Errorf("s3ds: invalid endpoint %q: %s", c.URL, err)
+			}
+			if disableSSL {
+				u.Scheme = "http"
+			}
+		}
+		weight := c.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		e := &endpoint{url: u, weight: weight}
+		es.endpoints = append(es.endpoints, e)
+		es.byHost[u.Host] = e
+	}
+	return es, nil
+}
+
+// pick chooses the endpoint for a request of class cl.
+func (es *endpointSet) pick(cl int) *endpoint {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	now := time.Now()
+	var healthy []*endpoint
+	for _, e := range es.endpoints {
+		if now.After(e.downUntil) {
+			healthy = append(healthy, e)
+		}
+	}
+	if len(healthy) == 0 {
+		// Everything is down; keep trying the primary.
+		return es.endpoints[0]
+	}
+	if cl == classWrite {
+		return healthy[0]
+	}
+
+	switch es.policy {
+	case EndpointPolicyWeighted:
+		total := 0
+		for _, e := range healthy {
+			total += e.weight
+		}
+		n := rand.Intn(total)
+		for _, e := range healthy {
+			if n < e.weight {
+				return e
+			}
+			n -= e.weight
+		}
+	case EndpointPolicyLatency:
+		best := healthy[0]
+		for _, e := range healthy[1:] {
+			// Endpoints without a measurement yet are tried first.
+			if e.latency < best.latency {
+				best = e
+			}
+		}
+		return best
+	}
+	return healthy[0]
+}
+
+// observe records the outcome of an attempt against e.
+func (es *endpointSet) observe(e *endpoint, failed bool, took time.Duration) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	if failed {
+		e.downUntil = time.Now().Add(endpointCooldown)
+		return
+	}
+	if e.latency == 0 {
+		e.latency = took
+	} else {
+		e.latency = (e.latency*7 + took) / 8
+	}
+}
+
+// endpointDown reports whether a failed attempt means the endpoint itself
+// is unavailable, as opposed to the request being rejected or throttled.
+// status is that of the response, or 0 without one.
+func endpointDown(err error, status int) bool {
+	if err == nil {
+		return false
+	}
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == request.CanceledErrorCode {
+		return false
+	}
+	switch status {
+	case 0, http.StatusInternalServerError, http.StatusBadGateway, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// direct points the attempt r at the endpoint to use for it.
+func (es *endpointSet) direct(r *http.Request) {
+	e := es.pick(requestClass(r))
+	host := e.url.Host
+	if es.bucket != "" && strings.HasPrefix(r.URL.Host, es.bucket+".") {
+		// Virtual-hosted: the bucket is part of the host name.
+		host = es.bucket + "." + host
+	}
+	r.URL.Scheme = e.url.Scheme
+	r.URL.Host = host
+	r.Host = host
+}
+
+// done records the outcome of the attempt r, sent by direct.
+func (es *endpointSet) done(r *http.Request, failed bool, took time.Duration) {
+	host := r.URL.Host
+	e, ok := es.byHost[host]
+	if !ok {
+		e, ok = es.byHost[strings.TrimPrefix(host, es.bucket+".")]
+	}
+	if ok {
+		es.observe(e, failed, took)
+	}
+}
@@ -0,0 +1,55 @@
+//go:build s3v1
+
+package s3
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+// TestEndpointVirtualHosted checks that requests sent to another endpoint
+// keep the bucket in the host name under virtual-hosted addressing.
+func TestEndpointVirtualHosted(t *testing.T) {
+	for _, c := range []struct {
+		pathStyle bool
+		want      string
+	}{
+		{false, "bucket.gw2.test"},
+		{true, "gw2.test"},
+	} {
+		var host string
+		sess := session.Must(session.NewSession(&aws.Config{
+			Credentials:      credentials.NewStaticCredentials("key", "secret", ""),
+			Endpoint:         aws.String("http://gw1.test"),
+			Region:           aws.String("us-east-1"),
+			S3ForcePathStyle: aws.Bool(c.pathStyle),
+		}))
+		svc := s3.New(sess)
+		svc.Config.HTTPClient = &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+			host = r.URL.Host
+			return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("")), Header: http.Header{}}, nil
+		})}
+		es, err := newEndpointSet([]EndpointConfig{{URL: "http://gw2.test"}}, "", "bucket", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		es.install(&svc.Handlers)
+		if _, err := svc.HeadObject(&s3.HeadObjectInput{Bucket: aws.String("bucket"), Key: aws.String("k")}); err != nil {
+			t.Fatal(err)
+		}
+		if host != c.want {
+			t.Errorf("path style %v: request sent to %s, want %s", c.pathStyle, host, c.want)
+		}
+	}
+}
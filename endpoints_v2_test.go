@@ -0,0 +1,55 @@
+//go:build !s3v1
+
+package s3
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	awsv2 "github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	s3v2 "github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go/middleware"
+)
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+// TestEndpointVirtualHosted checks that requests sent to another endpoint
+// keep the bucket in the host name under virtual-hosted addressing.
+func TestEndpointVirtualHosted(t *testing.T) {
+	for _, c := range []struct {
+		pathStyle bool
+		want      string
+	}{
+		{false, "bucket.gw2.test"},
+		{true, "gw2.test"},
+	} {
+		var host string
+		es, err := newEndpointSet([]EndpointConfig{{URL: "http://gw2.test"}}, "", "bucket", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		svc := s3v2.New(s3v2.Options{
+			Credentials:  credentials.NewStaticCredentialsProvider("key", "secret", ""),
+			BaseEndpoint: awsv2.String("http://gw1.test"),
+			Region:       "us-east-1",
+			UsePathStyle: c.pathStyle,
+			HTTPClient: &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+				host = r.URL.Host
+				return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("")), Header: http.Header{}}, nil
+			})},
+			APIOptions: []func(*middleware.Stack) error{endpointMiddleware{es}.add},
+		})
+		if _, err := svc.HeadObject(context.Background(), &s3v2.HeadObjectInput{Bucket: awsv2.String("bucket"), Key: awsv2.String("k")}); err != nil {
+			t.Fatal(err)
+		}
+		if host != c.want {
+			t.Errorf("path style %v: request sent to %s, want %s", c.pathStyle, host, c.want)
+		}
+	}
+}
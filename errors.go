@@ -0,0 +1,173 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	ds "github.com/ipfs/go-datastore"
+)
+
+// Classes of errors from the bucket. Operations return them wrapped in an
+// *Error carrying the original error; use ErrorClass to compare.
+var (
+	ErrThrottled     = errors.New("s3ds: request throttled")
+	ErrAuth          = errors.New("s3ds: access denied")
+	ErrBucketMissing = errors.New("s3ds: bucket does not exist")
+	ErrTimeout       = errors.New("s3ds: request timed out")
+	ErrArchived      = errors.New("s3ds: object is archived")
+
+	// ErrDeadlineExceeded is the class of a *DeadlineError.
+	ErrDeadlineExceeded = errors.New("s3ds: deadline exceeded")
+)
+
+// defaultMaxRetries is what the SDK uses when MaxRetries is not set.
+const defaultMaxRetries = 3
+
+// Error is an error from the bucket that falls into one of the classes
+// above.
+type Error struct {
+	Class error
+	Err   error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Class, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// DeadlineError is the error of a request that failed and could not be
+// retried before the deadline of its context, or of its timeout, ran
+// out. Rather than wait out a backoff that ends past the deadline, the
+// request gives up at once with the error of its last attempt.
+type DeadlineError struct {
+	// Operation is the S3 operation, e.g. "GetObject".
+	Operation string
+
+	// Attempts is how often the request was sent, and Elapsed the time
+	// since the first attempt.
+	Attempts int
+	Elapsed  time.Duration
+
+	// Err is the error of the last attempt.
+	Err error
+}
+
+func (e *DeadlineError) Error() string {
+	return fmt.Sprintf("%s failed %d times in %s: %s",
+		e.Operation, e.Attempts, e.Elapsed.Round(time.Millisecond), e.Err)
+}
+
+func (e *DeadlineError) Unwrap() error {
+	return e.Err
+}
+
+// ErrorClass returns the class of err: ErrThrottled, ErrAuth,
+// ErrBucketMissing, ErrTimeout, ErrDeadlineExceeded, ErrArchived,
+// ErrChecksumMismatch, ds.ErrNotFound, or nil for any other error.
+func ErrorClass(err error) error {
+	switch e := err.(type) {
+	case nil:
+		return nil
+	case *Error:
+		return e.Class
+	}
+	if err == ds.ErrNotFound {
+		return err
+	}
+	return classify(err, 0)
+}
+
+// classify maps an SDK error, and the HTTP status of the response if known,
+// to its class.
+func classify(err error, status int) error {
+	if _, ok := err.(*DeadlineError); ok {
+		return ErrDeadlineExceeded
+	}
+	if err == context.DeadlineExceeded {
+		return ErrTimeout
+	}
+	if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		return ErrTimeout
+	}
+	aerr, ok := err.(awserr.Error)
+	if !ok {
+		return nil
+	}
+	if rerr, ok := err.(awserr.RequestFailure); ok && status == 0 {
+		status = rerr.StatusCode()
+	}
+
+	switch aerr.Code() {
+	case s3.ErrCodeNoSuchKey, "NotFound":
+		return ds.ErrNotFound
+	case s3.ErrCodeNoSuchBucket:
+		return ErrBucketMissing
+	case "AccessDenied", "InvalidAccessKeyId", "SignatureDoesNotMatch",
+		"ExpiredToken", "InvalidToken", "RequestTimeTooSkewed":
+		return ErrAuth
+	case "BadDigest", "InvalidDigest", "XAmzContentSHA256Mismatch":
+		return ErrChecksumMismatch
+	case "InvalidObjectState":
+		// An object in an archive class; the status is 403.
+		return ErrArchived
+	case "RequestTimeout", request.ErrCodeResponseTimeout:
+		return ErrTimeout
+	case request.CanceledErrorCode:
+		if aerr.OrigErr() == context.DeadlineExceeded {
+			return ErrTimeout
+		}
+		return nil
+	}
+	if request.IsErrorThrottle(err) {
+		return ErrThrottled
+	}
+
+	if class := statusClass(status); class != nil {
+		return class
+	}
+	// Transport failures come wrapped in a RequestError.
+	if orig := aerr.OrigErr(); orig != nil && orig != err {
+		return classify(orig, status)
+	}
+	return nil
+}
+
+// statusClass classifies an HTTP error status.
+func statusClass(status int) error {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		return ErrThrottled
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return ErrAuth
+	case http.StatusGatewayTimeout:
+		return ErrTimeout
+	}
+	return nil
+}
+
+// parseError converts an error from the SDK to the error returned to
+// callers: ds.ErrNotFound for a missing key, an *Error for the other
+// classes, and err itself otherwise.
+func parseError(err error) error {
+	switch class := ErrorClass(err); class {
+	case nil:
+		return err
+	case ds.ErrNotFound:
+		return class
+	default:
+		if _, ok := err.(*Error); ok {
+			return err
+		}
+		return &Error{Class: class, Err: err}
+	}
+}
@@ -0,0 +1,123 @@
+package s3
+
+import (
+	"sync"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// Operations of an Event.
+const (
+	EventPut    = "put"
+	EventDelete = "delete"
+)
+
+// eventQueueSize is the number of events queued for a subscriber before
+// more are dropped.
+const eventQueueSize = 1024
+
+// Event is a change to the datastore, delivered to subscribers once the
+// bucket has it.
+type Event struct {
+	// Op is EventPut or EventDelete.
+	Op   string
+	Key  ds.Key
+	Time time.Time
+
+	// Size is the size of the value put, -1 if not known, such as for
+	// keys restored from a snapshot.
+	Size int
+
+	// Dropped is the number of events dropped right before this one
+	// because the subscriber fell behind.
+	Dropped int
+}
+
+// events delivers events to subscribers. Each subscriber has its events
+// queued and delivered in order by a goroutine of its own, so a slow
+// callback neither slows down writes nor holds up other subscribers; once
+// its queue is full, its events are dropped and counted instead.
+type events struct {
+	mu     sync.Mutex
+	subs   map[*subscriber]struct{}
+	closed bool
+
+	// changes, if set, records every event in the change log.
+	changes *changeLog
+}
+
+type subscriber struct {
+	queue   chan Event
+	dropped int
+}
+
+func newEvents() *events {
+	return &events{subs: make(map[*subscriber]struct{})}
+}
+
+func (e *events) emit(op string, k ds.Key, size int) {
+	now := time.Now()
+	if e.changes != nil {
+		e.changes.add(op, k, now)
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.subs) == 0 {
+		return
+	}
+	ev := Event{Op: op, Key: k, Time: now, Size: size}
+	for sub := range e.subs {
+		ev.Dropped = sub.dropped
+		select {
+		case sub.queue <- ev:
+			sub.dropped = 0
+		default:
+			sub.dropped++
+		}
+	}
+}
+
+func (e *events) unsubscribe(sub *subscriber) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, ok := e.subs[sub]; ok {
+		delete(e.subs, sub)
+		close(sub.queue)
+	}
+}
+
+func (e *events) close() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.closed = true
+	for sub := range e.subs {
+		delete(e.subs, sub)
+		close(sub.queue)
+	}
+}
+
+// Subscribe calls fn with every key put or deleted from now on, until the
+// returned function or Close is called; the events already queued are
+// delivered all the same. Events are emitted once the bucket has the
+// change, for puts and deletes of this datastore and of its batches,
+// copies, DeletePrefix and RestoreSnapshot, not for changes made by other
+// nodes. Routes and tenants have subscribers of their own.
+func (s *S3Bucket) Subscribe(fn func(Event)) (unsubscribe func()) {
+	sub := &subscriber{queue: make(chan Event, eventQueueSize)}
+	s.events.mu.Lock()
+	if s.events.closed {
+		close(sub.queue)
+	} else {
+		s.events.subs[sub] = struct{}{}
+	}
+	s.events.mu.Unlock()
+
+	go func() {
+		defer s.RecoverAndDump()
+		for ev := range sub.queue {
+			fn(ev)
+		}
+	}()
+	return func() { s.events.unsubscribe(sub) }
+}
@@ -0,0 +1,144 @@
+package s3
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"sync"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// featureFlagsName is the bookkeeping object FeatureFlagsRefresh reloads
+// the rollout map from. It holds a JSON object of feature name to percent.
+const featureFlagsName = "feature-flags.json"
+
+// Features FeatureFlags rolls out gradually. Each applies only where its
+// own setting enables it, and then to every operation unless FeatureFlags
+// has a percentage for it.
+const (
+	// FeaturePacking packs the small values of batches.
+	FeaturePacking = "packing"
+
+	// FeatureCompression compresses values put.
+	FeatureCompression = "compression"
+
+	// FeatureNegativeCache caches keys found missing.
+	FeatureNegativeCache = "negativeCache"
+
+	// FeatureWriteDedup drops puts of blocks written recently.
+	FeatureWriteDedup = "writeDedup"
+
+	// FeatureWriteBehind uploads puts in the background.
+	FeatureWriteBehind = "writeBehind"
+)
+
+// featureFlags decides which operations a gradually rolled out subsystem
+// applies to. Decisions are keyed on the datastore key so that a given key
+// is handled consistently while its feature stays at the same percentage.
+type featureFlags struct {
+	mu      sync.RWMutex
+	rollout map[string]float64
+}
+
+func newFeatureFlags(rollout map[string]float64) (*featureFlags, error) {
+	f := &featureFlags{}
+	if err := f.set(rollout); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *featureFlags) set(rollout map[string]float64) error {
+	m := make(map[string]float64, len(rollout))
+	for name, pct := range rollout {
+		if pct < 0 || pct > 100 {
+			return fmt.Errorf("s3ds: feature %q rollout %v not within 0-100", name, pct)
+		}
+		m[name] = pct
+	}
+	f.mu.Lock()
+	f.rollout = m
+	f.mu.Unlock()
+	return nil
+}
+
+// enabled reports whether feature applies to an operation on k. An empty
+// key makes a random decision per call.
+func (f *featureFlags) enabled(feature string, k ds.Key) bool {
+	f.mu.RLock()
+	pct := f.rollout[feature]
+	f.mu.RUnlock()
+
+	switch {
+	case pct <= 0:
+		return false
+	case pct >= 100:
+		return true
+	}
+
+	var bucket uint32
+	if k.String() == "/" {
+		bucket = uint32(rand.Intn(10000))
+	} else {
+		h := fnv.New32a()
+		h.Write([]byte(feature))
+		h.Write([]byte(k.String()))
+		bucket = h.Sum32() % 10000
+	}
+	return float64(bucket) < pct*100
+}
+
+// rolledOut reports whether a feature enabled by its setting applies to an
+// operation on k: always, unless it has a rollout percentage.
+func (f *featureFlags) rolledOut(feature string, k ds.Key) bool {
+	f.mu.RLock()
+	_, ok := f.rollout[feature]
+	f.mu.RUnlock()
+	return !ok || f.enabled(feature, k)
+}
+
+// FeatureEnabled reports whether the named feature is rolled out to k.
+func (s *S3Bucket) FeatureEnabled(feature string, k ds.Key) bool {
+	return s.flags.enabled(feature, k)
+}
+
+// SetFeatureRollout replaces the rollout percentages at runtime.
+func (s *S3Bucket) SetFeatureRollout(rollout map[string]float64) error {
+	return s.flags.set(rollout)
+}
+
+// refreshFeatureFlags reloads the rollout map from the bucket every
+// interval until the datastore is closed. A missing or invalid object
+// keeps the current rollout.
+func (s *S3Bucket) refreshFeatureFlags(interval time.Duration) {
+	defer s.RecoverAndDump()
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-s.done:
+			return
+		}
+
+		log := s.logs.get(LogFlags)
+		data, _, err := s.store.GetObject(context.Background(), s.metaPath(featureFlagsName))
+		if err != nil {
+			log.Debugf("refresh: %s", err)
+			continue
+		}
+		var rollout map[string]float64
+		if err := json.Unmarshal(data, &rollout); err != nil {
+			log.Warnf("refresh: invalid %s: %s", featureFlagsName, err)
+			continue
+		}
+		if err := s.flags.set(rollout); err != nil {
+			log.Warnf("refresh: %s", err)
+		}
+	}
+}
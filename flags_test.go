@@ -0,0 +1,60 @@
+package s3_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+
+	s3ds "github.com/ipfs-s3c-storj-plugin"
+	"github.com/ipfs-s3c-storj-plugin/s3test"
+)
+
+// TestFeatureRollout checks that packing only applies to the keys its
+// rollout picks.
+func TestFeatureRollout(t *testing.T) {
+	ctx := context.Background()
+	for _, c := range []struct {
+		name     string
+		rollout  map[string]float64
+		min, max int // objects of their own out of 100 keys
+	}{
+		{"none", map[string]float64{s3ds.FeaturePacking: 0}, 100, 100},
+		{"half", map[string]float64{s3ds.FeaturePacking: 50}, 30, 70},
+		{"unset", nil, 0, 0},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			f := s3test.New()
+			conf := f.Config("s3test")
+			conf.Packing, conf.FeatureFlags = true, c.rollout
+			d, err := s3ds.NewS3Datastore(conf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer d.Close()
+			b, err := d.Batch(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 100; i++ {
+				if err := b.Put(ctx, ds.NewKey(fmt.Sprintf("/k/%d", i)), []byte("v")); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := b.Commit(ctx); err != nil {
+				t.Fatal(err)
+			}
+			var objects int
+			for _, name := range f.Keys("s3test") {
+				if strings.HasPrefix(name, "/k/") {
+					objects++
+				}
+			}
+			if objects < c.min || objects > c.max {
+				t.Errorf("%d keys stored as objects, want %d to %d", objects, c.min, c.max)
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package s3
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+)
+
+const (
+	// defaultGatewayTimeout bounds each request to a gateway when
+	// GatewayTimeout is not set.
+	defaultGatewayTimeout = 30 * time.Second
+
+	// maxGatewayBlock is the largest block read from a gateway, the
+	// largest bitswap transfers.
+	maxGatewayBlock = 2 << 20
+)
+
+// gateways fetches blocks from trustless HTTP gateways, as raw blocks
+// (https://specs.ipfs.tech/http-gateways/trustless-gateway/). Gateways are
+// asked in order and nothing they return is trusted: a block has to hash
+// to the multihash of its key, so only sha2-256 and identity blocks are
+// fetched.
+type gateways struct {
+	urls    []string
+	client  *http.Client
+	timeout time.Duration
+	log     *subLogger
+}
+
+func newGateways(urls []string, timeout time.Duration, log *subLogger) *gateways {
+	if timeout <= 0 {
+		timeout = defaultGatewayTimeout
+	}
+	g := &gateways{client: &http.Client{}, timeout: timeout, log: log}
+	for _, u := range urls {
+		g.urls = append(g.urls, strings.TrimSuffix(u, "/"))
+	}
+	return g
+}
+
+// fetch returns the block under k from the first gateway that has it, or
+// ds.ErrNotFound.
+func (g *gateways) fetch(ctx context.Context, k ds.Key) ([]byte, error) {
+	b, err := keyToCid(k)
+	if err != nil {
+		return nil, ds.ErrNotFound
+	}
+	mh := cidMultihash(b)
+	if !verifiable(mh) {
+		return nil, ds.ErrNotFound
+	}
+	c, err := cid.Cast(b)
+	if err != nil {
+		return nil, ds.ErrNotFound
+	}
+	for _, u := range g.urls {
+		value, err := g.fetchFrom(ctx, u, c)
+		if err == nil && !digestMatches(mh, value) {
+			err = fmt.Errorf("block does not match its multihash")
+		}
+		if err == nil {
+			g.log.Debugf("fetched %s from %s", c, u)
+			return value, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err != ds.ErrNotFound {
+			g.log.Infof("fetching %s from %s: %s", c, u, err)
+		}
+	}
+	return nil, ds.ErrNotFound
+}
+
+func (g *gateways) fetchFrom(ctx context.Context, gateway string, c cid.Cid) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, g.timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, gateway+"/ipfs/"+c.String()+"?format=raw", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/vnd.ipld.raw")
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusGone:
+		return nil, ds.ErrNotFound
+	default:
+		return nil, fmt.Errorf("%s", resp.Status)
+	}
+	value, err := io.ReadAll(io.LimitReader(resp.Body, maxGatewayBlock+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(value) > maxGatewayBlock {
+		return nil, fmt.Errorf("block larger than %d bytes", maxGatewayBlock)
+	}
+	return value, nil
+}
+
+// getFromGateways fetches the block under k, missing from the bucket,
+// from the gateways and stores it, so that it is read from the bucket
+// next time. A failure to store it is logged; the block is returned all
+// the same.
+func (s *S3Bucket) getFromGateways(ctx context.Context, k ds.Key) ([]byte, error) {
+	value, err := s.gateways.fetch(ctx, k)
+	if err != nil || s.readOnly() {
+		return value, err
+	}
+	if perr := s.Put(ctx, k, value); perr != nil {
+		s.gateways.log.Warnf("storing %s fetched from a gateway: %s", k, perr)
+	}
+	return value, nil
+}
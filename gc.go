@@ -0,0 +1,132 @@
+package s3
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// gcGrace is how old an unindexed pack must be before GC deletes it, so
+// that a pack still being written is left alone.
+const gcGrace = time.Hour
+
+// GCResult reports what GC deleted.
+type GCResult struct {
+	// Objects is the number of objects deleted because a pack holds
+	// their value.
+	Objects int
+
+	// Packs is the number of packs deleted because no index refers to
+	// them.
+	Packs int
+
+	// Bytes is the storage freed.
+	Bytes int64
+}
+
+// GC deletes what packing leaves behind when it is interrupted: objects
+// whose value was moved into a pack but that were not deleted, and packs
+// uploaded without their index. It requires Packing, and the writer lease
+// if LeaseTTL is set.
+func (s *S3Bucket) GC(ctx context.Context) (GCResult, error) {
+	var res GCResult
+	if s.packs == nil {
+		return res, fmt.Errorf("s3ds: gc requires packing")
+	}
+	if s.readOnly() {
+		return res, ErrReadOnly
+	}
+	if err := s.requireLease(); err != nil {
+		return res, err
+	}
+	if err := s.auditMaintenance("GC", "gc", ""); err != nil {
+		return res, err
+	}
+
+	var garbage []ObjectInfo
+	listPrefix, _ := s.keys.listPrefix("/")
+	err := s.S3.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.Bucket),
+		Prefix: aws.String(path.Join(s.RootDirectory, listPrefix)),
+	}, func(page *s3.ListObjectsV2Output, last bool) bool {
+		for _, obj := range page.Contents {
+			name := aws.StringValue(obj.Key)
+			if s.isMetaPath(name) {
+				continue
+			}
+			loc, ok := s.packs.lookup(s.fromS3Path(name))
+			if !ok {
+				continue
+			}
+			// An object written after its key was packed is a Put that
+			// has not unpacked the key yet, and is the value to keep.
+			if created, ok := packTime(loc.pack); !ok || !aws.TimeValue(obj.LastModified).Before(created) {
+				continue
+			}
+			garbage = append(garbage, ObjectInfo{Name: name, Size: aws.Int64Value(obj.Size)})
+			res.Bytes += aws.Int64Value(obj.Size)
+		}
+		return true
+	})
+	if err != nil {
+		return res, fmt.Errorf("s3ds: listing objects: %s", err)
+	}
+
+	indexed := make(map[string]bool)
+	var packs []*s3.Object
+	err = s.S3.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.Bucket),
+		Prefix: aws.String(s.metaPath(packDirectory) + "/"),
+	}, func(page *s3.ListObjectsV2Output, last bool) bool {
+		for _, obj := range page.Contents {
+			name := path.Base(aws.StringValue(obj.Key))
+			switch {
+			case strings.HasSuffix(name, ".idx"):
+				indexed[strings.TrimSuffix(name, ".idx")] = true
+			case strings.HasSuffix(name, ".pack"):
+				packs = append(packs, obj)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return res, fmt.Errorf("s3ds: listing packs: %s", err)
+	}
+	cutoff := time.Now().Add(-gcGrace)
+	for _, obj := range packs {
+		id := strings.TrimSuffix(path.Base(aws.StringValue(obj.Key)), ".pack")
+		if indexed[id] || !aws.TimeValue(obj.LastModified).Before(cutoff) {
+			continue
+		}
+		garbage = append(garbage, ObjectInfo{Name: aws.StringValue(obj.Key), Size: aws.Int64Value(obj.Size)})
+		res.Packs++
+		res.Bytes += aws.Int64Value(obj.Size)
+	}
+	res.Objects = len(garbage) - res.Packs
+
+	if err := deleteObjects(ctx, s.store, garbage); err != nil {
+		return res, fmt.Errorf("s3ds: deleting garbage: %s", err)
+	}
+	s.logs.get(LogCompact).Infof("gc deleted %d shadowed objects and %d orphaned packs, %d bytes",
+		res.Objects, res.Packs, res.Bytes)
+	return res, nil
+}
+
+// packTime returns when the pack id was created.
+func packTime(id string) (time.Time, bool) {
+	i := strings.IndexByte(id, '-')
+	if i < 0 {
+		return time.Time{}, false
+	}
+	ns, err := strconv.ParseInt(id[:i], 16, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, ns), true
+}
@@ -0,0 +1,182 @@
+package s3
+
+import (
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	ds "github.com/ipfs/go-datastore"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+)
+
+// providerGCS selects Google Cloud Storage through its native API instead
+// of an S3 gateway.
+const providerGCS = "gcs"
+
+// gcsStore is the ObjectStore of Google Cloud Storage. GCS has no object
+// tags, so PutOptions.Tags is ignored. Downloads are always checked
+// against the object's CRC32C by the client.
+type gcsStore struct {
+	bucket    *storage.BucketHandle
+	workers   int
+	checksums bool
+}
+
+// newGCSStore opens conf.Bucket with the service account key in
+// conf.GCSCredentials, or the application default credentials if that is
+// empty.
+func newGCSStore(conf *Config) (*gcsStore, error) {
+	var opts []option.ClientOption
+	if conf.GCSCredentials != "" {
+		opts = append(opts, option.WithAuthCredentialsFile(option.ServiceAccount, conf.GCSCredentials))
+	}
+	client, err := storage.NewClient(context.Background(), opts...)
+	if err != nil {
+		return nil, fmt.Errorf("s3ds: creating gcs client: %s", err)
+	}
+	return &gcsStore{
+		bucket:    client.Bucket(conf.Bucket),
+		workers:   conf.Workers,
+		checksums: conf.Checksums,
+	}, nil
+}
+
+var _ ObjectStore = (*gcsStore)(nil)
+
+func (st *gcsStore) PutObject(ctx context.Context, name string, body []byte, opts PutOptions) error {
+	obj := st.bucket.Object(name)
+	if opts.IfAbsent {
+		obj = obj.If(storage.Conditions{DoesNotExist: true})
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	w := obj.NewWriter(ctx)
+	w.Metadata = opts.Metadata
+	w.StorageClass = opts.StorageClass
+	// Values are in memory already; send them in a single request.
+	w.ChunkSize = 0
+	if st.checksums {
+		sum := md5.Sum(body)
+		w.MD5 = sum[:]
+	}
+	if _, err := w.Write(body); err != nil {
+		// Cancelling the context aborts the upload.
+		cancel()
+		w.Close()
+		return gcsError(err)
+	}
+	err := w.Close()
+	if opts.IfAbsent && gcsStatus(err) == http.StatusPreconditionFailed {
+		return ErrObjectExists
+	}
+	if st.checksums && gcsStatus(err) == http.StatusBadRequest && strings.Contains(err.Error(), "MD5") {
+		return checksumError(name, "md5")
+	}
+	return gcsError(err)
+}
+
+func (st *gcsStore) GetObject(ctx context.Context, name string) ([]byte, ObjectInfo, error) {
+	r, err := st.bucket.Object(name).NewReader(ctx)
+	if err != nil {
+		return nil, ObjectInfo{}, gcsError(err)
+	}
+	defer r.Close()
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, ObjectInfo{}, gcsError(err)
+	}
+	return data, ObjectInfo{
+		Name:     name,
+		Size:     int64(len(data)),
+		Metadata: r.Metadata(),
+	}, nil
+}
+
+func (st *gcsStore) Head(ctx context.Context, name string) (ObjectInfo, error) {
+	attrs, err := st.bucket.Object(name).Attrs(ctx)
+	if err != nil {
+		return ObjectInfo{}, gcsError(err)
+	}
+	return ObjectInfo{
+		Name:     name,
+		Size:     attrs.Size,
+		Metadata: attrs.Metadata,
+	}, nil
+}
+
+func (st *gcsStore) List(ctx context.Context, prefix, token string, max int) ([]ObjectInfo, string, error) {
+	if max <= 0 || max > listMax {
+		max = listMax
+	}
+	query := &storage.Query{Prefix: prefix}
+	if err := query.SetAttrSelection([]string{"Name", "Size", "Updated"}); err != nil {
+		return nil, "", err
+	}
+
+	var attrs []*storage.ObjectAttrs
+	next, err := iterator.NewPager(st.bucket.Objects(ctx, query), max, token).NextPage(&attrs)
+	if err != nil {
+		return nil, "", gcsError(err)
+	}
+	objs := make([]ObjectInfo, 0, len(attrs))
+	for _, a := range attrs {
+		objs = append(objs, ObjectInfo{Name: a.Name, Size: a.Size, LastModified: a.Updated, ETag: a.Etag})
+	}
+	return objs, next, nil
+}
+
+// DeleteMany deletes the objects one request each, Workers at a time: the
+// JSON API's batch endpoint is not exposed by the Go client.
+func (st *gcsStore) DeleteMany(ctx context.Context, names []string) error {
+	return forEach(ctx, len(names), st.workers, func(ctx context.Context, i int) error {
+		err := st.bucket.Object(names[i]).Delete(ctx)
+		if err == storage.ErrObjectNotExist {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("deleting %s: %s", names[i], gcsError(err))
+		}
+		return nil
+	})
+}
+
+// gcsStatus returns the HTTP status of a GCS API error, or 0.
+func gcsStatus(err error) int {
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) {
+		return gerr.Code
+	}
+	return 0
+}
+
+// gcsError classifies an error of the GCS client like parseError does
+// those of the S3 SDK.
+func gcsError(err error) error {
+	var class error
+	switch {
+	case err == nil:
+		return nil
+	case err == storage.ErrObjectNotExist:
+		return ds.ErrNotFound
+	case err == storage.ErrBucketNotExist:
+		class = ErrBucketMissing
+	case errors.Is(err, context.DeadlineExceeded):
+		class = ErrTimeout
+	}
+	if c := statusClass(gcsStatus(err)); c != nil {
+		class = c
+	}
+	if class == nil {
+		return err
+	}
+	return &Error{Class: class, Err: err}
+}
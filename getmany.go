@@ -0,0 +1,32 @@
+package s3
+
+import (
+	"context"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// GetMany fetches keys concurrently using up to Workers requests in flight
+// and returns their values in the same order. Missing keys yield a nil
+// value rather than an error, so a DAG walk can batch its reads without
+// failing on the first absent block. Each key is read as Get reads it,
+// caches, write-behind and replica fallback included. The first other
+// error cancels the remaining fetches and is returned.
+func (s *S3Bucket) GetMany(ctx context.Context, keys []ds.Key) ([][]byte, error) {
+	values := make([][]byte, len(keys))
+	err := forEach(ctx, len(keys), s.Workers, func(ctx context.Context, i int) error {
+		value, err := s.Get(ctx, keys[i])
+		switch err {
+		case nil:
+			values[i] = value
+		case ds.ErrNotFound:
+		default:
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return values, nil
+}
@@ -0,0 +1,148 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	ds "github.com/ipfs/go-datastore"
+)
+
+// GetRange returns length bytes of the value of k starting at offset, or
+// everything from offset on if length is negative. The range is cut short
+// at the end of the value. Only the range is downloaded, except for
+// compressed or encoded values, values in tiering's cold bucket or
+// archived, and on providers without the S3 API, where the value is
+// fetched whole.
+func (s *S3Bucket) GetRange(ctx context.Context, k ds.Key, offset, length int64) ([]byte, error) {
+	if offset < 0 {
+		return nil, fmt.Errorf("s3ds: negative offset %d", offset)
+	}
+	if length == 0 {
+		return []byte{}, nil
+	}
+	if r := s.route(k); r != s {
+		return r.GetRange(ctx, k, offset, length)
+	}
+	if s.snapshot != nil {
+		value, err := s.snapshotGet(ctx, k)
+		if err != nil {
+			return nil, err
+		}
+		return sliceRange(value, offset, length), nil
+	}
+	if s.writeBehind != nil {
+		if value, ok := s.writeBehind.get(k); ok {
+			return sliceRange(value, offset, length), nil
+		}
+	}
+	if s.packs != nil {
+		if loc, ok := s.packs.lookup(k); ok {
+			if offset >= loc.length {
+				return []byte{}, nil
+			}
+			if length < 0 || offset+length > loc.length {
+				length = loc.length - offset
+			}
+			return s.getPacked(ctx, packLoc{pack: loc.pack, offset: loc.offset + offset, length: length})
+		}
+	}
+
+	name := s.s3Path(k)
+	data, info, err := getObjectRange(ctx, s.store, name, offset, length)
+	if err == errInvalidRange {
+		// Past the end of the object, which is shorter than the value if
+		// encoded.
+		data = []byte{}
+		info, err = s.store.Head(ctx, name)
+	}
+	encoded := err == nil && (info.Metadata[metaEncoding] != "" || info.Metadata[metaCodecs] != "")
+	tiered := s.tiering != nil && (err == ds.ErrNotFound || ErrorClass(err) == ErrArchived)
+	if encoded || tiered {
+		// The range is of the encoded bytes, or the value is in the cold
+		// bucket or archived: get the whole value.
+		value, err := s.get(ctx, k)
+		if err != nil {
+			return nil, err
+		}
+		s.record(opGet, k, len(value))
+		return sliceRange(value, offset, length), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.record(opGet, k, len(data))
+	return data, nil
+}
+
+// errInvalidRange is returned by GetObjectRange for offsets at or past the
+// end of the object.
+var errInvalidRange = errors.New("s3ds: invalid range")
+
+// objectRanger is implemented by ObjectStores that download part of an
+// object: length bytes from offset, or everything from offset on if length
+// is negative.
+type objectRanger interface {
+	GetObjectRange(ctx context.Context, name string, offset, length int64) ([]byte, ObjectInfo, error)
+}
+
+// getObjectRange downloads part of an object from store, if it can, or
+// else the whole object, cut down to the range.
+func getObjectRange(ctx context.Context, store ObjectStore, name string, offset, length int64) ([]byte, ObjectInfo, error) {
+	if r, ok := store.(objectRanger); ok {
+		return r.GetObjectRange(ctx, name, offset, length)
+	}
+	data, info, err := store.GetObject(ctx, name)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	if offset >= int64(len(data)) {
+		return nil, ObjectInfo{}, errInvalidRange
+	}
+	return sliceRange(data, offset, length), info, nil
+}
+
+func (st *s3Store) GetObjectRange(ctx context.Context, name string, offset, length int64) ([]byte, ObjectInfo, error) {
+	rng := fmt.Sprintf("bytes=%d-", offset)
+	if length > 0 {
+		rng = fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)
+	}
+	resp, err := st.client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(st.bucket),
+		Key:    aws.String(name),
+		Range:  aws.String(rng),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "InvalidRange" {
+		return nil, ObjectInfo{}, errInvalidRange
+	}
+	if err != nil {
+		return nil, ObjectInfo{}, parseError(err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	return data, ObjectInfo{Name: name, Size: aws.Int64Value(resp.ContentLength), Metadata: objectMetadata(resp.Metadata)}, nil
+}
+
+func (t *timeoutStore) GetObjectRange(ctx context.Context, name string, offset, length int64) ([]byte, ObjectInfo, error) {
+	ctx, cancel := withTimeout(ctx, t.timeouts.Get)
+	defer cancel()
+	return getObjectRange(ctx, t.ObjectStore, name, offset, length)
+}
+
+func sliceRange(value []byte, offset, length int64) []byte {
+	if offset >= int64(len(value)) {
+		return []byte{}
+	}
+	value = value[offset:]
+	if length >= 0 && length < int64(len(value)) {
+		value = value[:length]
+	}
+	return value
+}
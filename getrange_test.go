@@ -0,0 +1,37 @@
+package s3_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+
+	s3ds "github.com/ipfs-s3c-storj-plugin"
+)
+
+// TestGetRangeCompressed checks ranges of a compressed value that start
+// past the end of its much smaller object.
+func TestGetRangeCompressed(t *testing.T) {
+	ctx := context.Background()
+	d := newFakeDatastore(t, s3ds.Config{Compression: s3ds.CompressionGzip})
+	k := ds.NewKey("/zeros")
+	value := make([]byte, 1<<20)
+	value[len(value)-1] = 1
+	if err := d.Put(ctx, k, value); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []struct{ offset, length int64 }{{0, 10}, {1<<20 - 5, 10}, {1<<20 - 1, -1}, {1 << 20, 10}} {
+		got, err := d.GetRange(ctx, k, r.offset, r.length)
+		if err != nil {
+			t.Fatal(err)
+		}
+		end := r.offset + r.length
+		if r.length < 0 || end > int64(len(value)) {
+			end = int64(len(value))
+		}
+		if want := value[min(r.offset, end):end]; !bytes.Equal(got, want) {
+			t.Errorf("range %d+%d: got %d bytes, want %d", r.offset, r.length, len(got), len(want))
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package s3
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	ds "github.com/ipfs/go-datastore"
+)
+
+// Grants controls who besides the bucket owner may access the objects
+// the datastore writes. Grantee lists use the S3 header syntax, e.g.
+// `id="canonical-user-id"` or `uri="http://acs.amazonaws.com/groups/global/AllUsers"`,
+// separated by commas.
+//
+// Storj gateways do not implement object ACLs; share a prefix there with
+// an access grant instead.
+type Grants struct {
+	// ACL is a canned ACL such as "bucket-owner-full-control" or
+	// "public-read".
+	ACL string
+
+	// Read lists grantees allowed to read the objects.
+	Read string
+
+	// FullControl lists grantees allowed full control of the objects.
+	FullControl string
+}
+
+func (g Grants) empty() bool {
+	return g.ACL == "" && g.Read == "" && g.FullControl == ""
+}
+
+// applyACL sets the grants on the ACL fields shared by the requests
+// writing objects.
+func (g Grants) applyACL(acl, read, fullControl **string) {
+	if g.ACL != "" {
+		*acl = aws.String(g.ACL)
+	}
+	if g.Read != "" {
+		*read = aws.String(g.Read)
+	}
+	if g.FullControl != "" {
+		*fullControl = aws.String(g.FullControl)
+	}
+}
+
+func (g Grants) applyPut(input *s3.PutObjectInput) {
+	g.applyACL(&input.ACL, &input.GrantRead, &input.GrantFullControl)
+}
+
+func (g Grants) applyCopy(input *s3.CopyObjectInput) {
+	g.applyACL(&input.ACL, &input.GrantRead, &input.GrantFullControl)
+}
+
+// ApplyGrants sets the configured Grants on every object already stored
+// under prefix, e.g. to publish a dataset written before they were
+// configured. It returns the number of objects updated. Keys kept in packs
+// or stored by routes have no object of their own here and are skipped.
+// As with Keys, a listing error is logged and ends the list of keys early.
+func (s *S3Bucket) ApplyGrants(ctx context.Context, prefix string) (int, error) {
+	if s.readOnly() {
+		return 0, ErrReadOnly
+	}
+	if err := s.needS3(); err != nil {
+		return 0, err
+	}
+	if s.Grants.empty() {
+		return 0, fmt.Errorf("s3ds: no grants configured")
+	}
+	if err := s.auditMaintenance("ApplyGrants", "grant", prefix); err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	ch, err := s.Keys(ctx, prefix)
+	if err != nil {
+		return 0, err
+	}
+
+	// Keys are granted a listing page at a time, so a large prefix is
+	// never held in memory.
+	var (
+		n     int
+		batch []ds.Key
+	)
+	grant := func() error {
+		err := forEach(ctx, len(batch), s.Workers, func(ctx context.Context, i int) error {
+			input := &s3.PutObjectAclInput{
+				Bucket: aws.String(s.Bucket),
+				Key:    aws.String(s.s3Path(batch[i])),
+			}
+			s.Grants.applyACL(&input.ACL, &input.GrantRead, &input.GrantFullControl)
+			if _, err := s.S3.PutObjectAclWithContext(ctx, input); err != nil {
+				return fmt.Errorf("s3ds: granting %s: %s", batch[i], err)
+			}
+			return nil
+		})
+		n += len(batch)
+		batch = batch[:0]
+		return err
+	}
+	for k := range ch {
+		if s.routedElsewhere(k) {
+			continue
+		}
+		if s.packs != nil {
+			if _, ok := s.packs.lookup(k); ok {
+				continue
+			}
+		}
+		batch = append(batch, k)
+		if len(batch) == listMax {
+			if err := grant(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	if err := grant(); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
@@ -0,0 +1,44 @@
+package s3_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+
+	s3ds "github.com/ipfs-s3c-storj-plugin"
+)
+
+// TestApplyGrantsSkipsPacked checks that ApplyGrants only grants the keys
+// stored as objects of their own.
+func TestApplyGrantsSkipsPacked(t *testing.T) {
+	ctx := context.Background()
+	d := newFakeDatastore(t, s3ds.Config{
+		Packing:             true,
+		SmallValueThreshold: 16,
+		Grants:              s3ds.Grants{ACL: "public-read"},
+	})
+	b, err := d.Batch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"/a", "/b"} {
+		if err := b.Put(ctx, ds.NewKey(k), []byte(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Put(ctx, ds.NewKey("/large"), bytes.Repeat([]byte("x"), 64)); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	n, err := d.ApplyGrants(ctx, "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("granted %d keys, want 1", n)
+	}
+}
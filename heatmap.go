@@ -0,0 +1,238 @@
+package s3
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+const defaultHeatmapShard = "next-to-last/2"
+
+// Operation names used in statistics.
+const (
+	opGet    = "get"
+	opPut    = "put"
+	opHas    = "has"
+	opDelete = "delete"
+
+	opGetSize = "getSize"
+)
+
+// PrefixStats counts the operations on keys falling into one shard.
+type PrefixStats struct {
+	Gets     int64 `json:"gets"`
+	Puts     int64 `json:"puts"`
+	Has      int64 `json:"has"`
+	Deletes  int64 `json:"deletes"`
+	BytesIn  int64 `json:"bytesIn"`
+	BytesOut int64 `json:"bytesOut"`
+}
+
+// heatmap aggregates operations per shard of the key space, bucketing
+// keys with a flatfs style shard function so the counts show how a given
+// sharding would spread the load.
+type heatmap struct {
+	shard func(string) string
+
+	mu    sync.Mutex
+	stats map[string]*PrefixStats
+}
+
+func newHeatmap(shardFunc string) (*heatmap, error) {
+	if shardFunc == "" {
+		shardFunc = defaultHeatmapShard
+	}
+	shard, err := parseShardFunc(shardFunc)
+	if err != nil {
+		return nil, err
+	}
+	return &heatmap{shard: shard, stats: make(map[string]*PrefixStats)}, nil
+}
+
+// parseShardFunc parses the flatfs shard function syntax prefix/N,
+// suffix/N or next-to-last/N.
+func parseShardFunc(spec string) (func(string) string, error) {
+	i := strings.LastIndex(spec, "/")
+	if i < 0 {
+		return nil, fmt.Errorf("s3ds: invalid shard function %q", spec)
+	}
+	n, err := strconv.Atoi(spec[i+1:])
+	if err != nil || n <= 0 {
+		return nil, fmt.Errorf("s3ds: invalid shard function %q", spec)
+	}
+	pad := func(s string) string {
+		return strings.Repeat("_", n+1) + s
+	}
+	switch spec[:i] {
+	case "prefix":
+		return func(s string) string {
+			return (s + strings.Repeat("_", n))[:n]
+		}, nil
+	case "suffix":
+		return func(s string) string {
+			s = pad(s)
+			return s[len(s)-n:]
+		}, nil
+	case "next-to-last":
+		return func(s string) string {
+			s = pad(s)
+			return s[len(s)-n-1 : len(s)-1]
+		}, nil
+	default:
+		return nil, fmt.Errorf("s3ds: invalid shard function %q", spec)
+	}
+}
+
+// shardOf returns the shard of k: its parent and the shard of its base
+// namespace, e.g. /blocks/XY.
+func shardOf(shard func(string) string, k ds.Key) string {
+	name := k.Parent().String()
+	if name == "/" {
+		name = ""
+	}
+	return name + "/" + shard(k.BaseNamespace())
+}
+
+func (h *heatmap) record(op string, k ds.Key, size int) {
+	name := shardOf(h.shard, k)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	st, ok := h.stats[name]
+	if !ok {
+		st = &PrefixStats{}
+		h.stats[name] = st
+	}
+	switch op {
+	case opGet:
+		st.Gets++
+		st.BytesOut += int64(size)
+	case opPut:
+		st.Puts++
+		st.BytesIn += int64(size)
+	case opHas:
+		st.Has++
+	case opDelete:
+		st.Deletes++
+	}
+}
+
+// record accounts an operation on k moving size bytes.
+func (s *S3Bucket) record(op string, k ds.Key, size int) {
+	if s.heat != nil {
+		s.heat.record(op, k, size)
+	}
+	if s.journal != nil {
+		s.journal.add(op, k, size)
+	}
+}
+
+func (h *heatmap) snapshot() map[string]PrefixStats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	out := make(map[string]PrefixStats, len(h.stats))
+	for name, st := range h.stats {
+		out[name] = *st
+	}
+	return out
+}
+
+// Heatmap returns the operation counts per shard since startup, or nil if
+// neither HeatmapFile nor StatsAddr is configured.
+func (s *S3Bucket) Heatmap() map[string]PrefixStats {
+	if s.heat == nil {
+		return nil
+	}
+	return s.heat.snapshot()
+}
+
+// WriteHeatmapJSON writes the heatmap as a JSON object keyed by shard.
+func WriteHeatmapJSON(w io.Writer, stats map[string]PrefixStats) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(stats)
+}
+
+// WriteHeatmapPrometheus writes the heatmap in the Prometheus text
+// exposition format.
+func WriteHeatmapPrometheus(w io.Writer, stats map[string]PrefixStats) error {
+	names := make([]string, 0, len(stats))
+	for name := range stats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintln(w, "# TYPE s3ds_shard_operations_total counter")
+	for _, name := range names {
+		st := stats[name]
+		for _, c := range []struct {
+			op string
+			n  int64
+		}{{opGet, st.Gets}, {opPut, st.Puts}, {opHas, st.Has}, {opDelete, st.Deletes}} {
+			fmt.Fprintf(w, "s3ds_shard_operations_total{shard=%q,op=%q} %d\n", name, c.op, c.n)
+		}
+	}
+	fmt.Fprintln(w, "# TYPE s3ds_shard_bytes_total counter")
+	for _, name := range names {
+		st := stats[name]
+		fmt.Fprintf(w, "s3ds_shard_bytes_total{shard=%q,direction=\"in\"} %d\n", name, st.BytesIn)
+		_, err := fmt.Fprintf(w, "s3ds_shard_bytes_total{shard=%q,direction=\"out\"} %d\n", name, st.BytesOut)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exportHeatmap rewrites file every interval until the datastore is
+// closed. Files ending in .prom get the Prometheus format, along with the
+// request counts and costs, anything else JSON.
+func (s *S3Bucket) exportHeatmap(file string, interval time.Duration) {
+	defer s.RecoverAndDump()
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-s.done:
+			return
+		}
+		if err := s.writeHeatmapFile(file); err != nil {
+			s.logs.get(LogHeatmap).Warnf("writing %s: %s", file, err)
+		}
+	}
+}
+
+func (s *S3Bucket) writeHeatmapFile(file string) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(file), ".heatmap")
+	if err != nil {
+		return err
+	}
+	if filepath.Ext(file) == ".prom" {
+		err = WriteHeatmapPrometheus(tmp, s.heat.snapshot())
+		if err == nil {
+			err = WriteCostPrometheus(tmp, s.Costs())
+		}
+	} else {
+		err = WriteHeatmapJSON(tmp, s.heat.snapshot())
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
@@ -0,0 +1,13 @@
+//go:build integration
+
+package s3_test
+
+import (
+	"testing"
+
+	"github.com/ipfs-s3c-storj-plugin/s3test"
+)
+
+// TestEndpoints runs the subtests against the gateways configured through
+// S3TEST_<PROVIDER>_* environment variables, and skips if none is.
+func TestEndpoints(t *testing.T) { s3test.SubtestEndpoints(t) }
@@ -0,0 +1,179 @@
+package s3
+
+import (
+	"context"
+	"net/http"
+)
+
+// Calls to the ObjectStore, as seen by an Interceptor.
+const (
+	OpPutObject  = "PutObject"
+	OpGetObject  = "GetObject"
+	OpHead       = "Head"
+	OpList       = "List"
+	OpDeleteMany = "DeleteMany"
+	OpCopyObject = "CopyObject"
+)
+
+// Call describes a call to the bucket to an Interceptor.
+type Call struct {
+	// Op is one of the Op constants.
+	Op string
+
+	// Name is the object's name, the prefix of a List, or the
+	// destination of a CopyObject, whose source is Source.
+	Name   string
+	Source string
+
+	// Names are the objects of a DeleteMany.
+	Names []string
+
+	// Size is the size of the object uploaded or copied, or, for After,
+	// of the object read or found by Head.
+	Size int64
+
+	// Header is added to the HTTP requests of the call. It only applies
+	// to S3 gateways reached through the datastore's own client.
+	Header http.Header
+}
+
+// Interceptor hooks into every call the datastore makes to its
+// ObjectStore, e.g. to add headers, enforce quotas or inject failures in
+// tests. Bookkeeping that uses the S3 client directly, such as snapshots,
+// is not intercepted.
+//
+// Either function may be nil. Calls are made concurrently, so both must
+// be safe for concurrent use.
+type Interceptor struct {
+	// Before is called before the call is made. An error fails the call
+	// without making it.
+	Before func(ctx context.Context, call *Call) error
+
+	// After is called with the outcome of a call whose Before succeeded,
+	// and returns the error the call fails with instead.
+	After func(ctx context.Context, call *Call, err error) error
+}
+
+// interceptorStore runs the calls to an ObjectStore through a chain of
+// interceptors: the Before functions in order, the After functions in
+// reverse.
+type interceptorStore struct {
+	ObjectStore
+	interceptors []Interceptor
+}
+
+type callHeaderKey struct{}
+
+func (t *interceptorStore) intercept(ctx context.Context, call *Call, fn func(ctx context.Context) error) error {
+	call.Header = make(http.Header)
+	var (
+		n   int
+		err error
+	)
+	for ; n < len(t.interceptors); n++ {
+		if before := t.interceptors[n].Before; before != nil {
+			if err = before(ctx, call); err != nil {
+				break
+			}
+		}
+	}
+	if err == nil {
+		callCtx := ctx
+		if len(call.Header) > 0 {
+			callCtx = context.WithValue(ctx, callHeaderKey{}, call.Header)
+		}
+		err = fn(callCtx)
+	}
+	for n--; n >= 0; n-- {
+		if after := t.interceptors[n].After; after != nil {
+			err = after(ctx, call, err)
+		}
+	}
+	return err
+}
+
+// addCallHeader sets on h, the header of a request, the headers
+// interceptors added to the call of ctx.
+func addCallHeader(ctx context.Context, h http.Header) {
+	call, _ := ctx.Value(callHeaderKey{}).(http.Header)
+	for k, v := range call {
+		h[k] = v
+	}
+}
+
+func (t *interceptorStore) PutObject(ctx context.Context, name string, body []byte, opts PutOptions) error {
+	call := &Call{Op: OpPutObject, Name: name, Size: int64(len(body))}
+	return t.intercept(ctx, call, func(ctx context.Context) error {
+		return t.ObjectStore.PutObject(ctx, name, body, opts)
+	})
+}
+
+func (t *interceptorStore) GetObject(ctx context.Context, name string) ([]byte, ObjectInfo, error) {
+	var (
+		data []byte
+		info ObjectInfo
+	)
+	call := &Call{Op: OpGetObject, Name: name}
+	err := t.intercept(ctx, call, func(ctx context.Context) error {
+		var err error
+		data, info, err = t.ObjectStore.GetObject(ctx, name)
+		call.Size = int64(len(data))
+		return err
+	})
+	return data, info, err
+}
+
+func (t *interceptorStore) Head(ctx context.Context, name string) (ObjectInfo, error) {
+	var info ObjectInfo
+	call := &Call{Op: OpHead, Name: name}
+	err := t.intercept(ctx, call, func(ctx context.Context) error {
+		var err error
+		info, err = t.ObjectStore.Head(ctx, name)
+		call.Size = info.Size
+		return err
+	})
+	return info, err
+}
+
+func (t *interceptorStore) List(ctx context.Context, prefix, token string, max int) ([]ObjectInfo, string, error) {
+	var (
+		objs []ObjectInfo
+		next string
+	)
+	call := &Call{Op: OpList, Name: prefix}
+	err := t.intercept(ctx, call, func(ctx context.Context) error {
+		var err error
+		objs, next, err = t.ObjectStore.List(ctx, prefix, token, max)
+		return err
+	})
+	return objs, next, err
+}
+
+func (t *interceptorStore) DeleteMany(ctx context.Context, names []string) error {
+	call := &Call{Op: OpDeleteMany, Names: names}
+	return t.intercept(ctx, call, func(ctx context.Context) error {
+		return t.ObjectStore.DeleteMany(ctx, names)
+	})
+}
+
+func (t *interceptorStore) GetObjectRange(ctx context.Context, name string, offset, length int64) ([]byte, ObjectInfo, error) {
+	var (
+		data []byte
+		info ObjectInfo
+	)
+	call := &Call{Op: OpGetObject, Name: name}
+	err := t.intercept(ctx, call, func(ctx context.Context) error {
+		var err error
+		data, info, err = getObjectRange(ctx, t.ObjectStore, name, offset, length)
+		call.Size = int64(len(data))
+		return err
+	})
+	return data, info, err
+}
+
+func (t *interceptorStore) CopyObject(ctx context.Context, src, dst string, size int64, opts PutOptions) error {
+	call := &Call{Op: OpCopyObject, Name: dst, Source: src, Size: size}
+	return t.intercept(ctx, call, func(ctx context.Context) error {
+		return copyObject(ctx, t.ObjectStore, src, dst, size, opts)
+	})
+}
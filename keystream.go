@@ -0,0 +1,138 @@
+package s3
+
+import (
+	"context"
+	"path"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+// keysPrefetch is how many pages of the listing Keys fetches ahead of the
+// page its reader is on.
+const keysPrefetch = 1
+
+// Keys streams every key under prefix. The next page of the listing is
+// fetched while the keys of the current one are read, so enumerating the
+// whole datastore, as GC and reproviding do, does not stall on every page.
+//
+// A listing error is logged and closes the channel early; the channel is
+// also closed when ctx is done.
+func (s *S3Bucket) Keys(ctx context.Context, prefix string) (<-chan ds.Key, error) {
+	p := ds.NewKey(prefix)
+	if s.snapshot != nil || len(s.routes) > 0 {
+		// Both need the merging Query does.
+		return s.queryKeys(ctx, p.String())
+	}
+	if s.writeBehind != nil {
+		if err := s.writeBehind.wait(ctx, p); err != nil {
+			return nil, err
+		}
+	}
+	var packed []string
+	if s.packs != nil {
+		packed = s.packs.keys(p.String())
+	}
+
+	listPrefix, filter := s.keys.listPrefix(p.String())
+	objPrefix := path.Join(s.RootDirectory, listPrefix)
+	ctx, cancel := context.WithCancel(ctx)
+	pages := make(chan []ObjectInfo, keysPrefetch)
+	var listErr error
+	go func() {
+		defer s.RecoverAndDump()
+		defer close(pages)
+		token := ""
+		for {
+			objs, next, err := s.store.List(ctx, objPrefix, token, 0)
+			if err != nil {
+				listErr = err
+				return
+			}
+			select {
+			case pages <- objs:
+			case <-ctx.Done():
+				return
+			}
+			if next == "" {
+				return
+			}
+			token = next
+		}
+	}()
+
+	out := make(chan ds.Key, dsq.KeysOnlyBufSize)
+	go func() {
+		defer s.RecoverAndDump()
+		defer close(out)
+		defer cancel()
+
+		send := func(k ds.Key) bool {
+			select {
+			case out <- k:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+		for objs := range pages {
+			for _, obj := range objs {
+				if s.isMetaPath(obj.Name) {
+					continue
+				}
+				k := s.fromS3Path(obj.Name)
+				if filter && !hasKeyPrefix(k, p.String()) {
+					continue
+				}
+				if s.packs != nil {
+					// Listed with the packed keys.
+					if _, ok := s.packs.lookup(k); ok {
+						continue
+					}
+				}
+				if !send(k) {
+					return
+				}
+			}
+		}
+		// pages is closed, so the lister is done with listErr.
+		if listErr != nil {
+			if ctx.Err() == nil {
+				s.logs.get(LogS3).Errorf("listing keys under %s: %s", p, listErr)
+			}
+			return
+		}
+		for _, k := range packed {
+			if !send(ds.RawKey(k)) {
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+// queryKeys is Keys by way of a keys-only query.
+func (s *S3Bucket) queryKeys(ctx context.Context, prefix string) (<-chan ds.Key, error) {
+	res, err := s.Query(ctx, dsq.Query{Prefix: prefix, KeysOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	out := make(chan ds.Key, dsq.KeysOnlyBufSize)
+	go func() {
+		defer s.RecoverAndDump()
+		defer close(out)
+		defer res.Close()
+		for r := range res.Next() {
+			if r.Error != nil {
+				s.logs.get(LogS3).Errorf("listing keys under %s: %s", prefix, r.Error)
+				return
+			}
+			select {
+			case out <- ds.RawKey(r.Key):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, nil
+}
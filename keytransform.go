@@ -0,0 +1,116 @@
+package s3
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+const (
+	// KeyTransformRaw stores every key under its datastore key string. This
+	// is the default.
+	KeyTransformRaw = "raw"
+
+	// KeyTransformFlatfs stores base32 block keys the way flatfs lays them
+	// out on disk: sharded by the next-to-last two characters and suffixed
+	// with ".data", e.g. /CIQAB...XYZ -> XY/CIQAB...XYZ.data.
+	KeyTransformFlatfs = "flatfs"
+
+	flatfsExtension = ".data"
+	flatfsShardLen  = 2
+)
+
+// keyTransform translates between datastore keys and object names relative
+// to the root directory. Names may carry a leading slash; it is dropped when
+// joined with the root directory.
+type keyTransform interface {
+	objectName(k ds.Key) string
+	datastoreKey(name string) ds.Key
+
+	// listPrefix returns the object name prefix to list for a query prefix,
+	// and whether the listing has to be filtered client-side because the
+	// layout does not preserve key prefixes.
+	listPrefix(prefix string) (string, bool)
+}
+
+func newKeyTransform(name string) (keyTransform, error) {
+	switch name {
+	case "", KeyTransformRaw:
+		return rawTransform{}, nil
+	case KeyTransformFlatfs:
+		return flatfsTransform{}, nil
+	default:
+		return nil, fmt.Errorf("s3ds: unknown key transform %q", name)
+	}
+}
+
+type rawTransform struct{}
+
+func (rawTransform) objectName(k ds.Key) string {
+	return k.String()
+}
+
+func (rawTransform) datastoreKey(name string) ds.Key {
+	return ds.NewKey(name)
+}
+
+func (rawTransform) listPrefix(prefix string) (string, bool) {
+	return prefix, false
+}
+
+type flatfsTransform struct{}
+
+func (flatfsTransform) objectName(k ds.Key) string {
+	name := strings.TrimPrefix(k.String(), "/")
+	if !isBase32Block(name) {
+		return name
+	}
+	return path.Join(flatfsShard(name), name+flatfsExtension)
+}
+
+func (flatfsTransform) datastoreKey(name string) ds.Key {
+	dir, file := path.Split(name)
+	if strings.HasSuffix(file, flatfsExtension) {
+		base := strings.TrimSuffix(file, flatfsExtension)
+		if isBase32Block(base) && strings.TrimSuffix(dir, "/") == flatfsShard(base) {
+			return ds.NewKey(base)
+		}
+	}
+	return ds.NewKey(name)
+}
+
+func (flatfsTransform) listPrefix(prefix string) (string, bool) {
+	k := ds.NewKey(prefix)
+	if k.String() == "/" {
+		return "", false
+	}
+	// Block keys are spread across shard directories, so any prefix that
+	// could match one forces a full listing.
+	if len(k.Namespaces()) == 1 && isBase32Chars(k.BaseNamespace()) {
+		return "", true
+	}
+	return strings.TrimPrefix(k.String(), "/"), false
+}
+
+// flatfsShard implements the flatfs next-to-last/2 sharding function.
+func flatfsShard(name string) string {
+	padded := strings.Repeat("_", flatfsShardLen+1) + name
+	return padded[len(padded)-flatfsShardLen-1 : len(padded)-1]
+}
+
+// isBase32Block reports whether name looks like a block key written by the
+// go-ipfs blockstore: a single upper-case, unpadded base32 component.
+func isBase32Block(name string) bool {
+	return len(name) > flatfsShardLen && !strings.Contains(name, "/") && isBase32Chars(name)
+}
+
+func isBase32Chars(s string) bool {
+	for _, c := range s {
+		if !(c >= 'A' && c <= 'Z' || c >= '2' && c <= '7') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,163 @@
+package s3
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// leaseName is the bookkeeping object holding the writer lease.
+const leaseName = "lease.json"
+
+// ErrLeaseHeld is returned by GC and Compact while another node holds the
+// writer lease of the bucket.
+var ErrLeaseHeld = errors.New("s3ds: another node holds the writer lease")
+
+type leaseRecord struct {
+	Holder  string    `json:"holder"`
+	Expires time.Time `json:"expires"`
+}
+
+// lease is the writer lease of a bucket shared by several nodes. The node
+// holding it renews it every third of LeaseTTL; the others try to take it
+// over as soon as it expires.
+//
+// Taking over an expired lease is not atomic: two nodes doing so at the
+// same moment both write it and both read it back, and if both reads come
+// after the last write only its writer holds the lease. The check narrows
+// the window to a few milliseconds rather than closing it.
+type lease struct {
+	s      *S3Bucket
+	ttl    time.Duration
+	holder string
+
+	mu      sync.Mutex
+	expires time.Time
+}
+
+func newLease(s *S3Bucket, ttl time.Duration) *lease {
+	host, _ := os.Hostname()
+	id := make([]byte, 8)
+	rand.Read(id)
+	return &lease{
+		s:      s,
+		ttl:    ttl,
+		holder: fmt.Sprintf("%s/%d/%s", host, os.Getpid(), hex.EncodeToString(id)),
+	}
+}
+
+func (l *lease) read(ctx context.Context) (leaseRecord, error) {
+	var rec leaseRecord
+	data, _, err := l.s.store.GetObject(ctx, l.s.metaPath(leaseName))
+	if err != nil {
+		return rec, err
+	}
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return rec, fmt.Errorf("s3ds: invalid %s: %s", leaseName, err)
+	}
+	return rec, nil
+}
+
+// acquire takes the lease if it is free or expired, or renews it if this
+// node holds it, and reports whether this node holds it now.
+func (l *lease) acquire(ctx context.Context) (bool, error) {
+	cur, err := l.read(ctx)
+	free := err == ds.ErrNotFound
+	if err != nil && !free {
+		return false, err
+	}
+	if !free && cur.Holder != l.holder && time.Now().Before(cur.Expires) {
+		return false, nil
+	}
+
+	expires := time.Now().Add(l.ttl)
+	body, err := json.Marshal(leaseRecord{Holder: l.holder, Expires: expires})
+	if err != nil {
+		return false, err
+	}
+	err = l.s.store.PutObject(ctx, l.s.metaPath(leaseName), body, PutOptions{IfAbsent: free})
+	if err == ErrObjectExists {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	// Another node may have taken over an expired lease at the same time.
+	if cur, err = l.read(ctx); err != nil {
+		return false, err
+	}
+	if cur.Holder != l.holder {
+		return false, nil
+	}
+	l.mu.Lock()
+	l.expires = expires
+	l.mu.Unlock()
+	return true, nil
+}
+
+// held reports whether this node held the lease when it last renewed it,
+// and that renewal has not expired yet.
+func (l *lease) held() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return time.Now().Before(l.expires)
+}
+
+// renew keeps acquiring the lease until the datastore is closed.
+func (l *lease) renew() {
+	defer l.s.RecoverAndDump()
+
+	t := time.NewTicker(l.ttl / 3)
+	defer t.Stop()
+	log := l.s.logs.get(LogLease)
+	for {
+		select {
+		case <-t.C:
+		case <-l.s.done:
+			return
+		}
+		had := l.held()
+		ok, err := l.acquire(context.Background())
+		switch {
+		case err != nil:
+			log.Warnf("renewing: %s", err)
+		case ok && !had:
+			log.Infof("acquired writer lease as %s", l.holder)
+		case !ok && had:
+			log.Warnf("lost writer lease")
+			l.mu.Lock()
+			l.expires = time.Time{}
+			l.mu.Unlock()
+		}
+	}
+}
+
+// release gives up the lease if this node holds it.
+func (l *lease) release(ctx context.Context) error {
+	if !l.held() {
+		return nil
+	}
+	cur, err := l.read(ctx)
+	if err != nil || cur.Holder != l.holder {
+		return nil
+	}
+	return l.s.store.DeleteMany(ctx, []string{l.s.metaPath(leaseName)})
+}
+
+// requireLease fails with ErrLeaseHeld unless LeaseTTL is off or this node
+// holds the writer lease.
+func (s *S3Bucket) requireLease() error {
+	if s.lease != nil && !s.lease.held() {
+		return ErrLeaseHeld
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package s3
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// lifecycleRulePrefix marks the lifecycle rules ApplyLifecycle manages.
+// Rules with other IDs are left alone.
+const lifecycleRulePrefix = "s3ds-"
+
+// LifecycleConfig describes the bucket lifecycle rules ApplyLifecycle
+// installs. Prefixes are datastore key prefixes, such as "/tmp".
+type LifecycleConfig struct {
+	// ExpirePrefixes hold scratch data, whose objects are deleted
+	// ExpireDays after they were written.
+	ExpirePrefixes []string
+	ExpireDays     int
+
+	// AbortMultipartDays aborts multipart uploads still incomplete after
+	// this many days, whose parts are billed but invisible.
+	AbortMultipartDays int
+
+	// Transitions move objects to cheaper storage classes as they age.
+	Transitions []LifecycleTransition
+}
+
+// LifecycleTransition moves the objects under Prefix to StorageClass,
+// e.g. "STANDARD_IA" or "GLACIER_IR", Days after they were written.
+type LifecycleTransition struct {
+	Prefix       string
+	Days         int
+	StorageClass string
+}
+
+// lifecyclePrefix returns the object name prefix of a datastore key
+// prefix.
+func (s *S3Bucket) lifecyclePrefix(prefix string) (string, error) {
+	name, filtered := s.keys.listPrefix(prefix)
+	if filtered {
+		return "", fmt.Errorf("s3ds: lifecycle prefix %q has no object prefix with keyTransform %q", prefix, s.KeyTransform)
+	}
+	name = strings.TrimPrefix(path.Join(s.RootDirectory, name), "/")
+	if name == "" {
+		return "", nil
+	}
+	return name + "/", nil
+}
+
+func (s *S3Bucket) lifecycleRules(conf LifecycleConfig) ([]*s3.LifecycleRule, error) {
+	var rules []*s3.LifecycleRule
+	rule := func(id, prefix string) (*s3.LifecycleRule, error) {
+		p, err := s.lifecyclePrefix(prefix)
+		if err != nil {
+			return nil, err
+		}
+		r := &s3.LifecycleRule{
+			ID:     aws.String(lifecycleRulePrefix + id),
+			Status: aws.String(s3.ExpirationStatusEnabled),
+			Filter: &s3.LifecycleRuleFilter{Prefix: aws.String(p)},
+		}
+		rules = append(rules, r)
+		return r, nil
+	}
+
+	if len(conf.ExpirePrefixes) > 0 && conf.ExpireDays <= 0 {
+		return nil, fmt.Errorf("s3ds: lifecycle expire prefixes need expire days")
+	}
+	for i, prefix := range conf.ExpirePrefixes {
+		r, err := rule(fmt.Sprintf("expire-%d", i), prefix)
+		if err != nil {
+			return nil, err
+		}
+		r.Expiration = &s3.LifecycleExpiration{Days: aws.Int64(int64(conf.ExpireDays))}
+	}
+	if conf.AbortMultipartDays > 0 {
+		r, err := rule("abort-multipart", "/")
+		if err != nil {
+			return nil, err
+		}
+		r.AbortIncompleteMultipartUpload = &s3.AbortIncompleteMultipartUpload{
+			DaysAfterInitiation: aws.Int64(int64(conf.AbortMultipartDays)),
+		}
+	}
+	for i, t := range conf.Transitions {
+		if t.Days <= 0 || t.StorageClass == "" {
+			return nil, fmt.Errorf("s3ds: lifecycle transition of %q needs days and a storage class", t.Prefix)
+		}
+		r, err := rule(fmt.Sprintf("transition-%d", i), t.Prefix)
+		if err != nil {
+			return nil, err
+		}
+		r.Transitions = []*s3.Transition{{
+			Days:         aws.Int64(int64(t.Days)),
+			StorageClass: aws.String(t.StorageClass),
+		}}
+	}
+	return rules, nil
+}
+
+// ApplyLifecycle replaces the lifecycle rules installed by earlier calls
+// with the ones conf describes, keeping rules added by other means. It
+// returns the number of rules installed.
+func (s *S3Bucket) ApplyLifecycle(ctx context.Context, conf LifecycleConfig) (int, error) {
+	if err := s.needS3(); err != nil {
+		return 0, err
+	}
+	if s.readOnly() {
+		return 0, ErrReadOnly
+	}
+	if err := s.auditMaintenance("ApplyLifecycle", "lifecycle", ""); err != nil {
+		return 0, err
+	}
+	rules, err := s.lifecycleRules(conf)
+	if err != nil {
+		return 0, err
+	}
+
+	current, err := s.S3.GetBucketLifecycleConfigurationWithContext(ctx, &s3.GetBucketLifecycleConfigurationInput{
+		Bucket: aws.String(s.Bucket),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "NoSuchLifecycleConfiguration" {
+		current, err = nil, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("s3ds: reading lifecycle rules: %s", parseError(err))
+	}
+	installed := len(rules)
+	if current != nil {
+		for _, r := range current.Rules {
+			if !strings.HasPrefix(aws.StringValue(r.ID), lifecycleRulePrefix) {
+				rules = append(rules, r)
+			}
+		}
+	}
+
+	if len(rules) == 0 {
+		_, err = s.S3.DeleteBucketLifecycleWithContext(ctx, &s3.DeleteBucketLifecycleInput{
+			Bucket: aws.String(s.Bucket),
+		})
+	} else {
+		_, err = s.S3.PutBucketLifecycleConfigurationWithContext(ctx, &s3.PutBucketLifecycleConfigurationInput{
+			Bucket:                 aws.String(s.Bucket),
+			LifecycleConfiguration: &s3.BucketLifecycleConfiguration{Rules: rules},
+		})
+	}
+	if err != nil {
+		return 0, fmt.Errorf("s3ds: installing lifecycle rules: %s", parseError(err))
+	}
+	return installed, nil
+}
@@ -0,0 +1,220 @@
+package s3
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Logger receives the datastore's log output. Its method set is shared by
+// go-log and zap's SugaredLogger, so either can be passed in directly; wrap
+// a *slog.Logger with SlogLogger.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// Values of Config.LogFormat.
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// SlogLogger adapts l to Logger. Messages are formatted with their
+// arguments and logged at the matching slog level.
+func SlogLogger(l *slog.Logger) Logger {
+	return slogLogger{l}
+}
+
+type slogLogger struct {
+	l *slog.Logger
+}
+
+func (l slogLogger) log(level slog.Level, format string, args []interface{}) {
+	l.l.Log(context.Background(), level, fmt.Sprintf(format, args...))
+}
+
+func (l slogLogger) Debugf(format string, args ...interface{}) { l.log(slog.LevelDebug, format, args) }
+func (l slogLogger) Infof(format string, args ...interface{})  { l.log(slog.LevelInfo, format, args) }
+func (l slogLogger) Warnf(format string, args ...interface{})  { l.log(slog.LevelWarn, format, args) }
+func (l slogLogger) Errorf(format string, args ...interface{}) { l.log(slog.LevelError, format, args) }
+
+// LogLevel filters log output.
+type LogLevel int
+
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+	LevelOff
+)
+
+var logLevelNames = map[string]LogLevel{
+	"debug": LevelDebug,
+	"info":  LevelInfo,
+	"warn":  LevelWarn,
+	"error": LevelError,
+	"off":   LevelOff,
+}
+
+// ParseLogLevel parses "debug", "info", "warn", "error" or "off".
+func ParseLogLevel(name string) (LogLevel, error) {
+	level, ok := logLevelNames[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("s3ds: unknown log level %q", name)
+	}
+	return level, nil
+}
+
+// Subsystems with their own log level in Config.LogLevels.
+const (
+	LogS3          = "s3"
+	LogBatch       = "batch"
+	LogWriteBehind = "writebehind"
+	LogFlags       = "flags"
+	LogHeatmap     = "heatmap"
+	LogReplica     = "replica"
+	LogCompact     = "compact"
+	LogAudit       = "audit"
+	LogLease       = "lease"
+	LogGateway     = "gateway"
+	LogNotify      = "notify"
+	LogChanges     = "changes"
+)
+
+// logSubsystems are the subsystems Config.LogLevels may name.
+var logSubsystems = map[string]bool{
+	LogS3: true, LogBatch: true, LogWriteBehind: true, LogFlags: true, LogHeatmap: true, LogReplica: true,
+	LogCompact: true, LogAudit: true, LogLease: true, LogGateway: true, LogNotify: true, LogChanges: true,
+}
+
+// subLogger is a Logger filtered to the level of one subsystem.
+type subLogger struct {
+	out    Logger
+	prefix string
+	level  LogLevel
+}
+
+func (l *subLogger) Debugf(format string, args ...interface{}) {
+	if l.level <= LevelDebug {
+		l.out.Debugf(l.prefix+format, args...)
+	}
+}
+
+func (l *subLogger) Infof(format string, args ...interface{}) {
+	if l.level <= LevelInfo {
+		l.out.Infof(l.prefix+format, args...)
+	}
+}
+
+func (l *subLogger) Warnf(format string, args ...interface{}) {
+	if l.level <= LevelWarn {
+		l.out.Warnf(l.prefix+format, args...)
+	}
+}
+
+func (l *subLogger) Errorf(format string, args ...interface{}) {
+	if l.level <= LevelError {
+		l.out.Errorf(l.prefix+format, args...)
+	}
+}
+
+// stdLogger is the default Logger, writing to LogPath or standard error.
+type stdLogger struct {
+	*log.Logger
+}
+
+// newStdLogger returns the default Logger writing to out in format, which
+// is LogFormatText (the default) or LogFormatJSON for one slog JSON record
+// per line.
+func newStdLogger(out io.Writer, format string) (Logger, error) {
+	switch format {
+	case "", LogFormatText:
+		return &stdLogger{log.New(out, "s3ds: ", log.LstdFlags)}, nil
+	case LogFormatJSON:
+		// Levels are filtered per subsystem before records get here.
+		h := slog.NewJSONHandler(out, &slog.HandlerOptions{Level: slog.LevelDebug})
+		return SlogLogger(slog.New(h).With("logger", "s3ds")), nil
+	default:
+		return nil, fmt.Errorf("s3ds: unknown log format %q", format)
+	}
+}
+
+func (l *stdLogger) Debugf(format string, args ...interface{}) { l.Printf("DEBUG "+format, args...) }
+func (l *stdLogger) Infof(format string, args ...interface{})  { l.Printf("INFO "+format, args...) }
+func (l *stdLogger) Warnf(format string, args ...interface{})  { l.Printf("WARN "+format, args...) }
+func (l *stdLogger) Errorf(format string, args ...interface{}) { l.Printf("ERROR "+format, args...) }
+
+// loggers hands out the per-subsystem loggers.
+type loggers struct {
+	out    Logger
+	def    LogLevel
+	levels map[string]LogLevel
+
+	// file is LogPath, open for the default logger.
+	file *os.File
+}
+
+func newLoggers(conf *Config) (*loggers, error) {
+	l := &loggers{out: conf.Logger, def: LevelWarn, levels: make(map[string]LogLevel)}
+	if l.out == nil {
+		var out io.Writer = os.Stderr
+		if conf.LogPath != "" {
+			f, err := os.OpenFile(conf.LogPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+			if err != nil {
+				return nil, fmt.Errorf("s3ds: opening log: %s", err)
+			}
+			l.file, out = f, f
+		}
+		std, err := newStdLogger(out, conf.LogFormat)
+		if err != nil {
+			l.close()
+			return nil, err
+		}
+		l.out = std
+	}
+	if conf.LogLevel != "" {
+		level, err := ParseLogLevel(conf.LogLevel)
+		if err != nil {
+			l.close()
+			return nil, err
+		}
+		l.def = level
+	}
+	for subsystem, name := range conf.LogLevels {
+		if !logSubsystems[subsystem] {
+			l.close()
+			return nil, fmt.Errorf("s3ds: unknown log subsystem %q", subsystem)
+		}
+		level, err := ParseLogLevel(name)
+		if err != nil {
+			l.close()
+			return nil, err
+		}
+		l.levels[subsystem] = level
+	}
+	return l, nil
+}
+
+func (l *loggers) get(subsystem string) *subLogger {
+	level, ok := l.levels[subsystem]
+	if !ok {
+		level = l.def
+	}
+	return &subLogger{out: l.out, prefix: subsystem + ": ", level: level}
+}
+
+// close closes the log file of the default logger, if any.
+func (l *loggers) close() error {
+	if l.file == nil {
+		return nil
+	}
+	return l.file.Close()
+}
@@ -0,0 +1,97 @@
+package s3
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// Version is the version of the datastore, recorded in the layout
+// manifest of the buckets it writes.
+const Version = "0.0.1"
+
+const (
+	layoutManifestName = "manifest.json"
+
+	// layoutFormat is the version of the manifest and of the object layout
+	// it describes. Buckets with a newer format are refused.
+	layoutFormat = 1
+)
+
+// layoutManifest describes how a bucket's objects are laid out. Every
+// node sharing the bucket has to agree on it, or they would read and
+// write different objects for the same keys.
+type layoutManifest struct {
+	Format       int    `json:"format"`
+	KeyTransform string `json:"keyTransform"`
+	Shard        string `json:"shard,omitempty"`
+	Packing      bool   `json:"packing"`
+
+	// Version is the version of the datastore that wrote the manifest.
+	Version string `json:"version"`
+}
+
+func (s *S3Bucket) layout() layoutManifest {
+	m := layoutManifest{
+		Format:       layoutFormat,
+		KeyTransform: s.KeyTransform,
+		Packing:      s.Packing,
+		Version:      Version,
+	}
+	if m.KeyTransform == "" {
+		m.KeyTransform = KeyTransformRaw
+	}
+	if m.KeyTransform == KeyTransformFlatfs {
+		m.Shard = fmt.Sprintf("/repo/flatfs/shard/v1/next-to-last/%d", flatfsShardLen)
+	}
+	return m
+}
+
+// checkManifest compares the configured layout with the manifest in the
+// bucket, writing the manifest if there is none yet.
+func (s *S3Bucket) checkManifest(ctx context.Context) error {
+	want := s.layout()
+	name := s.metaPath(layoutManifestName)
+
+	data, _, err := s.store.GetObject(ctx, name)
+	if err == ds.ErrNotFound {
+		if s.readOnly() || s.DryRun {
+			return nil
+		}
+		body, err := json.Marshal(want)
+		if err != nil {
+			return err
+		}
+		err = s.store.PutObject(ctx, name, body, PutOptions{IfAbsent: true})
+		if err != ErrObjectExists {
+			if err != nil {
+				return fmt.Errorf("s3ds: writing layout manifest: %s", err)
+			}
+			return nil
+		}
+		// Another node wrote it first.
+		data, _, err = s.store.GetObject(ctx, name)
+	}
+	if err != nil {
+		return fmt.Errorf("s3ds: reading layout manifest: %s", err)
+	}
+
+	var have layoutManifest
+	if err := json.Unmarshal(data, &have); err != nil {
+		return fmt.Errorf("s3ds: invalid layout manifest %s: %s", name, err)
+	}
+	switch {
+	case have.Format > layoutFormat:
+		return fmt.Errorf("s3ds: bucket layout format %d was written by version %s, this is %s and supports format %d",
+			have.Format, have.Version, Version, layoutFormat)
+	case have.KeyTransform != want.KeyTransform:
+		return fmt.Errorf("s3ds: bucket uses keyTransform %q, configured is %q", have.KeyTransform, want.KeyTransform)
+	case have.Shard != want.Shard:
+		return fmt.Errorf("s3ds: bucket uses shard function %q, configured is %q", have.Shard, want.Shard)
+	case have.Packing != want.Packing:
+		return fmt.Errorf("s3ds: bucket uses packing %t, configured is %t", have.Packing, want.Packing)
+	}
+	return nil
+}
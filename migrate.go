@@ -0,0 +1,250 @@
+package s3
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+const (
+	// metaDirectory holds the plugin's own bookkeeping objects below the
+	// root directory.
+	metaDirectory = ".s3ds"
+
+	migrateCheckpointName = "migrate-checkpoint"
+
+	defaultCheckpointInterval = 1000
+)
+
+// MigrateOptions tunes Migrate.
+type MigrateOptions struct {
+	// Workers is the number of parallel uploads. Defaults to Config.Workers.
+	Workers int
+
+	// CheckpointInterval is how many keys are copied between checkpoint
+	// writes. Defaults to 1000.
+	CheckpointInterval int
+
+	// Resume skips every key up to the last checkpoint written by a
+	// previous, interrupted run.
+	Resume bool
+
+	// Verify re-checks every source key against the bucket once the copy is
+	// done, comparing sizes.
+	Verify bool
+
+	// Progress, if set, is called after every key with the running totals.
+	// It is called from a single goroutine.
+	Progress func(MigrateProgress)
+}
+
+// MigrateProgress reports how far a migration got.
+type MigrateProgress struct {
+	Total    int
+	Copied   int
+	Skipped  int
+	Bytes    int64
+	Verified int
+}
+
+// Migrate copies every key of src into the bucket. Keys are processed in
+// sorted order so an interrupted run can be resumed from the checkpoint
+// object it leaves behind; src only needs to support a plain keys-only
+// query, which is what flatfs and badger offer.
+func (s *S3Bucket) Migrate(ctx context.Context, src ds.Datastore, opts MigrateOptions) (MigrateProgress, error) {
+	var progress MigrateProgress
+
+	if opts.Workers <= 0 {
+		opts.Workers = s.Workers
+	}
+	if opts.CheckpointInterval <= 0 {
+		opts.CheckpointInterval = defaultCheckpointInterval
+	}
+
+	keys, err := sortedKeys(ctx, src)
+	if err != nil {
+		return progress, err
+	}
+	progress.Total = len(keys)
+
+	start := 0
+	if opts.Resume {
+		last, err := s.readCheckpoint()
+		if err != nil {
+			return progress, err
+		}
+		start = sort.SearchStrings(keys, last)
+		if start < len(keys) && keys[start] == last {
+			start++
+		}
+		progress.Skipped = start
+	}
+
+	type result struct {
+		index int
+		size  int
+		err   error
+	}
+
+	jobs := make(chan int)
+	results := make(chan result)
+
+	var wg sync.WaitGroup
+	wg.Add(opts.Workers)
+	for w := 0; w < opts.Workers; w++ {
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				k := ds.NewKey(keys[i])
+				value, err := src.Get(ctx, k)
+				if err == nil {
+					err = s.putFrom(ctx, "Migrate", k, value)
+				}
+				results <- result{index: i, size: len(value), err: err}
+			}
+		}()
+	}
+
+	go func() {
+		defer close(jobs)
+		for i := start; i < len(keys); i++ {
+			select {
+			case jobs <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	// Results arrive out of order; the checkpoint only ever moves past keys
+	// whose predecessors have all been copied.
+	done := make(map[int]bool)
+	next := start
+	var errs []string
+	for r := range results {
+		if r.err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", keys[r.index], r.err))
+			continue
+		}
+		done[r.index] = true
+		progress.Copied++
+		progress.Bytes += int64(r.size)
+
+		advanced := false
+		for done[next] {
+			delete(done, next)
+			next++
+			advanced = true
+		}
+		if advanced && progress.Copied%opts.CheckpointInterval == 0 && len(errs) == 0 {
+			if err := s.writeCheckpoint(keys[next-1]); err != nil {
+				errs = append(errs, err.Error())
+			}
+		}
+		if opts.Progress != nil {
+			opts.Progress(progress)
+		}
+	}
+
+	if next > start && len(errs) == 0 {
+		if err := s.writeCheckpoint(keys[next-1]); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return progress, fmt.Errorf("s3ds: migration failed:\n%s", strings.Join(errs, "\n"))
+	}
+	if err := ctx.Err(); err != nil {
+		return progress, err
+	}
+
+	if opts.Verify {
+		for _, k := range keys {
+			if err := ctx.Err(); err != nil {
+				return progress, err
+			}
+			if err := s.verifyKey(ctx, src, ds.NewKey(k)); err != nil {
+				errs = append(errs, err.Error())
+				continue
+			}
+			progress.Verified++
+			if opts.Progress != nil {
+				opts.Progress(progress)
+			}
+		}
+		if len(errs) > 0 {
+			return progress, fmt.Errorf("s3ds: migration verify failed:\n%s", strings.Join(errs, "\n"))
+		}
+	}
+
+	return progress, nil
+}
+
+func (s *S3Bucket) verifyKey(ctx context.Context, src ds.Datastore, k ds.Key) error {
+	want, err := src.GetSize(ctx, k)
+	if err != nil {
+		return fmt.Errorf("%s: %s", k, err)
+	}
+	got, err := s.GetSize(ctx, k)
+	if err != nil {
+		return fmt.Errorf("%s: %s", k, err)
+	}
+	if got != want {
+		return fmt.Errorf("%s: size mismatch: source %d, bucket %d", k, want, got)
+	}
+	return nil
+}
+
+func sortedKeys(ctx context.Context, src ds.Datastore) ([]string, error) {
+	res, err := src.Query(ctx, dsq.Query{KeysOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+
+	var keys []string
+	for r := range res.Next() {
+		if r.Error != nil {
+			return nil, r.Error
+		}
+		keys = append(keys, r.Key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// metaPath returns the object name of a bookkeeping object. go-ipfs never
+// writes keys under /.s3ds, and Query skips these objects.
+func (s *S3Bucket) metaPath(name string) string {
+	return path.Join(s.RootDirectory, metaDirectory, name)
+}
+
+func (s *S3Bucket) isMetaPath(p string) bool {
+	return strings.HasPrefix(p, s.metaPath("")+"/")
+}
+
+func (s *S3Bucket) readCheckpoint() (string, error) {
+	data, _, err := s.store.GetObject(context.Background(), s.metaPath(migrateCheckpointName))
+	if err == ds.ErrNotFound {
+		return "", nil
+	}
+	return string(data), err
+}
+
+func (s *S3Bucket) writeCheckpoint(key string) error {
+	if s.DryRun {
+		return nil
+	}
+	return s.store.PutObject(context.Background(), s.metaPath(migrateCheckpointName), []byte(key), PutOptions{})
+}
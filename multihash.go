@@ -0,0 +1,50 @@
+package s3
+
+import (
+	"encoding/hex"
+	"fmt"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// metaMultihash records the multihash of a block, hex encoded, so the
+// object can be checked without knowing the key layout it was written
+// with.
+const metaMultihash = "s3ds-multihash"
+
+// blockMultihash returns the multihash of the block stored under k, or nil
+// if k is not a block key.
+func blockMultihash(k ds.Key) []byte {
+	c, err := keyToCid(k)
+	if err != nil {
+		return nil
+	}
+	return cidMultihash(c)
+}
+
+// withMultihash adds the multihash of the block under k to meta.
+func withMultihash(meta map[string]string, k ds.Key) map[string]string {
+	mh := blockMultihash(k)
+	if mh == nil {
+		return meta
+	}
+	if meta == nil {
+		meta = make(map[string]string, 1)
+	}
+	meta[metaMultihash] = hex.EncodeToString(mh)
+	return meta
+}
+
+// verifyBlock checks that value, read from k, hashes to the multihash
+// recorded with it, or else to the one in k. Values whose hash function is
+// not supported are let through.
+func verifyBlock(k ds.Key, value []byte, meta map[string]string) error {
+	mh := blockMultihash(k)
+	if recorded, err := hex.DecodeString(meta[metaMultihash]); err == nil && isMultihash(recorded) {
+		mh = recorded
+	}
+	if mh == nil || !verifiable(mh) || digestMatches(mh, value) {
+		return nil
+	}
+	return &Error{Class: ErrChecksumMismatch, Err: fmt.Errorf("block %s does not match its multihash", k)}
+}
@@ -0,0 +1,114 @@
+package s3
+
+import (
+	"sync"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// defaultNegativeCacheSize bounds the negative cache when
+// NegativeCacheSize is not set.
+const defaultNegativeCacheSize = 100000
+
+// negativeCache remembers keys the bucket did not have, so the lookups
+// bitswap repeats for blocks nobody has stored are answered locally.
+//
+// A lookup that misses may race with a Put of the same key; its miss is
+// only cached if no key was invalidated since the lookup started.
+type negativeCache struct {
+	ttl time.Duration
+	max int
+
+	mu      sync.Mutex
+	entries map[string]time.Time
+	gen     uint64
+}
+
+func newNegativeCache(ttl time.Duration, max int) *negativeCache {
+	if max <= 0 {
+		max = defaultNegativeCacheSize
+	}
+	return &negativeCache{ttl: ttl, max: max, entries: make(map[string]time.Time)}
+}
+
+// generation is taken before a lookup and passed to add with its miss.
+func (c *negativeCache) generation() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.gen
+}
+
+func (c *negativeCache) size() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+func (c *negativeCache) missing(k ds.Key) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	expires, ok := c.entries[k.String()]
+	if ok && time.Now().After(expires) {
+		delete(c.entries, k.String())
+		return false
+	}
+	return ok
+}
+
+func (c *negativeCache) add(k ds.Key, gen uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if gen != c.gen {
+		return
+	}
+	now := time.Now()
+	if len(c.entries) >= c.max {
+		for name, expires := range c.entries {
+			if now.After(expires) {
+				delete(c.entries, name)
+			}
+		}
+		if len(c.entries) >= c.max {
+			return
+		}
+	}
+	c.entries[k.String()] = now.Add(c.ttl)
+}
+
+func (c *negativeCache) invalidate(keys ...ds.Key) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	for _, k := range keys {
+		delete(c.entries, k.String())
+	}
+}
+
+// knownMissing reports whether k is cached as missing. It returns the
+// generation to record a miss of the lookup with otherwise.
+func (s *S3Bucket) knownMissing(k ds.Key) (bool, uint64) {
+	if s.negative == nil || !s.flags.rolledOut(FeatureNegativeCache, k) {
+		return false, 0
+	}
+	if s.negative.missing(k) {
+		s.stats.lookup(cacheNegative, true)
+		return true, 0
+	}
+	s.stats.lookup(cacheNegative, false)
+	return false, s.negative.generation()
+}
+
+// recordMissing caches k as missing if err says it is.
+func (s *S3Bucket) recordMissing(k ds.Key, gen uint64, err error) {
+	if s.negative != nil && err == ds.ErrNotFound && s.flags.rolledOut(FeatureNegativeCache, k) {
+		s.negative.add(k, gen)
+	}
+}
+
+// forgetMissing drops keys that are about to be written from the cache.
+func (s *S3Bucket) forgetMissing(keys ...ds.Key) {
+	if s.negative != nil {
+		s.negative.invalidate(keys...)
+	}
+}
@@ -0,0 +1,264 @@
+package s3
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	ds "github.com/ipfs/go-datastore"
+)
+
+const (
+	// notificationPath is where the webhook takes notifications.
+	notificationPath = "/s3ds/notifications"
+
+	// maxNotification is the largest notification the webhook reads.
+	maxNotification = 1 << 20
+
+	// notificationRetry is how long receiving from the queue waits after
+	// a failure.
+	notificationRetry = 10 * time.Second
+)
+
+// NotificationConfig receives the bucket's event notifications, so that
+// objects written or deleted by other nodes invalidate the caches of this
+// one at once instead of when their entries expire. Notifications come
+// from an SQS queue, directly or through SNS, or are POSTed to a webhook,
+// as MinIO and SNS HTTP subscriptions do. Configure the bucket to notify
+// of object creation and removal.
+type NotificationConfig struct {
+	// Queue is the URL of an SQS queue. Messages are deleted once read,
+	// so every node needs a queue of its own, e.g. each subscribed to an
+	// SNS topic the bucket notifies.
+	Queue string
+
+	// Region, AccessKey and SecretKey are those of the queue. They
+	// default to the bucket's.
+	Region    string
+	AccessKey string
+	SecretKey string
+
+	// Addr, if set, is the address the webhook listens on, taking
+	// notifications at /s3ds/notifications.
+	Addr string
+
+	// Token, if set, has to be sent to the webhook as a bearer token or a
+	// token query parameter.
+	Token string
+}
+
+// s3Notification is a notification of S3 bucket events. A notification
+// sent through SNS is wrapped in a message whose Message is the
+// notification.
+type s3Notification struct {
+	Records []struct {
+		EventName string `json:"eventName"`
+		S3        struct {
+			Bucket struct {
+				Name string `json:"name"`
+			} `json:"bucket"`
+			Object struct {
+				Key string `json:"key"`
+			} `json:"object"`
+		} `json:"s3"`
+	}
+
+	Type         string
+	Message      string
+	SubscribeURL string
+}
+
+type notifications struct {
+	s   *S3Bucket
+	log *subLogger
+
+	queue string
+	sqs   *sqs.SQS
+	srv   *http.Server
+}
+
+func newNotifications(s *S3Bucket, conf NotificationConfig) (*notifications, error) {
+	if conf.Queue == "" && conf.Addr == "" {
+		return nil, fmt.Errorf("s3ds: notifications need a queue or an addr")
+	}
+	n := &notifications{s: s, log: s.logs.get(LogNotify), queue: conf.Queue}
+	if conf.Queue != "" {
+		u, err := url.Parse(conf.Queue)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("s3ds: notifications: queue %q is not a URL", conf.Queue)
+		}
+		region, accessKey, secretKey := s.Region, s.AccessKey, s.SecretKey
+		if conf.Region != "" {
+			region = conf.Region
+		}
+		if conf.AccessKey != "" {
+			accessKey, secretKey = conf.AccessKey, conf.SecretKey
+		}
+		sess, err := session.NewSession(&aws.Config{
+			Credentials: credentials.NewStaticCredentials(accessKey, secretKey, ""),
+			Endpoint:    aws.String(u.Scheme + "://" + u.Host),
+			Region:      aws.String(region),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("s3ds: notifications: %s", err)
+		}
+		n.sqs = sqs.New(sess)
+	}
+	if conf.Addr != "" {
+		l, err := net.Listen("tcp", conf.Addr)
+		if err != nil {
+			return nil, fmt.Errorf("s3ds: notifications: %s", err)
+		}
+		mux := http.NewServeMux()
+		mux.HandleFunc(notificationPath, n.webhook(conf.Token))
+		n.srv = &http.Server{Handler: mux}
+		go func() {
+			defer s.RecoverAndDump()
+			if err := n.srv.Serve(l); err != http.ErrServerClosed {
+				n.log.Warnf("webhook: %s", err)
+			}
+		}()
+	}
+	if n.sqs != nil {
+		go n.receive()
+	}
+	return n, nil
+}
+
+// receive reads the queue until Close.
+func (n *notifications) receive() {
+	defer n.s.RecoverAndDump()
+	for {
+		out, err := n.sqs.ReceiveMessageWithContext(n.s.ctx, &sqs.ReceiveMessageInput{
+			QueueUrl:            aws.String(n.queue),
+			MaxNumberOfMessages: aws.Int64(10),
+			WaitTimeSeconds:     aws.Int64(20),
+		})
+		if n.s.ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			n.log.Warnf("receiving from %s: %s", n.queue, err)
+			select {
+			case <-time.After(notificationRetry):
+				continue
+			case <-n.s.done:
+				return
+			}
+		}
+		if len(out.Messages) == 0 {
+			continue
+		}
+		// Messages that do not parse are deleted too: they never will.
+		entries := make([]*sqs.DeleteMessageBatchRequestEntry, len(out.Messages))
+		for i, m := range out.Messages {
+			if err := n.handle([]byte(aws.StringValue(m.Body))); err != nil {
+				n.log.Warnf("message %s: %s", aws.StringValue(m.MessageId), err)
+			}
+			entries[i] = &sqs.DeleteMessageBatchRequestEntry{Id: aws.String(strconv.Itoa(i)), ReceiptHandle: m.ReceiptHandle}
+		}
+		if _, err := n.sqs.DeleteMessageBatchWithContext(n.s.ctx, &sqs.DeleteMessageBatchInput{
+			QueueUrl: aws.String(n.queue),
+			Entries:  entries,
+		}); err != nil && n.s.ctx.Err() == nil {
+			n.log.Warnf("deleting messages from %s: %s", n.queue, err)
+		}
+	}
+}
+
+func (n *notifications) webhook(token string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST notifications", http.StatusMethodNotAllowed)
+			return
+		}
+		if token != "" && !tokenMatches(r, token) {
+			http.Error(w, "bad token", http.StatusUnauthorized)
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxNotification))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := n.handle(body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+	}
+}
+
+func tokenMatches(r *http.Request, token string) bool {
+	got := r.URL.Query().Get("token")
+	if got == "" {
+		got = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+	return subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
+
+// handle invalidates the keys of the objects a notification is about.
+func (n *notifications) handle(body []byte) error {
+	var msg s3Notification
+	if err := json.Unmarshal(body, &msg); err != nil {
+		return err
+	}
+	switch msg.Type {
+	case "Notification":
+		return n.handle([]byte(msg.Message))
+	case "SubscriptionConfirmation":
+		// Not visited on our own: anyone reaching the webhook could make
+		// us request any URL.
+		n.log.Warnf("confirm the SNS subscription by visiting %s", msg.SubscribeURL)
+		return nil
+	}
+
+	s := n.s
+	var prefix string
+	if s.RootDirectory != "" {
+		prefix = strings.TrimSuffix(path.Clean(s.RootDirectory), "/") + "/"
+	}
+	for _, rec := range msg.Records {
+		if rec.S3.Bucket.Name != "" && rec.S3.Bucket.Name != s.Bucket {
+			continue
+		}
+		// Object keys are URL encoded, with spaces as +.
+		name, err := url.QueryUnescape(rec.S3.Object.Key)
+		if err != nil {
+			return fmt.Errorf("object key %q: %s", rec.S3.Object.Key, err)
+		}
+		if !strings.HasPrefix(name, prefix) || s.isMetaPath(name) {
+			continue
+		}
+		k := s.fromS3Path(name)
+		n.log.Debugf("%s %s", rec.EventName, k)
+		s.forgetRemote(k)
+	}
+	return nil
+}
+
+// forgetRemote drops k, written or deleted by another node, from the
+// caches.
+func (s *S3Bucket) forgetRemote(k ds.Key) {
+	s.forgetMissing(k)
+	if s.recent != nil {
+		s.recent.forget(s.s3Path(k))
+	}
+	s.gets.Forget(k.String())
+}
+
+func (n *notifications) close() {
+	if n.srv != nil {
+		n.srv.Close()
+	}
+}
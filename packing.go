@@ -0,0 +1,369 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+const (
+	// packDirectory holds the pack objects and their indexes under the
+	// bookkeeping directory.
+	packDirectory = "packs"
+
+	defaultPackSize = 4 << 20
+)
+
+// A pack stores many small values in one object. Its index object lists
+// where in the pack each key's value is. Pack names sort by creation
+// time, and a key in several packs belongs to the newest.
+type packEntry struct {
+	Key    string `json:"key"`
+	Offset int64  `json:"offset"`
+	Length int64  `json:"length"`
+}
+
+type packIndexObject struct {
+	Size    int64       `json:"size"`
+	Entries []packEntry `json:"entries"`
+}
+
+type packLoc struct {
+	pack           string
+	offset, length int64
+}
+
+// packIndex is the in-memory index of every pack in the bucket.
+type packIndex struct {
+	mu      sync.RWMutex
+	locs    map[string]packLoc
+	members map[string]map[string]struct{}
+	sizes   map[string]int64
+
+	// rewrite serializes updates of index objects.
+	rewrite sync.Mutex
+}
+
+func newPackIndex() *packIndex {
+	return &packIndex{
+		locs:    make(map[string]packLoc),
+		members: make(map[string]map[string]struct{}),
+		sizes:   make(map[string]int64),
+	}
+}
+
+func newPackID() string {
+	return fmt.Sprintf("%016x-%08x", time.Now().UnixNano(), rand.Uint32())
+}
+
+func (p *packIndex) add(id string, idx *packIndexObject) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sizes[id] = idx.Size
+	members := make(map[string]struct{}, len(idx.Entries))
+	p.members[id] = members
+	for _, e := range idx.Entries {
+		if old, ok := p.locs[e.Key]; ok {
+			delete(p.members[old.pack], e.Key)
+		}
+		p.locs[e.Key] = packLoc{pack: id, offset: e.Offset, length: e.Length}
+		members[e.Key] = struct{}{}
+	}
+}
+
+func (p *packIndex) lookup(k ds.Key) (packLoc, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	loc, ok := p.locs[k.String()]
+	return loc, ok
+}
+
+// keys returns the packed keys under prefix, sorted.
+func (p *packIndex) keys(prefix string) []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	var keys []string
+	for k := range p.locs {
+		if hasKeyPrefix(ds.NewKey(k), prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (s *S3Bucket) packObject(id string) string {
+	return s.metaPath(path.Join(packDirectory, id+".pack"))
+}
+
+func (s *S3Bucket) packIndexObject(id string) string {
+	return s.metaPath(path.Join(packDirectory, id+".idx"))
+}
+
+// loadPacks reads every pack index in the bucket.
+func (s *S3Bucket) loadPacks(ctx context.Context) (*packIndex, error) {
+	var (
+		ids   []string
+		token string
+	)
+	for {
+		objs, next, err := s.store.List(ctx, s.metaPath(packDirectory)+"/", token, listMax)
+		if err != nil {
+			return nil, fmt.Errorf("s3ds: listing packs: %s", err)
+		}
+		for _, obj := range objs {
+			name := path.Base(obj.Name)
+			if strings.HasSuffix(name, ".idx") {
+				ids = append(ids, strings.TrimSuffix(name, ".idx"))
+			}
+		}
+		if next == "" {
+			break
+		}
+		token = next
+	}
+	sort.Strings(ids)
+
+	indexes := make([]*packIndexObject, len(ids))
+	err := forEach(ctx, len(ids), s.Workers, func(ctx context.Context, i int) error {
+		idx, err := s.readPackIndex(ctx, ids[i])
+		if err != nil {
+			return fmt.Errorf("s3ds: reading pack %s: %s", ids[i], err)
+		}
+		indexes[i] = idx
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	p := newPackIndex()
+	for i, id := range ids {
+		p.add(id, indexes[i])
+	}
+	return p, nil
+}
+
+func (s *S3Bucket) readPackIndex(ctx context.Context, id string) (*packIndexObject, error) {
+	data, _, err := s.store.GetObject(ctx, s.packIndexObject(id))
+	if err != nil {
+		return nil, err
+	}
+	idx := &packIndexObject{}
+	if err := json.Unmarshal(data, idx); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+func (s *S3Bucket) writePackIndex(ctx context.Context, id string, idx *packIndexObject) error {
+	data, err := json.Marshal(idx)
+	if err != nil {
+		return err
+	}
+	return s.store.PutObject(ctx, s.packIndexObject(id), data, PutOptions{})
+}
+
+// writePack stores values in a new pack. The pack is uploaded before its
+// index, so a crash in between leaves an unreferenced pack rather than an
+// index pointing nowhere.
+func (s *S3Bucket) writePack(ctx context.Context, keys []ds.Key, values [][]byte) error {
+	id := newPackID()
+	var body bytes.Buffer
+	idx := &packIndexObject{Entries: make([]packEntry, len(keys))}
+	for i, k := range keys {
+		idx.Entries[i] = packEntry{Key: k.String(), Offset: int64(body.Len()), Length: int64(len(values[i]))}
+		body.Write(values[i])
+	}
+	idx.Size = int64(body.Len())
+
+	var opts PutOptions
+	if s.Tagging && len(s.TagLabels) > 0 {
+		tags := url.Values{}
+		for name, value := range s.TagLabels {
+			tags.Set(name, value)
+		}
+		opts.Tags = tags.Encode()
+	}
+	if err := s.store.PutObject(ctx, s.packObject(id), body.Bytes(), opts); err != nil {
+		return fmt.Errorf("s3ds: writing pack: %s", err)
+	}
+	if err := s.writePackIndex(ctx, id, idx); err != nil {
+		return fmt.Errorf("s3ds: writing pack index: %s", err)
+	}
+	s.packs.add(id, idx)
+	return nil
+}
+
+// unpack drops keys from the packs holding them, so that a later Put or
+// Delete of a key is not shadowed by its packed value. Packs left without
+// keys are deleted.
+func (s *S3Bucket) unpack(ctx context.Context, keys []ds.Key) error {
+	p := s.packs
+	p.rewrite.Lock()
+	defer p.rewrite.Unlock()
+
+	affected := make(map[string]struct{})
+	p.mu.Lock()
+	for _, k := range keys {
+		if loc, ok := p.locs[k.String()]; ok {
+			delete(p.locs, k.String())
+			delete(p.members[loc.pack], k.String())
+			affected[loc.pack] = struct{}{}
+		}
+	}
+	p.mu.Unlock()
+
+	for id := range affected {
+		p.mu.RLock()
+		idx := &packIndexObject{Size: p.sizes[id]}
+		for k := range p.members[id] {
+			loc := p.locs[k]
+			idx.Entries = append(idx.Entries, packEntry{Key: k, Offset: loc.offset, Length: loc.length})
+		}
+		p.mu.RUnlock()
+
+		if len(idx.Entries) > 0 {
+			sort.Slice(idx.Entries, func(i, j int) bool { return idx.Entries[i].Offset < idx.Entries[j].Offset })
+			if err := s.writePackIndex(ctx, id, idx); err != nil {
+				return fmt.Errorf("s3ds: rewriting pack index: %s", err)
+			}
+			continue
+		}
+		if err := s.deletePack(ctx, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *S3Bucket) deletePack(ctx context.Context, id string) error {
+	p := s.packs
+	p.mu.RLock()
+	size := p.sizes[id]
+	p.mu.RUnlock()
+	// The index goes first so the pack is never referenced while missing.
+	if err := s.store.DeleteMany(ctx, []string{s.packIndexObject(id)}); err != nil {
+		return fmt.Errorf("s3ds: deleting pack %s: %s", id, err)
+	}
+	if err := deleteObjects(ctx, s.store, []ObjectInfo{{Name: s.packObject(id), Size: size}}); err != nil {
+		return fmt.Errorf("s3ds: deleting pack %s: %s", id, err)
+	}
+	p.mu.Lock()
+	delete(p.members, id)
+	delete(p.sizes, id)
+	p.mu.Unlock()
+	return nil
+}
+
+// getPacked reads a packed value with a ranged request.
+func (s *S3Bucket) getPacked(ctx context.Context, loc packLoc) ([]byte, error) {
+	if loc.length == 0 {
+		return []byte{}, nil
+	}
+	data, _, err := getObjectRange(ctx, s.store, s.packObject(loc.pack), loc.offset, loc.length)
+	if err != nil {
+		return nil, fmt.Errorf("s3ds: reading pack %s: %s", loc.pack, err)
+	}
+	return data, nil
+}
+
+// nextPacked returns the next packed query result, consuming keys and the
+// remaining offset.
+func (s *S3Bucket) nextPacked(ctx context.Context, q dsq.Query, keys *[]string, skip *int) (dsq.Result, bool) {
+	for len(*keys) > 0 {
+		k := ds.NewKey((*keys)[0])
+		*keys = (*keys)[1:]
+		loc, ok := s.packs.lookup(k)
+		if !ok {
+			// Deleted since the query started.
+			continue
+		}
+		if *skip > 0 {
+			*skip--
+			continue
+		}
+		entry := dsq.Entry{Key: k.String(), Size: -1}
+		switch {
+		case !q.KeysOnly:
+			value, err := s.getPacked(ctx, loc)
+			if err != nil {
+				return dsq.Result{Error: err}, false
+			}
+			entry.Value, entry.Size = value, len(value)
+		case q.ReturnsSizes:
+			entry.Size = int(loc.length)
+		}
+		return dsq.Result{Entry: entry}, true
+	}
+	return dsq.Result{}, false
+}
+
+// packJobs groups the small values of a batch into packs of at most
+// PackSize bytes and returns a batch job per pack. The remaining keys are
+// returned to be written as objects of their own.
+func (b *s3Batch) packJobs(keys []ds.Key) ([]func(context.Context) error, []ds.Key) {
+	s := b.s
+	threshold := s.SmallValueThreshold()
+	packSize := s.PackSize
+	if packSize <= 0 {
+		packSize = defaultPackSize
+	}
+
+	var (
+		jobs   []func(context.Context) error
+		rest   []ds.Key
+		keysIn []ds.Key
+		vals   [][]byte
+		size   int
+	)
+	flush := func() {
+		if len(keysIn) == 0 {
+			return
+		}
+		pk, pv := keysIn, vals
+		jobs = append(jobs, func(ctx context.Context) error {
+			if err := s.writePack(ctx, pk, pv); err != nil {
+				return err
+			}
+			for i, k := range pk {
+				s.events.emit(EventPut, k, len(pv[i]))
+			}
+			if s.replica != nil {
+				for i, k := range pk {
+					if err := s.replica.write(ctx, replOpPut, k, pv[i]); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		})
+		keysIn, vals, size = nil, nil, 0
+	}
+	for _, k := range keys {
+		val := b.ops[s.s3Path(k)].val
+		if len(val) >= threshold || !s.flags.rolledOut(FeaturePacking, k) {
+			rest = append(rest, k)
+			continue
+		}
+		if size+len(val) > packSize {
+			flush()
+		}
+		keysIn = append(keysIn, k)
+		vals = append(vals, val)
+		size += len(val)
+	}
+	flush()
+	return jobs, rest
+}
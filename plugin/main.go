@@ -2,92 +2,1109 @@ package main
 
 import (
 	"fmt"
+	"time"
 
-	s3ds "github.com/ipfs-s3c-storj-plugin"
-	"gx/ipfs/QmVW2X4U9QBYetpW49jKAt5csiCDZvogGqTUQRNhPGirAz/go-ipfs/plugin"
-	"gx/ipfs/QmVW2X4U9QBYetpW49jKAt5csiCDZvogGqTUQRNhPGirAz/go-ipfs/repo"
-	"gx/ipfs/QmVW2X4U9QBYetpW49jKAt5csiCDZvogGqTUQRNhPGirAz/go-ipfs/repo/fsrepo"
+	s3ds "github.com/ipfs-s3c-storj-plugin/api/v1"
+	"github.com/ipfs/kubo/plugin"
+	"github.com/ipfs/kubo/repo"
+	"github.com/ipfs/kubo/repo/fsrepo"
 )
 
 var Plugins = []plugin.Plugin{
 	&S3Plugin{},
+	&S3MountPlugin{},
 }
 
+// main is never run; kubo loads the package with -buildmode=plugin. It
+// lets go build ./... and go vet ./... check the package.
+func main() {}
+
 var _ plugin.PluginDatastore = (*S3Plugin)(nil)
 
-type S3Plugin struct{}
+type S3Plugin struct{}
+
+func (s3p S3Plugin) Name() string {
+	return "s3-datastore-plugin"
+}
+
+func (s3p S3Plugin) Version() string {
+	return s3ds.Version
+}
+
+func (s3p S3Plugin) Init(env *plugin.Environment) error {
+	return nil
+}
+
+var DatastoreType = "s3ds"
+
+func (s3p S3Plugin) DatastoreTypeName() string {
+	return DatastoreType
+}
+
+func (s3p S3Plugin) DatastoreConfigParser() fsrepo.ConfigFromMap {
+	return func(m map[string]interface{}) (fsrepo.DatastoreConfig, error) {
+		// Region, endpoint and, for providers with their own API, the
+		// keys may be left to the provider preset.
+		var region string
+		if v, ok := m["region"]; ok {
+			region, ok = v.(string)
+			if !ok {
+				return nil, fmt.Errorf("s3ds: region not a string")
+			}
+		}
+
+		bucket, ok := m["bucket"].(string)
+		if !ok {
+			return nil, fmt.Errorf("s3ds: no bucket specified")
+		}
+
+		var accessKey string
+		if v, ok := m["accessKey"]; ok {
+			accessKey, ok = v.(string)
+			if !ok {
+				return nil, fmt.Errorf("s3ds: accessKey not a string")
+			}
+		}
+
+		var secretKey string
+		if v, ok := m["secretKey"]; ok {
+			secretKey, ok = v.(string)
+			if !ok {
+				return nil, fmt.Errorf("s3ds: secretKey not a string")
+			}
+		}
+
+		/*
+			var sessionToken string
+			if v, ok := m["sessionToken"]; ok {
+				sessionToken, ok = v.(string)
+				if !ok {
+					return nil, fmt.Errorf("s3ds: sessionToken not a string")
+				}
+			}
+
+			var endpoint string
+			if v, ok := m["regionEndpoint"]; ok {
+				endpoint, ok = v.(string)
+				if !ok {
+					return nil, fmt.Errorf("s3ds: regionEndpoint not a string")
+				}
+			}
+		*/
+
+		var endpoint string
+		if v, ok := m["endpoint"]; ok {
+			endpoint, ok = v.(string)
+			if !ok {
+				return nil, fmt.Errorf("ds-storj: unable to convert endpoint to string type")
+			}
+		}
+
+		var rootDirectory string
+		if v, ok := m["rootDirectory"]; ok {
+			rootDirectory, ok = v.(string)
+			if !ok {
+				return nil, fmt.Errorf("s3ds: rootDirectory not a string")
+			}
+		}
+		var keyTransform string
+		if v, ok := m["keyTransform"]; ok {
+			keyTransform, ok = v.(string)
+			if !ok {
+				return nil, fmt.Errorf("s3ds: keyTransform not a string")
+			}
+		}
+
+		var provider string
+		if v, ok := m["provider"]; ok {
+			provider, ok = v.(string)
+			if !ok {
+				return nil, fmt.Errorf("s3ds: provider not a string")
+			}
+		}
+
+		var addressing string
+		if v, ok := m["addressing"]; ok {
+			addressing, ok = v.(string)
+			if !ok {
+				return nil, fmt.Errorf("s3ds: addressing not a string")
+			}
+		}
+
+		var partSize int
+		if v, ok := m["partSize"]; ok {
+			sizef, ok := v.(float64)
+			partSize = int(sizef)
+			switch {
+			case !ok:
+				return nil, fmt.Errorf("s3ds: partSize not a number")
+			case partSize <= 0:
+				return nil, fmt.Errorf("s3ds: partSize <= 0: %f", sizef)
+			case float64(partSize) != sizef:
+				return nil, fmt.Errorf("s3ds: partSize is not an integer: %f", sizef)
+			}
+		}
+
+		var maxRetries int
+		if v, ok := m["maxRetries"]; ok {
+			retriesf, ok := v.(float64)
+			maxRetries = int(retriesf)
+			switch {
+			case !ok:
+				return nil, fmt.Errorf("s3ds: maxRetries not a number")
+			case float64(maxRetries) != retriesf:
+				return nil, fmt.Errorf("s3ds: maxRetries is not an integer: %f", retriesf)
+			}
+		}
+
+		var gcsCredentials string
+		if v, ok := m["gcsCredentials"]; ok {
+			gcsCredentials, ok = v.(string)
+			if !ok {
+				return nil, fmt.Errorf("s3ds: gcsCredentials not a string")
+			}
+		}
+
+		var azureAccount string
+		if v, ok := m["azureAccount"]; ok {
+			azureAccount, ok = v.(string)
+			if !ok {
+				return nil, fmt.Errorf("s3ds: azureAccount not a string")
+			}
+		}
+
+		var azureKey string
+		if v, ok := m["azureKey"]; ok {
+			azureKey, ok = v.(string)
+			if !ok {
+				return nil, fmt.Errorf("s3ds: azureKey not a string")
+			}
+		}
+
+		var azureClientID string
+		if v, ok := m["azureClientID"]; ok {
+			azureClientID, ok = v.(string)
+			if !ok {
+				return nil, fmt.Errorf("s3ds: azureClientID not a string")
+			}
+		}
+
+		var existenceCheck string
+		if v, ok := m["existenceCheck"]; ok {
+			existenceCheck, ok = v.(string)
+			if !ok {
+				return nil, fmt.Errorf("s3ds: existenceCheck not a string")
+			}
+		}
+
+		var featureFlags map[string]float64
+		if v, ok := m["featureFlags"]; ok {
+			flags, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("s3ds: featureFlags not an object")
+			}
+			featureFlags = make(map[string]float64, len(flags))
+			for name, pct := range flags {
+				pctf, ok := pct.(float64)
+				if !ok {
+					return nil, fmt.Errorf("s3ds: featureFlags.%s not a number", name)
+				}
+				featureFlags[name] = pctf
+			}
+		}
+
+		var featureFlagsRefresh time.Duration
+		if v, ok := m["featureFlagsRefresh"]; ok {
+			refresh, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("s3ds: featureFlagsRefresh not a string")
+			}
+			var err error
+			featureFlagsRefresh, err = time.ParseDuration(refresh)
+			if err != nil {
+				return nil, fmt.Errorf("s3ds: featureFlagsRefresh: %s", err)
+			}
+		}
+
+		var writeBehind bool
+		if v, ok := m["writeBehind"]; ok {
+			writeBehind, ok = v.(bool)
+			if !ok {
+				return nil, fmt.Errorf("s3ds: writeBehind not a boolean")
+			}
+		}
+
+		var writeBehindQueue int
+		if v, ok := m["writeBehindQueue"]; ok {
+			queuef, ok := v.(float64)
+			writeBehindQueue = int(queuef)
+			switch {
+			case !ok:
+				return nil, fmt.Errorf("s3ds: writeBehindQueue not a number")
+			case writeBehindQueue <= 0:
+				return nil, fmt.Errorf("s3ds: writeBehindQueue <= 0: %f", queuef)
+			case float64(writeBehindQueue) != queuef:
+				return nil, fmt.Errorf("s3ds: writeBehindQueue is not an integer: %f", queuef)
+			}
+		}
+
+		var pipelinedBatches bool
+		if v, ok := m["pipelinedBatches"]; ok {
+			pipelinedBatches, ok = v.(bool)
+			if !ok {
+				return nil, fmt.Errorf("s3ds: pipelinedBatches not a boolean")
+			}
+		}
+
+		var maxBatchOps int
+		if v, ok := m["maxBatchOps"]; ok {
+			opsf, ok := v.(float64)
+			maxBatchOps = int(opsf)
+			switch {
+			case !ok:
+				return nil, fmt.Errorf("s3ds: maxBatchOps not a number")
+			case maxBatchOps <= 0:
+				return nil, fmt.Errorf("s3ds: maxBatchOps <= 0: %f", opsf)
+			case float64(maxBatchOps) != opsf:
+				return nil, fmt.Errorf("s3ds: maxBatchOps is not an integer: %f", opsf)
+			}
+		}
+
+		var maxBatchBytes int
+		if v, ok := m["maxBatchBytes"]; ok {
+			bytesf, ok := v.(float64)
+			maxBatchBytes = int(bytesf)
+			switch {
+			case !ok:
+				return nil, fmt.Errorf("s3ds: maxBatchBytes not a number")
+			case maxBatchBytes <= 0:
+				return nil, fmt.Errorf("s3ds: maxBatchBytes <= 0: %f", bytesf)
+			case float64(maxBatchBytes) != bytesf:
+				return nil, fmt.Errorf("s3ds: maxBatchBytes is not an integer: %f", bytesf)
+			}
+		}
+
+		var heatmapFile string
+		if v, ok := m["heatmapFile"]; ok {
+			heatmapFile, ok = v.(string)
+			if !ok {
+				return nil, fmt.Errorf("s3ds: heatmapFile not a string")
+			}
+		}
+
+		var heatmapInterval time.Duration
+		if v, ok := m["heatmapInterval"]; ok {
+			interval, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("s3ds: heatmapInterval not a string")
+			}
+			var err error
+			heatmapInterval, err = time.ParseDuration(interval)
+			if err != nil {
+				return nil, fmt.Errorf("s3ds: heatmapInterval: %s", err)
+			}
+		}
+
+		var heatmapShard string
+		if v, ok := m["heatmapShard"]; ok {
+			heatmapShard, ok = v.(string)
+			if !ok {
+				return nil, fmt.Errorf("s3ds: heatmapShard not a string")
+			}
+		}
+
+		var digestInterval time.Duration
+		if v, ok := m["digestInterval"]; ok {
+			interval, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("s3ds: digestInterval not a string")
+			}
+			var err error
+			digestInterval, err = time.ParseDuration(interval)
+			if err != nil {
+				return nil, fmt.Errorf("s3ds: digestInterval: %s", err)
+			}
+		}
+
+		var digestShard string
+		if v, ok := m["digestShard"]; ok {
+			digestShard, ok = v.(string)
+			if !ok {
+				return nil, fmt.Errorf("s3ds: digestShard not a string")
+			}
+		}
+
+		var statsAddr string
+		if v, ok := m["statsAddr"]; ok {
+			statsAddr, ok = v.(string)
+			if !ok {
+				return nil, fmt.Errorf("s3ds: statsAddr not a string")
+			}
+		}
+
+		var statsWindow time.Duration
+		if v, ok := m["statsWindow"]; ok {
+			window, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("s3ds: statsWindow not a string")
+			}
+			var err error
+			statsWindow, err = time.ParseDuration(window)
+			if err != nil {
+				return nil, fmt.Errorf("s3ds: statsWindow: %s", err)
+			}
+		}
+
+		var syncVerify bool
+		if v, ok := m["syncVerify"]; ok {
+			syncVerify, ok = v.(bool)
+			if !ok {
+				return nil, fmt.Errorf("s3ds: syncVerify not a boolean")
+			}
+		}
+
+		var syncVerifyTimeout time.Duration
+		if v, ok := m["syncVerifyTimeout"]; ok {
+			timeout, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("s3ds: syncVerifyTimeout not a string")
+			}
+			var err error
+			syncVerifyTimeout, err = time.ParseDuration(timeout)
+			if err != nil {
+				return nil, fmt.Errorf("s3ds: syncVerifyTimeout: %s", err)
+			}
+		}
+
+		var compression string
+		if v, ok := m["compression"]; ok {
+			compression, ok = v.(string)
+			if !ok {
+				return nil, fmt.Errorf("s3ds: compression not a string")
+			}
+		}
+
+		var compressionLevel int
+		if v, ok := m["compressionLevel"]; ok {
+			levelf, ok := v.(float64)
+			compressionLevel = int(levelf)
+			switch {
+			case !ok:
+				return nil, fmt.Errorf("s3ds: compressionLevel not a number")
+			case float64(compressionLevel) != levelf:
+				return nil, fmt.Errorf("s3ds: compressionLevel is not an integer: %f", levelf)
+			}
+		}
+
+		var codecNames []string
+		if v, ok := m["codecs"]; ok {
+			names, ok := v.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("s3ds: codecs not an array")
+			}
+			for _, n := range names {
+				name, ok := n.(string)
+				if !ok {
+					return nil, fmt.Errorf("s3ds: codecs entry not a string")
+				}
+				codecNames = append(codecNames, name)
+			}
+		}
+
+		var uploadRate, downloadRate int
+		for name, dst := range map[string]*int{
+			"uploadRate":   &uploadRate,
+			"downloadRate": &downloadRate,
+		} {
+			if v, ok := m[name]; ok {
+				ratef, ok := v.(float64)
+				*dst = int(ratef)
+				switch {
+				case !ok:
+					return nil, fmt.Errorf("s3ds: %s not a number", name)
+				case *dst <= 0:
+					return nil, fmt.Errorf("s3ds: %s <= 0: %f", name, ratef)
+				case float64(*dst) != ratef:
+					return nil, fmt.Errorf("s3ds: %s is not an integer: %f", name, ratef)
+				}
+			}
+		}
+
+		var timeouts s3ds.OpTimeouts
+		if v, ok := m["timeouts"]; ok {
+			var err error
+			if timeouts, err = parseTimeouts(v); err != nil {
+				return nil, fmt.Errorf("s3ds: timeouts: %s", err)
+			}
+		}
+
+		var readLimit, writeLimit, listLimit s3ds.OpLimit
+		if v, ok := m["rateLimits"]; ok {
+			limits, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("s3ds: rateLimits not an object")
+			}
+			for class, dst := range map[string]*s3ds.OpLimit{
+				"read":  &readLimit,
+				"write": &writeLimit,
+				"list":  &listLimit,
+			} {
+				if v, ok := limits[class]; ok {
+					var err error
+					if *dst, err = parseOpLimit(v); err != nil {
+						return nil, fmt.Errorf("s3ds: rateLimits.%s: %s", class, err)
+					}
+				}
+			}
+		}
+
+		var adaptiveConcurrency bool
+		if v, ok := m["adaptiveConcurrency"]; ok {
+			adaptiveConcurrency, ok = v.(bool)
+			if !ok {
+				return nil, fmt.Errorf("s3ds: adaptiveConcurrency not a boolean")
+			}
+		}
+
+		var minConcurrency int
+		if v, ok := m["minConcurrency"]; ok {
+			minf, ok := v.(float64)
+			minConcurrency = int(minf)
+			switch {
+			case !ok:
+				return nil, fmt.Errorf("s3ds: minConcurrency not a number")
+			case minConcurrency <= 0:
+				return nil, fmt.Errorf("s3ds: minConcurrency <= 0: %f", minf)
+			case float64(minConcurrency) != minf:
+				return nil, fmt.Errorf("s3ds: minConcurrency is not an integer: %f", minf)
+			}
+		}
+
+		var crashDumpFile string
+		if v, ok := m["crashDumpFile"]; ok {
+			crashDumpFile, ok = v.(string)
+			if !ok {
+				return nil, fmt.Errorf("s3ds: crashDumpFile not a string")
+			}
+		}
+
+		var crashDumpInterval time.Duration
+		if v, ok := m["crashDumpInterval"]; ok {
+			interval, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("s3ds: crashDumpInterval not a string")
+			}
+			var err error
+			crashDumpInterval, err = time.ParseDuration(interval)
+			if err != nil {
+				return nil, fmt.Errorf("s3ds: crashDumpInterval: %s", err)
+			}
+		}
+
+		var crashDumpToBucket bool
+		if v, ok := m["crashDumpToBucket"]; ok {
+			crashDumpToBucket, ok = v.(bool)
+			if !ok {
+				return nil, fmt.Errorf("s3ds: crashDumpToBucket not a boolean")
+			}
+		}
+
+		var transport s3ds.TransportConfig
+		if v, ok := m["transport"]; ok {
+			var err error
+			if transport, err = parseTransport(v); err != nil {
+				return nil, fmt.Errorf("s3ds: transport: %s", err)
+			}
+		}
+
+		var logPath string
+		if v, ok := m["logPath"]; ok {
+			logPath, ok = v.(string)
+			if !ok {
+				return nil, fmt.Errorf("s3ds: logPath not a string")
+			}
+		}
+
+		var logLevel string
+		if v, ok := m["logLevel"]; ok {
+			logLevel, ok = v.(string)
+			if !ok {
+				return nil, fmt.Errorf("s3ds: logLevel not a string")
+			}
+		}
+
+		var logFormat string
+		if v, ok := m["logFormat"]; ok {
+			logFormat, ok = v.(string)
+			if !ok {
+				return nil, fmt.Errorf("s3ds: logFormat not a string")
+			}
+		}
+
+		var slowRequestThreshold time.Duration
+		if v, ok := m["slowRequestThreshold"]; ok {
+			threshold, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("s3ds: slowRequestThreshold not a string")
+			}
+			var err error
+			slowRequestThreshold, err = time.ParseDuration(threshold)
+			if err != nil {
+				return nil, fmt.Errorf("s3ds: slowRequestThreshold: %s", err)
+			}
+		}
+
+		var logLevels map[string]string
+		if v, ok := m["logLevels"]; ok {
+			levels, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("s3ds: logLevels not an object")
+			}
+			logLevels = make(map[string]string, len(levels))
+			for subsystem, level := range levels {
+				if logLevels[subsystem], ok = level.(string); !ok {
+					return nil, fmt.Errorf("s3ds: logLevels.%s not a string", subsystem)
+				}
+			}
+		}
+
+		var snapshotManifest string
+		if v, ok := m["snapshotManifest"]; ok {
+			snapshotManifest, ok = v.(string)
+			if !ok {
+				return nil, fmt.Errorf("s3ds: snapshotManifest not a string")
+			}
+		}
+
+		var endpoints []s3ds.EndpointConfig
+		if v, ok := m["endpoints"]; ok {
+			list, ok := v.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("s3ds: endpoints not an array")
+			}
+			for i, e := range list {
+				conf, err := parseEndpoint(e)
+				if err != nil {
+					return nil, fmt.Errorf("s3ds: endpoints[%d]: %s", i, err)
+				}
+				endpoints = append(endpoints, conf)
+			}
+		}
+
+		var endpointPolicy string
+		if v, ok := m["endpointPolicy"]; ok {
+			endpointPolicy, ok = v.(string)
+			if !ok {
+				return nil, fmt.Errorf("s3ds: endpointPolicy not a string")
+			}
+		}
+
+		var smallValueThreshold int
+		if v, ok := m["smallValueThreshold"]; ok {
+			thresholdf, ok := v.(float64)
+			smallValueThreshold = int(thresholdf)
+			switch {
+			case !ok:
+				return nil, fmt.Errorf("s3ds: smallValueThreshold not a number")
+			case smallValueThreshold <= 0:
+				return nil, fmt.Errorf("s3ds: smallValueThreshold <= 0: %f", thresholdf)
+			case float64(smallValueThreshold) != thresholdf:
+				return nil, fmt.Errorf("s3ds: smallValueThreshold is not an integer: %f", thresholdf)
+			}
+		}
+
+		var smallValueAutoTune bool
+		if v, ok := m["smallValueAutoTune"]; ok {
+			smallValueAutoTune, ok = v.(bool)
+			if !ok {
+				return nil, fmt.Errorf("s3ds: smallValueAutoTune not a boolean")
+			}
+		}
+
+		var replica *s3ds.ReplicaConfig
+		if v, ok := m["replica"]; ok {
+			conf, err := parseReplica(v)
+			if err != nil {
+				return nil, fmt.Errorf("s3ds: replica: %s", err)
+			}
+			replica = &conf
+		}
+
+		var gateways []string
+		if v, ok := m["gateways"]; ok {
+			urls, ok := v.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("s3ds: gateways not an array")
+			}
+			for _, u := range urls {
+				url, ok := u.(string)
+				if !ok {
+					return nil, fmt.Errorf("s3ds: gateways entry not a string")
+				}
+				gateways = append(gateways, url)
+			}
+		}
+
+		var gatewayTimeout time.Duration
+		if v, ok := m["gatewayTimeout"]; ok {
+			timeout, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("s3ds: gatewayTimeout not a string")
+			}
+			var err error
+			if gatewayTimeout, err = time.ParseDuration(timeout); err != nil {
+				return nil, fmt.Errorf("s3ds: gatewayTimeout: %s", err)
+			}
+		}
+
+		var grants s3ds.Grants
+		if v, ok := m["grants"]; ok {
+			g, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("s3ds: grants not an object")
+			}
+			for name, dst := range map[string]*string{
+				"acl":         &grants.ACL,
+				"read":        &grants.Read,
+				"fullControl": &grants.FullControl,
+			} {
+				if v, ok := g[name]; ok {
+					if *dst, ok = v.(string); !ok {
+						return nil, fmt.Errorf("s3ds: grants.%s not a string", name)
+					}
+				}
+			}
+		}
+
+		var prices *s3ds.PriceTable
+		if v, ok := m["prices"]; ok {
+			p, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("s3ds: prices not an object")
+			}
+			prices = &s3ds.PriceTable{}
+			for name, dst := range map[string]*float64{
+				"putPer1000":    &prices.PutPer1000,
+				"getPer1000":    &prices.GetPer1000,
+				"listPer1000":   &prices.ListPer1000,
+				"deletePer1000": &prices.DeletePer1000,
+				"ingressPerGB":  &prices.IngressPerGB,
+				"egressPerGB":   &prices.EgressPerGB,
+			} {
+				if v, ok := p[name]; ok {
+					if *dst, ok = v.(float64); !ok {
+						return nil, fmt.Errorf("s3ds: prices.%s not a number", name)
+					}
+				}
+			}
+		}
+
+		var readOnly bool
+		if v, ok := m["readOnly"]; ok {
+			readOnly, ok = v.(bool)
+			if !ok {
+				return nil, fmt.Errorf("s3ds: readOnly not a boolean")
+			}
+		}
+
+		var skipExisting bool
+		if v, ok := m["skipExisting"]; ok {
+			skipExisting, ok = v.(bool)
+			if !ok {
+				return nil, fmt.Errorf("s3ds: skipExisting not a boolean")
+			}
+		}
+
+		var skipExistingCheck string
+		if v, ok := m["skipExistingCheck"]; ok {
+			skipExistingCheck, ok = v.(string)
+			if !ok {
+				return nil, fmt.Errorf("s3ds: skipExistingCheck not a string")
+			}
+		}
+
+		var packing bool
+		if v, ok := m["packing"]; ok {
+			packing, ok = v.(bool)
+			if !ok {
+				return nil, fmt.Errorf("s3ds: packing not a boolean")
+			}
+		}
+
+		var packSize int
+		if v, ok := m["packSize"]; ok {
+			sizef, ok := v.(float64)
+			packSize = int(sizef)
+			switch {
+			case !ok:
+				return nil, fmt.Errorf("s3ds: packSize not a number")
+			case packSize <= 0:
+				return nil, fmt.Errorf("s3ds: packSize <= 0: %f", sizef)
+			case float64(packSize) != sizef:
+				return nil, fmt.Errorf("s3ds: packSize is not an integer: %f", sizef)
+			}
+		}
+
+		var compactInterval time.Duration
+		if v, ok := m["compactInterval"]; ok {
+			interval, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("s3ds: compactInterval not a string")
+			}
+			var err error
+			if compactInterval, err = time.ParseDuration(interval); err != nil {
+				return nil, fmt.Errorf("s3ds: compactInterval: %s", err)
+			}
+		}
+
+		var shutdownTimeout time.Duration
+		if v, ok := m["shutdownTimeout"]; ok {
+			timeout, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("s3ds: shutdownTimeout not a string")
+			}
+			var err error
+			if shutdownTimeout, err = time.ParseDuration(timeout); err != nil {
+				return nil, fmt.Errorf("s3ds: shutdownTimeout: %s", err)
+			}
+		}
+
+		var negativeCacheTTL time.Duration
+		if v, ok := m["negativeCacheTTL"]; ok {
+			ttl, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("s3ds: negativeCacheTTL not a string")
+			}
+			var err error
+			if negativeCacheTTL, err = time.ParseDuration(ttl); err != nil {
+				return nil, fmt.Errorf("s3ds: negativeCacheTTL: %s", err)
+			}
+		}
+
+		var negativeCacheSize int
+		if v, ok := m["negativeCacheSize"]; ok {
+			sizef, ok := v.(float64)
+			negativeCacheSize = int(sizef)
+			switch {
+			case !ok:
+				return nil, fmt.Errorf("s3ds: negativeCacheSize not a number")
+			case negativeCacheSize <= 0:
+				return nil, fmt.Errorf("s3ds: negativeCacheSize <= 0: %f", sizef)
+			case float64(negativeCacheSize) != sizef:
+				return nil, fmt.Errorf("s3ds: negativeCacheSize is not an integer: %f", sizef)
+			}
+		}
+
+		var writeDedupWindow time.Duration
+		if v, ok := m["writeDedupWindow"]; ok {
+			window, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("s3ds: writeDedupWindow not a string")
+			}
+			var err error
+			if writeDedupWindow, err = time.ParseDuration(window); err != nil {
+				return nil, fmt.Errorf("s3ds: writeDedupWindow: %s", err)
+			}
+		}
+
+		var writeDedupSize int
+		if v, ok := m["writeDedupSize"]; ok {
+			sizef, ok := v.(float64)
+			writeDedupSize = int(sizef)
+			switch {
+			case !ok:
+				return nil, fmt.Errorf("s3ds: writeDedupSize not a number")
+			case writeDedupSize <= 0:
+				return nil, fmt.Errorf("s3ds: writeDedupSize <= 0: %f", sizef)
+			case float64(writeDedupSize) != sizef:
+				return nil, fmt.Errorf("s3ds: writeDedupSize is not an integer: %f", sizef)
+			}
+		}
+
+		var notifications *s3ds.NotificationConfig
+		if v, ok := m["notifications"]; ok {
+			conf, err := parseNotifications(v)
+			if err != nil {
+				return nil, fmt.Errorf("s3ds: notifications: %s", err)
+			}
+			notifications = &conf
+		}
+
+		var changeLogInterval time.Duration
+		if v, ok := m["changeLogInterval"]; ok {
+			interval, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("s3ds: changeLogInterval not a string")
+			}
+			var err error
+			if changeLogInterval, err = time.ParseDuration(interval); err != nil {
+				return nil, fmt.Errorf("s3ds: changeLogInterval: %s", err)
+			}
+		}
+
+		var lifecycle *s3ds.LifecycleConfig
+		if v, ok := m["lifecycle"]; ok {
+			conf, err := parseLifecycle(v)
+			if err != nil {
+				return nil, fmt.Errorf("s3ds: lifecycle: %s", err)
+			}
+			lifecycle = &conf
+		}
 
-func (s3p S3Plugin) Name() string {
-	return "s3-datastore-plugin"
-}
+		var softDelete bool
+		if v, ok := m["softDelete"]; ok {
+			softDelete, ok = v.(bool)
+			if !ok {
+				return nil, fmt.Errorf("s3ds: softDelete not a boolean")
+			}
+		}
 
-func (s3p S3Plugin) Version() string {
-	return "0.0.1"
-}
+		var softDeleteRetention time.Duration
+		if v, ok := m["softDeleteRetention"]; ok {
+			retention, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("s3ds: softDeleteRetention not a string")
+			}
+			var err error
+			if softDeleteRetention, err = time.ParseDuration(retention); err != nil {
+				return nil, fmt.Errorf("s3ds: softDeleteRetention: %s", err)
+			}
+		}
 
-func (s3p S3Plugin) Init() error {
-	return nil
-}
-var DatastoreType = "s3ds"
-func (s3p S3Plugin) DatastoreTypeName() string {
-	return DatastoreType
-}
+		var tombstones bool
+		if v, ok := m["tombstones"]; ok {
+			tombstones, ok = v.(bool)
+			if !ok {
+				return nil, fmt.Errorf("s3ds: tombstones not a boolean")
+			}
+		}
 
-func (s3p S3Plugin) DatastoreConfigParser() fsrepo.ConfigFromMap {
-	return func(m map[string]interface{}) (fsrepo.DatastoreConfig, error) {
-		region, ok := m["region"].(string)
-		if !ok {
-			return nil, fmt.Errorf("s3ds: no region specified")
+		var maxBytes, maxObjects int64
+		for name, dst := range map[string]*int64{
+			"maxBytes":   &maxBytes,
+			"maxObjects": &maxObjects,
+		} {
+			if v, ok := m[name]; ok {
+				nf, ok := v.(float64)
+				*dst = int64(nf)
+				switch {
+				case !ok:
+					return nil, fmt.Errorf("s3ds: %s not a number", name)
+				case *dst <= 0:
+					return nil, fmt.Errorf("s3ds: %s <= 0: %f", name, nf)
+				case float64(*dst) != nf:
+					return nil, fmt.Errorf("s3ds: %s is not an integer: %f", name, nf)
+				}
+			}
 		}
 
-		bucket, ok := m["bucket"].(string)
-		if !ok {
-			return nil, fmt.Errorf("s3ds: no bucket specified")
+		var leaseTTL time.Duration
+		if v, ok := m["leaseTTL"]; ok {
+			ttl, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("s3ds: leaseTTL not a string")
+			}
+			var err error
+			if leaseTTL, err = time.ParseDuration(ttl); err != nil {
+				return nil, fmt.Errorf("s3ds: leaseTTL: %s", err)
+			}
 		}
 
-		accessKey, ok := m["accessKey"].(string)
-		if !ok {
-			return nil, fmt.Errorf("s3ds: no accessKey specified")
+		var compactUtilization float64
+		if v, ok := m["compactUtilization"]; ok {
+			compactUtilization, ok = v.(float64)
+			if !ok {
+				return nil, fmt.Errorf("s3ds: compactUtilization not a number")
+			}
 		}
 
-		secretKey, ok := m["secretKey"].(string)
-		if !ok {
-			return nil, fmt.Errorf("s3ds: no secretKey specified")
+		var tagging bool
+		if v, ok := m["tagging"]; ok {
+			tagging, ok = v.(bool)
+			if !ok {
+				return nil, fmt.Errorf("s3ds: tagging not a boolean")
+			}
 		}
 
-/*
-		var sessionToken string
-		if v, ok := m["sessionToken"]; ok {
-			sessionToken, ok = v.(string)
+		var checksums bool
+		if v, ok := m["checksums"]; ok {
+			checksums, ok = v.(bool)
 			if !ok {
-				return nil, fmt.Errorf("s3ds: sessionToken not a string")
+				return nil, fmt.Errorf("s3ds: checksums not a boolean")
 			}
 		}
 
-		var endpoint string
-		if v, ok := m["regionEndpoint"]; ok {
-			endpoint, ok = v.(string)
+		var verifyOnRead bool
+		if v, ok := m["verifyOnRead"]; ok {
+			verifyOnRead, ok = v.(bool)
 			if !ok {
-				return nil, fmt.Errorf("s3ds: regionEndpoint not a string")
+				return nil, fmt.Errorf("s3ds: verifyOnRead not a boolean")
 			}
 		}
-*/
 
-		endpoint, ok := m["endpoint"].(string)
-		if !ok {
-			return nil, fmt.Errorf("ds-storj: unable to convert endpoint to string type")
+		var tagLabels map[string]string
+		if v, ok := m["tagLabels"]; ok {
+			labels, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("s3ds: tagLabels not an object")
+			}
+			tagLabels = make(map[string]string, len(labels))
+			for name, value := range labels {
+				if tagLabels[name], ok = value.(string); !ok {
+					return nil, fmt.Errorf("s3ds: tagLabels.%s not a string", name)
+				}
+			}
 		}
-		if endpoint == "" {
-			return nil, fmt.Errorf("ds-storj: endpoint configuration is empty")
+
+		var storageClass string
+		if v, ok := m["storageClass"]; ok {
+			storageClass, ok = v.(string)
+			if !ok {
+				return nil, fmt.Errorf("s3ds: storageClass not a string")
+			}
 		}
 
-		var rootDirectory string
-		if v, ok := m["rootDirectory"]; ok {
-			rootDirectory, ok = v.(string)
+		var storageClasses map[string]string
+		if v, ok := m["storageClasses"]; ok {
+			classes, ok := v.(map[string]interface{})
 			if !ok {
-				return nil, fmt.Errorf("s3ds: rootDirectory not a string")
+				return nil, fmt.Errorf("s3ds: storageClasses not an object")
+			}
+			storageClasses = make(map[string]string, len(classes))
+			for ns, class := range classes {
+				if storageClasses[ns], ok = class.(string); !ok {
+					return nil, fmt.Errorf("s3ds: storageClasses.%s not a string", ns)
+				}
+			}
+		}
+
+		var tiering *s3ds.TieringConfig
+		if v, ok := m["tiering"]; ok {
+			conf, err := parseTiering(v)
+			if err != nil {
+				return nil, fmt.Errorf("s3ds: tiering: %s", err)
+			}
+			tiering = &conf
+		}
+
+		var chaos *s3ds.ChaosConfig
+		if v, ok := m["chaos"]; ok {
+			conf, err := parseChaos(v)
+			if err != nil {
+				return nil, fmt.Errorf("s3ds: chaos: %s", err)
+			}
+			chaos = &conf
+		}
+
+		var breaker *s3ds.BreakerConfig
+		if v, ok := m["breaker"]; ok {
+			conf, err := parseBreaker(v)
+			if err != nil {
+				return nil, fmt.Errorf("s3ds: breaker: %s", err)
+			}
+			breaker = &conf
+		}
+
+		var routes map[string]s3ds.RouteConfig
+		if v, ok := m["routes"]; ok {
+			rm, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("s3ds: routes not an object")
+			}
+			routes = make(map[string]s3ds.RouteConfig, len(rm))
+			for prefix, v := range rm {
+				rc, err := parseRoute(v)
+				if err != nil {
+					return nil, fmt.Errorf("s3ds: routes.%s: %s", prefix, err)
+				}
+				routes[prefix] = rc
+			}
+		}
+
+		var tenants map[string]s3ds.TenantConfig
+		if v, ok := m["tenants"]; ok {
+			tm, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("s3ds: tenants not an object")
+			}
+			tenants = make(map[string]s3ds.TenantConfig, len(tm))
+			for name, v := range tm {
+				tc, err := parseTenant(v)
+				if err != nil {
+					return nil, fmt.Errorf("s3ds: tenants.%s: %s", name, err)
+				}
+				tenants[name] = tc
+			}
+		}
+
+		var auditLog string
+		if v, ok := m["auditLog"]; ok {
+			auditLog, ok = v.(string)
+			if !ok {
+				return nil, fmt.Errorf("s3ds: auditLog not a string")
+			}
+		}
+
+		var auditToBucket bool
+		if v, ok := m["auditToBucket"]; ok {
+			auditToBucket, ok = v.(bool)
+			if !ok {
+				return nil, fmt.Errorf("s3ds: auditToBucket not a boolean")
+			}
+		}
+
+		var auditInterval time.Duration
+		if v, ok := m["auditInterval"]; ok {
+			interval, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("s3ds: auditInterval not a string")
+			}
+			var err error
+			if auditInterval, err = time.ParseDuration(interval); err != nil {
+				return nil, fmt.Errorf("s3ds: auditInterval: %s", err)
+			}
+		}
+
+		var dryRun bool
+		if v, ok := m["dryRun"]; ok {
+			dryRun, ok = v.(bool)
+			if !ok {
+				return nil, fmt.Errorf("s3ds: dryRun not a boolean")
+			}
+		}
+
+		var autoDetectRegion bool
+		if v, ok := m["autoDetectRegion"]; ok {
+			autoDetectRegion, ok = v.(bool)
+			if !ok {
+				return nil, fmt.Errorf("s3ds: autoDetectRegion not a boolean")
+			}
+		}
+
+		var createBucketIfMissing bool
+		if v, ok := m["createBucketIfMissing"]; ok {
+			createBucketIfMissing, ok = v.(bool)
+			if !ok {
+				return nil, fmt.Errorf("s3ds: createBucketIfMissing not a boolean")
+			}
+		}
+
+		var bucketVersioning bool
+		if v, ok := m["bucketVersioning"]; ok {
+			bucketVersioning, ok = v.(bool)
+			if !ok {
+				return nil, fmt.Errorf("s3ds: bucketVersioning not a boolean")
+			}
+		}
+
+		var bucketEncryption string
+		if v, ok := m["bucketEncryption"]; ok {
+			bucketEncryption, ok = v.(string)
+			if !ok {
+				return nil, fmt.Errorf("s3ds: bucketEncryption not a string")
 			}
 		}
+
 		var workers int
 		if v, ok := m["workers"]; ok {
 			workersf, ok := v.(float64)
@@ -104,33 +1121,646 @@ func (s3p S3Plugin) DatastoreConfigParser() fsrepo.ConfigFromMap {
 
 		return &S3Config{
 			cfg: s3ds.Config{
-				Region:         region,
-				Bucket:         bucket,
-				AccessKey:      accessKey,
-				SecretKey:      secretKey,
-				Endpoint:       endpoint,
-			//	SessionToken:   sessionToken,
-				RootDirectory:  rootDirectory,
-				Workers:        workers,
-			//	RegionEndpoint: endpoint,
+				Region:    region,
+				Bucket:    bucket,
+				AccessKey: accessKey,
+				SecretKey: secretKey,
+				Endpoint:  endpoint,
+				//	SessionToken:   sessionToken,
+				RootDirectory:         rootDirectory,
+				Workers:               workers,
+				KeyTransform:          keyTransform,
+				Provider:              provider,
+				Addressing:            addressing,
+				PartSize:              partSize,
+				MaxRetries:            maxRetries,
+				Prices:                prices,
+				NegativeCacheTTL:      negativeCacheTTL,
+				NegativeCacheSize:     negativeCacheSize,
+				WriteDedupWindow:      writeDedupWindow,
+				WriteDedupSize:        writeDedupSize,
+				Notifications:         notifications,
+				ChangeLogInterval:     changeLogInterval,
+				Checksums:             checksums,
+				VerifyOnRead:          verifyOnRead,
+				GCSCredentials:        gcsCredentials,
+				AzureAccount:          azureAccount,
+				AzureKey:              azureKey,
+				AzureClientID:         azureClientID,
+				ExistenceCheck:        existenceCheck,
+				FeatureFlags:          featureFlags,
+				FeatureFlagsRefresh:   featureFlagsRefresh,
+				WriteBehind:           writeBehind,
+				WriteBehindQueue:      writeBehindQueue,
+				PipelinedBatches:      pipelinedBatches,
+				MaxBatchOps:           maxBatchOps,
+				MaxBatchBytes:         maxBatchBytes,
+				ShutdownTimeout:       shutdownTimeout,
+				LeaseTTL:              leaseTTL,
+				SoftDelete:            softDelete,
+				Tombstones:            tombstones,
+				MaxBytes:              maxBytes,
+				MaxObjects:            maxObjects,
+				Lifecycle:             lifecycle,
+				StorageClass:          storageClass,
+				StorageClasses:        storageClasses,
+				Tiering:               tiering,
+				Chaos:                 chaos,
+				Breaker:               breaker,
+				SoftDeleteRetention:   softDeleteRetention,
+				HeatmapFile:           heatmapFile,
+				HeatmapInterval:       heatmapInterval,
+				HeatmapShard:          heatmapShard,
+				DigestInterval:        digestInterval,
+				DigestShard:           digestShard,
+				StatsAddr:             statsAddr,
+				StatsWindow:           statsWindow,
+				SyncVerify:            syncVerify,
+				SyncVerifyTimeout:     syncVerifyTimeout,
+				Compression:           compression,
+				CompressionLevel:      compressionLevel,
+				CodecNames:            codecNames,
+				Timeouts:              timeouts,
+				UploadRate:            uploadRate,
+				DownloadRate:          downloadRate,
+				ReadLimit:             readLimit,
+				WriteLimit:            writeLimit,
+				ListLimit:             listLimit,
+				AdaptiveConcurrency:   adaptiveConcurrency,
+				MinConcurrency:        minConcurrency,
+				CrashDumpFile:         crashDumpFile,
+				CrashDumpInterval:     crashDumpInterval,
+				CrashDumpToBucket:     crashDumpToBucket,
+				Transport:             transport,
+				LogPath:               logPath,
+				LogLevel:              logLevel,
+				LogLevels:             logLevels,
+				LogFormat:             logFormat,
+				SlowRequestThreshold:  slowRequestThreshold,
+				SnapshotManifest:      snapshotManifest,
+				Endpoints:             endpoints,
+				EndpointPolicy:        endpointPolicy,
+				SmallValueThreshold:   smallValueThreshold,
+				SmallValueAutoTune:    smallValueAutoTune,
+				Replica:               replica,
+				Gateways:              gateways,
+				GatewayTimeout:        gatewayTimeout,
+				Grants:                grants,
+				ReadOnly:              readOnly,
+				SkipExisting:          skipExisting,
+				SkipExistingCheck:     skipExistingCheck,
+				Packing:               packing,
+				PackSize:              packSize,
+				CompactInterval:       compactInterval,
+				CompactUtilization:    compactUtilization,
+				Tagging:               tagging,
+				TagLabels:             tagLabels,
+				Routes:                routes,
+				Tenants:               tenants,
+				AuditLog:              auditLog,
+				AuditToBucket:         auditToBucket,
+				AuditInterval:         auditInterval,
+				DryRun:                dryRun,
+				AutoDetectRegion:      autoDetectRegion,
+				CreateBucketIfMissing: createBucketIfMissing,
+				BucketVersioning:      bucketVersioning,
+				BucketEncryption:      bucketEncryption,
+				//	RegionEndpoint: endpoint,
 			},
 		}, nil
 	}
 }
 
+func parseOpLimit(v interface{}) (s3ds.OpLimit, error) {
+	var limit s3ds.OpLimit
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return limit, fmt.Errorf("not an object")
+	}
+	if v, ok := m["maxConcurrent"]; ok {
+		maxf, ok := v.(float64)
+		limit.MaxConcurrent = int(maxf)
+		switch {
+		case !ok:
+			return limit, fmt.Errorf("maxConcurrent not a number")
+		case limit.MaxConcurrent < 0:
+			return limit, fmt.Errorf("maxConcurrent < 0: %f", maxf)
+		case float64(limit.MaxConcurrent) != maxf:
+			return limit, fmt.Errorf("maxConcurrent is not an integer: %f", maxf)
+		}
+	}
+	if v, ok := m["perSecond"]; ok {
+		limit.PerSecond, ok = v.(float64)
+		switch {
+		case !ok:
+			return limit, fmt.Errorf("perSecond not a number")
+		case limit.PerSecond < 0:
+			return limit, fmt.Errorf("perSecond < 0: %f", limit.PerSecond)
+		}
+	}
+	return limit, nil
+}
+
+func parseTimeouts(v interface{}) (s3ds.OpTimeouts, error) {
+	var conf s3ds.OpTimeouts
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return conf, fmt.Errorf("not an object")
+	}
+	for name, dst := range map[string]*time.Duration{
+		"get":    &conf.Get,
+		"has":    &conf.Has,
+		"put":    &conf.Put,
+		"list":   &conf.List,
+		"delete": &conf.Delete,
+	} {
+		if v, ok := m[name]; ok {
+			d, ok := v.(string)
+			if !ok {
+				return conf, fmt.Errorf("%s not a string", name)
+			}
+			var err error
+			if *dst, err = time.ParseDuration(d); err != nil {
+				return conf, fmt.Errorf("%s: %s", name, err)
+			}
+		}
+	}
+	return conf, nil
+}
+
+func parseChaos(v interface{}) (s3ds.ChaosConfig, error) {
+	var conf s3ds.ChaosConfig
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return conf, fmt.Errorf("not an object")
+	}
+	if v, ok := m["latency"]; ok {
+		latency, ok := v.(string)
+		if !ok {
+			return conf, fmt.Errorf("latency not a string")
+		}
+		var err error
+		if conf.Latency, err = time.ParseDuration(latency); err != nil {
+			return conf, fmt.Errorf("latency: %s", err)
+		}
+	}
+	for name, dst := range map[string]*float64{
+		"latencyRate":  &conf.LatencyRate,
+		"throttleRate": &conf.ThrottleRate,
+		"failureRate":  &conf.FailureRate,
+		"truncateRate": &conf.TruncateRate,
+	} {
+		if v, ok := m[name]; ok {
+			if *dst, ok = v.(float64); !ok {
+				return conf, fmt.Errorf("%s not a number", name)
+			}
+		}
+	}
+	if v, ok := m["seed"]; ok {
+		seedf, ok := v.(float64)
+		conf.Seed = int64(seedf)
+		switch {
+		case !ok:
+			return conf, fmt.Errorf("seed not a number")
+		case float64(conf.Seed) != seedf:
+			return conf, fmt.Errorf("seed is not an integer: %f", seedf)
+		}
+	}
+	return conf, nil
+}
+
+func parseNotifications(v interface{}) (s3ds.NotificationConfig, error) {
+	var conf s3ds.NotificationConfig
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return conf, fmt.Errorf("not an object")
+	}
+	for name, dst := range map[string]*string{
+		"queue":     &conf.Queue,
+		"region":    &conf.Region,
+		"accessKey": &conf.AccessKey,
+		"secretKey": &conf.SecretKey,
+		"addr":      &conf.Addr,
+		"token":     &conf.Token,
+	} {
+		if v, ok := m[name]; ok {
+			if *dst, ok = v.(string); !ok {
+				return conf, fmt.Errorf("%s not a string", name)
+			}
+		}
+	}
+	return conf, nil
+}
+
+func parseBreaker(v interface{}) (s3ds.BreakerConfig, error) {
+	var conf s3ds.BreakerConfig
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return conf, fmt.Errorf("not an object")
+	}
+	v, ok = m["errorRate"]
+	if !ok {
+		return conf, fmt.Errorf("errorRate missing")
+	}
+	if conf.ErrorRate, ok = v.(float64); !ok {
+		return conf, fmt.Errorf("errorRate not a number")
+	}
+	for name, dst := range map[string]*time.Duration{
+		"slowCall": &conf.SlowCall,
+		"window":   &conf.Window,
+		"cooldown": &conf.Cooldown,
+	} {
+		if v, ok := m[name]; ok {
+			d, ok := v.(string)
+			if !ok {
+				return conf, fmt.Errorf("%s not a string", name)
+			}
+			var err error
+			if *dst, err = time.ParseDuration(d); err != nil {
+				return conf, fmt.Errorf("%s: %s", name, err)
+			}
+		}
+	}
+	for name, dst := range map[string]*int{
+		"minCalls": &conf.MinCalls,
+		"probes":   &conf.Probes,
+	} {
+		if v, ok := m[name]; ok {
+			nf, ok := v.(float64)
+			*dst = int(nf)
+			switch {
+			case !ok:
+				return conf, fmt.Errorf("%s not a number", name)
+			case float64(*dst) != nf:
+				return conf, fmt.Errorf("%s is not an integer: %f", name, nf)
+			}
+		}
+	}
+	return conf, nil
+}
+
+func parseTransport(v interface{}) (s3ds.TransportConfig, error) {
+	var conf s3ds.TransportConfig
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return conf, fmt.Errorf("not an object")
+	}
+	for name, dst := range map[string]*time.Duration{
+		"dialTimeout":           &conf.DialTimeout,
+		"responseHeaderTimeout": &conf.ResponseHeaderTimeout,
+		"idleConnTimeout":       &conf.IdleConnTimeout,
+		"resolveInterval":       &conf.ResolveInterval,
+	} {
+		if v, ok := m[name]; ok {
+			d, ok := v.(string)
+			if !ok {
+				return conf, fmt.Errorf("%s not a string", name)
+			}
+			var err error
+			if *dst, err = time.ParseDuration(d); err != nil {
+				return conf, fmt.Errorf("%s: %s", name, err)
+			}
+		}
+	}
+	if v, ok := m["maxIdleConns"]; ok {
+		maxf, ok := v.(float64)
+		conf.MaxIdleConns = int(maxf)
+		switch {
+		case !ok:
+			return conf, fmt.Errorf("maxIdleConns not a number")
+		case conf.MaxIdleConns <= 0:
+			return conf, fmt.Errorf("maxIdleConns <= 0: %f", maxf)
+		case float64(conf.MaxIdleConns) != maxf:
+			return conf, fmt.Errorf("maxIdleConns is not an integer: %f", maxf)
+		}
+	}
+	for name, dst := range map[string]*string{
+		"tlsMinVersion": &conf.TLSMinVersion,
+		"tlsCAFile":     &conf.TLSCAFile,
+		"tlsCertFile":   &conf.TLSCertFile,
+		"tlsKeyFile":    &conf.TLSKeyFile,
+		"proxy":         &conf.Proxy,
+	} {
+		if v, ok := m[name]; ok {
+			if *dst, ok = v.(string); !ok {
+				return conf, fmt.Errorf("%s not a string", name)
+			}
+		}
+	}
+	if v, ok := m["tlsInsecureSkipVerify"]; ok {
+		if conf.TLSInsecureSkipVerify, ok = v.(bool); !ok {
+			return conf, fmt.Errorf("tlsInsecureSkipVerify not a boolean")
+		}
+	}
+	return conf, nil
+}
+
 type S3Config struct {
 	cfg s3ds.Config
 }
 
+func parseReplica(v interface{}) (s3ds.ReplicaConfig, error) {
+	var conf s3ds.ReplicaConfig
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return conf, fmt.Errorf("not an object")
+	}
+	for name, dst := range map[string]*string{
+		"bucket":    &conf.Bucket,
+		"region":    &conf.Region,
+		"endpoint":  &conf.Endpoint,
+		"accessKey": &conf.AccessKey,
+		"secretKey": &conf.SecretKey,
+		"journal":   &conf.Journal,
+	} {
+		if v, ok := m[name]; ok {
+			if *dst, ok = v.(string); !ok {
+				return conf, fmt.Errorf("%s not a string", name)
+			}
+		}
+	}
+	if v, ok := m["async"]; ok {
+		if conf.Async, ok = v.(bool); !ok {
+			return conf, fmt.Errorf("async not a boolean")
+		}
+	}
+	if v, ok := m["repairInterval"]; ok {
+		interval, ok := v.(string)
+		if !ok {
+			return conf, fmt.Errorf("repairInterval not a string")
+		}
+		var err error
+		if conf.RepairInterval, err = time.ParseDuration(interval); err != nil {
+			return conf, fmt.Errorf("repairInterval: %s", err)
+		}
+	}
+	if v, ok := m["repairRate"]; ok {
+		ratef, ok := v.(float64)
+		conf.RepairRate = int(ratef)
+		switch {
+		case !ok:
+			return conf, fmt.Errorf("repairRate not a number")
+		case conf.RepairRate < 0:
+			return conf, fmt.Errorf("repairRate < 0: %f", ratef)
+		case float64(conf.RepairRate) != ratef:
+			return conf, fmt.Errorf("repairRate is not an integer: %f", ratef)
+		}
+	}
+	if v, ok := m["repairCompareETags"]; ok {
+		if conf.RepairCompareETags, ok = v.(bool); !ok {
+			return conf, fmt.Errorf("repairCompareETags not a boolean")
+		}
+	}
+	return conf, nil
+}
+
+// parseDays parses a whole, positive number of days.
+func parseDays(v interface{}, name string) (int, error) {
+	daysf, ok := v.(float64)
+	days := int(daysf)
+	switch {
+	case !ok:
+		return 0, fmt.Errorf("%s not a number", name)
+	case days <= 0:
+		return 0, fmt.Errorf("%s <= 0: %f", name, daysf)
+	case float64(days) != daysf:
+		return 0, fmt.Errorf("%s is not an integer: %f", name, daysf)
+	}
+	return days, nil
+}
+
+func parseLifecycle(v interface{}) (s3ds.LifecycleConfig, error) {
+	var conf s3ds.LifecycleConfig
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return conf, fmt.Errorf("not an object")
+	}
+	if v, ok := m["expirePrefixes"]; ok {
+		prefixes, ok := v.([]interface{})
+		if !ok {
+			return conf, fmt.Errorf("expirePrefixes not an array")
+		}
+		for _, p := range prefixes {
+			prefix, ok := p.(string)
+			if !ok {
+				return conf, fmt.Errorf("expirePrefixes entry not a string")
+			}
+			conf.ExpirePrefixes = append(conf.ExpirePrefixes, prefix)
+		}
+	}
+	for name, dst := range map[string]*int{
+		"expireDays":         &conf.ExpireDays,
+		"abortMultipartDays": &conf.AbortMultipartDays,
+	} {
+		if v, ok := m[name]; ok {
+			var err error
+			if *dst, err = parseDays(v, name); err != nil {
+				return conf, err
+			}
+		}
+	}
+	if v, ok := m["transitions"]; ok {
+		transitions, ok := v.([]interface{})
+		if !ok {
+			return conf, fmt.Errorf("transitions not an array")
+		}
+		for _, tv := range transitions {
+			tm, ok := tv.(map[string]interface{})
+			if !ok {
+				return conf, fmt.Errorf("transition not an object")
+			}
+			var t s3ds.LifecycleTransition
+			if t.Prefix, ok = tm["prefix"].(string); !ok {
+				return conf, fmt.Errorf("transition prefix not a string")
+			}
+			if t.StorageClass, ok = tm["storageClass"].(string); !ok {
+				return conf, fmt.Errorf("transition storageClass not a string")
+			}
+			var err error
+			if t.Days, err = parseDays(tm["days"], "transition days"); err != nil {
+				return conf, err
+			}
+			conf.Transitions = append(conf.Transitions, t)
+		}
+	}
+	return conf, nil
+}
+
+func parseTiering(v interface{}) (s3ds.TieringConfig, error) {
+	var conf s3ds.TieringConfig
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return conf, fmt.Errorf("not an object")
+	}
+	for name, dst := range map[string]*string{
+		"storageClass": &conf.StorageClass,
+		"bucket":       &conf.Bucket,
+		"stateFile":    &conf.StateFile,
+	} {
+		if v, ok := m[name]; ok {
+			if *dst, ok = v.(string); !ok {
+				return conf, fmt.Errorf("%s not a string", name)
+			}
+		}
+	}
+	for name, dst := range map[string]*time.Duration{
+		"coldAfter":   &conf.ColdAfter,
+		"interval":    &conf.Interval,
+		"restoreWait": &conf.RestoreWait,
+	} {
+		if v, ok := m[name]; ok {
+			d, ok := v.(string)
+			if !ok {
+				return conf, fmt.Errorf("%s not a string", name)
+			}
+			var err error
+			if *dst, err = time.ParseDuration(d); err != nil {
+				return conf, fmt.Errorf("%s: %s", name, err)
+			}
+		}
+	}
+	if v, ok := m["restoreDays"]; ok {
+		var err error
+		if conf.RestoreDays, err = parseDays(v, "restoreDays"); err != nil {
+			return conf, err
+		}
+	}
+	if v, ok := m["blocks"]; ok {
+		blocksf, ok := v.(float64)
+		conf.Blocks = int(blocksf)
+		switch {
+		case !ok:
+			return conf, fmt.Errorf("blocks not a number")
+		case conf.Blocks <= 0:
+			return conf, fmt.Errorf("blocks <= 0: %f", blocksf)
+		case float64(conf.Blocks) != blocksf:
+			return conf, fmt.Errorf("blocks is not an integer: %f", blocksf)
+		}
+	}
+	return conf, nil
+}
+
+func parseRoute(v interface{}) (s3ds.RouteConfig, error) {
+	var conf s3ds.RouteConfig
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return conf, fmt.Errorf("not an object")
+	}
+	for name, dst := range map[string]*string{
+		"bucket":        &conf.Bucket,
+		"rootDirectory": &conf.RootDirectory,
+		"region":        &conf.Region,
+		"endpoint":      &conf.Endpoint,
+		"accessKey":     &conf.AccessKey,
+		"secretKey":     &conf.SecretKey,
+	} {
+		if v, ok := m[name]; ok {
+			if *dst, ok = v.(string); !ok {
+				return conf, fmt.Errorf("%s not a string", name)
+			}
+		}
+	}
+	return conf, nil
+}
+
+func parseTenant(v interface{}) (s3ds.TenantConfig, error) {
+	var conf s3ds.TenantConfig
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return conf, fmt.Errorf("not an object")
+	}
+	if conf.RootDirectory, ok = m["rootDirectory"].(string); !ok || conf.RootDirectory == "" {
+		return conf, fmt.Errorf("rootDirectory not a string")
+	}
+	for name, dst := range map[string]*string{
+		"accessKey": &conf.AccessKey,
+		"secretKey": &conf.SecretKey,
+	} {
+		if v, ok := m[name]; ok {
+			if *dst, ok = v.(string); !ok {
+				return conf, fmt.Errorf("%s not a string", name)
+			}
+		}
+	}
+	if v, ok := m["readOnly"]; ok {
+		if conf.ReadOnly, ok = v.(bool); !ok {
+			return conf, fmt.Errorf("readOnly not a boolean")
+		}
+	}
+	for name, dst := range map[string]*int64{
+		"maxBytes":   &conf.MaxBytes,
+		"maxObjects": &conf.MaxObjects,
+	} {
+		if v, ok := m[name]; ok {
+			nf, ok := v.(float64)
+			*dst = int64(nf)
+			switch {
+			case !ok:
+				return conf, fmt.Errorf("%s not a number", name)
+			case *dst <= 0:
+				return conf, fmt.Errorf("%s <= 0: %f", name, nf)
+			case float64(*dst) != nf:
+				return conf, fmt.Errorf("%s is not an integer: %f", name, nf)
+			}
+		}
+	}
+	return conf, nil
+}
+
+// parseEndpoint accepts a URL or an object with url and weight.
+func parseEndpoint(v interface{}) (s3ds.EndpointConfig, error) {
+	var conf s3ds.EndpointConfig
+	if u, ok := v.(string); ok {
+		conf.URL = u
+		return conf, nil
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return conf, fmt.Errorf("not a string or object")
+	}
+	if conf.URL, ok = m["url"].(string); !ok || conf.URL == "" {
+		return conf, fmt.Errorf("url not a string")
+	}
+	if v, ok := m["weight"]; ok {
+		weightf, ok := v.(float64)
+		conf.Weight = int(weightf)
+		switch {
+		case !ok:
+			return conf, fmt.Errorf("weight not a number")
+		case conf.Weight <= 0:
+			return conf, fmt.Errorf("weight <= 0: %f", weightf)
+		case float64(conf.Weight) != weightf:
+			return conf, fmt.Errorf("weight is not an integer: %f", weightf)
+		}
+	}
+	return conf, nil
+}
+
 func (s3c *S3Config) DiskSpec() fsrepo.DiskSpec {
-	return fsrepo.DiskSpec{
+	spec := fsrepo.DiskSpec{
 		"bucket":        s3c.cfg.Bucket,
 		"region":        s3c.cfg.Region,
-        "endpoint":      s3c.cfg.Endpoint,
+		"endpoint":      s3c.cfg.Endpoint,
 		"rootDirectory": s3c.cfg.RootDirectory,
 	}
+	// The key layout changes where objects live, so it is part of the spec,
+	// but only when set so existing repos keep their datastore_spec.
+	if s3c.cfg.KeyTransform != "" {
+		spec["keyTransform"] = s3c.cfg.KeyTransform
+	}
+	if len(s3c.cfg.Routes) > 0 {
+		routes := make(map[string]interface{}, len(s3c.cfg.Routes))
+		for prefix, rc := range s3c.cfg.Routes {
+			routes[prefix] = map[string]interface{}{
+				"bucket":        rc.Bucket,
+				"rootDirectory": rc.RootDirectory,
+			}
+		}
+		spec["routes"] = routes
+	}
+	return spec
 }
 
 func (s3c *S3Config) Create(path string) (repo.Datastore, error) {
-	return s3ds.NewS3Datastore(s3c.cfg)
+	return s3ds.New(s3c.cfg)
 }
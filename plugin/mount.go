@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/ipfs/kubo/plugin"
+	"github.com/ipfs/kubo/repo/fsrepo"
+)
+
+var _ plugin.PluginDatastore = (*S3MountPlugin)(nil)
+
+// S3MountPlugin provides the usual split of a repo between the bucket and
+// local disk: blocks go to s3ds, everything else (pins, MFS root, DHT
+// records) to a local store. The spec
+//
+//	{
+//	  "type": "s3ds-mount",
+//	  "s3": { ...s3ds spec without "type"... },
+//	  "local": { ...any datastore spec... },
+//	  "mountpoint": "/blocks"
+//	}
+//
+// is expanded into the equivalent mount spec, so the datastore_spec it
+// writes is the same as that of a hand-written one and a repo can switch
+// between the two. "local" defaults to leveldb in the repo's "datastore"
+// directory and "mountpoint" to "/blocks".
+type S3MountPlugin struct{}
+
+func (S3MountPlugin) Name() string {
+	return "s3-mount-datastore-plugin"
+}
+
+func (S3MountPlugin) Version() string {
+	return "0.0.1"
+}
+
+func (S3MountPlugin) Init(env *plugin.Environment) error {
+	return nil
+}
+
+var MountDatastoreType = "s3ds-mount"
+
+func (S3MountPlugin) DatastoreTypeName() string {
+	return MountDatastoreType
+}
+
+func (S3MountPlugin) DatastoreConfigParser() fsrepo.ConfigFromMap {
+	return func(m map[string]interface{}) (fsrepo.DatastoreConfig, error) {
+		spec, err := mountSpec(m)
+		if err != nil {
+			return nil, err
+		}
+		return fsrepo.AnyDatastoreConfig(spec)
+	}
+}
+
+// mountSpec expands an s3ds-mount spec into a mount spec.
+func mountSpec(m map[string]interface{}) (map[string]interface{}, error) {
+	s3spec, ok := m["s3"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("s3ds: no s3 spec specified")
+	}
+	child := make(map[string]interface{}, len(s3spec)+1)
+	for k, v := range s3spec {
+		child[k] = v
+	}
+	child["type"] = DatastoreType
+
+	mountpoint := "/blocks"
+	if v, ok := m["mountpoint"]; ok {
+		if mountpoint, ok = v.(string); !ok {
+			return nil, fmt.Errorf("s3ds: mountpoint is not a string")
+		}
+		if mountpoint == "" || mountpoint == "/" || mountpoint[0] != '/' {
+			return nil, fmt.Errorf("s3ds: mountpoint must be a key namespace such as /blocks, got %q", mountpoint)
+		}
+	}
+
+	local := map[string]interface{}{
+		"type":   "measure",
+		"prefix": "leveldb.datastore",
+		"child": map[string]interface{}{
+			"type":        "levelds",
+			"path":        "datastore",
+			"compression": "none",
+		},
+	}
+	if v, ok := m["local"]; ok {
+		if local, ok = v.(map[string]interface{}); !ok {
+			return nil, fmt.Errorf("s3ds: local is not a datastore spec")
+		}
+		if _, ok := local["type"].(string); !ok {
+			return nil, fmt.Errorf("s3ds: local has no type")
+		}
+	}
+
+	withMountpoint := func(spec map[string]interface{}, mountpoint string) map[string]interface{} {
+		out := make(map[string]interface{}, len(spec)+1)
+		for k, v := range spec {
+			out[k] = v
+		}
+		out["mountpoint"] = mountpoint
+		return out
+	}
+	return map[string]interface{}{
+		"type": "mount",
+		"mounts": []interface{}{
+			withMountpoint(map[string]interface{}{
+				"type":   "measure",
+				"prefix": "s3.datastore",
+				"child":  child,
+			}, mountpoint),
+			withMountpoint(local, "/"),
+		},
+	}, nil
+}
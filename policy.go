@@ -0,0 +1,270 @@
+package s3
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// IAMPolicy is an IAM policy document, as returned by ScopedPolicy.
+// Marshalled to JSON it can be attached to a user or role as is.
+type IAMPolicy struct {
+	Version   string         `json:"Version"`
+	Statement []IAMStatement `json:"Statement"`
+}
+
+// IAMStatement is a statement of an IAMPolicy.
+type IAMStatement struct {
+	Sid       string                         `json:"Sid,omitempty"`
+	Effect    string                         `json:"Effect"`
+	Action    []string                       `json:"Action"`
+	Resource  []string                       `json:"Resource"`
+	Condition map[string]map[string][]string `json:"Condition,omitempty"`
+}
+
+// policyScope is a bucket and root directory the datastore reaches with
+// its own credentials.
+type policyScope struct {
+	bucket string
+	root   string
+}
+
+// ScopedPolicy returns the smallest IAM policy that lets a datastore
+// opened with conf do everything it is configured to: the actions it
+// calls, on the objects under RootDirectory and on listings of them only.
+// Routes, replicas and a tiering bucket reached with the same credentials
+// are included; those with credentials of their own need policies of
+// their own, as do tenants.
+func ScopedPolicy(conf Config) (IAMPolicy, error) {
+	switch conf.Provider {
+	case providerGCS, providerAzure:
+		return IAMPolicy{}, fmt.Errorf("s3ds: no IAM policy for provider %s", conf.Provider)
+	}
+	if conf.Bucket == "" {
+		return IAMPolicy{}, fmt.Errorf("s3ds: missing bucket")
+	}
+	profile := providerProfiles[conf.Provider]
+	write := !conf.ReadOnly
+
+	objectActions := []string{"s3:GetObject"}
+	bucketActions := []string{"s3:ListBucket"}
+	if write {
+		objectActions = append(objectActions, "s3:PutObject", "s3:DeleteObject", "s3:AbortMultipartUpload")
+		if conf.Tagging {
+			objectActions = append(objectActions, "s3:PutObjectTagging")
+		}
+		if !conf.Grants.empty() {
+			objectActions = append(objectActions, "s3:PutObjectAcl")
+		}
+		if conf.Tiering != nil {
+			objectActions = append(objectActions, "s3:RestoreObject")
+		}
+	}
+	if conf.SoftDelete || conf.SnapshotManifest != "" || profile.deleteVersions {
+		objectActions = append(objectActions, "s3:GetObjectVersion")
+		bucketActions = append(bucketActions, "s3:ListBucketVersions", "s3:GetBucketVersioning")
+		if write {
+			objectActions = append(objectActions, "s3:DeleteObjectVersion")
+		}
+	}
+
+	// Bucket settings are applied to the datastore's own bucket on open.
+	var setupActions []string
+	if write && !conf.DryRun {
+		if conf.Lifecycle != nil {
+			setupActions = append(setupActions, "s3:GetLifecycleConfiguration", "s3:PutLifecycleConfiguration")
+		}
+		if conf.CreateBucketIfMissing {
+			setupActions = append(setupActions, "s3:CreateBucket")
+		}
+		if conf.BucketVersioning {
+			setupActions = append(setupActions, "s3:PutBucketVersioning")
+		}
+		if conf.BucketEncryption != "" {
+			setupActions = append(setupActions, "s3:PutEncryptionConfiguration")
+		}
+	}
+
+	scopes := []policyScope{{bucket: conf.Bucket, root: conf.RootDirectory}}
+	for _, prefix := range sortedRoutes(conf.Routes) {
+		rc := conf.Routes[prefix]
+		if rc.AccessKey != "" {
+			continue
+		}
+		sc := policyScope{bucket: conf.Bucket, root: conf.RootDirectory}
+		if rc.Bucket != "" {
+			sc.bucket = rc.Bucket
+		}
+		if rc.RootDirectory != "" {
+			sc.root = rc.RootDirectory
+		}
+		scopes = append(scopes, sc)
+	}
+	if conf.Replica != nil && conf.Replica.AccessKey == "" && conf.Replica.Bucket != "" {
+		scopes = append(scopes, policyScope{bucket: conf.Replica.Bucket, root: conf.RootDirectory})
+	}
+	if conf.Tiering != nil && conf.Tiering.Bucket != "" {
+		scopes = append(scopes, policyScope{bucket: conf.Tiering.Bucket, root: conf.RootDirectory})
+	}
+
+	var objects, buckets []string
+	listPrefixes := make(map[string][]string)
+	for _, sc := range scopes {
+		root := cleanRoot(sc.root)
+		objects = appendUnique(objects, objectARN(sc.bucket, root))
+		if _, ok := listPrefixes[sc.bucket]; !ok {
+			buckets = append(buckets, sc.bucket)
+		}
+		if root == "" {
+			// Listing the whole bucket needs no condition.
+			listPrefixes[sc.bucket] = appendUnique(listPrefixes[sc.bucket], "")
+			continue
+		}
+		// Listings of the root directory itself use it without a
+		// trailing slash.
+		listPrefixes[sc.bucket] = appendUnique(listPrefixes[sc.bucket], root, root+"/*")
+	}
+
+	policy := IAMPolicy{Version: "2012-10-17"}
+	policy.Statement = append(policy.Statement, IAMStatement{
+		Sid:      "S3dsObjects",
+		Effect:   "Allow",
+		Action:   objectActions,
+		Resource: objects,
+	})
+	for i, bucket := range buckets {
+		st := IAMStatement{
+			Sid:      fmt.Sprintf("S3dsList%d", i),
+			Effect:   "Allow",
+			Action:   bucketActions,
+			Resource: []string{bucketARN(bucket)},
+		}
+		if prefixes := listPrefixes[bucket]; !containsString(prefixes, "") {
+			st.Condition = map[string]map[string][]string{
+				"StringLike": {"s3:prefix": prefixes},
+			}
+		}
+		policy.Statement = append(policy.Statement, st)
+	}
+	if len(setupActions) > 0 {
+		policy.Statement = append(policy.Statement, IAMStatement{
+			Sid:      "S3dsBucketSetup",
+			Effect:   "Allow",
+			Action:   setupActions,
+			Resource: []string{bucketARN(conf.Bucket)},
+		})
+	}
+	return policy, nil
+}
+
+// StorjShare restricts the access grant of a StorjShareCommand.
+type StorjShare struct {
+	// Prefix limits the grant to the keys under this datastore prefix,
+	// taken as a whole namespace. Defaults to every key.
+	Prefix string
+
+	// ReadOnly allows downloads and listings only.
+	ReadOnly bool
+
+	// NotAfter, if set, is when the grant expires.
+	NotAfter time.Time
+}
+
+// StorjShareCommand returns the uplink command that creates an access
+// grant, and the gateway credentials for it, limited to the objects of a
+// datastore opened with conf.
+func StorjShareCommand(conf Config) (string, error) {
+	return RestrictedStorjShareCommandLine(conf, StorjShare{ReadOnly: conf.ReadOnly})
+}
+
+// RestrictedStorjShareCommandLine is StorjShareCommand for a grant further
+// restricted by share, e.g. to hand out read-only access to a namespace
+// for a day. It only prints the command, quoted for a POSIX shell: the
+// grant is derived when uplink runs it, from the access uplink is set up
+// with, as there is no uplink library here to derive it in-process.
+func RestrictedStorjShareCommandLine(conf Config, share StorjShare) (string, error) {
+	if conf.Bucket == "" {
+		return "", fmt.Errorf("s3ds: missing bucket")
+	}
+	keys, err := newKeyTransform(conf.KeyTransform)
+	if err != nil {
+		return "", err
+	}
+	prefix := ds.NewKey(share.Prefix).String()
+	listPrefix, filter := keys.listPrefix(prefix)
+	if filter {
+		return "", fmt.Errorf("s3ds: the %s key layout does not keep %s under one prefix", conf.KeyTransform, prefix)
+	}
+
+	objPrefix := cleanRoot(path.Join(conf.RootDirectory, listPrefix))
+	if conf.ReadOnly {
+		share.ReadOnly = true
+	}
+	args := []string{"uplink", "share", "--register", "--readonly=" + strconv.FormatBool(share.ReadOnly)}
+	if !share.NotAfter.IsZero() {
+		args = append(args, "--not-after="+share.NotAfter.UTC().Format(time.RFC3339))
+	}
+	target := "sj://" + conf.Bucket + "/"
+	if objPrefix != "" {
+		target += objPrefix + "/"
+	}
+	args = append(args, target)
+	for i, arg := range args {
+		args[i] = shellQuote(arg)
+	}
+	return strings.Join(args, " "), nil
+}
+
+// shellQuote quotes s for a POSIX shell, unless it needs none.
+func shellQuote(s string) string {
+	if s != "" && strings.Trim(s, shellSafe) == "" {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+const shellSafe = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_-.,/:=@%+"
+
+func bucketARN(bucket string) string {
+	return "arn:aws:s3:::" + bucket
+}
+
+func objectARN(bucket, root string) string {
+	if root == "" {
+		return bucketARN(bucket) + "/*"
+	}
+	return bucketARN(bucket) + "/" + root + "/*"
+}
+
+func sortedRoutes(routes map[string]RouteConfig) []string {
+	prefixes := make([]string, 0, len(routes))
+	for prefix := range routes {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	return prefixes
+}
+
+// appendUnique appends the strings not in list yet.
+func appendUnique(list []string, strs ...string) []string {
+	for _, s := range strs {
+		if !containsString(list, s) {
+			list = append(list, s)
+		}
+	}
+	return list
+}
+
+func containsString(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,35 @@
+package s3_test
+
+import (
+	"testing"
+
+	s3ds "github.com/ipfs-s3c-storj-plugin"
+)
+
+// TestStorjShareCommandQuoting checks that prefixes a shell would split or
+// interpret reach uplink as one argument.
+func TestStorjShareCommandQuoting(t *testing.T) {
+	conf := s3ds.Config{Bucket: "ipfs", RootDirectory: "node 1"}
+	for prefix, want := range map[string]string{
+		"/pins":     "uplink share --register --readonly=true 'sj://ipfs/node 1/pins/'",
+		"/my pins":  "uplink share --register --readonly=true 'sj://ipfs/node 1/my pins/'",
+		"/it's":     `uplink share --register --readonly=true 'sj://ipfs/node 1/it'\''s/'`,
+		"/$(rm -r)": "uplink share --register --readonly=true 'sj://ipfs/node 1/$(rm -r)/'",
+	} {
+		cmd, err := s3ds.RestrictedStorjShareCommandLine(conf, s3ds.StorjShare{Prefix: prefix, ReadOnly: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cmd != want {
+			t.Errorf("prefix %q: got %s, want %s", prefix, cmd, want)
+		}
+	}
+
+	cmd, err := s3ds.StorjShareCommand(s3ds.Config{Bucket: "ipfs", RootDirectory: "node1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "uplink share --register --readonly=false sj://ipfs/node1/"; cmd != want {
+		t.Errorf("got %s, want %s", cmd, want)
+	}
+}
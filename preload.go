@@ -0,0 +1,72 @@
+package s3
+
+import (
+	"context"
+	"sync"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// PreloadResult counts the keys Preload read.
+type PreloadResult struct {
+	Loaded  int
+	Missing int
+
+	// Archived keys are being restored, which did not finish within
+	// Tiering.RestoreWait. They are readable once it has.
+	Archived int
+}
+
+// Preload reads keys ahead of the requests for them, with up to Workers
+// reads in flight, so that content is quick to serve once announced:
+// blocks moved to cold storage by tiering are moved back, archived ones
+// are restored, keys cached as missing are looked up again, and caches in
+// front of the bucket, such as a CDN or the edge of Storj's gateway, see
+// the reads. The datastore keeps no copy of values itself.
+//
+// Missing and archived keys are counted, not errors. Any other error
+// stops the preload and is returned with the counts so far.
+func (s *S3Bucket) Preload(ctx context.Context, keys []ds.Key) (PreloadResult, error) {
+	var (
+		mu  sync.Mutex
+		res PreloadResult
+	)
+	err := forEach(ctx, len(keys), s.Workers, func(ctx context.Context, i int) error {
+		k := keys[i]
+		s.route(k).forgetMissing(k)
+		_, err := s.Get(ctx, k)
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case err == nil:
+			res.Loaded++
+		case err == ds.ErrNotFound:
+			res.Missing++
+		case ErrorClass(err) == ErrArchived:
+			res.Archived++
+		default:
+			return err
+		}
+		return nil
+	})
+	return res, err
+}
+
+// PreloadPrefix is Preload of every key under prefix. As with Keys, a
+// listing error is logged and ends the list of keys early.
+func (s *S3Bucket) PreloadPrefix(ctx context.Context, prefix string) (PreloadResult, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	ch, err := s.Keys(ctx, prefix)
+	if err != nil {
+		return PreloadResult{}, err
+	}
+	var keys []ds.Key
+	for k := range ch {
+		keys = append(keys, k)
+	}
+	if err := ctx.Err(); err != nil {
+		return PreloadResult{}, err
+	}
+	return s.Preload(ctx, keys)
+}
@@ -0,0 +1,62 @@
+package s3
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	ds "github.com/ipfs/go-datastore"
+)
+
+// maxPresignExpiry is the longest validity SigV4 allows a presigned URL.
+const maxPresignExpiry = 7 * 24 * time.Hour
+
+// PresignGet returns a URL from which anyone can download the value of k
+// until expiry has passed, so that an HTTP gateway can redirect clients to
+// the bucket instead of serving large blocks itself. It checks that k
+// exists with a HEAD request first, and fails for values the URL would
+// not serve as they are: compressed or packed ones.
+func (s *S3Bucket) PresignGet(ctx context.Context, k ds.Key, expiry time.Duration) (string, error) {
+	if r := s.route(k); r != s {
+		return r.PresignGet(ctx, k, expiry)
+	}
+	if err := s.needS3(); err != nil {
+		return "", err
+	}
+	if expiry <= 0 || expiry > maxPresignExpiry {
+		return "", fmt.Errorf("s3ds: presigned URL expiry %s not within 7 days", expiry)
+	}
+	if s.packs != nil {
+		if _, ok := s.packs.lookup(k); ok {
+			return "", fmt.Errorf("s3ds: %s is packed and has no object of its own", k)
+		}
+	}
+
+	bucket := s.Bucket
+	name := s.s3Path(k)
+	info, err := s.store.Head(ctx, name)
+	if err == ds.ErrNotFound && s.tiering != nil && s.tiering.elsewhere(k) {
+		bucket = s.tiering.conf.Bucket
+		info, err = s.tiering.head(ctx, k)
+	}
+	if err != nil {
+		return "", err
+	}
+	if encoding := info.Metadata[metaEncoding]; encoding != "" {
+		return "", fmt.Errorf("s3ds: %s is stored with encoding %s", k, encoding)
+	}
+	if codecs := info.Metadata[metaCodecs]; codecs != "" {
+		return "", fmt.Errorf("s3ds: %s is stored with codecs %s", k, codecs)
+	}
+
+	url, err := s.S3.PresignGetObject(&s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(name),
+	}, expiry)
+	if err != nil {
+		return "", fmt.Errorf("s3ds: presigning %s: %s", k, err)
+	}
+	return url, nil
+}
@@ -0,0 +1,219 @@
+package s3
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// ExistenceCheckHead answers Has with a HeadObject request.
+	ExistenceCheckHead = "head"
+
+	// ExistenceCheckList answers Has with a ListObjectsV2 request for at
+	// most one key, using the exact object name as prefix. Some gateways
+	// serve listings from their metadata index while HEAD has to resolve
+	// the object itself, or return stale results for HEAD after a write.
+	ExistenceCheckList = "list"
+
+	// AddressingPath names the bucket in the first component of the
+	// request path: https://endpoint/bucket/key.
+	AddressingPath = "path"
+
+	// AddressingVirtualHosted names the bucket in the host name:
+	// https://bucket.endpoint/key.
+	AddressingVirtualHosted = "virtual-hosted"
+)
+
+// providerProfile collects the per-provider defaults applied when the
+// corresponding Config field is left empty, and the quirks of its object
+// store.
+type providerProfile struct {
+	existenceCheck    string
+	skipExistingCheck string
+
+	// endpoint is the gateway's URL, with {region} standing for Region.
+	endpoint string
+	region   string
+
+	// resolveInterval is the default of Transport.ResolveInterval.
+	resolveInterval time.Duration
+
+	// virtualHosted addresses the bucket as a subdomain of the endpoint
+	// instead of the first path component, unless Addressing says
+	// otherwise.
+	virtualHosted bool
+
+	// partSize splits larger uploads into multipart uploads, in parts no
+	// smaller than minPartSize.
+	partSize    int
+	minPartSize int
+
+	// segmentSize is the size of the segments the gateway stores objects
+	// in. PartSize is rounded up to a multiple of it, and uploads are
+	// counted in segments for Stats.
+	segmentSize int
+
+	maxRetries int
+
+	// sha256Checksums means the gateway stores x-amz-checksum-sha256.
+	sha256Checksums bool
+
+	// deleteVersions removes all versions of deleted objects.
+	deleteVersions bool
+
+	// prices are the list prices in USD, for Costs.
+	prices PriceTable
+}
+
+const (
+	// storjSegmentSize is the segment size of Storj gateways.
+	storjSegmentSize = 64 << 20
+
+	// s3MinPartSize is the smallest part S3 accepts in a multipart upload,
+	// except for the last.
+	s3MinPartSize = 5 << 20
+)
+
+var providerProfiles = map[string]providerProfile{
+	"": {
+		existenceCheck:    ExistenceCheckHead,
+		skipExistingCheck: SkipExistingHas,
+		region:            "us-east-1",
+		minPartSize:       s3MinPartSize,
+		maxRetries:        defaultMaxRetries,
+	},
+	"aws": {
+		existenceCheck:    ExistenceCheckHead,
+		skipExistingCheck: SkipExistingConditional,
+		region:            "us-east-1",
+		virtualHosted:     true,
+		minPartSize:       s3MinPartSize,
+		maxRetries:        defaultMaxRetries,
+		sha256Checksums:   true,
+		// S3 Standard in us-east-1.
+		prices: PriceTable{PutPer1000: 0.005, GetPer1000: 0.0004, ListPer1000: 0.005, EgressPerGB: 0.09},
+	},
+	"minio": {
+		existenceCheck:    ExistenceCheckHead,
+		skipExistingCheck: SkipExistingConditional,
+		region:            "us-east-1",
+		minPartSize:       s3MinPartSize,
+		maxRetries:        defaultMaxRetries,
+		sha256Checksums:   true,
+	},
+	"b2": {
+		existenceCheck:    ExistenceCheckHead,
+		skipExistingCheck: SkipExistingHas,
+		endpoint:          "https://s3.{region}.backblazeb2.com",
+		minPartSize:       s3MinPartSize,
+		// B2 answers 503 whenever a storage pod is busy and expects the
+		// client to retry.
+		maxRetries:     5,
+		deleteVersions: true,
+		// Egress is free up to three times the stored data; this assumes
+		// the node serves more.
+		prices: PriceTable{GetPer1000: 0.0004, ListPer1000: 0.004, EgressPerGB: 0.01},
+	},
+	"wasabi": {
+		existenceCheck:    ExistenceCheckHead,
+		skipExistingCheck: SkipExistingHas,
+		endpoint:          "https://s3.{region}.wasabisys.com",
+		region:            "us-east-1",
+		minPartSize:       s3MinPartSize,
+		maxRetries:        defaultMaxRetries,
+	},
+	"filebase": {
+		existenceCheck:    ExistenceCheckHead,
+		skipExistingCheck: SkipExistingHas,
+		endpoint:          "https://s3.filebase.com",
+		region:            "us-east-1",
+		minPartSize:       s3MinPartSize,
+		// Uploads are pinned to IPFS before they are acknowledged and
+		// time out more often than on other gateways.
+		maxRetries: 5,
+		prices:     PriceTable{EgressPerGB: 0.0059},
+	},
+	"storj": {
+		existenceCheck:    ExistenceCheckList,
+		skipExistingCheck: SkipExistingHas,
+		endpoint:          "https://gateway.storjshare.io",
+		region:            "us-1",
+		partSize:          storjSegmentSize,
+		minPartSize:       s3MinPartSize,
+		segmentSize:       storjSegmentSize,
+		maxRetries:        5,
+		resolveInterval:   time.Minute,
+		prices:            PriceTable{EgressPerGB: 0.007},
+	},
+
+	providerGCS:   {existenceCheck: ExistenceCheckHead, skipExistingCheck: SkipExistingConditional},
+	providerAzure: {existenceCheck: ExistenceCheckHead, skipExistingCheck: SkipExistingConditional},
+}
+
+// applyProvider fills in the defaults of conf.Provider.
+func applyProvider(conf *Config) error {
+	profile, ok := providerProfiles[conf.Provider]
+	if !ok {
+		return fmt.Errorf("s3ds: unknown provider %q", conf.Provider)
+	}
+
+	if conf.ExistenceCheck == "" {
+		conf.ExistenceCheck = profile.existenceCheck
+	}
+	switch conf.ExistenceCheck {
+	case ExistenceCheckHead, ExistenceCheckList:
+	default:
+		return fmt.Errorf("s3ds: unknown existence check %q", conf.ExistenceCheck)
+	}
+
+	if conf.SkipExistingCheck == "" {
+		conf.SkipExistingCheck = profile.skipExistingCheck
+	}
+	switch conf.SkipExistingCheck {
+	case SkipExistingHas, SkipExistingConditional:
+	default:
+		return fmt.Errorf("s3ds: unknown skip existing check %q", conf.SkipExistingCheck)
+	}
+
+	if conf.Addressing == "" {
+		conf.Addressing = AddressingPath
+		if profile.virtualHosted {
+			conf.Addressing = AddressingVirtualHosted
+		}
+	}
+	switch conf.Addressing {
+	case AddressingPath, AddressingVirtualHosted:
+	default:
+		return fmt.Errorf("s3ds: unknown addressing %q", conf.Addressing)
+	}
+
+	if conf.Region == "" {
+		conf.Region = profile.region
+	}
+	if conf.Endpoint == "" && len(conf.Endpoints) == 0 && profile.endpoint != "" {
+		if strings.Contains(profile.endpoint, "{region}") && conf.Region == "" {
+			return fmt.Errorf("s3ds: provider %s requires a region", conf.Provider)
+		}
+		conf.Endpoint = strings.ReplaceAll(profile.endpoint, "{region}", conf.Region)
+	}
+	if conf.PartSize == 0 {
+		conf.PartSize = profile.partSize
+	}
+	if profile.segmentSize > 0 && conf.PartSize%profile.segmentSize != 0 {
+		// Every part starts a segment of its own, so a part that is not
+		// a multiple of the segment size leaves one partly filled.
+		conf.PartSize += profile.segmentSize - conf.PartSize%profile.segmentSize
+	}
+	if conf.PartSize != 0 && conf.PartSize < profile.minPartSize {
+		return fmt.Errorf("s3ds: partSize %d is below the minimum of %d for provider %q", conf.PartSize, profile.minPartSize, conf.Provider)
+	}
+	if conf.MaxRetries == 0 {
+		conf.MaxRetries = profile.maxRetries
+	}
+	if conf.Transport.ResolveInterval == 0 {
+		conf.Transport.ResolveInterval = profile.resolveInterval
+	}
+
+	return nil
+}
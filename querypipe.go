@@ -0,0 +1,93 @@
+package s3
+
+import (
+	"context"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+// pendingValue is a query entry whose value is being fetched.
+type pendingValue struct {
+	res  dsq.Result
+	done chan struct{}
+}
+
+// pipelineValues fills in the values of the entries returned by keys,
+// fetching up to workers of them at a time ahead of the caller while
+// returning them in order. A query over thousands of blocks then takes a
+// fraction of the round trips one Get after another would. The first error
+// ends the results.
+func pipelineValues(ctx context.Context, keys func() (dsq.Result, bool), get func(context.Context, ds.Key) ([]byte, error), workers int) dsq.Iterator {
+	if workers <= 0 {
+		workers = 1
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	out := make(chan *pendingValue, workers)
+	sem := make(chan struct{}, workers)
+
+	go func() {
+		defer close(out)
+		for {
+			res, ok := keys()
+			if !ok && res.Error == nil {
+				return
+			}
+			p := &pendingValue{res: res, done: make(chan struct{})}
+			if res.Error != nil {
+				close(p.done)
+			} else {
+				select {
+				case sem <- struct{}{}:
+				case <-ctx.Done():
+					return
+				}
+				go func() {
+					defer func() { <-sem }()
+					defer close(p.done)
+					value, err := get(ctx, ds.NewKey(p.res.Key))
+					if err != nil {
+						p.res = dsq.Result{Error: err}
+						return
+					}
+					p.res.Value, p.res.Size = value, len(value)
+				}()
+			}
+			select {
+			case out <- p:
+			case <-ctx.Done():
+				return
+			}
+			if res.Error != nil {
+				return
+			}
+		}
+	}()
+
+	failed := false
+	return dsq.Iterator{
+		Next: func() (dsq.Result, bool) {
+			if failed {
+				return dsq.Result{}, false
+			}
+			p, ok := <-out
+			if !ok {
+				if err := ctx.Err(); err != nil {
+					failed = true
+					return dsq.Result{Error: err}, true
+				}
+				return dsq.Result{}, false
+			}
+			<-p.done
+			if p.res.Error != nil {
+				failed = true
+				cancel()
+			}
+			return p.res, true
+		},
+		Close: func() error {
+			cancel()
+			return nil
+		},
+	}
+}
@@ -0,0 +1,326 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrQuotaExceeded is returned by writes that would take the objects under
+// the root directory past MaxBytes or MaxObjects.
+var ErrQuotaExceeded = errors.New("s3ds: quota exceeded")
+
+// quotaRecountAge is how old the count of usage has to be before a write
+// refused by the quota has it counted again.
+const quotaRecountAge = time.Minute
+
+// quotaRetry is how long the first count of usage waits after a failure.
+const quotaRetry = 10 * time.Second
+
+// QuotaStats is the usage of the root directory as counted against
+// MaxBytes and MaxObjects.
+type QuotaStats struct {
+	Bytes      int64 `json:"bytes"`
+	Objects    int64 `json:"objects"`
+	MaxBytes   int64 `json:"maxBytes,omitempty"`
+	MaxObjects int64 `json:"maxObjects,omitempty"`
+
+	// Counted is when the objects were last listed, zero until the first
+	// listing is done.
+	Counted time.Time `json:"counted"`
+}
+
+// quota tracks the usage of the root directory. It is seeded by listing
+// the root directory, which uploads wait for, and every upload and delete
+// is added to it since.
+// Uploads replacing an object are only accounted for by the next listing,
+// so usage errs on the high side: once a write would exceed the quota and
+// the last listing is older than quotaRecountAge, the write is refused and
+// the root directory listed again in the background. The datastore's
+// metadata, other than packs, does not count.
+type quota struct {
+	store      ObjectStore
+	prefix     string
+	meta       string
+	maxBytes   int64
+	maxObjects int64
+	log        *subLogger
+
+	// ready is closed once usage was first counted.
+	ready chan struct{}
+
+	mu       sync.Mutex
+	bytes    int64
+	objects  int64
+	counted  time.Time
+	counting bool
+
+	// pendingBytes and pendingObjects are the uploads since the listing
+	// in progress started.
+	pendingBytes   int64
+	pendingObjects int64
+}
+
+func newQuota(store ObjectStore, root string, maxBytes, maxObjects int64, log *subLogger) *quota {
+	prefix := cleanRoot(root)
+	if prefix != "" {
+		prefix += "/"
+	}
+	meta := path.Join(cleanRoot(root), metaDirectory) + "/"
+	return &quota{
+		store:      store,
+		prefix:     prefix,
+		meta:       meta,
+		maxBytes:   maxBytes,
+		maxObjects: maxObjects,
+		log:        log,
+		ready:      make(chan struct{}),
+	}
+}
+
+// start counts usage in the background, again every quotaRetry until it
+// succeeds.
+func (q *quota) start(s *S3Bucket) {
+	go func() {
+		defer s.RecoverAndDump()
+		for {
+			err := q.count(s.ctx)
+			if err == nil || s.ctx.Err() != nil {
+				return
+			}
+			q.log.Warnf("quota: counting usage: %s; uploads wait until it is counted", err)
+			select {
+			case <-time.After(quotaRetry):
+			case <-s.done:
+				return
+			}
+		}
+	}()
+}
+
+// wait waits for usage to be first counted.
+func (q *quota) wait(ctx context.Context) error {
+	select {
+	case <-q.ready:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// exempt reports whether the object name is metadata of the datastore,
+// which the quota leaves out. Packs hold values, so they count.
+func (q *quota) exempt(name string) bool {
+	return strings.HasPrefix(name, q.meta) && !strings.HasPrefix(name, q.meta+packDirectory+"/")
+}
+
+// count lists the root directory and sets the usage to what it holds,
+// plus the uploads made meanwhile. It returns at once if a listing is
+// already in progress.
+func (q *quota) count(ctx context.Context) error {
+	q.mu.Lock()
+	if q.counting {
+		q.mu.Unlock()
+		return nil
+	}
+	q.counting = true
+	q.pendingBytes, q.pendingObjects = 0, 0
+	q.mu.Unlock()
+
+	var (
+		bytes, objects int64
+		token          string
+		err            error
+	)
+	for {
+		var objs []ObjectInfo
+		if objs, token, err = q.store.List(ctx, q.prefix, token, listMax); err != nil {
+			break
+		}
+		for _, obj := range objs {
+			if q.exempt(obj.Name) {
+				continue
+			}
+			bytes += obj.Size
+			objects++
+		}
+		if token == "" {
+			break
+		}
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.counting = false
+	if err != nil {
+		return err
+	}
+	q.bytes, q.objects = bytes+q.pendingBytes, objects+q.pendingObjects
+	if q.counted.IsZero() {
+		close(q.ready)
+	}
+	q.counted = time.Now()
+	q.log.Debugf("quota: %d bytes in %d objects under %q", q.bytes, q.objects, path.Clean("/"+q.prefix))
+	return nil
+}
+
+// recount counts usage again in the background, if the last count is old
+// enough.
+func (q *quota) recount(s *S3Bucket) {
+	q.mu.Lock()
+	stale := !q.counting && time.Since(q.counted) >= quotaRecountAge
+	q.mu.Unlock()
+	if !stale {
+		return
+	}
+	go func() {
+		defer s.RecoverAndDump()
+		if err := q.count(s.ctx); err != nil && s.ctx.Err() == nil {
+			q.log.Warnf("quota: counting usage: %s", err)
+		}
+	}()
+}
+
+// reserve adds an upload of size bytes to the usage, or reports that it
+// would exceed the quota.
+func (q *quota) reserve(size int64) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.maxBytes > 0 && q.bytes+size > q.maxBytes || q.maxObjects > 0 && q.objects+1 > q.maxObjects {
+		return false
+	}
+	q.add(size, 1)
+	return true
+}
+
+// release takes back a reservation whose upload failed, or the usage of
+// a deleted object.
+func (q *quota) release(size int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.add(-size, -1)
+}
+
+func (q *quota) add(bytes, objects int64) {
+	q.bytes += bytes
+	q.objects += objects
+	if q.counting {
+		q.pendingBytes += bytes
+		q.pendingObjects += objects
+	}
+}
+
+func (q *quota) snapshot() QuotaStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return QuotaStats{
+		Bytes:      q.bytes,
+		Objects:    q.objects,
+		MaxBytes:   q.maxBytes,
+		MaxObjects: q.maxObjects,
+		Counted:    q.counted,
+	}
+}
+
+// quotaStore refuses uploads to an ObjectStore past the quota.
+type quotaStore struct {
+	ObjectStore
+	s     *S3Bucket
+	quota *quota
+}
+
+func (t *quotaStore) upload(ctx context.Context, name string, size int64, fn func() error) error {
+	if t.quota.exempt(name) {
+		return fn()
+	}
+	if err := t.quota.wait(ctx); err != nil {
+		return err
+	}
+	if !t.quota.reserve(size) {
+		t.quota.recount(t.s)
+		return ErrQuotaExceeded
+	}
+	err := fn()
+	if err != nil {
+		t.quota.release(size)
+	}
+	return err
+}
+
+func (t *quotaStore) PutObject(ctx context.Context, name string, body []byte, opts PutOptions) error {
+	return t.upload(ctx, name, int64(len(body)), func() error {
+		return t.ObjectStore.PutObject(ctx, name, body, opts)
+	})
+}
+
+func (t *quotaStore) CopyObject(ctx context.Context, src, dst string, size int64, opts PutOptions) error {
+	return t.upload(ctx, dst, size, func() error {
+		return copyObject(ctx, t.ObjectStore, src, dst, size, opts)
+	})
+}
+
+func (t *quotaStore) GetObjectRange(ctx context.Context, name string, offset, length int64) ([]byte, ObjectInfo, error) {
+	return getObjectRange(ctx, t.ObjectStore, name, offset, length)
+}
+
+// DeleteMany is DeleteSized with the sizes of the objects looked up first,
+// Workers at a time. Callers that listed the objects pass their sizes to
+// deleteObjects instead.
+func (t *quotaStore) DeleteMany(ctx context.Context, names []string) error {
+	objs := make([]ObjectInfo, len(names))
+	forEach(ctx, len(names), t.s.Workers, func(ctx context.Context, i int) error {
+		objs[i] = ObjectInfo{Name: names[i], Size: -1}
+		if t.quota.exempt(names[i]) {
+			return nil
+		}
+		// Missing objects, or those that cannot be looked up, are left to
+		// the next listing.
+		if info, err := t.ObjectStore.Head(ctx, names[i]); err == nil {
+			objs[i].Size = info.Size
+		}
+		return nil
+	})
+	return t.DeleteSized(ctx, objs)
+}
+
+// DeleteSized takes the objects deleted off the usage, except those of
+// size -1, which are left to the next listing. A delete that failed may
+// have deleted some of the objects, so usage is counted again.
+func (t *quotaStore) DeleteSized(ctx context.Context, objs []ObjectInfo) error {
+	names := make([]string, len(objs))
+	for i, obj := range objs {
+		names[i] = obj.Name
+	}
+	if err := t.ObjectStore.DeleteMany(ctx, names); err != nil {
+		t.quota.recount(t.s)
+		return err
+	}
+	for _, obj := range objs {
+		if obj.Size >= 0 && !t.quota.exempt(obj.Name) {
+			t.quota.release(obj.Size)
+		}
+	}
+	return nil
+}
+
+// sizedDeleter is implemented by ObjectStores that need the sizes of the
+// objects they delete.
+type sizedDeleter interface {
+	DeleteSized(ctx context.Context, objs []ObjectInfo) error
+}
+
+// deleteObjects deletes objs from store, passing their sizes along if it
+// needs them.
+func deleteObjects(ctx context.Context, store ObjectStore, objs []ObjectInfo) error {
+	if d, ok := store.(sizedDeleter); ok {
+		return d.DeleteSized(ctx, objs)
+	}
+	names := make([]string, len(objs))
+	for i, obj := range objs {
+		names[i] = obj.Name
+	}
+	return store.DeleteMany(ctx, names)
+}
@@ -0,0 +1,164 @@
+package s3_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+
+	s3ds "github.com/ipfs-s3c-storj-plugin"
+	"github.com/ipfs-s3c-storj-plugin/s3test"
+)
+
+// TestQuotaDeletes checks that deletes free up the quota at once.
+func TestQuotaDeletes(t *testing.T) {
+	ctx := context.Background()
+	d := newFakeDatastore(t, s3ds.Config{MaxObjects: 2})
+	for _, k := range []string{"/a", "/b"} {
+		if err := d.Put(ctx, ds.NewKey(k), []byte(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Put(ctx, ds.NewKey("/c"), []byte("c")); err != s3ds.ErrQuotaExceeded {
+		t.Fatalf("got %v, want ErrQuotaExceeded", err)
+	}
+	if err := d.Delete(ctx, ds.NewKey("/a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Put(ctx, ds.NewKey("/c"), []byte("c")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestQuotaTombstones checks that a full quota still lets deletes record
+// their tombstones.
+func TestQuotaTombstones(t *testing.T) {
+	ctx := context.Background()
+	d := newFakeDatastore(t, s3ds.Config{MaxObjects: 1, Tombstones: true})
+	if err := d.Put(ctx, ds.NewKey("/a"), []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Delete(ctx, ds.NewKey("/a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Put(ctx, ds.NewKey("/b"), []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// checkUsage fails unless the usage d counts matches what a datastore
+// opened afresh on f lists.
+func checkUsage(t *testing.T, f *s3test.Fake, d *s3ds.S3Bucket, conf s3ds.Config) s3ds.QuotaStats {
+	t.Helper()
+	fresh, err := openFakeDatastore(t, f, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want *s3ds.QuotaStats
+	for want == nil || want.Counted.IsZero() {
+		time.Sleep(time.Millisecond)
+		want = fresh.Stats().Quota
+	}
+	got := d.Stats().Quota
+	if got.Bytes != want.Bytes || got.Objects != want.Objects {
+		t.Fatalf("usage %d bytes in %d objects, listed %d bytes in %d objects", got.Bytes, got.Objects, want.Bytes, want.Objects)
+	}
+	return *got
+}
+
+// TestQuotaCompactGC checks that compaction and GC take the objects they
+// delete off the usage.
+func TestQuotaCompactGC(t *testing.T) {
+	ctx := context.Background()
+	var failDeletes atomic.Bool
+	conf := s3ds.Config{
+		MaxBytes:            1 << 20,
+		Packing:             true,
+		SmallValueThreshold: 1024,
+		Interceptors: []s3ds.Interceptor{{
+			Before: func(_ context.Context, call *s3ds.Call) error {
+				if call.Op == s3ds.OpDeleteMany && failDeletes.Load() {
+					return errors.New("injected")
+				}
+				return nil
+			},
+		}},
+	}
+	f := s3test.New()
+	d, err := openFakeDatastore(t, f, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		value := []byte(fmt.Sprintf("block %d", i))
+		if err := d.Put(ctx, blockKey(value), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	before := checkUsage(t, f, d, conf)
+
+	// Compaction that fails to delete the packed objects leaves them to
+	// GC.
+	failDeletes.Store(true)
+	if _, err := d.Compact(ctx); err == nil {
+		t.Fatal("compaction deleted the packed objects")
+	}
+	failDeletes.Store(false)
+	packed := checkUsage(t, f, d, conf)
+	if packed.Objects <= before.Objects {
+		t.Fatalf("%d objects after packing, want more than %d", packed.Objects, before.Objects)
+	}
+	res, err := d.GC(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Objects != 4 {
+		t.Fatalf("gc deleted %d objects, want 4", res.Objects)
+	}
+	collected := checkUsage(t, f, d, conf)
+	if collected.Objects != packed.Objects-4 {
+		t.Fatalf("%d objects after gc, want %d", collected.Objects, packed.Objects-4)
+	}
+
+	for i := 4; i < 8; i++ {
+		value := []byte(fmt.Sprintf("block %d", i))
+		if err := d.Put(ctx, blockKey(value), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := d.Compact(ctx); err != nil {
+		t.Fatal(err)
+	}
+	checkUsage(t, f, d, conf)
+}
+
+// TestQuotaCopy checks that Copy and Rename count the value they write
+// once.
+func TestQuotaCopy(t *testing.T) {
+	ctx := context.Background()
+	conf := s3ds.Config{MaxObjects: 10}
+	f := s3test.New()
+	d, err := openFakeDatastore(t, f, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Put(ctx, ds.NewKey("/a"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Copy(ctx, ds.NewKey("/a"), ds.NewKey("/b")); err != nil {
+		t.Fatal(err)
+	}
+	if usage := checkUsage(t, f, d, conf); usage.Objects != 2 || usage.Bytes != 10 {
+		t.Fatalf("usage %d bytes in %d objects after copy, want 10 in 2", usage.Bytes, usage.Objects)
+	}
+	if err := d.Rename(ctx, ds.NewKey("/b"), ds.NewKey("/c")); err != nil {
+		t.Fatal(err)
+	}
+	if usage := checkUsage(t, f, d, conf); usage.Objects != 2 || usage.Bytes != 10 {
+		t.Fatalf("usage %d bytes in %d objects after rename, want 10 in 2", usage.Bytes, usage.Objects)
+	}
+}
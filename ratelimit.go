@@ -0,0 +1,161 @@
+package s3
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// OpLimit caps one class of requests.
+type OpLimit struct {
+	// MaxConcurrent is the number of requests allowed in flight, counting
+	// until the response body is closed. Zero means unlimited.
+	MaxConcurrent int
+
+	// PerSecond is the sustained request rate, with bursts of up to one
+	// second's worth of requests. Zero means unlimited.
+	PerSecond float64
+}
+
+func (l OpLimit) enabled() bool {
+	return l.MaxConcurrent > 0 || l.PerSecond > 0
+}
+
+// Request classes for rate limiting.
+const (
+	classRead = iota
+	classWrite
+	classList
+	numClasses
+)
+
+// limitedTransport enforces an OpLimit per request class underneath the
+// SDK, so retries are limited like any other request.
+type limitedTransport struct {
+	next    http.RoundTripper
+	classes [numClasses]*classLimiter
+}
+
+type classLimiter struct {
+	sem    chan struct{}
+	bucket *tokenBucket
+}
+
+func newLimitedTransport(next http.RoundTripper, read, write, list OpLimit) http.RoundTripper {
+	if !read.enabled() && !write.enabled() && !list.enabled() {
+		return next
+	}
+	t := &limitedTransport{next: next}
+	for class, l := range []OpLimit{read, write, list} {
+		cl := &classLimiter{}
+		if l.MaxConcurrent > 0 {
+			cl.sem = make(chan struct{}, l.MaxConcurrent)
+		}
+		if l.PerSecond > 0 {
+			cl.bucket = newTokenBucket(l.PerSecond)
+		}
+		t.classes[class] = cl
+	}
+	return t
+}
+
+func requestClass(r *http.Request) int {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		if r.URL.Query().Get("list-type") != "" {
+			return classList
+		}
+		return classRead
+	default:
+		return classWrite
+	}
+}
+
+func (t *limitedTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	cl := t.classes[requestClass(r)]
+	ctx := r.Context()
+
+	if cl.bucket != nil {
+		if err := cl.bucket.wait(ctx); err != nil {
+			return nil, err
+		}
+	}
+	if cl.sem == nil {
+		return t.next.RoundTrip(r)
+	}
+
+	select {
+	case cl.sem <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	release := func() { <-cl.sem }
+
+	resp, err := t.next.RoundTrip(r)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	resp.Body = &releaseOnClose{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+type releaseOnClose struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (r *releaseOnClose) Close() error {
+	err := r.ReadCloser.Close()
+	r.once.Do(r.release)
+	return err
+}
+
+// tokenBucket is a token bucket refilled at rate tokens per second and
+// holding at most one second's worth.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64) *tokenBucket {
+	return &tokenBucket{rate: rate, tokens: burstOf(rate), last: time.Now()}
+}
+
+func burstOf(rate float64) float64 {
+	if rate < 1 {
+		return 1
+	}
+	return rate
+}
+
+// wait takes a token, sleeping until one is available or ctx is done.
+func (b *tokenBucket) wait(ctx context.Context) error {
+	for {
+		b.mu.Lock()
+		now := time.Now()
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if max := burstOf(b.rate); b.tokens > max {
+			b.tokens = max
+		}
+		b.last = now
+		if b.tokens >= 1 {
+			b.tokens--
+			b.mu.Unlock()
+			return nil
+		}
+		delay := time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+		b.mu.Unlock()
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
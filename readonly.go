@@ -0,0 +1,12 @@
+package s3
+
+import "errors"
+
+// ErrReadOnly is returned by mutating operations on a read-only datastore.
+var ErrReadOnly = errors.New("s3ds: datastore is read-only")
+
+// readOnly reports whether writes are refused, either by ReadOnly or
+// because the datastore is a snapshot view.
+func (s *S3Bucket) readOnly() bool {
+	return s.ReadOnly || s.snapshot != nil
+}
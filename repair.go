@@ -0,0 +1,226 @@
+package s3
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sync"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	"golang.org/x/time/rate"
+)
+
+// RepairProgress counts what a Repair pass found and did.
+type RepairProgress struct {
+	// Checked is the number of objects of the primary compared.
+	Checked int `json:"checked"`
+
+	// Missing objects were not in the replica, and Mismatched differed
+	// from it in size or, with RepairCompareETags, ETag. Copied is how
+	// many of both were copied to the replica.
+	Missing    int `json:"missing"`
+	Mismatched int `json:"mismatched"`
+	Copied     int `json:"copied"`
+
+	// Extra objects are only in the replica. They are left alone: they
+	// may be writes the primary has not listed yet.
+	Extra int `json:"extra"`
+}
+
+// objectCursor walks the listing of an ObjectStore an object at a time.
+type objectCursor struct {
+	store  ObjectStore
+	prefix string
+	skip   func(name string) bool
+
+	objs  []ObjectInfo
+	token string
+	done  bool
+}
+
+// peek returns the next object, or false at the end of the listing.
+func (c *objectCursor) peek(ctx context.Context) (ObjectInfo, bool, error) {
+	for len(c.objs) == 0 {
+		if c.done {
+			return ObjectInfo{}, false, nil
+		}
+		objs, next, err := c.store.List(ctx, c.prefix, c.token, 0)
+		if err != nil {
+			return ObjectInfo{}, false, err
+		}
+		for _, obj := range objs {
+			if !c.skip(obj.Name) {
+				c.objs = append(c.objs, obj)
+			}
+		}
+		c.token, c.done = next, next == ""
+	}
+	return c.objs[0], true, nil
+}
+
+func (c *objectCursor) next() {
+	c.objs = c.objs[1:]
+}
+
+// Repair compares the listings of the primary and the replica under
+// prefix and copies the objects the replica misses, or has in another
+// size, from the primary. Objects are copied as stored, compressed or
+// not. progress, if set, is called with the running totals after every
+// page of the primary's listing.
+//
+// Repair fixes what mirroring lost, such as the writes of an async
+// replica whose journal was lost with the node. Objects written while it
+// runs may be reported and copied needlessly.
+func (s *S3Bucket) Repair(ctx context.Context, prefix string, progress func(RepairProgress)) (RepairProgress, error) {
+	var p RepairProgress
+	if s.replica == nil {
+		return p, fmt.Errorf("s3ds: Repair needs a replica")
+	}
+	if s.Packing {
+		return p, fmt.Errorf("s3ds: Repair cannot compare packed values")
+	}
+	if s.readOnly() {
+		return p, ErrReadOnly
+	}
+	if err := s.auditMaintenance("Repair", auditPut, prefix); err != nil {
+		return p, err
+	}
+	ctx, end := s.beginWrite(ctx)
+	defer end()
+
+	replica := s.replica.replica
+	conf := s.Replica
+	listPrefix, filter := s.keys.listPrefix(ds.NewKey(prefix).String())
+	objPrefix := path.Join(s.RootDirectory, listPrefix)
+	skip := func(name string) bool {
+		return s.isMetaPath(name) || filter && !hasKeyPrefix(s.fromS3Path(name), prefix)
+	}
+	primary := &objectCursor{store: s.store, prefix: objPrefix, skip: skip}
+	secondary := &objectCursor{store: replica.store, prefix: objPrefix, skip: skip}
+
+	var limiter *rate.Limiter
+	if conf.RepairRate > 0 {
+		limiter = rate.NewLimiter(rate.Limit(conf.RepairRate), 1)
+	}
+	var mu sync.Mutex
+	copyPage := func(names []string) error {
+		return forEach(ctx, len(names), s.Workers, func(ctx context.Context, i int) error {
+			if limiter != nil {
+				if err := limiter.Wait(ctx); err != nil {
+					return err
+				}
+			}
+			data, info, err := s.store.GetObject(ctx, names[i])
+			if err == ds.ErrNotFound {
+				// Deleted since it was listed.
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			k := s.fromS3Path(names[i])
+			opts := PutOptions{
+				Metadata:     info.Metadata,
+				Tags:         s.objectTags(k, len(data)),
+				StorageClass: s.storageClass(k),
+			}
+			if err := replica.store.PutObject(ctx, names[i], data, opts); err != nil {
+				return fmt.Errorf("copying %s: %s", names[i], err)
+			}
+			mu.Lock()
+			p.Copied++
+			mu.Unlock()
+			return nil
+		})
+	}
+
+	var page []string
+	for {
+		obj, ok, err := primary.peek(ctx)
+		if err != nil {
+			return p, err
+		}
+		// The replica's objects before obj are not in the primary.
+		var (
+			robj ObjectInfo
+			rok  bool
+		)
+		for {
+			if robj, rok, err = secondary.peek(ctx); err != nil {
+				return p, err
+			}
+			if !rok || ok && robj.Name >= obj.Name {
+				break
+			}
+			p.Extra++
+			secondary.next()
+		}
+		if !ok {
+			break
+		}
+		primary.next()
+		p.Checked++
+
+		switch {
+		case !rok || robj.Name != obj.Name:
+			p.Missing++
+			page = append(page, obj.Name)
+		case robj.Size != obj.Size,
+			conf.RepairCompareETags && obj.ETag != "" && robj.ETag != "" && obj.ETag != robj.ETag:
+			p.Mismatched++
+			page = append(page, obj.Name)
+			secondary.next()
+		default:
+			secondary.next()
+		}
+
+		if len(primary.objs) == 0 {
+			// End of a page of the primary's listing.
+			if err := copyPage(page); err != nil {
+				return p, err
+			}
+			page = page[:0]
+			if progress != nil {
+				progress(p)
+			}
+		}
+	}
+	if err := copyPage(page); err != nil {
+		return p, err
+	}
+	if progress != nil {
+		progress(p)
+	}
+	return p, nil
+}
+
+// repairLoop runs Repair passes over the whole datastore until it is
+// closed.
+func (s *S3Bucket) repairLoop(interval time.Duration) {
+	defer s.RecoverAndDump()
+
+	log := s.logs.get(LogReplica)
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-s.done:
+			return
+		}
+		if err := s.requireLease(); err != nil {
+			continue
+		}
+		p, err := s.Repair(s.ctx, "/", nil)
+		if err != nil {
+			if s.ctx.Err() == nil {
+				log.Warnf("repair: %s", err)
+			}
+			continue
+		}
+		if p.Missing+p.Mismatched > 0 {
+			log.Infof("repair: copied %d of %d missing and %d mismatched objects to the replica", p.Copied, p.Missing, p.Mismatched)
+		}
+	}
+}
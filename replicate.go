@@ -0,0 +1,338 @@
+package s3
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"sync"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// ReplicaConfig describes a second bucket that Puts and Deletes are
+// mirrored to. Empty connection settings default to the primary's.
+type ReplicaConfig struct {
+	Bucket    string
+	Region    string
+	Endpoint  string
+	AccessKey string
+	SecretKey string
+
+	// Async acknowledges writes once the primary has them and mirrors
+	// them in the background. Otherwise a write fails unless both buckets
+	// took it.
+	Async bool
+
+	// Journal is the file recording async writes not yet mirrored, so
+	// they are replayed after a restart. Without it they are lost when
+	// the process exits.
+	Journal string
+
+	// RepairInterval, if set, runs Repair over the whole datastore this
+	// often, copying what the replica misses.
+	RepairInterval time.Duration
+
+	// RepairRate limits the objects Repair copies per second; 0 means no
+	// limit.
+	RepairRate int
+
+	// RepairCompareETags makes Repair also copy objects whose ETags
+	// differ, not only their sizes. Both buckets have to compute ETags
+	// alike, which S3-compatible gateways do for single uploads.
+	RepairCompareETags bool
+}
+
+const (
+	replOpPut    = "put"
+	replOpDelete = "delete"
+)
+
+type replOp struct {
+	Seq   uint64 `json:"seq"`
+	Op    string `json:"op,omitempty"`
+	Key   string `json:"key,omitempty"`
+	Done  bool   `json:"done,omitempty"`
+	value []byte
+}
+
+// replicator mirrors writes to the replica bucket.
+type replicator struct {
+	primary *S3Bucket
+	replica *S3Bucket
+	async   bool
+
+	// ctx is that of async mirroring, which outlives the primary's until
+	// the queues are drained on shutdown.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	queues []chan *replOp
+	wg     sync.WaitGroup
+
+	// sending is held by writes while they queue, and by drain while it
+	// closes the queues.
+	sending   sync.RWMutex
+	closed    bool
+	drainOnce sync.Once
+
+	mu      sync.Mutex
+	seq     uint64
+	journal *os.File
+}
+
+// secondaryConfig derives the configuration of a datastore opened on
+// behalf of the primary, such as a replica or a routed namespace, from the
+// primary's. Connection settings that are set replace the primary's. Every
+// subsystem with its own background work or bookkeeping stays with the
+// primary.
+func secondaryConfig(conf Config, bucket, region, endpoint, accessKey, secretKey string) Config {
+	for dst, src := range map[*string]string{
+		&conf.Bucket:    bucket,
+		&conf.Region:    region,
+		&conf.Endpoint:  endpoint,
+		&conf.AccessKey: accessKey,
+		&conf.SecretKey: secretKey,
+	} {
+		if src != "" {
+			*dst = src
+		}
+	}
+	if endpoint != "" {
+		conf.Endpoints, conf.EndpointPolicy = nil, ""
+	}
+	conf.Replica = nil
+	conf.Routes = nil
+	conf.Tenants = nil
+	conf.Notifications, conf.ChangeLogInterval = nil, 0
+	conf.MaxBytes, conf.MaxObjects = 0, 0
+	conf.Tiering = nil
+	conf.WriteBehind, conf.WriteBehindQueue = false, 0
+	conf.SyncVerify, conf.SyncVerifyTimeout = false, 0
+	conf.HeatmapFile, conf.HeatmapInterval, conf.HeatmapShard = "", 0, ""
+	conf.StatsAddr, conf.StatsWindow = "", 0
+	conf.DigestInterval = 0
+	conf.CrashDumpFile, conf.CrashDumpInterval, conf.CrashDumpToBucket = "", 0, false
+	conf.FeatureFlagsRefresh = 0
+	conf.SnapshotManifest = ""
+	conf.SmallValueAutoTune = false
+	conf.CompactInterval = 0
+	conf.AuditLog, conf.AuditToBucket, conf.AuditInterval, conf.DryRun = "", false, 0, false
+	return conf
+}
+
+func newReplicator(primary *S3Bucket, conf ReplicaConfig) (*replicator, error) {
+	rc := secondaryConfig(primary.Config, conf.Bucket, conf.Region, conf.Endpoint, conf.AccessKey, conf.SecretKey)
+	replica, err := NewS3Datastore(rc)
+	if err != nil {
+		return nil, fmt.Errorf("s3ds: replica: %s", err)
+	}
+	r := &replicator{primary: primary, replica: replica, async: conf.Async}
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	if !r.async {
+		return r, nil
+	}
+
+	var replay []*replOp
+	if conf.Journal != "" {
+		if replay, err = r.openJournal(conf.Journal); err != nil {
+			return nil, err
+		}
+	}
+	r.queues = make([]chan *replOp, primary.Workers)
+	r.wg.Add(len(r.queues))
+	for i := range r.queues {
+		r.queues[i] = make(chan *replOp, defaultWriteBehindQueue)
+		go r.mirror(r.queues[i])
+	}
+	for _, op := range replay {
+		if err := r.enqueue(context.Background(), op); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// openJournal loads the writes a previous process did not mirror, and
+// rewrites the journal to hold only those.
+func (r *replicator) openJournal(file string) ([]*replOp, error) {
+	pending := make(map[uint64]*replOp)
+	var order []uint64
+	f, err := os.Open(file)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, fmt.Errorf("s3ds: opening replication journal: %s", err)
+	default:
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			op := &replOp{}
+			if err := json.Unmarshal(sc.Bytes(), op); err != nil {
+				// A torn last line from a crash; everything before it
+				// is intact.
+				break
+			}
+			if op.Done {
+				delete(pending, op.Seq)
+				continue
+			}
+			pending[op.Seq] = op
+			order = append(order, op.Seq)
+			if op.Seq > r.seq {
+				r.seq = op.Seq
+			}
+		}
+		f.Close()
+	}
+
+	var replay []*replOp
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, seq := range order {
+		if op, ok := pending[seq]; ok {
+			replay = append(replay, op)
+			enc.Encode(op)
+		}
+	}
+	if err := writeFileAtomic(file, buf.Bytes()); err != nil {
+		return nil, fmt.Errorf("s3ds: rewriting replication journal: %s", err)
+	}
+	if r.journal, err = os.OpenFile(file, os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+		return nil, fmt.Errorf("s3ds: opening replication journal: %s", err)
+	}
+	return replay, nil
+}
+
+func (r *replicator) record(op *replOp) error {
+	if r.journal == nil {
+		return nil
+	}
+	data, err := json.Marshal(op)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, err = r.journal.Write(append(data, '\n'))
+	return err
+}
+
+// enqueue hands op to the worker owning its key, so writes to one key
+// reach the replica in order. It blocks while the worker's queue is full,
+// until ctx is done or the datastore closed; op is then left to the
+// journal, if any.
+func (r *replicator) enqueue(ctx context.Context, op *replOp) error {
+	r.sending.RLock()
+	defer r.sending.RUnlock()
+	if r.closed {
+		return ErrClosed
+	}
+	h := fnv.New32a()
+	h.Write([]byte(op.Key))
+	queue := r.queues[h.Sum32()%uint32(len(r.queues))]
+	select {
+	case queue <- op:
+		return nil
+	default:
+	}
+	select {
+	case queue <- op:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-r.primary.done:
+		return ErrClosed
+	}
+}
+
+// write mirrors a write that the primary accepted.
+func (r *replicator) write(ctx context.Context, op string, k ds.Key, value []byte) error {
+	if !r.async {
+		if err := r.apply(ctx, op, k, value); err != nil {
+			return fmt.Errorf("s3ds: replicating %s of %s: %s", op, k, err)
+		}
+		return nil
+	}
+
+	r.mu.Lock()
+	r.seq++
+	o := &replOp{Seq: r.seq, Op: op, Key: k.String(), value: value}
+	r.mu.Unlock()
+	if err := r.record(o); err != nil {
+		return fmt.Errorf("s3ds: replication journal: %s", err)
+	}
+	if err := r.enqueue(ctx, o); err != nil {
+		return fmt.Errorf("s3ds: replicating %s of %s: %s", op, k, err)
+	}
+	return nil
+}
+
+func (r *replicator) apply(ctx context.Context, op string, k ds.Key, value []byte) error {
+	if op == replOpDelete {
+		err := r.replica.Delete(ctx, k)
+		if err == ds.ErrNotFound {
+			err = nil
+		}
+		return err
+	}
+	return r.replica.put(ctx, k, value)
+}
+
+func (r *replicator) mirror(queue <-chan *replOp) {
+	defer r.wg.Done()
+	defer r.primary.RecoverAndDump()
+	log := r.primary.logs.get(LogReplica)
+	for op := range queue {
+		k := ds.NewKey(op.Key)
+		value := op.value
+		if op.Op == replOpPut && value == nil {
+			// Replayed from the journal: the primary has the value.
+			var err error
+			value, err = r.primary.get(r.ctx, k)
+			if err == ds.ErrNotFound {
+				// Deleted since; a later journal entry mirrors that.
+				r.record(&replOp{Seq: op.Seq, Done: true})
+				continue
+			}
+			if err != nil {
+				log.Warnf("replaying %s of %s: %s", op.Op, k, err)
+				continue
+			}
+		}
+		if err := r.apply(r.ctx, op.Op, k, value); err != nil {
+			// Leave it in the journal for the next start.
+			log.Warnf("mirroring %s of %s: %s", op.Op, k, err)
+			continue
+		}
+		r.record(&replOp{Seq: op.Seq, Done: true})
+	}
+}
+
+// drain mirrors the writes queued so far and stops the workers. Writes
+// from then on fail with ErrClosed.
+func (r *replicator) drain() {
+	r.drainOnce.Do(func() {
+		r.sending.Lock()
+		r.closed = true
+		for _, q := range r.queues {
+			close(q)
+		}
+		r.sending.Unlock()
+		r.wg.Wait()
+	})
+}
+
+// close drains the mirroring queues, unless cancelled, and closes the
+// replica.
+func (r *replicator) close() error {
+	r.drain()
+	r.cancel()
+	if r.journal != nil {
+		r.journal.Close()
+	}
+	return r.replica.Close()
+}
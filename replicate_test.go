@@ -0,0 +1,47 @@
+package s3_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+
+	s3ds "github.com/ipfs-s3c-storj-plugin"
+	"github.com/ipfs-s3c-storj-plugin/s3test"
+)
+
+// TestAsyncReplicaClose checks that Close mirrors the writes queued for an
+// async replica before stopping, and that writes after it fail.
+func TestAsyncReplicaClose(t *testing.T) {
+	ctx := context.Background()
+	f := s3test.New("replica")
+	conf := f.Config("primary")
+	conf.Replica = &s3ds.ReplicaConfig{Bucket: "replica", Async: true}
+	d, err := s3ds.NewS3Datastore(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const n = 200
+	for i := 0; i < n; i++ {
+		if err := d.Put(ctx, ds.NewKey(fmt.Sprintf("/k/%d", i)), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var got int
+	for _, name := range f.Keys("replica") {
+		if strings.HasPrefix(name, "/k/") {
+			got++
+		}
+	}
+	if got != n {
+		t.Errorf("replica has %d keys, want %d", got, n)
+	}
+	if err := d.Put(ctx, ds.NewKey("/k/late"), []byte("v")); err == nil {
+		t.Error("Put after Close did not fail")
+	}
+}
@@ -0,0 +1,143 @@
+package s3
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+)
+
+// reprovideState is where the announcements of the blocks under one prefix
+// stand. It is kept in the bucket, so that a node restarted against it
+// picks up where the previous one stopped.
+type reprovideState struct {
+	// Announced is the start of the last complete pass.
+	Announced time.Time `json:"announced,omitempty"`
+
+	// Started is the start of the pass in progress, and Cursor the
+	// continuation of its listing.
+	Started time.Time `json:"started,omitempty"`
+	Cursor  string    `json:"cursor,omitempty"`
+}
+
+func (s *S3Bucket) reprovidePath(prefix string) string {
+	return s.metaPath(path.Join("reprovide", url.PathEscape(prefix)+".json"))
+}
+
+func (s *S3Bucket) readReprovideState(ctx context.Context, prefix string) (reprovideState, error) {
+	var st reprovideState
+	data, _, err := s.store.GetObject(ctx, s.reprovidePath(prefix))
+	if err == ds.ErrNotFound {
+		return st, nil
+	}
+	if err != nil {
+		return st, err
+	}
+	if err := json.Unmarshal(data, &st); err != nil {
+		return st, fmt.Errorf("s3ds: invalid reprovide state of %s: %s", prefix, err)
+	}
+	return st, nil
+}
+
+func (s *S3Bucket) writeReprovideState(ctx context.Context, prefix string, st reprovideState) error {
+	if s.DryRun {
+		return nil
+	}
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	return s.store.PutObject(ctx, s.reprovidePath(prefix), data, PutOptions{})
+}
+
+// Reprovide calls announce with the CIDs of the blocks under prefix, a
+// page at a time, and returns how many it passed. Prefixes whose last
+// complete pass started less than interval ago are skipped.
+//
+// The position in the listing is saved in the bucket after every page
+// announce accepts, and the start of every complete pass per prefix, so a
+// node restarted against the same bucket resumes the pass in progress
+// instead of announcing every block again. Packed blocks are announced at
+// the end of a pass.
+func (s *S3Bucket) Reprovide(ctx context.Context, prefix string, interval time.Duration, announce func([]cid.Cid) error) (int, error) {
+	p := ds.NewKey(prefix)
+	if r := s.route(p); r != s {
+		return r.Reprovide(ctx, prefix, interval, announce)
+	}
+	st, err := s.readReprovideState(ctx, p.String())
+	if err != nil {
+		return 0, err
+	}
+	if st.Cursor == "" {
+		if !st.Announced.IsZero() && time.Since(st.Announced) < interval {
+			return 0, nil
+		}
+		st.Started = time.Now()
+	}
+
+	listPrefix, filter := s.keys.listPrefix(p.String())
+	objPrefix := path.Join(s.RootDirectory, listPrefix)
+	n := 0
+	send := func(cids []cid.Cid) error {
+		if len(cids) == 0 {
+			return nil
+		}
+		if err := announce(cids); err != nil {
+			return err
+		}
+		n += len(cids)
+		return nil
+	}
+	for {
+		objs, next, err := s.store.List(ctx, objPrefix, st.Cursor, 0)
+		if err != nil {
+			return n, err
+		}
+		var cids []cid.Cid
+		for _, obj := range objs {
+			if s.isMetaPath(obj.Name) {
+				continue
+			}
+			k := s.fromS3Path(obj.Name)
+			if filter && !hasKeyPrefix(k, p.String()) {
+				continue
+			}
+			if c, ok := blockCid(k); ok {
+				cids = append(cids, c)
+			}
+		}
+		if err := send(cids); err != nil {
+			return n, err
+		}
+
+		st.Cursor = next
+		if next == "" {
+			break
+		}
+		if err := s.writeReprovideState(ctx, p.String(), st); err != nil {
+			return n, fmt.Errorf("s3ds: saving reprovide state of %s: %s", p, err)
+		}
+	}
+
+	if s.packs != nil {
+		var cids []cid.Cid
+		for _, k := range s.packs.keys(p.String()) {
+			if c, ok := blockCid(ds.RawKey(k)); ok {
+				cids = append(cids, c)
+			}
+		}
+		if err := send(cids); err != nil {
+			return n, err
+		}
+	}
+	st.Announced, st.Started = st.Started, time.Time{}
+	if err := s.writeReprovideState(ctx, p.String(), st); err != nil {
+		return n, fmt.Errorf("s3ds: saving reprovide state of %s: %s", p, err)
+	}
+	return n, nil
+}
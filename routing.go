@@ -0,0 +1,214 @@
+package s3
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+// RouteConfig stores the keys under a namespace in another bucket or root
+// directory. Empty fields default to the datastore's own settings.
+type RouteConfig struct {
+	Bucket        string
+	RootDirectory string
+	Region        string
+	Endpoint      string
+	AccessKey     string
+	SecretKey     string
+}
+
+type route struct {
+	prefix string
+	ds     *S3Bucket
+}
+
+func newRoutes(conf Config) ([]route, error) {
+	var routes []route
+	for prefix, rc := range conf.Routes {
+		c := secondaryConfig(conf, rc.Bucket, rc.Region, rc.Endpoint, rc.AccessKey, rc.SecretKey)
+		if rc.RootDirectory != "" {
+			c.RootDirectory = rc.RootDirectory
+		}
+		d, err := NewS3Datastore(c)
+		if err != nil {
+			for _, r := range routes {
+				r.ds.Close()
+			}
+			return nil, fmt.Errorf("s3ds: route %s: %s", prefix, err)
+		}
+		routes = append(routes, route{prefix: ds.NewKey(prefix).String(), ds: d})
+	}
+	// The most specific route wins.
+	sort.Slice(routes, func(i, j int) bool { return len(routes[i].prefix) > len(routes[j].prefix) })
+	return routes, nil
+}
+
+// route returns the datastore storing k.
+func (s *S3Bucket) route(k ds.Key) *S3Bucket {
+	for _, r := range s.routes {
+		if hasKeyPrefix(k, r.prefix) {
+			return r.ds
+		}
+	}
+	return s
+}
+
+// routedElsewhere reports whether k is stored by a route.
+func (s *S3Bucket) routedElsewhere(k ds.Key) bool {
+	return s.route(k) != s
+}
+
+// routedQuery answers q when routes are set. A prefix inside a route is
+// answered by it; otherwise the results of every route under the prefix
+// follow the datastore's own.
+func (s *S3Bucket) routedQuery(ctx context.Context, q dsq.Query) (dsq.Results, bool, error) {
+	if len(s.routes) == 0 {
+		return nil, false, nil
+	}
+	prefix := ds.NewKey(q.Prefix)
+	if r := s.route(prefix); r != s {
+		res, err := r.Query(ctx, q)
+		return res, true, err
+	}
+
+	var under []*S3Bucket
+	var prefixes []string
+	for _, r := range s.routes {
+		if hasKeyPrefix(ds.NewKey(r.prefix), prefix.String()) {
+			under = append(under, r.ds)
+			prefixes = append(prefixes, r.prefix)
+		}
+	}
+	if len(under) == 0 {
+		return nil, false, nil
+	}
+
+	// Offset and limit apply to the combined results.
+	sub := q
+	sub.Offset, sub.Limit = 0, 0
+	own, err := s.query(ctx, sub)
+	if err != nil {
+		return nil, true, err
+	}
+	sources := []dsq.Results{own}
+	for i, d := range under {
+		rq := sub
+		rq.Prefix = prefixes[i]
+		res, err := d.Query(ctx, rq)
+		if err != nil {
+			for _, r := range sources {
+				r.Close()
+			}
+			return nil, true, err
+		}
+		sources = append(sources, res)
+	}
+
+	skip, sent := q.Offset, 0
+	next := func() (dsq.Result, bool) {
+		for len(sources) > 0 {
+			if q.Limit > 0 && sent >= q.Limit {
+				return dsq.Result{}, false
+			}
+			r, ok := sources[0].NextSync()
+			if !ok {
+				sources[0].Close()
+				sources = sources[1:]
+				continue
+			}
+			if r.Error == nil && len(sources) == len(under)+1 && s.routedElsewhere(ds.NewKey(r.Key)) {
+				// A stray object in the datastore's own bucket under a
+				// routed namespace.
+				continue
+			}
+			if r.Error == nil && skip > 0 {
+				skip--
+				continue
+			}
+			sent++
+			return r, true
+		}
+		return dsq.Result{}, false
+	}
+	return dsq.ResultsFromIterator(q, dsq.Iterator{
+		Next: next,
+		Close: func() error {
+			for _, r := range sources {
+				r.Close()
+			}
+			return nil
+		},
+	}), true, nil
+}
+
+// routedBatch splits a batch by route.
+type routedBatch struct {
+	s       *S3Bucket
+	batches map[*S3Bucket]ds.Batch
+}
+
+func (b *routedBatch) batch(ctx context.Context, k ds.Key) (ds.Batch, error) {
+	d := b.s.route(k)
+	if batch, ok := b.batches[d]; ok {
+		return batch, nil
+	}
+	var batch ds.Batch
+	if d == b.s {
+		batch = b.s.newBatch()
+	} else {
+		var err error
+		if batch, err = d.Batch(ctx); err != nil {
+			return nil, err
+		}
+	}
+	b.batches[d] = batch
+	return batch, nil
+}
+
+func (b *routedBatch) Put(ctx context.Context, k ds.Key, val []byte) error {
+	batch, err := b.batch(ctx, k)
+	if err != nil {
+		return err
+	}
+	return batch.Put(ctx, k, val)
+}
+
+func (b *routedBatch) Delete(ctx context.Context, k ds.Key) error {
+	batch, err := b.batch(ctx, k)
+	if err != nil {
+		return err
+	}
+	return batch.Delete(ctx, k)
+}
+
+func (b *routedBatch) Commit(ctx context.Context) error {
+	var errs []string
+	for d, batch := range b.batches {
+		// Routed datastores do not audit; the batch of the datastore's
+		// own keys audits itself.
+		if d != b.s && b.s.auditor != nil && !batch.(*s3Batch).auditOps(b.s.auditor) {
+			continue
+		}
+		if err := batch.Commit(ctx); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("s3ds: failed routed batch:\n%s", strings.Join(errs, "\n"))
+	}
+	return nil
+}
+
+func (s *S3Bucket) closeRoutes() error {
+	var err error
+	for _, r := range s.routes {
+		if cerr := r.ds.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
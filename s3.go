@@ -1,20 +1,20 @@
 package s3
 
 import (
-	"bytes"
+	"context"
 	"fmt"
-	"io/ioutil"
+	"net/http"
 	"path"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
-	ds "gx/ipfs/QmaRb5yNXKonhbkpNxNawoydk4N6es6b4fPj19sjEKsh5D/go-datastore"
-	dsq "gx/ipfs/QmaRb5yNXKonhbkpNxNawoydk4N6es6b4fPj19sjEKsh5D/go-datastore/query"
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	"golang.org/x/sync/singleflight"
 )
 
 const (
@@ -31,13 +31,61 @@ const (
 
 type S3Bucket struct {
 	Config
-	S3 *s3.S3
+	S3    S3Client
+	store ObjectStore
+
+	keys        keyTransform
+	flags       *featureFlags
+	writeBehind *writeBehind
+	heat        *heatmap
+	unverified  *unverifiedWrites
+	compressor  *compressor
+	codecs      []Codec
+	adaptive    *aimdLimiter
+	dns         *dnsWatcher
+	journal     *journal
+	logs        *loggers
+	snapshot    *snapshotView
+	tuner       *thresholdTuner
+	replica     *replicator
+	packs       *packIndex
+	routes      []route
+	tenants     map[string]*S3Bucket
+	auditor     *auditor
+	costs       *costCounter
+	gets        singleflight.Group
+	breaker     *breaker
+	negative    *negativeCache
+	recent      *recentWrites
+	gateways    *gateways
+	quota       *quota
+	notify      *notifications
+	changes     *changeLog
+	events      *events
+	lease       *lease
+	tiering     *tiering
+	stats       *accessStats
+	segments    *segmentCounter
+	statsServer *http.Server
+
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// ctx is cancelled by Close once it stops waiting for inflight
+	// writes; background uploads run under it.
+	ctx              context.Context
+	cancel           context.CancelFunc
+	inflight         sync.WaitGroup
+	cancelledBatches int64
+
+	// coalescedGets is the number of downloads getCoalesced has running.
+	coalescedGets int64
 }
 
 type Config struct {
 	AccessKey string
 	SecretKey string
-//	SessionToken   string
+	//	SessionToken   string
 	Bucket        string
 	Region        string
 	Endpoint      string
@@ -45,6 +93,486 @@ type Config struct {
 	LogPath       string
 	Secure        bool
 	Workers       int
+
+	// KeyTransform selects how datastore keys map to object names. See
+	// KeyTransformRaw and KeyTransformFlatfs.
+	KeyTransform string
+
+	// Provider names the S3 implementation behind Endpoint ("aws",
+	// "minio", "b2", "wasabi", "filebase" or "storj") and selects defaults
+	// suited to it: the endpoint and region of hosted services, path or
+	// virtual-hosted addressing, PartSize and MaxRetries. With one of
+	// these a working configuration needs only credentials and Bucket.
+	// It also works around the provider's quirks: deletes on Backblaze B2
+	// remove every version of the object instead of hiding it.
+	//
+	// "gcs" and "azure" store values in Google Cloud Storage and Azure
+	// Blob Storage through their own APIs. Only Bucket, RootDirectory and
+	// the provider's own settings below apply of the connection settings,
+	// and features built on S3 requests are unavailable.
+	Provider string
+
+	// Addressing selects how requests name the bucket: AddressingPath or
+	// AddressingVirtualHosted. Defaults to virtual-hosted for provider
+	// "aws", which is phasing out path-style requests, and to path-style
+	// otherwise. Bucket names that are not valid host names are always
+	// addressed by path.
+	Addressing string
+
+	// AzureAccount is the storage account of provider "azure", whose
+	// container is named by Bucket. Endpoint, if set, replaces the
+	// account's blob service URL.
+	AzureAccount string
+
+	// AzureKey is the account's shared key. Without one the host's
+	// managed identity is used: the system-assigned one, or the
+	// user-assigned one with client ID AzureClientID.
+	AzureKey      string
+	AzureClientID string
+
+	// GCSCredentials is the path of a service account key file in JSON
+	// for provider "gcs". Defaults to the application default
+	// credentials.
+	GCSCredentials string
+
+	// PartSize splits uploads larger than this into multipart uploads of
+	// parts this size. Defaults to Storj's 64MiB segment size for
+	// provider "storj", and to single uploads otherwise. It cannot be
+	// below 5MiB, the smallest part S3 accepts. For provider "storj" it
+	// is rounded up to a multiple of the segment size.
+	PartSize int
+
+	// MaxRetries is how often a failed request is retried. Defaults to
+	// what suits Provider; negative disables retries.
+	MaxRetries int
+
+	// NegativeCacheTTL, if set, caches keys that Get, Has and GetSize
+	// found missing for this long, so repeated lookups of blocks the
+	// bucket does not have cost no requests. Writes through this
+	// datastore invalidate the cache; writes by other nodes become
+	// visible once the entry expires, or at once with Notifications.
+	NegativeCacheTTL time.Duration
+
+	// NegativeCacheSize bounds the number of cached keys. Defaults to
+	// 100000.
+	NegativeCacheSize int
+
+	// WriteDedupWindow, if set, drops a Put of a block this datastore
+	// wrote less than this long ago without any request: blocks are
+	// content-addressed, so the value is the same, and adding content
+	// often writes a block twice. Deletes through this datastore end the
+	// window of their keys; blocks deleted by other nodes or by lifecycle
+	// rules are only written again once it has passed.
+	WriteDedupWindow time.Duration
+
+	// WriteDedupSize bounds the number of blocks remembered. Defaults to
+	// 100000.
+	WriteDedupSize int
+
+	// Notifications, if set, receives the bucket's event notifications
+	// and invalidates the caches above for objects other nodes write or
+	// delete.
+	Notifications *NotificationConfig
+
+	// ChangeLogInterval, if set, keeps the caches above coherent between
+	// nodes sharing the bucket without notifications: every interval,
+	// each node records the keys it wrote or deleted under a change log
+	// in the bucket, and invalidates those recorded by the others. See
+	// ReadChangeLog.
+	ChangeLogInterval time.Duration
+
+	// VerifyOnRead rehashes every block read and fails with
+	// ErrChecksumMismatch if it does not match the multihash recorded in
+	// its object's metadata, or else in its key, instead of handing
+	// corrupt data to IPFS. Only sha2-256 and identity hashes are checked.
+	VerifyOnRead bool
+
+	// Checksums sends the MD5 sum of every upload, and its SHA-256 sum
+	// where the provider keeps it, so the gateway rejects bodies damaged
+	// in transit, and verifies downloads against them. A download that
+	// does not match is retried once, then fails with
+	// ErrChecksumMismatch.
+	Checksums bool
+
+	// Prices are used by Costs to estimate what the requests sent to the
+	// bucket cost. Defaults to the list prices of Provider in USD, or
+	// zero for self-hosted and unknown providers.
+	Prices *PriceTable
+
+	// ExistenceCheck selects how Has is answered: ExistenceCheckHead or
+	// ExistenceCheckList. Defaults to what is cheaper for Provider.
+	ExistenceCheck string
+
+	// FeatureFlags maps feature names to the percentage of operations they
+	// are enabled for, to roll out new subsystems gradually: Packing,
+	// Compression, NegativeCacheTTL, WriteDedupWindow and WriteBehind, as
+	// FeaturePacking and so on, once their settings enable them.
+	// Operations are picked by key, so a key is handled the same way while
+	// the percentage stays.
+	FeatureFlags map[string]float64
+
+	// FeatureFlagsRefresh, if set, reloads FeatureFlags from the
+	// .s3ds/feature-flags.json object in the bucket at this interval.
+	FeatureFlagsRefresh time.Duration
+
+	// WriteBehind makes Put return once the value is queued; uploads happen
+	// in the background, those of a key in the order it was put. Flush
+	// waits for them. Puts after Close fail with ErrClosed.
+	WriteBehind bool
+
+	// WriteBehindQueue bounds the number of queued uploads, shared evenly
+	// between the Workers. Defaults to 1000.
+	WriteBehindQueue int
+
+	// PipelinedBatches starts uploading the blocks put into a batch right
+	// away, with up to Workers uploads in flight, instead of at Commit.
+	// Blocks then show up before Commit, and stay if the batch is never
+	// committed; other keys and deletes still wait for it.
+	PipelinedBatches bool
+
+	// MaxBatchOps and MaxBatchBytes, if set, bound the puts and deletes a
+	// batch holds and the size of the values it holds. A batch reaching
+	// either applies what it holds as a sub-batch right away, so a large
+	// pin does not keep every value in memory until Commit. Sub-batches
+	// are applied in order, but show up before Commit.
+	MaxBatchOps   int
+	MaxBatchBytes int
+
+	// SkipManifestCheck opens the bucket without comparing KeyTransform
+	// and Packing with the layout manifest that the first node to open it
+	// wrote, and that every other node is checked against. Only tools that
+	// convert a bucket between layouts should need it.
+	SkipManifestCheck bool
+
+	// Lifecycle, if set, is installed as the bucket's lifecycle rules at
+	// startup with ApplyLifecycle.
+	Lifecycle *LifecycleConfig
+
+	// SoftDelete makes Delete leave a delete marker in the versioned
+	// bucket, so that Undelete can bring the key back, e.g. after an
+	// unintended repo gc. The bucket must have versioning enabled; see
+	// BucketVersioning.
+	SoftDelete bool
+
+	// SoftDeleteRetention, if set, runs Purge with this retention every
+	// hour, so that deleted and overwritten values do not pile up.
+	SoftDeleteRetention time.Duration
+
+	// Tombstones records every key deleted through Delete, batches,
+	// DeletePrefix and RestoreSnapshot in a small object under the
+	// metadata directory, before deleting it, so that deletions in a
+	// shared bucket can be traced. See ListTombstones.
+	Tombstones bool
+
+	// MaxBytes and MaxObjects, if set, are a quota on the objects under
+	// RootDirectory: uploads that would take them past it fail with
+	// ErrQuotaExceeded. Usage is counted by listing RootDirectory at
+	// startup, which uploads wait for. Uploads and deletes are accounted
+	// for as they are made, except that an upload replacing an object
+	// counts in full until the next listing, made when a write is refused
+	// and the last one is a minute old. The metadata directory does not
+	// count, except for packs.
+	MaxBytes   int64
+	MaxObjects int64
+
+	// LeaseTTL, if set, coordinates the nodes sharing the bucket through a
+	// lease object: one node at a time holds it, renewing it every third
+	// of LeaseTTL, and GC and Compact fail with ErrLeaseHeld on all
+	// others. A node that stops renewing loses the lease once LeaseTTL
+	// has passed.
+	LeaseTTL time.Duration
+
+	// ShutdownTimeout is how long Close waits for batch commits and
+	// background uploads to finish before cancelling them. Defaults to
+	// 30s. Close reports cancelled or failed writes as a *ShutdownError.
+	ShutdownTimeout time.Duration
+
+	// HeatmapFile, if set, is periodically rewritten with operation counts
+	// and byte volumes per key shard, as JSON or, for a .prom file, in the
+	// Prometheus text format together with the metrics of Costs.
+	HeatmapFile string
+
+	// HeatmapInterval is how often HeatmapFile is written. Defaults to a
+	// minute.
+	HeatmapInterval time.Duration
+
+	// HeatmapShard is the flatfs style shard function keys are bucketed
+	// with, e.g. "prefix/2" or "next-to-last/2" (the default).
+	HeatmapShard string
+
+	// DigestInterval, if set, lists the bucket this often to store a
+	// ListingDigest in it, and one in the replica's, so that ReadDigest
+	// and ReplicaDivergence can compare listings without listing.
+	DigestInterval time.Duration
+
+	// DigestShard is the flatfs style shard function that cuts the key
+	// space into the shards of a ListingDigest. Defaults to
+	// "next-to-last/2".
+	DigestShard string
+
+	// StatsAddr, if set, serves Stats as JSON at /debug/s3ds/stats on
+	// this address, e.g. "localhost:5002". It also enables the heatmap
+	// behind Stats' HotPrefixes without HeatmapFile.
+	StatsAddr string
+
+	// StatsWindow is the sliding window Stats reports latencies over.
+	// Defaults to a minute.
+	StatsWindow time.Duration
+
+	// SyncVerify makes Sync poll every key written under its prefix until
+	// the gateway serves it, for eventually consistent backends. Keys
+	// deleted since are not polled, nor writes past the first 100000
+	// between Syncs.
+	SyncVerify bool
+
+	// SyncVerifyTimeout bounds that polling. Defaults to 30 seconds.
+	SyncVerifyTimeout time.Duration
+
+	// Compression compresses values before upload: "" (off) or
+	// CompressionGzip. Values that do not shrink are stored as is, and
+	// compressed objects stay readable with compression turned off.
+	Compression string
+
+	// CompressionLevel is the gzip level, 1-9. Defaults to gzip's default.
+	CompressionLevel int
+
+	// CodecNames and Codecs transform values after compression, e.g. to
+	// encrypt them: the codecs registered under CodecNames first, then
+	// Codecs, in order. Reads undo them in reverse, and read objects
+	// written without them as they are. Packed values are not encoded.
+	CodecNames []string
+	Codecs     []Codec
+
+	// Timeouts bound gets, HEADs, uploads, listings and deletes of values
+	// separately, through the context of each call.
+	Timeouts OpTimeouts
+
+	// Breaker, if set, fails calls to the bucket at once while too many
+	// of them fail, rather than let each wait out its timeouts during an
+	// outage of the gateway. See BreakerConfig.
+	Breaker *BreakerConfig
+
+	// ReadLimit, WriteLimit and ListLimit cap GET/HEAD, mutating and list
+	// requests respectively, to stay below the gateway's throttling.
+	ReadLimit  OpLimit
+	WriteLimit OpLimit
+	ListLimit  OpLimit
+
+	// UploadRate and DownloadRate cap the bytes per second sent to and
+	// received from the gateway, across all requests, so syncing a node
+	// does not saturate the host's link. Zero means unlimited.
+	UploadRate   int
+	DownloadRate int
+
+	// AdaptiveConcurrency replaces the fixed Workers count with a limit
+	// that grows while requests succeed and halves whenever the gateway
+	// throttles, between MinConcurrency and Workers.
+	AdaptiveConcurrency bool
+
+	// MinConcurrency is the floor of the adaptive limit. Defaults to 1.
+	MinConcurrency int
+
+	// CrashDumpFile, if set, receives a JSON snapshot of recent operations
+	// and in-memory state: every CrashDumpInterval, and when a goroutine
+	// guarded by RecoverAndDump panics.
+	CrashDumpFile string
+
+	// CrashDumpInterval defaults to a minute.
+	CrashDumpInterval time.Duration
+
+	// CrashDumpToBucket also uploads panic dumps below .s3ds/crash/ in the
+	// bucket.
+	CrashDumpToBucket bool
+
+	// Transport tunes timeouts, connection pooling, TLS and proxying of the
+	// HTTP client.
+	Transport TransportConfig
+
+	// Logger receives log output. Defaults to a logger writing to LogPath,
+	// or standard error if that is empty.
+	Logger Logger
+
+	// LogLevel is the level of every subsystem not listed in LogLevels.
+	// Defaults to "warn".
+	LogLevel string
+
+	// LogLevels sets the level per subsystem, one of the Log constants,
+	// e.g. {"s3": "debug"} to log every SDK request.
+	LogLevels map[string]string
+
+	// LogFormat is LogFormatText (the default) or LogFormatJSON for the
+	// default logger.
+	LogFormat string
+
+	// SlowRequestThreshold, if set, logs a warning for every S3 request,
+	// retries included, that takes longer than this.
+	SlowRequestThreshold time.Duration
+
+	// SnapshotManifest opens a read-only view serving only the keys, and
+	// on versioned buckets the versions, recorded by CaptureManifest under
+	// this name.
+	SnapshotManifest string
+
+	// Endpoints lists several gateways serving the bucket, primary first.
+	// Writes go to the first healthy one; reads are spread according to
+	// EndpointPolicy. An endpoint that fails to answer is skipped for a
+	// while and the request retried on the next. Endpoint defaults to the
+	// first entry.
+	Endpoints []EndpointConfig
+
+	// EndpointPolicy is EndpointPolicyOrder (the default),
+	// EndpointPolicyWeighted or EndpointPolicyLatency.
+	EndpointPolicy string
+
+	// SmallValueThreshold is the size in bytes below which values count as
+	// small. Defaults to 16KiB.
+	SmallValueThreshold int
+
+	// SmallValueAutoTune moves the threshold, starting from
+	// SmallValueThreshold, to the break-even size between per-request
+	// overhead and transfer time measured on this provider's uploads.
+	SmallValueAutoTune bool
+
+	// Replica mirrors Puts and Deletes to a second bucket, which Get falls
+	// back to when the primary does not have a key.
+	Replica *ReplicaConfig
+
+	// Gateways are trustless HTTP gateways, e.g.
+	// https://trustless-gateway.link, that Get asks in order for blocks
+	// missing from the bucket, and from Replica. A block fetched is
+	// checked against its multihash and stored in the bucket. Only
+	// blocks hashed with sha2-256 or identity are fetched.
+	Gateways []string
+
+	// GatewayTimeout bounds each request to a gateway. Defaults to 30
+	// seconds.
+	GatewayTimeout time.Duration
+
+	// Grants are applied to every object written. See ApplyGrants for
+	// objects written before.
+	Grants Grants
+
+	// ReadOnly rejects Put, Delete and Batch with ErrReadOnly, for nodes
+	// serving a bucket that another node writes.
+	ReadOnly bool
+
+	// SkipExisting does not upload blocks that are already in the bucket.
+	// Blocks are content-addressed, so an existing object already holds
+	// the value; other keys are always written.
+	SkipExisting bool
+
+	// SkipExistingCheck selects how existing blocks are detected:
+	// SkipExistingHas or SkipExistingConditional. Defaults to what
+	// Provider supports.
+	SkipExistingCheck string
+
+	// Packing stores the values smaller than SmallValueThreshold written
+	// in a batch together in pack objects, instead of one object each.
+	Packing bool
+
+	// PackSize is the size in bytes packs are filled up to. Defaults to
+	// 4MiB.
+	PackSize int
+
+	// CompactInterval runs Compact in the background this often.
+	CompactInterval time.Duration
+
+	// CompactUtilization is the share of live bytes below which Compact
+	// rewrites a pack. Defaults to 0.5.
+	CompactUtilization float64
+
+	// Tagging tags every object written with its namespace (the first
+	// key component, e.g. "blocks"), the codec of blocks and a size class
+	// of tiny (<1KiB), small (<16KiB), medium (<256KiB) or large, for cost
+	// analysis and lifecycle rules. Not every gateway supports tags.
+	Tagging bool
+
+	// TagLabels are added to the tags of every object with Tagging.
+	TagLabels map[string]string
+
+	// StorageClass is the storage class objects are written to, in the
+	// provider's terms: e.g. "STANDARD_IA" or "GLACIER_IR" on AWS,
+	// "NEARLINE" on GCS, "Cool" on Azure. Classes whose objects must be
+	// restored before they can be read are refused. Defaults to the
+	// bucket's default class.
+	StorageClass string
+
+	// StorageClasses overrides StorageClass per namespace, the first
+	// component of the key, e.g. {"blocks": "STANDARD_IA"}.
+	StorageClasses map[string]string
+
+	// Tiering, if set, demotes blocks that go unread to an archive
+	// storage class or another bucket, and promotes them when read.
+	Tiering *TieringConfig
+
+	// Routes stores namespaces in other buckets or root directories, e.g.
+	// {"/pins": {RootDirectory: "meta"}}, so small hot records can live
+	// apart from the blocks. Routed keys are written synchronously and
+	// reported in the heatmap; replication, write-behind and the other
+	// background subsystems apply to the datastore's own keys only.
+	Routes map[string]RouteConfig
+
+	// Tenants are further repositories in the bucket, each under its own
+	// root directory and with its own credentials, opened with the
+	// datastore and returned by Tenant. The datastore needs a
+	// RootDirectory of its own next to theirs.
+	Tenants map[string]TenantConfig
+
+	// AuditLog appends a JSON line with the key, size and calling
+	// operation of every Put and Delete, in batches too, to this file
+	// before the operation is executed. Maintenance operations such as
+	// Compact get a line each.
+	AuditLog string
+
+	// AuditToBucket writes the same records as objects under
+	// rootDirectory/.s3ds/audit, uploaded every AuditInterval (a minute by
+	// default) and on Close. Records buffered when the process dies are
+	// lost.
+	AuditToBucket bool
+	AuditInterval time.Duration
+
+	// Client, if set, is used to talk to the bucket instead of a client
+	// built from the connection settings above, which are then ignored
+	// along with Transport, Endpoints, rate limits and
+	// AdaptiveConcurrency. Tests inject a fake here.
+	Client S3Client
+
+	// ClientOptions customize the SDK client built from the connection
+	// settings, after they are applied: func(*s3.Options) of
+	// aws-sdk-go-v2 to replace the HTTP client, add middleware or change
+	// when checksums are computed, or func(*aws.Config) of aws-sdk-go v1
+	// when built with -tags s3v1.
+	ClientOptions []ClientOption
+
+	// Chaos injects latency, throttling, failures and truncated bodies
+	// into the requests to the bucket, for resilience tests. Like
+	// Transport, it is ignored with a Client set above.
+	Chaos *ChaosConfig
+
+	// Interceptors see every upload, download, HEAD, listing, deletion and
+	// copy of objects, in order before it is made and in reverse after. Headers they add are not sent by a
+	// Client set above, nor to GCS or Azure.
+	Interceptors []Interceptor
+
+	// AutoDetectRegion asks the gateway for the bucket's region at startup
+	// and uses it instead of Region, which then only serves as a hint.
+	AutoDetectRegion bool
+
+	// CreateBucketIfMissing creates the bucket at startup if it does not
+	// exist, in Region. A bucket it creates gets versioning with
+	// BucketVersioning and default encryption with BucketEncryption
+	// (BucketEncryptionAES256 or BucketEncryptionKMS); existing buckets
+	// are left as they are.
+	CreateBucketIfMissing bool
+	BucketVersioning      bool
+	BucketEncryption      string
+
+	// DryRun records writes like AuditLog, or as warnings in the log, but
+	// does not execute them: Put, Delete and batches succeed without
+	// touching the bucket, and maintenance operations fail with
+	// ErrDryRun. Reads still go to the bucket, so a new deployment can be
+	// validated against a production bucket.
+	DryRun bool
 }
 
 func NewS3Datastore(conf Config) (*S3Bucket, error) {
@@ -52,50 +580,446 @@ func NewS3Datastore(conf Config) (*S3Bucket, error) {
 		conf.Workers = defaultWorkers
 	}
 
-// Configure to use Minio Server
-	s3Config := &aws.Config{
- // TODO: determine if we need session token
-		Credentials:      credentials.NewStaticCredentials(conf.AccessKey, conf.SecretKey, ""),
-		Endpoint:         aws.String(conf.Endpoint),
-		Region:           aws.String(conf.Region),
-		DisableSSL:       aws.Bool(conf.Secure),
-		S3ForcePathStyle: aws.Bool(true),
+	if err := applyProvider(&conf); err != nil {
+		return nil, err
+	}
+	if err := validateConfig(&conf); err != nil {
+		return nil, err
 	}
-	s3Session, err := session.NewSession(s3Config)
+
+	keys, err := newKeyTransform(conf.KeyTransform)
+	if err != nil {
+		return nil, err
+	}
+
+	flags, err := newFeatureFlags(conf.FeatureFlags)
 	if err != nil {
 		return nil, err
 	}
-		
-	return &S3Bucket{
-		S3:     s3.New(s3Session),
-		Config: conf,
-	}, nil
+
+	// Configure to use Minio Server
+	logs, err := newLoggers(&conf)
+	if err != nil {
+		return nil, err
+	}
+	s3Log := logs.get(LogS3)
+
+	var (
+		client   S3Client
+		store    ObjectStore
+		adaptive *aimdLimiter
+		dns      *dnsWatcher
+		costs    = newCostCounter()
+	)
+	switch conf.Provider {
+	case providerGCS:
+		if store, err = newGCSStore(&conf); err != nil {
+			return nil, err
+		}
+	case providerAzure:
+		if store, err = newAzureStore(&conf); err != nil {
+			return nil, err
+		}
+	default:
+		client = conf.Client
+		if client == nil {
+			if client, adaptive, dns, err = newClient(&conf, s3Log, costs); err != nil {
+				return nil, err
+			}
+		}
+		store = newS3Store(client, &conf)
+	}
+	var segments *segmentCounter
+	if size := providerProfiles[conf.Provider].segmentSize; size > 0 {
+		segments = newSegmentCounter(size, conf.PartSize)
+		store = &segmentStore{ObjectStore: store, counter: segments}
+	}
+	if conf.Timeouts.enabled() {
+		store = &timeoutStore{ObjectStore: store, timeouts: conf.Timeouts}
+	}
+	var brk *breaker
+	if conf.Breaker != nil {
+		var err error
+		if brk, err = newBreaker(*conf.Breaker, s3Log); err != nil {
+			return nil, err
+		}
+		store = &breakerStore{ObjectStore: store, breaker: brk}
+	}
+	if len(conf.Interceptors) > 0 {
+		store = &interceptorStore{ObjectStore: store, interceptors: conf.Interceptors}
+	}
+	var recent *recentWrites
+	if conf.WriteDedupWindow > 0 {
+		recent = newRecentWrites(conf.WriteDedupWindow, conf.WriteDedupSize)
+		store = &dedupStore{ObjectStore: store, recent: recent}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	b := &S3Bucket{
+		ctx:      ctx,
+		cancel:   cancel,
+		S3:       client,
+		store:    store,
+		Config:   conf,
+		keys:     keys,
+		flags:    flags,
+		adaptive: adaptive,
+		dns:      dns,
+		recent:   recent,
+		breaker:  brk,
+		costs:    costs,
+		logs:     logs,
+		stats:    newAccessStats(conf.StatsWindow),
+		events:   newEvents(),
+		segments: segments,
+		done:     make(chan struct{}),
+	}
+	if conf.MaxBytes > 0 || conf.MaxObjects > 0 {
+		b.quota = newQuota(store, conf.RootDirectory, conf.MaxBytes, conf.MaxObjects, s3Log)
+		b.store = &quotaStore{ObjectStore: store, s: b, quota: b.quota}
+	}
+	if conf.Compression != "" {
+		if b.compressor, err = newCompressor(conf.Compression, conf.CompressionLevel); err != nil {
+			return nil, err
+		}
+	}
+	if b.codecs, err = newCodecs(conf); err != nil {
+		return nil, err
+	}
+	if conf.SnapshotManifest != "" {
+		if b.snapshot, err = b.loadSnapshotView(conf.SnapshotManifest); err != nil {
+			return nil, err
+		}
+	}
+	if !conf.SkipManifestCheck {
+		if err := b.checkManifest(context.Background()); err != nil {
+			return nil, err
+		}
+	}
+	if conf.LeaseTTL > 0 && !b.readOnly() && !conf.DryRun {
+		b.lease = newLease(b, conf.LeaseTTL)
+		if ok, err := b.lease.acquire(context.Background()); err != nil {
+			return nil, fmt.Errorf("s3ds: acquiring writer lease: %s", err)
+		} else if !ok {
+			logs.get(LogLease).Infof("another node holds the writer lease")
+		}
+		go b.lease.renew()
+	}
+	if conf.Lifecycle != nil && !b.readOnly() && !conf.DryRun {
+		if _, err := b.ApplyLifecycle(context.Background(), *conf.Lifecycle); err != nil {
+			return nil, err
+		}
+	}
+	if conf.Tiering != nil {
+		if b.tiering, err = newTiering(b, *conf.Tiering); err != nil {
+			return nil, err
+		}
+		go b.tieringLoop()
+	}
+	if conf.SoftDelete {
+		if err := b.checkVersioning(context.Background()); err != nil {
+			return nil, err
+		}
+		if conf.SoftDeleteRetention > 0 {
+			go b.purgeLoop()
+		}
+	}
+	if conf.CrashDumpFile != "" || conf.CrashDumpToBucket {
+		b.journal = newJournal()
+	}
+	if conf.CrashDumpFile != "" {
+		interval := conf.CrashDumpInterval
+		if interval <= 0 {
+			interval = time.Minute
+		}
+		go b.persistState(interval)
+	}
+	if conf.AuditLog != "" || conf.AuditToBucket || conf.DryRun {
+		if b.auditor, err = newAuditor(b); err != nil {
+			return nil, err
+		}
+	}
+	if len(conf.Routes) > 0 {
+		if b.routes, err = newRoutes(conf); err != nil {
+			return nil, err
+		}
+	}
+	if len(conf.Tenants) > 0 {
+		if b.tenants, err = newTenants(conf); err != nil {
+			return nil, err
+		}
+	}
+	if conf.Packing {
+		if b.packs, err = b.loadPacks(context.Background()); err != nil {
+			return nil, err
+		}
+	}
+	if len(conf.Gateways) > 0 {
+		b.gateways = newGateways(conf.Gateways, conf.GatewayTimeout, logs.get(LogGateway))
+	}
+	if conf.Replica != nil {
+		if b.replica, err = newReplicator(b, *conf.Replica); err != nil {
+			return nil, err
+		}
+		if conf.Replica.RepairInterval > 0 {
+			go b.repairLoop(conf.Replica.RepairInterval)
+		}
+	}
+	if conf.DigestInterval > 0 {
+		if _, err := parseShardFunc(b.digestShard()); err != nil {
+			return nil, err
+		}
+		go b.digestLoop(conf.DigestInterval)
+	}
+	if conf.SmallValueAutoTune {
+		b.tuner = newThresholdTuner(conf.SmallValueThreshold)
+	}
+	if conf.NegativeCacheTTL > 0 {
+		b.negative = newNegativeCache(conf.NegativeCacheTTL, conf.NegativeCacheSize)
+	}
+	if conf.Notifications != nil {
+		if b.notify, err = newNotifications(b, *conf.Notifications); err != nil {
+			return nil, err
+		}
+	}
+	if conf.ChangeLogInterval > 0 {
+		b.changes = newChangeLog(b, conf.ChangeLogInterval)
+		b.events.changes = b.changes
+		go b.changes.run()
+	}
+	if conf.SyncVerify {
+		b.unverified = &unverifiedWrites{keys: make(map[string]struct{})}
+	}
+	if conf.WriteBehind {
+		b.writeBehind = newWriteBehind(b, conf.WriteBehindQueue)
+	}
+	if conf.HeatmapFile != "" || conf.StatsAddr != "" {
+		if b.heat, err = newHeatmap(conf.HeatmapShard); err != nil {
+			return nil, err
+		}
+	}
+	if conf.HeatmapFile != "" {
+		interval := conf.HeatmapInterval
+		if interval <= 0 {
+			interval = time.Minute
+		}
+		go b.exportHeatmap(conf.HeatmapFile, interval)
+	}
+	if conf.CompactInterval > 0 {
+		go b.compactLoop(conf.CompactInterval)
+	}
+	if conf.FeatureFlagsRefresh > 0 {
+		go b.refreshFeatureFlags(conf.FeatureFlagsRefresh)
+	}
+	if b.dns != nil {
+		go b.resolveLoop(conf.Transport.ResolveInterval)
+	}
+	if b.quota != nil {
+		b.quota.start(b)
+	}
+	if conf.StatsAddr != "" {
+		if b.statsServer, err = b.serveStats(conf.StatsAddr); err != nil {
+			return nil, fmt.Errorf("s3ds: stats endpoint: %s", err)
+		}
+	}
+	return b, nil
 }
 
-func (s *S3Bucket) Put(k ds.Key, value []byte) error {
-	_, err := s.S3.PutObject(&s3.PutObjectInput{
-		Bucket: aws.String(s.Bucket),
-		Key:    aws.String(s.s3Path(k.String())),
-		Body:   bytes.NewReader(value),
-	})
-	return parseError(err)
+func (s *S3Bucket) Put(ctx context.Context, k ds.Key, value []byte) (err error) {
+	defer s.stats.done(opPut, time.Now(), &err)
+	return s.putFrom(ctx, "Put", k, value)
 }
 
-func (s *S3Bucket) Get(k ds.Key) ([]byte, error) {
-	resp, err := s.S3.GetObject(&s3.GetObjectInput{
-		Bucket: aws.String(s.Bucket),
-		Key:    aws.String(s.s3Path(k.String())),
-	})
+// putFrom is Put on behalf of the named operation, for the audit log.
+func (s *S3Bucket) putFrom(ctx context.Context, caller string, k ds.Key, value []byte) error {
+	if s.readOnly() {
+		return ErrReadOnly
+	}
+	s.record(opPut, k, len(value))
+	if !s.audit(caller, auditPut, k, len(value)) {
+		return nil
+	}
+	if r := s.route(k); r != s {
+		return r.Put(ctx, k, value)
+	}
+	if s.writeBehind != nil {
+		if s.flags.rolledOut(FeatureWriteBehind, k) {
+			return s.writeBehind.put(ctx, k, value)
+		}
+		// Queued before the rollout changed: it must not land after.
+		if err := s.writeBehind.wait(ctx, k); err != nil {
+			return err
+		}
+	}
+	return s.put(ctx, k, value)
+}
+
+func (s *S3Bucket) put(ctx context.Context, k ds.Key, value []byte) error {
+	dedup := s.recent != nil && immutable(k) && s.flags.rolledOut(FeatureWriteDedup, k)
+	if dedup {
+		seen := s.recent.seen(s.s3Path(k))
+		s.stats.lookup(cacheWriteDedup, seen)
+		if seen {
+			return nil
+		}
+	}
+
+	body := value
+	opts := PutOptions{Tags: s.objectTags(k, len(value)), StorageClass: s.storageClass(k)}
+	if s.compressor != nil && s.flags.rolledOut(FeatureCompression, k) {
+		body, opts.Metadata = s.compressor.compress(value)
+	}
+	var err error
+	if body, opts.Metadata, err = s.encodeCodecs(body, len(value), opts.Metadata); err != nil {
+		return err
+	}
+	opts.Metadata = withMultihash(opts.Metadata, k)
+
+	s.forgetMissing(k)
+	start := time.Now()
+	if s.SkipExisting && immutable(k) {
+		var skipped bool
+		if skipped, err = s.putIfAbsent(ctx, k, body, opts); skipped {
+			return nil
+		}
+	} else {
+		err = s.store.PutObject(ctx, s.s3Path(k), body, opts)
+	}
+	if err == nil {
+		// Gets from now on must not join a download of the old value,
+		// nor trust a miss cached during the upload.
+		s.gets.Forget(k.String())
+		s.forgetMissing(k)
+	}
+	if err == nil && s.packs != nil {
+		if _, ok := s.packs.lookup(k); ok {
+			err = s.unpack(ctx, []ds.Key{k})
+		}
+	}
+	if err == nil && s.tuner != nil {
+		s.tuner.observe(len(body), time.Since(start))
+	}
+	if err == nil && s.tiering != nil && immutable(k) {
+		s.tiering.touch(k)
+	}
+	if err == nil && s.unverified != nil {
+		s.unverified.add(k)
+	}
+	if err == nil && dedup {
+		s.recent.add(s.s3Path(k))
+	}
+	if err == nil {
+		s.events.emit(EventPut, k, len(value))
+	}
+	if err == nil && s.replica != nil {
+		return s.replica.write(ctx, replOpPut, k, value)
+	}
+	return err
+}
+
+func (s *S3Bucket) Get(ctx context.Context, k ds.Key) (value []byte, err error) {
+	defer s.stats.done(opGet, time.Now(), &err)
+	if r := s.route(k); r != s {
+		value, err := r.Get(ctx, k)
+		if err == nil {
+			s.record(opGet, k, len(value))
+		}
+		return value, err
+	}
+	if s.snapshot != nil {
+		return s.snapshotGet(ctx, k)
+	}
+	if s.writeBehind != nil {
+		if value, ok := s.writeBehind.get(k); ok {
+			s.record(opGet, k, len(value))
+			return value, nil
+		}
+	}
+	missing, gen := s.knownMissing(k)
+	if missing {
+		return nil, ds.ErrNotFound
+	}
+	value, err = s.getCoalesced(ctx, k)
+	if err == ds.ErrNotFound && s.replica != nil {
+		value, err = s.replica.replica.get(ctx, k)
+	}
+	if err == ds.ErrNotFound && s.gateways != nil {
+		value, err = s.getFromGateways(ctx, k)
+	}
+	s.recordMissing(k, gen, err)
+	if err == nil {
+		s.record(opGet, k, len(value))
+	}
+	return value, err
+}
+
+func (s *S3Bucket) get(ctx context.Context, k ds.Key) ([]byte, error) {
+	value, meta, err := s.getValue(ctx, k)
+	if err == nil && s.VerifyOnRead {
+		err = verifyBlock(k, value, meta)
+	}
 	if err != nil {
-		return nil, parseError(err)
+		return nil, err
 	}
-	defer resp.Body.Close()
+	return value, nil
+}
 
-	return ioutil.ReadAll(resp.Body)
+// getValue returns the value under k and the metadata of its object, which
+// is nil for packed values.
+func (s *S3Bucket) getValue(ctx context.Context, k ds.Key) ([]byte, map[string]string, error) {
+	if s.packs != nil {
+		if loc, ok := s.packs.lookup(k); ok {
+			value, err := s.getPacked(ctx, loc)
+			return value, nil, err
+		}
+	}
+	data, info, err := s.store.GetObject(ctx, s.s3Path(k))
+	if s.tiering != nil {
+		data, info, err = s.tiering.get(ctx, k, data, info, err)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	value, err := s.decodeValue(data, info.Metadata)
+	return value, info.Metadata, err
 }
 
-func (s *S3Bucket) Has(k ds.Key) (exists bool, err error) {
-	_, err = s.GetSize(k)
+func (s *S3Bucket) Has(ctx context.Context, k ds.Key) (exists bool, err error) {
+	defer s.stats.done(opHas, time.Now(), &err)
+	s.record(opHas, k, 0)
+	if r := s.route(k); r != s {
+		return r.Has(ctx, k)
+	}
+	if s.snapshot != nil {
+		_, ok := s.snapshot.entries[k.String()]
+		return ok, nil
+	}
+	if s.writeBehind != nil {
+		if _, ok := s.writeBehind.get(k); ok {
+			return true, nil
+		}
+	}
+	if s.packs != nil {
+		if _, ok := s.packs.lookup(k); ok {
+			return true, nil
+		}
+	}
+	if s.ExistenceCheck == ExistenceCheckList {
+		missing, gen := s.knownMissing(k)
+		if missing {
+			return false, nil
+		}
+		exists, err = s.hasByList(ctx, k)
+		if err == nil && !exists && s.tiering != nil {
+			exists = s.tiering.elsewhere(k)
+		}
+		if err == nil && !exists {
+			s.recordMissing(k, gen, ds.ErrNotFound)
+		}
+		return exists, err
+	}
+
+	_, err = s.getSizeCached(ctx, k)
 	if err != nil {
 		if err == ds.ErrNotFound {
 			return false, nil
@@ -105,83 +1029,193 @@ func (s *S3Bucket) Has(k ds.Key) (exists bool, err error) {
 	return true, nil
 }
 
-func (s *S3Bucket) GetSize(k ds.Key) (size int, err error) {
-	resp, err := s.S3.HeadObject(&s3.HeadObjectInput{
-		Bucket: aws.String(s.Bucket),
-		Key:    aws.String(s.s3Path(k.String())),
-	})
+// hasByList checks for k with a listing of at most one object starting
+// with its exact name.
+func (s *S3Bucket) hasByList(ctx context.Context, k ds.Key) (bool, error) {
+	name := s.s3Path(k)
+	objs, _, err := s.store.List(ctx, name, "", 1)
 	if err != nil {
-		if s3Err, ok := err.(awserr.Error); ok && s3Err.Code() == "NotFound" {
-			return -1, ds.ErrNotFound
+		return false, err
+	}
+	return len(objs) > 0 && objs[0].Name == name, nil
+}
+
+func (s *S3Bucket) GetSize(ctx context.Context, k ds.Key) (size int, err error) {
+	defer s.stats.done(opGetSize, time.Now(), &err)
+	return s.getSizeCached(ctx, k)
+}
+
+// getSizeCached is GetSize without the statistics, which Has keeps.
+func (s *S3Bucket) getSizeCached(ctx context.Context, k ds.Key) (int, error) {
+	if r := s.route(k); r != s {
+		return r.GetSize(ctx, k)
+	}
+	if s.snapshot != nil {
+		return s.snapshotGetSize(ctx, k)
+	}
+	if s.writeBehind != nil {
+		if value, ok := s.writeBehind.get(k); ok {
+			return len(value), nil
+		}
+	}
+	missing, gen := s.knownMissing(k)
+	if missing {
+		return -1, ds.ErrNotFound
+	}
+	size, err := s.getSize(ctx, k)
+	s.recordMissing(k, gen, err)
+	return size, err
+}
+
+func (s *S3Bucket) getSize(ctx context.Context, k ds.Key) (int, error) {
+	if s.packs != nil {
+		if loc, ok := s.packs.lookup(k); ok {
+			return int(loc.length), nil
 		}
+	}
+	info, err := s.store.Head(ctx, s.s3Path(k))
+	if err == ds.ErrNotFound && s.tiering != nil {
+		info, err = s.tiering.head(ctx, k)
+	}
+	if err != nil {
 		return -1, err
 	}
-	return int(*resp.ContentLength), nil
+	if size := info.Metadata[metaSize]; size != "" {
+		return strconv.Atoi(size)
+	}
+	return int(info.Size), nil
 }
 
-func (s *S3Bucket) Delete(k ds.Key) error {
-	_, err := s.S3.DeleteObject(&s3.DeleteObjectInput{
-		Bucket: aws.String(s.Bucket),
-		Key:    aws.String(s.s3Path(k.String())),
-	})
-	return parseError(err)
+func (s *S3Bucket) Delete(ctx context.Context, k ds.Key) (err error) {
+	defer s.stats.done(opDelete, time.Now(), &err)
+	if s.readOnly() {
+		return ErrReadOnly
+	}
+	s.record(opDelete, k, 0)
+	if !s.audit("Delete", auditDelete, k, 0) {
+		return nil
+	}
+	if r := s.route(k); r != s {
+		return r.Delete(ctx, k)
+	}
+	if s.writeBehind != nil {
+		// Let a queued upload of k land first so it cannot resurrect it.
+		if err := s.writeBehind.wait(ctx, k); err != nil {
+			return err
+		}
+	}
+	if err := s.writeTombstones(ctx, "Delete", []ds.Key{k}); err != nil {
+		return err
+	}
+	err = s.store.DeleteMany(ctx, []string{s.s3Path(k)})
+	if err == nil {
+		s.gets.Forget(k.String())
+		s.events.emit(EventDelete, k, 0)
+		s.forgetUnverified(k)
+	}
+	if err == nil && s.tiering != nil {
+		err = s.tiering.deleted(ctx, k)
+	}
+	if err == nil && s.packs != nil {
+		err = s.unpack(ctx, []ds.Key{k})
+	}
+	if err == nil && s.replica != nil {
+		return s.replica.write(ctx, replOpDelete, k, nil)
+	}
+	return err
 }
 
-func (s *S3Bucket) Query(q dsq.Query) (dsq.Results, error) {
+func (s *S3Bucket) Query(ctx context.Context, q dsq.Query) (dsq.Results, error) {
 	if q.Orders != nil || q.Filters != nil {
 		return nil, fmt.Errorf("s3ds: filters or orders are not supported")
 	}
+	if res, ok, err := s.routedQuery(ctx, q); ok {
+		return res, err
+	}
+	return s.query(ctx, q)
+}
+
+// query lists the datastore's own keys.
+func (s *S3Bucket) query(ctx context.Context, q dsq.Query) (dsq.Results, error) {
+	if s.snapshot != nil {
+		return s.snapshotQuery(ctx, q)
+	}
+
+	if s.writeBehind != nil {
+		if err := s.writeBehind.wait(ctx, ds.NewKey(q.Prefix)); err != nil {
+			return nil, err
+		}
+	}
+
+	// Values are fetched by a pipeline in front of the keys-only listing.
+	withValues := !q.KeysOnly
+	kq := q
+	if withValues {
+		kq.KeysOnly, kq.ReturnsSizes = true, false
+	}
+
+	// The prefix is cleaned like go-datastore does, so that it cannot
+	// escape the root directory.
+	qPrefix := ds.NewKey(q.Prefix).String()
+	prefix, filter := s.keys.listPrefix(qPrefix)
+	listPrefix := path.Join(s.RootDirectory, prefix)
+	if !filter && qPrefix != "/" {
+		// Only keys under the namespace, not /pins for /pin.
+		listPrefix += "/"
+	}
 
 	limit := q.Limit + q.Offset
-	if limit == 0 || limit > listMax {
+	if filter || limit == 0 || limit > listMax {
 		limit = listMax
 	}
 
-	resp, err := s.S3.ListObjectsV2(&s3.ListObjectsV2Input{
-		Bucket:  aws.String(s.Bucket),
-		Prefix:  aws.String(s.s3Path(q.Prefix)),
-		MaxKeys: aws.Int64(int64(limit)),
-	})
+	objs, token, err := s.store.List(ctx, listPrefix, "", limit)
 	if err != nil {
 		return nil, err
 	}
 
-	index := q.Offset
-	nextValue := func() (dsq.Result, bool) {
-		for index >= len(resp.Contents) {
-			if !*resp.IsTruncated {
-				return dsq.Result{}, false
-			}
-
-			index -= len(resp.Contents)
-
-			resp, err = s.S3.ListObjectsV2(&s3.ListObjectsV2Input{
-				Bucket:            aws.String(s.Bucket),
-				Prefix:            aws.String(s.s3Path(q.Prefix)),
-				Delimiter:         aws.String("/"),
-				MaxKeys:           aws.Int64(listMax),
-				ContinuationToken: resp.NextContinuationToken,
-			})
-			if err != nil {
-				return dsq.Result{Error: err}, false
-			}
-		}
+	// Packed keys follow the listed objects.
+	var packed []string
+	if s.packs != nil {
+		packed = s.packs.keys(q.Prefix)
+	}
 
-		entry := dsq.Entry{
-			Key: ds.NewKey(*resp.Contents[index].Key).String(),
+	var entries []dsq.Entry
+	skip := q.Offset
+	returned := 0
+	nextValue := func() (dsq.Result, bool) {
+		if q.Limit > 0 && returned >= q.Limit {
+			return dsq.Result{}, false
 		}
-		if !q.KeysOnly {
-			value, err := s.Get(ds.NewKey(entry.Key))
-			if err != nil {
+		for len(entries) == 0 {
+			if objs == nil {
+				if token == "" {
+					res, ok := s.nextPacked(ctx, kq, &packed, &skip)
+					if ok {
+						returned++
+					}
+					return res, ok
+				}
+				objs, token, err = s.store.List(ctx, listPrefix, token, listMax)
+				if err != nil {
+					return dsq.Result{Error: err}, false
+				}
+			}
+			page := objs
+			objs = nil
+			if entries, err = s.queryEntries(ctx, kq, page, filter, &skip, q.Limit-returned); err != nil {
 				return dsq.Result{Error: err}, false
 			}
-			entry.Value = value
 		}
-
-		index++
+		entry := entries[0]
+		entries = entries[1:]
+		returned++
 		return dsq.Result{Entry: entry}, true
 	}
 
+	if withValues {
+		return dsq.ResultsFromIterator(q, pipelineValues(ctx, nextValue, s.Get, s.Workers)), nil
+	}
 	return dsq.ResultsFromIterator(q, dsq.Iterator{
 		Close: func() error {
 			return nil
@@ -190,156 +1224,476 @@ func (s *S3Bucket) Query(q dsq.Query) (dsq.Results, error) {
 	}), nil
 }
 
-func (s *S3Bucket) Batch() (ds.Batch, error) {
-	return &s3Batch{
+// queryEntries turns a page of listed objects into the keys-only entries
+// of q, after skipping the first skip of them and keeping at most max, if
+// positive.
+func (s *S3Bucket) queryEntries(ctx context.Context, q dsq.Query, objs []ObjectInfo, filter bool, skip *int, max int) ([]dsq.Entry, error) {
+	var (
+		entries []dsq.Entry
+		sizes   []int64
+	)
+	for _, obj := range objs {
+		if max > 0 && len(entries) == max {
+			break
+		}
+		if s.isMetaPath(obj.Name) {
+			continue
+		}
+		key := s.fromS3Path(obj.Name)
+		if !inQuery(key, q.Prefix) {
+			continue
+		}
+		if s.packs != nil {
+			// A packed value shadows an older object of the same key.
+			if _, ok := s.packs.lookup(key); ok {
+				continue
+			}
+		}
+		if *skip > 0 {
+			*skip--
+			continue
+		}
+		entries = append(entries, dsq.Entry{Key: key.String(), Size: -1})
+		sizes = append(sizes, obj.Size)
+	}
+
+	var err error
+	switch {
+	case !q.ReturnsSizes:
+	case s.storesValues():
+		// The listed size is that of the stored object, which is the
+		// value unless it was compressed or encoded.
+		for i := range entries {
+			entries[i].Size = int(sizes[i])
+		}
+	default:
+		err = forEach(ctx, len(entries), s.Workers, func(ctx context.Context, i int) error {
+			size, err := s.GetSize(ctx, ds.NewKey(entries[i].Key))
+			if err != nil {
+				return err
+			}
+			entries[i].Size = size
+			return nil
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func (s *S3Bucket) Batch(ctx context.Context) (ds.Batch, error) {
+	if s.readOnly() {
+		return nil, ErrReadOnly
+	}
+	if len(s.routes) > 0 {
+		return &routedBatch{s: s, batches: make(map[*S3Bucket]ds.Batch)}, nil
+	}
+	return s.newBatch(), nil
+}
+
+func (s *S3Bucket) newBatch() *s3Batch {
+	b := &s3Batch{
 		s:          s,
 		ops:        make(map[string]batchOp),
 		numWorkers: s.Workers,
-	}, nil
+	}
+	if s.PipelinedBatches {
+		b.pipeline = newBatchPipeline(s, s.Workers)
+	}
+	return b
 }
 
+// Close waits up to ShutdownTimeout for outstanding writes, cancels the
+// rest and stops background work.
 func (s *S3Bucket) Close() error {
-	return nil
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.done)
+		defer s.events.close()
+		if s.statsServer != nil {
+			s.statsServer.Close()
+		}
+		if s.notify != nil {
+			s.notify.close()
+		}
+		err = s.drain()
+		if s.writeBehind != nil {
+			s.writeBehind.close()
+		}
+		if s.changes != nil {
+			if cerr := s.changes.flush(context.Background()); err == nil {
+				err = cerr
+			}
+		}
+		if s.tiering != nil {
+			if terr := s.tiering.save(); err == nil {
+				err = terr
+			}
+		}
+		if s.lease != nil {
+			if lerr := s.lease.release(context.Background()); err == nil {
+				err = lerr
+			}
+		}
+		if s.auditor != nil {
+			if aerr := s.auditor.close(); err == nil {
+				err = aerr
+			}
+		}
+		if s.replica != nil {
+			if rerr := s.replica.close(); err == nil {
+				err = rerr
+			}
+		}
+		if rerr := s.closeRoutes(); err == nil {
+			err = rerr
+		}
+		if terr := s.closeTenants(); err == nil {
+			err = terr
+		}
+		// Last, as everything above may log.
+		if lerr := s.logs.close(); err == nil {
+			err = lerr
+		}
+	})
+	return err
 }
 
-func (s *S3Bucket) s3Path(p string) string {
-	return path.Join(s.RootDirectory, p)
+func (s *S3Bucket) s3Path(k ds.Key) string {
+	return path.Join(s.RootDirectory, s.keys.objectName(k))
 }
 
-func parseError(err error) error {
-	if s3Err, ok := err.(awserr.Error); ok && s3Err.Code() == s3.ErrCodeNoSuchKey {
-		return ds.ErrNotFound
+// fromS3Path is the inverse of s3Path.
+func (s *S3Bucket) fromS3Path(p string) ds.Key {
+	if s.RootDirectory != "" {
+		p = strings.TrimPrefix(p, path.Clean(s.RootDirectory))
 	}
-	return nil
+	return s.keys.datastoreKey(strings.TrimPrefix(p, "/"))
 }
 
+// hasKeyPrefix reports whether k is prefix or under it, matching whole
+// namespaces like go-datastore: /pin is not a prefix of /pins.
+func hasKeyPrefix(k ds.Key, prefix string) bool {
+	p := ds.NewKey(prefix)
+	return p.String() == "/" || k.Equal(p) || strings.HasPrefix(k.String(), p.String()+"/")
+}
+
+// inQuery reports whether a query for prefix returns k: like
+// go-datastore, it only returns keys under the prefix, not the prefix
+// itself.
+func inQuery(k ds.Key, prefix string) bool {
+	p := ds.NewKey(prefix)
+	return p.String() == "/" || strings.HasPrefix(k.String(), p.String()+"/")
+}
+
+// s3Batch holds puts and deletes until Commit. The last operation on a
+// key wins: a Put after a Delete of the same key stores the value, a
+// Delete after a Put removes it, and the operations before are dropped.
+// Keys are matched by object name, so two keys stored under the same
+// object do not both reach the bucket. Commit applies the remaining
+// operations in the order they were last made.
 type s3Batch struct {
 	s          *S3Bucket
 	ops        map[string]batchOp
 	numWorkers int
+	pipeline   *batchPipeline
+
+	// bytes is the size of the values in ops.
+	bytes int
+
+	// seq numbers the operations, in order.
+	seq int
 }
 
 type batchOp struct {
+	key    ds.Key
 	val    []byte
 	delete bool
-}
+	seq    int
 
+	// pipelined puts have their upload started by the pipeline, and
+	// uploaded puts have it done. Commit puts those whose upload failed
+	// again.
+	pipelined bool
+	uploaded  bool
+}
 
-func (b *s3Batch) Put(k ds.Key, val []byte) error {
-	b.ops[k.String()] = batchOp{
+func (b *s3Batch) Put(ctx context.Context, k ds.Key, val []byte) error {
+	if b.pipeline != nil && immutable(k) {
+		if op, ok := b.ops[b.s.s3Path(k)]; ok && (op.pipelined || op.uploaded) {
+			return nil
+		}
+		// set numbers the operation b.seq+1.
+		if err := b.pipeline.upload(ctx, k, val, b.seq+1); err != nil {
+			return err
+		}
+		b.set(k, batchOp{val: val, pipelined: true})
+		return b.flushIfFull(ctx)
+	}
+	b.set(k, batchOp{
 		val:    val,
 		delete: false,
-	}
-	return nil
+	})
+	return b.flushIfFull(ctx)
 }
 
-func (b *s3Batch) Delete(k ds.Key) error {
-	b.ops[k.String()] = batchOp{
+func (b *s3Batch) Delete(ctx context.Context, k ds.Key) error {
+	b.set(k, batchOp{
 		val:    nil,
 		delete: true,
+	})
+	return b.flushIfFull(ctx)
+}
+
+// set records op as the last operation on k.
+func (b *s3Batch) set(k ds.Key, op batchOp) {
+	name := b.s.s3Path(k)
+	if old, ok := b.ops[name]; ok {
+		b.bytes -= len(old.val)
+	}
+	b.seq++
+	op.key, op.seq = k, b.seq
+	b.ops[name] = op
+	b.bytes += len(op.val)
+}
+
+// sortedOps returns the operations of the batch in the order they were
+// made.
+func (b *s3Batch) sortedOps() []batchOp {
+	ops := make([]batchOp, 0, len(b.ops))
+	for _, op := range b.ops {
+		ops = append(ops, op)
+	}
+	sort.Slice(ops, func(i, j int) bool { return ops[i].seq < ops[j].seq })
+	return ops
+}
+
+// flushIfFull commits the operations held so far as a sub-batch once they
+// reach MaxBatchOps or MaxBatchBytes, and starts the batch over. If the
+// commit fails the operations are kept, and the next Put, Delete or
+// Commit tries them again.
+func (b *s3Batch) flushIfFull(ctx context.Context) error {
+	full := (b.s.MaxBatchOps > 0 && len(b.ops) >= b.s.MaxBatchOps) ||
+		(b.s.MaxBatchBytes > 0 && b.bytes >= b.s.MaxBatchBytes)
+	if !full {
+		return nil
+	}
+	if err := b.Commit(ctx); err != nil {
+		return err
+	}
+	b.ops = make(map[string]batchOp)
+	b.bytes = 0
+	if b.pipeline != nil {
+		b.pipeline = newBatchPipeline(b.s, b.s.Workers)
 	}
 	return nil
 }
 
-func (b *s3Batch) Commit() error {
+// Commit applies the batch. Once ctx is done no further jobs are started,
+// in-flight requests are cancelled and a *BatchError reports how much of
+// the batch was applied.
+func (b *s3Batch) Commit(ctx context.Context) error {
+	if b.s.auditor != nil && !b.auditOps(b.s.auditor) {
+		return nil
+	}
+	ctx, end := b.s.beginWrite(ctx)
+	defer end()
+	start := time.Now()
+	log := b.s.logs.get(LogBatch)
+
+	// Deletes must not overtake the uploads of the keys they delete.
+	var pipelined int
+	if b.pipeline != nil {
+		uploaded, failed := b.pipeline.wait(ctx)
+		for name, op := range b.ops {
+			if op.pipelined {
+				op.pipelined, op.uploaded = false, uploaded[op.seq]
+				b.ops[name] = op
+			}
+		}
+		pipelined = len(uploaded)
+		if failed > 0 {
+			log.Infof("%d pipelined uploads failed; putting them again", failed)
+		}
+		if b.pipeline.ctx.Err() != nil {
+			// Cancelled with ctx; later puts need a pipeline of their own.
+			b.pipeline = newBatchPipeline(b.s, b.s.Workers)
+		}
+	}
+
 	var (
-		deleteObjs []*s3.ObjectIdentifier
+		deleteKeys []ds.Key
 		putKeys    []ds.Key
+		uploaded   []ds.Key
 	)
-	for k, op := range b.ops {
-		if op.delete {
-			deleteObjs = append(deleteObjs, &s3.ObjectIdentifier{
-				Key: aws.String(k),
+	for _, op := range b.sortedOps() {
+		switch {
+		case op.delete:
+			deleteKeys = append(deleteKeys, op.key)
+		case op.uploaded:
+			uploaded = append(uploaded, op.key)
+		default:
+			putKeys = append(putKeys, op.key)
+		}
+	}
+
+	if b.s.writeBehind != nil {
+		// Let queued uploads of the batch's keys land first so they cannot
+		// overwrite it.
+		keys := make([]ds.Key, 0, len(b.ops))
+		for _, op := range b.ops {
+			keys = append(keys, op.key)
+		}
+		if err := b.s.writeBehind.waitKeys(ctx, keys); err != nil {
+			return err
+		}
+	}
+
+	// Before and after: a miss cached while the batch is uploading would
+	// outlive it.
+	b.s.forgetMissing(putKeys...)
+	defer b.s.forgetMissing(putKeys...)
+	defer b.s.forgetMissing(uploaded...)
+
+	var jobs []func(context.Context) error
+	objectKeys := putKeys
+	if b.s.packs != nil {
+		jobs, objectKeys = b.packJobs(putKeys)
+		if len(deleteKeys) > 0 {
+			jobs = append(jobs, func(ctx context.Context) error {
+				return b.s.unpack(ctx, deleteKeys)
 			})
-		} else {
-			putKeys = append(putKeys, ds.NewKey(k))
 		}
 	}
+	for _, k := range objectKeys {
+		jobs = append(jobs, b.newPutJob(k, b.ops[b.s.s3Path(k)].val))
+	}
+	for i := 0; i < len(deleteKeys); i += deleteMax {
+		limit := deleteMax
+		if len(deleteKeys[i:]) < limit {
+			limit = len(deleteKeys[i:])
+		}
 
-	numJobs := len(putKeys) + (len(deleteObjs) / deleteMax)
-	jobs := make(chan func() error, numJobs)
-	results := make(chan error, numJobs)
+		jobs = append(jobs, b.newDeleteJob(deleteKeys[i:i+limit]))
+	}
 
 	numWorkers := b.numWorkers
-	if numJobs < numWorkers {
-		numWorkers = numJobs
+	if len(jobs) < numWorkers {
+		numWorkers = len(jobs)
 	}
 
+	queue := make(chan func(context.Context) error)
+	results := make(chan error, len(jobs))
+
 	var wg sync.WaitGroup
 	wg.Add(numWorkers)
-	defer wg.Wait()
-
 	for w := 0; w < numWorkers; w++ {
 		go func() {
 			defer wg.Done()
-			worker(jobs, results)
+			worker(ctx, queue, results)
 		}()
 	}
 
-	for _, k := range putKeys {
-		jobs <- b.newPutJob(k, b.ops[k.String()].val)
+	started := 0
+enqueue:
+	for _, job := range jobs {
+		select {
+		case queue <- job:
+			started++
+		case <-ctx.Done():
+			break enqueue
+		}
 	}
+	close(queue)
+	wg.Wait()
 
-	if len(deleteObjs) > 0 {
-		for i := 0; i < len(deleteObjs); i += deleteMax {
-			limit := deleteMax
-			if len(deleteObjs[i:]) < limit {
-				limit = len(deleteObjs[i:])
-			}
-
-			jobs <- b.newDeleteJob(deleteObjs[i : i+limit])
+	berr := &BatchError{Done: pipelined, Pending: len(jobs) - started}
+	for i := 0; i < started; i++ {
+		if err := <-results; err != nil {
+			berr.Errs = append(berr.Errs, err)
+		} else {
+			berr.Done++
 		}
 	}
-	close(jobs)
 
-	var errs []string
-	for i := 0; i < numJobs; i++ {
-		err := <-results
-		if err != nil {
-			errs = append(errs, err.Error())
-		}
+	if (berr.Pending > 0 || len(berr.Errs) > 0) && b.s.ctx.Err() != nil {
+		atomic.AddInt64(&b.s.cancelledBatches, 1)
 	}
-	if len(errs) > 0 {
-		return fmt.Errorf("s3ds: failed batch operation:\n%s", strings.Join(errs, "\n"))
+	if berr.Pending > 0 || len(berr.Errs) > 0 {
+		log.Warnf("commit of %d puts and %d deletes incomplete: %d jobs failed, %d not started",
+			len(putKeys)+len(uploaded), len(deleteKeys), len(berr.Errs), berr.Pending)
+		return berr
 	}
+	log.Infof("committed %d puts (%d bytes) and %d deletes in %s",
+		len(putKeys)+len(uploaded), b.bytes, len(deleteKeys), time.Since(start).Round(time.Millisecond))
 
 	return nil
 }
 
-func (b *s3Batch) newPutJob(k ds.Key, value []byte) func() error {
-	return func() error {
-		return b.s.Put(k, value)
+// BatchError is returned by a batch commit that did not apply every job. A
+// job is a single put, a pack of small puts or a DeleteObjects call of up
+// to 1000 keys.
+type BatchError struct {
+	Done    int
+	Pending int
+	Errs    []error
+}
+
+func (e *BatchError) Error() string {
+	errs := make([]string, 0, len(e.Errs)+1)
+	for _, err := range e.Errs {
+		errs = append(errs, err.Error())
+	}
+	if e.Pending > 0 {
+		errs = append(errs, fmt.Sprintf("%d jobs not started", e.Pending))
 	}
+	return fmt.Sprintf("s3ds: failed batch operation:\n%s", strings.Join(errs, "\n"))
 }
 
-func (b *s3Batch) newDeleteJob(objs []*s3.ObjectIdentifier) func() error {
-	return func() error {
-		resp, err := b.s.S3.DeleteObjects(&s3.DeleteObjectsInput{
-			Bucket: aws.String(b.s.Bucket),
-			Delete: &s3.Delete{
-				Objects: objs,
-			},
-		})
-		if err != nil {
+func (b *s3Batch) newPutJob(k ds.Key, value []byte) func(context.Context) error {
+	return func(ctx context.Context) error {
+		return b.s.put(ctx, k, value)
+	}
+}
+
+func (b *s3Batch) newDeleteJob(keys []ds.Key) func(context.Context) error {
+	return func(ctx context.Context) error {
+		if err := b.s.writeTombstones(ctx, "Batch", keys); err != nil {
 			return err
 		}
-
-		var errs []string
-		for _, err := range resp.Errors {
-			errs = append(errs, err.String())
+		names := make([]string, len(keys))
+		for i, k := range keys {
+			names[i] = b.s.s3Path(k)
+		}
+		if err := b.s.store.DeleteMany(ctx, names); err != nil {
+			return err
 		}
+		for _, k := range keys {
+			b.s.gets.Forget(k.String())
+			b.s.events.emit(EventDelete, k, 0)
+		}
+		b.s.forgetUnverified(keys...)
 
-		if len(errs) > 0 {
-			return fmt.Errorf("failed to delete objects: %s", errs)
+		if b.s.replica != nil {
+			var errs []string
+			for _, k := range keys {
+				if err := b.s.replica.write(ctx, replOpDelete, k, nil); err != nil {
+					errs = append(errs, err.Error())
+				}
+			}
+			if len(errs) > 0 {
+				return fmt.Errorf("failed to delete objects: %s", errs)
+			}
 		}
 
 		return nil
 	}
 }
 
-func worker(jobs <-chan func() error, results chan<- error) {
+func worker(ctx context.Context, jobs <-chan func(context.Context) error, results chan<- error) {
 	for j := range jobs {
-		results <- j()
+		results <- j(ctx)
 	}
 }
 
@@ -0,0 +1,296 @@
+package s3_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+
+	s3ds "github.com/ipfs-s3c-storj-plugin"
+	"github.com/ipfs-s3c-storj-plugin/s3test"
+)
+
+func newFakeDatastore(t *testing.T, conf s3ds.Config) *s3ds.S3Bucket {
+	t.Helper()
+	d, err := openFakeDatastore(t, s3test.New(), conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// openFakeDatastore opens a datastore with conf in a bucket of f, closed
+// when the test ends.
+func openFakeDatastore(t *testing.T, f *s3test.Fake, conf s3ds.Config) (*s3ds.S3Bucket, error) {
+	c := f.Config("s3test")
+	conf.Bucket, conf.Client, conf.Region = c.Bucket, c.Client, c.Region
+	d, err := s3ds.NewS3Datastore(conf)
+	if err != nil {
+		return nil, err
+	}
+	t.Cleanup(func() { d.Close() })
+	return d, nil
+}
+
+// blockKey returns the key the blockstore stores value under.
+func blockKey(value []byte) ds.Key {
+	sum := sha256.Sum256(value)
+	mh := append([]byte{0x12, 0x20}, sum[:]...)
+	return ds.NewKey("/blocks/" + base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(mh))
+}
+
+// checkValue fails unless k holds want, or is missing if want is nil.
+func checkValue(t *testing.T, d *s3ds.S3Bucket, k ds.Key, want []byte) {
+	t.Helper()
+	got, err := d.Get(context.Background(), k)
+	switch {
+	case want == nil && err != ds.ErrNotFound:
+		t.Errorf("%s: got %q, %v, want it deleted", k, got, err)
+	case want != nil && err != nil:
+		t.Errorf("%s: %s", k, err)
+	case want != nil && !bytes.Equal(got, want):
+		t.Errorf("%s: got %q, want %q", k, got, want)
+	}
+}
+
+// TestBatchLastOpWins checks that Commit applies the last operation on a
+// key, and on keys stored under the same object name.
+func TestBatchLastOpWins(t *testing.T) {
+	ctx := context.Background()
+	k := ds.NewKey("/a")
+
+	t.Run("put then delete", func(t *testing.T) {
+		d := newFakeDatastore(t, s3ds.Config{})
+		b, err := d.Batch(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Put(ctx, k, []byte("a")); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Delete(ctx, k); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Commit(ctx); err != nil {
+			t.Fatal(err)
+		}
+		checkValue(t, d, k, nil)
+	})
+
+	t.Run("delete then put", func(t *testing.T) {
+		d := newFakeDatastore(t, s3ds.Config{})
+		if err := d.Put(ctx, k, []byte("old")); err != nil {
+			t.Fatal(err)
+		}
+		b, err := d.Batch(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Delete(ctx, k); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Put(ctx, k, []byte("new")); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Commit(ctx); err != nil {
+			t.Fatal(err)
+		}
+		checkValue(t, d, k, []byte("new"))
+	})
+
+	// With the flatfs layout the block key /CIQAXYZ and the key
+	// /XY/CIQAXYZ.data are both stored as XY/CIQAXYZ.data.
+	block, file := ds.NewKey("/CIQAXYZ"), ds.NewKey("/XY/CIQAXYZ.data")
+	flatfs := s3ds.Config{RootDirectory: "ipfs", KeyTransform: s3ds.KeyTransformFlatfs}
+
+	t.Run("same object put twice", func(t *testing.T) {
+		d := newFakeDatastore(t, flatfs)
+		b, err := d.Batch(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Put(ctx, block, []byte("block")); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Put(ctx, file, []byte("file")); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Commit(ctx); err != nil {
+			t.Fatal(err)
+		}
+		checkValue(t, d, block, []byte("file"))
+	})
+
+	t.Run("same object put then deleted", func(t *testing.T) {
+		d := newFakeDatastore(t, flatfs)
+		b, err := d.Batch(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Put(ctx, block, []byte("block")); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Delete(ctx, file); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Commit(ctx); err != nil {
+			t.Fatal(err)
+		}
+		checkValue(t, d, block, nil)
+	})
+}
+
+// failPuts returns an interceptor failing the uploads of k while fail is
+// set.
+func failPuts(k ds.Key, fail *atomic.Bool) s3ds.Interceptor {
+	return s3ds.Interceptor{
+		Before: func(_ context.Context, call *s3ds.Call) error {
+			if call.Op == s3ds.OpPutObject && strings.HasSuffix(call.Name, k.BaseNamespace()) && fail.Load() {
+				return errors.New("injected")
+			}
+			return nil
+		},
+	}
+}
+
+// TestPipelinedBatchRetry checks that a block whose pipelined upload
+// failed is put again by the next commit.
+func TestPipelinedBatchRetry(t *testing.T) {
+	ctx := context.Background()
+	a, b, c := []byte("a"), []byte("b"), []byte("c")
+
+	t.Run("commit", func(t *testing.T) {
+		var fail atomic.Bool
+		fail.Store(true)
+		d := newFakeDatastore(t, s3ds.Config{
+			PipelinedBatches: true,
+			Interceptors:     []s3ds.Interceptor{failPuts(blockKey(a), &fail)},
+		})
+		batch, err := d.Batch(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, v := range [][]byte{a, b} {
+			if err := batch.Put(ctx, blockKey(v), v); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := batch.Commit(ctx); err == nil {
+			t.Fatal("commit succeeded with a failing upload")
+		}
+		fail.Store(false)
+		if err := batch.Commit(ctx); err != nil {
+			t.Fatal(err)
+		}
+		checkValue(t, d, blockKey(a), a)
+		checkValue(t, d, blockKey(b), b)
+	})
+
+	t.Run("sub-batch", func(t *testing.T) {
+		var fail atomic.Bool
+		fail.Store(true)
+		d := newFakeDatastore(t, s3ds.Config{
+			PipelinedBatches: true,
+			MaxBatchOps:      2,
+			Interceptors:     []s3ds.Interceptor{failPuts(blockKey(a), &fail)},
+		})
+		batch, err := d.Batch(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := batch.Put(ctx, blockKey(a), a); err != nil {
+			t.Fatal(err)
+		}
+		// Fills the sub-batch, whose commit fails.
+		if err := batch.Put(ctx, blockKey(b), b); err == nil {
+			t.Fatal("sub-batch committed with a failing upload")
+		}
+		fail.Store(false)
+		if err := batch.Put(ctx, blockKey(c), c); err != nil {
+			t.Fatal(err)
+		}
+		if err := batch.Commit(ctx); err != nil {
+			t.Fatal(err)
+		}
+		for _, v := range [][]byte{a, b, c} {
+			checkValue(t, d, blockKey(v), v)
+		}
+	})
+}
+
+// TestGetManyWriteBehind checks that GetMany sees values still queued for
+// upload, like Get.
+func TestGetManyWriteBehind(t *testing.T) {
+	ctx := context.Background()
+	d := newFakeDatastore(t, s3ds.Config{WriteBehind: true})
+	keys := []ds.Key{ds.NewKey("/a"), ds.NewKey("/missing"), ds.NewKey("/b")}
+	for _, k := range []ds.Key{keys[0], keys[2]} {
+		if err := d.Put(ctx, k, []byte(k.String())); err != nil {
+			t.Fatal(err)
+		}
+	}
+	values, err := d.GetMany(ctx, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(values[0]) != "/a" || values[1] != nil || string(values[2]) != "/b" {
+		t.Errorf("got %q", values)
+	}
+}
+
+// TestHasManyWriteBehind checks that HasMany, answered from a listing,
+// counts values still queued for upload.
+func TestHasManyWriteBehind(t *testing.T) {
+	ctx := context.Background()
+	d := newFakeDatastore(t, s3ds.Config{WriteBehind: true})
+	keys := make([]ds.Key, 100)
+	for i := range keys {
+		keys[i] = ds.NewKey(fmt.Sprintf("/many/%d", i))
+		if err := d.Put(ctx, keys[i], []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	exists, err := d.HasMany(ctx, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, ok := range exists {
+		if !ok {
+			t.Errorf("%s missing", keys[i])
+		}
+	}
+}
+
+// TestSyncVerifyDeleted checks that Sync does not wait for keys deleted
+// after they were written.
+func TestSyncVerifyDeleted(t *testing.T) {
+	ctx := context.Background()
+	d := newFakeDatastore(t, s3ds.Config{SyncVerify: true, SyncVerifyTimeout: time.Second})
+	k := ds.NewKey("/a")
+	if err := d.Put(ctx, k, []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Delete(ctx, k); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Sync(ctx, ds.NewKey("/")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestLogLevelsUnknownSubsystem checks that a level for a subsystem that
+// does not exist is refused rather than ignored.
+func TestLogLevelsUnknownSubsystem(t *testing.T) {
+	_, err := openFakeDatastore(t, s3test.New(), s3ds.Config{LogLevels: map[string]string{"scrub": "debug"}})
+	if err == nil {
+		t.Fatal("unknown subsystem accepted")
+	}
+}
@@ -0,0 +1,333 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// s3Store is the ObjectStore of S3 compatible gateways. The quirks of the
+// provider are taken from its profile.
+type s3Store struct {
+	client S3Client
+	bucket string
+	grants Grants
+
+	// partSize, if set, splits larger uploads into multipart uploads of
+	// parts this size.
+	partSize int
+
+	// deleteVersions deletes every version of an object instead of adding
+	// a delete marker, for gateways that only hide deleted objects.
+	deleteVersions bool
+
+	// checksums sends Content-MD5, and x-amz-checksum-sha256 with sha256,
+	// on uploads and verifies downloads.
+	checksums bool
+	sha256    bool
+}
+
+func newS3Store(client S3Client, conf *Config) *s3Store {
+	profile := providerProfiles[conf.Provider]
+	return &s3Store{
+		client:         client,
+		bucket:         conf.Bucket,
+		grants:         conf.Grants,
+		partSize:       conf.PartSize,
+		deleteVersions: profile.deleteVersions && !conf.SoftDelete,
+		checksums:      conf.Checksums,
+		sha256:         conf.Checksums && profile.sha256Checksums,
+	}
+}
+
+var _ ObjectStore = (*s3Store)(nil)
+
+func (st *s3Store) PutObject(ctx context.Context, name string, body []byte, opts PutOptions) error {
+	if st.partSize > 0 && len(body) > st.partSize && !opts.IfAbsent {
+		return st.putMultipart(ctx, name, body, opts)
+	}
+
+	input := &s3.PutObjectInput{
+		Bucket:   aws.String(st.bucket),
+		Key:      aws.String(name),
+		Body:     bytes.NewReader(body),
+		Metadata: aws.StringMap(opts.Metadata),
+	}
+	st.grants.applyPut(input)
+	if opts.Tags != "" {
+		input.Tagging = aws.String(opts.Tags)
+	}
+	if opts.StorageClass != "" {
+		input.StorageClass = aws.String(opts.StorageClass)
+	}
+	if st.checksums {
+		input.ContentMD5 = aws.String(md5Base64(body))
+	}
+	if st.sha256 {
+		input.ChecksumSHA256 = aws.String(sha256Base64(body))
+	}
+	if !opts.IfAbsent {
+		_, err := st.client.PutObjectWithContext(ctx, input)
+		return parseError(err)
+	}
+
+	_, err := st.client.PutObjectIfAbsentWithContext(ctx, input)
+	if rerr, ok := err.(awserr.RequestFailure); ok && rerr.StatusCode() == http.StatusPreconditionFailed {
+		return ErrObjectExists
+	}
+	return parseError(err)
+}
+
+// putMultipart uploads body in parts of partSize. Storj gateways store
+// each part as its own segment, so parts matching the segment size avoid
+// the overhead of splitting a large single upload.
+func (st *s3Store) putMultipart(ctx context.Context, name string, body []byte, opts PutOptions) error {
+	create := &s3.CreateMultipartUploadInput{
+		Bucket:   aws.String(st.bucket),
+		Key:      aws.String(name),
+		Metadata: aws.StringMap(opts.Metadata),
+	}
+	if st.grants.ACL != "" {
+		create.ACL = aws.String(st.grants.ACL)
+	}
+	if st.grants.Read != "" {
+		create.GrantRead = aws.String(st.grants.Read)
+	}
+	if st.grants.FullControl != "" {
+		create.GrantFullControl = aws.String(st.grants.FullControl)
+	}
+	if opts.Tags != "" {
+		create.Tagging = aws.String(opts.Tags)
+	}
+	if opts.StorageClass != "" {
+		create.StorageClass = aws.String(opts.StorageClass)
+	}
+	upload, err := st.client.CreateMultipartUploadWithContext(ctx, create)
+	if err != nil {
+		return parseError(err)
+	}
+
+	var parts []*s3.CompletedPart
+	for off, n := 0, int64(1); off < len(body); off, n = off+st.partSize, n+1 {
+		end := off + st.partSize
+		if end > len(body) {
+			end = len(body)
+		}
+		part := &s3.UploadPartInput{
+			Bucket:     aws.String(st.bucket),
+			Key:        aws.String(name),
+			UploadId:   upload.UploadId,
+			PartNumber: aws.Int64(n),
+			Body:       bytes.NewReader(body[off:end]),
+		}
+		if st.checksums {
+			part.ContentMD5 = aws.String(md5Base64(body[off:end]))
+		}
+		resp, err := st.client.UploadPartWithContext(ctx, part)
+		if err != nil {
+			st.abortMultipart(name, upload.UploadId)
+			return parseError(err)
+		}
+		parts = append(parts, &s3.CompletedPart{ETag: resp.ETag, PartNumber: aws.Int64(n)})
+	}
+
+	_, err = st.client.CompleteMultipartUploadWithContext(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(st.bucket),
+		Key:             aws.String(name),
+		UploadId:        upload.UploadId,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		st.abortMultipart(name, upload.UploadId)
+	}
+	return parseError(err)
+}
+
+// abortMultipart releases the parts of a failed upload. It runs on its own
+// context, as the upload's may be what failed it.
+func (st *s3Store) abortMultipart(name string, id *string) {
+	ctx, cancel := context.WithTimeout(context.Background(), bucketCheckTimeout)
+	defer cancel()
+	st.client.AbortMultipartUploadWithContext(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(st.bucket),
+		Key:      aws.String(name),
+		UploadId: id,
+	})
+}
+
+func (st *s3Store) GetObject(ctx context.Context, name string) ([]byte, ObjectInfo, error) {
+	data, info, err := st.getObject(ctx, name)
+	if ErrorClass(err) == ErrChecksumMismatch {
+		// Most likely damaged in transit; try once more.
+		data, info, err = st.getObject(ctx, name)
+	}
+	return data, info, err
+}
+
+func (st *s3Store) getObject(ctx context.Context, name string) ([]byte, ObjectInfo, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(st.bucket),
+		Key:    aws.String(name),
+	}
+	if st.sha256 {
+		input.ChecksumMode = aws.String(s3.ChecksumModeEnabled)
+	}
+	resp, err := st.client.GetObjectWithContext(ctx, input)
+	if err != nil {
+		return nil, ObjectInfo{}, parseError(err)
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	if st.checksums {
+		err := verifyS3Object(name, data, aws.StringValue(resp.ETag),
+			aws.StringValue(resp.ChecksumSHA256), aws.StringValue(resp.ServerSideEncryption))
+		if err != nil {
+			return nil, ObjectInfo{}, err
+		}
+	}
+	return data, ObjectInfo{
+		Name:     name,
+		Size:     int64(len(data)),
+		Metadata: objectMetadata(resp.Metadata),
+	}, nil
+}
+
+func (st *s3Store) Head(ctx context.Context, name string) (ObjectInfo, error) {
+	return st.head(ctx, st.bucket, name)
+}
+
+func (st *s3Store) head(ctx context.Context, bucket, name string) (ObjectInfo, error) {
+	resp, err := st.client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(name),
+	})
+	if err != nil {
+		return ObjectInfo{}, parseError(err)
+	}
+	return ObjectInfo{
+		Name:     name,
+		Size:     aws.Int64Value(resp.ContentLength),
+		Metadata: objectMetadata(resp.Metadata),
+	}, nil
+}
+
+func (st *s3Store) List(ctx context.Context, prefix, token string, max int) ([]ObjectInfo, string, error) {
+	if max <= 0 || max > listMax {
+		max = listMax
+	}
+	input := &s3.ListObjectsV2Input{
+		Bucket:  aws.String(st.bucket),
+		Prefix:  aws.String(prefix),
+		MaxKeys: aws.Int64(int64(max)),
+	}
+	if token != "" {
+		input.ContinuationToken = aws.String(token)
+	}
+	resp, err := st.client.ListObjectsV2WithContext(ctx, input)
+	if err != nil {
+		return nil, "", parseError(err)
+	}
+
+	objs := make([]ObjectInfo, 0, len(resp.Contents))
+	for _, obj := range resp.Contents {
+		objs = append(objs, ObjectInfo{
+			Name:         aws.StringValue(obj.Key),
+			Size:         aws.Int64Value(obj.Size),
+			LastModified: aws.TimeValue(obj.LastModified),
+			ETag:         aws.StringValue(obj.ETag),
+		})
+	}
+	if !aws.BoolValue(resp.IsTruncated) {
+		return objs, "", nil
+	}
+	return objs, aws.StringValue(resp.NextContinuationToken), nil
+}
+
+func (st *s3Store) DeleteMany(ctx context.Context, names []string) error {
+	var objs []*s3.ObjectIdentifier
+	if st.deleteVersions {
+		var err error
+		if objs, err = st.versions(ctx, names); err != nil {
+			return err
+		}
+	} else {
+		for _, name := range names {
+			objs = append(objs, &s3.ObjectIdentifier{Key: aws.String(name)})
+		}
+	}
+
+	var errs []string
+	for i := 0; i < len(objs); i += deleteMax {
+		end := i + deleteMax
+		if end > len(objs) {
+			end = len(objs)
+		}
+		resp, err := st.client.DeleteObjectsWithContext(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(st.bucket),
+			Delete: &s3.Delete{Objects: objs[i:end]},
+		})
+		if err != nil {
+			return parseError(err)
+		}
+		for _, err := range resp.Errors {
+			errs = append(errs, err.String())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to delete objects: %s", errs)
+	}
+	return nil
+}
+
+// versions lists every version of the named objects. Backblaze B2 only
+// hides an object deleted without a version ID, and keeps billing for
+// it.
+func (st *s3Store) versions(ctx context.Context, names []string) ([]*s3.ObjectIdentifier, error) {
+	var objs []*s3.ObjectIdentifier
+	for _, name := range names {
+		err := st.client.ListObjectVersionsPagesWithContext(ctx, &s3.ListObjectVersionsInput{
+			Bucket: aws.String(st.bucket),
+			Prefix: aws.String(name),
+		}, func(page *s3.ListObjectVersionsOutput, last bool) bool {
+			for _, v := range page.Versions {
+				if aws.StringValue(v.Key) == name {
+					objs = append(objs, &s3.ObjectIdentifier{Key: v.Key, VersionId: v.VersionId})
+				}
+			}
+			for _, m := range page.DeleteMarkers {
+				if aws.StringValue(m.Key) == name {
+					objs = append(objs, &s3.ObjectIdentifier{Key: m.Key, VersionId: m.VersionId})
+				}
+			}
+			return true
+		})
+		if err != nil {
+			return nil, parseError(err)
+		}
+	}
+	return objs, nil
+}
+
+// objectMetadata converts user metadata as returned by the SDK, with
+// canonical header capitalisation, to the lower case keys of ObjectInfo.
+func objectMetadata(meta map[string]*string) map[string]string {
+	if len(meta) == 0 {
+		return nil
+	}
+	m := make(map[string]string, len(meta))
+	for k, v := range meta {
+		m[strings.ToLower(k)] = aws.StringValue(v)
+	}
+	return m
+}
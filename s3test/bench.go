@@ -0,0 +1,280 @@
+package s3test
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+
+	s3ds "github.com/ipfs-s3c-storj-plugin"
+)
+
+// Distribution is a distribution of value sizes. Values take the sizes
+// in turn, so a size listed more often is more frequent.
+type Distribution struct {
+	Name  string
+	Sizes []int
+}
+
+// Distributions are the value sizes typical of IPFS repos the benchmarks
+// run with: 256KiB file chunks, 1KiB DAG nodes, and both, with the three
+// directory and file nodes per chunk of small files.
+var Distributions = []Distribution{
+	{Name: "block", Sizes: []int{256 << 10}},
+	{Name: "node", Sizes: []int{1 << 10}},
+	{Name: "mixed", Sizes: []int{256 << 10, 1 << 10, 1 << 10, 1 << 10}},
+}
+
+const (
+	// benchBatchSize is the number of puts per batch of Batch.
+	benchBatchSize = 32
+
+	// benchKeys is the number of keys Get reads from and Query lists.
+	benchKeys = 64
+)
+
+// benchmarks are the benchmarks BenchmarkAll runs for every distribution,
+// by name.
+var benchmarks = []struct {
+	name string
+	run  func(b *testing.B, d *s3ds.S3Bucket, dist Distribution)
+}{
+	{"Put", benchPut},
+	{"Get", benchGet},
+	{"Batch", benchBatch},
+	{"Query", benchQuery},
+}
+
+// noise fills values, so that compression and deduplication do not
+// flatter the results.
+var noise = func() []byte {
+	buf := make([]byte, 256<<10)
+	rand.New(rand.NewSource(1)).Read(buf)
+	return buf
+}()
+
+// size returns the size of the i-th value of dist.
+func (dist Distribution) size(i int) int {
+	return dist.Sizes[i%len(dist.Sizes)]
+}
+
+// mean returns the mean size of the values of dist.
+func (dist Distribution) mean() int64 {
+	var sum int64
+	for _, size := range dist.Sizes {
+		sum += int64(size)
+	}
+	return sum / int64(len(dist.Sizes))
+}
+
+// value returns the i-th value of dist, which differs from all others.
+func (dist Distribution) value(i int) []byte {
+	v := make([]byte, dist.size(i))
+	for n := 0; n < len(v); n += copy(v[n:], noise) {
+	}
+	if len(v) >= 8 {
+		binary.BigEndian.PutUint64(v, uint64(i))
+	}
+	return v
+}
+
+func benchKey(i int) ds.Key {
+	return ds.NewKey(fmt.Sprintf("/bench/%08d", i))
+}
+
+// fill puts the first n values of dist.
+func fill(b *testing.B, d *s3ds.S3Bucket, dist Distribution, n int) {
+	ctx := context.Background()
+	for i := 0; i < n; i++ {
+		if err := d.Put(ctx, benchKey(i), dist.value(i)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchPut(b *testing.B, d *s3ds.S3Bucket, dist Distribution) {
+	ctx := context.Background()
+	var next atomic.Int64
+	b.SetBytes(dist.mean())
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			i := int(next.Add(1) - 1)
+			if err := d.Put(ctx, benchKey(i), dist.value(i)); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func benchGet(b *testing.B, d *s3ds.S3Bucket, dist Distribution) {
+	ctx := context.Background()
+	fill(b, d, dist, benchKeys)
+	var next atomic.Int64
+	b.SetBytes(dist.mean())
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			i := int(next.Add(1)-1) % benchKeys
+			if _, err := d.Get(ctx, benchKey(i)); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func benchBatch(b *testing.B, d *s3ds.S3Bucket, dist Distribution) {
+	ctx := context.Background()
+	b.SetBytes(dist.mean() * benchBatchSize)
+	for n := 0; n < b.N; n++ {
+		batch, err := d.Batch(ctx)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for i := n * benchBatchSize; i < (n+1)*benchBatchSize; i++ {
+			if err := batch.Put(ctx, benchKey(i), dist.value(i)); err != nil {
+				b.Fatal(err)
+			}
+		}
+		if err := batch.Commit(ctx); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchQuery(b *testing.B, d *s3ds.S3Bucket, dist Distribution) {
+	ctx := context.Background()
+	fill(b, d, dist, benchKeys)
+	b.SetBytes(dist.mean() * benchKeys)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		res, err := d.Query(ctx, dsq.Query{Prefix: "/bench"})
+		if err != nil {
+			b.Fatal(err)
+		}
+		entries, err := res.Rest()
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(entries) != benchKeys {
+			b.Fatalf("query returned %d entries, want %d", len(entries), benchKeys)
+		}
+	}
+}
+
+// BenchmarkAll runs every benchmark against a datastore opened with conf,
+// as sub-benchmarks named after the operation and the distribution, e.g.
+// "Put/block". Keys are deleted after each.
+func BenchmarkAll(b *testing.B, conf s3ds.Config) {
+	d, err := s3ds.NewS3Datastore(conf)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer d.Close()
+	for _, bm := range benchmarks {
+		for _, dist := range Distributions {
+			b.Run(bm.name+"/"+dist.Name, func(b *testing.B) {
+				bm.run(b, d, dist)
+				b.StopTimer()
+				clearDatastore(b, d)
+			})
+		}
+	}
+}
+
+// BenchmarkFake runs BenchmarkAll against a new Fake with the settings of
+// conf, which measures the datastore itself.
+func BenchmarkFake(b *testing.B, conf s3ds.Config) {
+	c := New().Config("s3test")
+	conf.Bucket, conf.Client = c.Bucket, c.Client
+	if conf.Region == "" {
+		conf.Region = c.Region
+	}
+	BenchmarkAll(b, conf)
+}
+
+// BenchmarkEndpoints runs BenchmarkAll against each endpoint from
+// EndpointsFromEnv, under a new RootDirectory deleted afterwards, and
+// skips if there are none.
+func BenchmarkEndpoints(b *testing.B) {
+	endpoints := EndpointsFromEnv()
+	if len(endpoints) == 0 {
+		b.Skip("no endpoints configured; set S3TEST_<PROVIDER>_BUCKET")
+	}
+	for _, e := range endpoints {
+		b.Run(e.Provider, func(b *testing.B) {
+			conf := scratch(e.Config, "s3bench")
+			defer func() {
+				if err := deleteRoot(conf); err != nil {
+					b.Error(err)
+				}
+			}()
+			BenchmarkAll(b, conf)
+		})
+	}
+}
+
+// Result is the outcome of a benchmark run by Benchmark, in the units of
+// the go test benchmark output.
+type Result struct {
+	Name        string  `json:"name"`
+	N           int     `json:"n"`
+	NsPerOp     int64   `json:"nsPerOp"`
+	MBPerSec    float64 `json:"mbPerSec"`
+	AllocsPerOp int64   `json:"allocsPerOp"`
+	BytesPerOp  int64   `json:"allocedBytesPerOp"`
+}
+
+// Benchmark runs the benchmarks whose names match outside of go test,
+// e.g. from a command tracking performance over time, under a new
+// RootDirectory of conf's bucket deleted afterwards. A nil match runs all.
+func Benchmark(conf s3ds.Config, match func(name string) bool) ([]Result, error) {
+	conf = scratch(conf, "s3bench")
+	d, err := s3ds.NewS3Datastore(conf)
+	if err != nil {
+		return nil, err
+	}
+	var results []Result
+	for _, bm := range benchmarks {
+		for _, dist := range Distributions {
+			name := bm.name + "/" + dist.Name
+			if match != nil && !match(name) {
+				continue
+			}
+			failed := false
+			res := testing.Benchmark(func(b *testing.B) {
+				b.ReportAllocs()
+				defer func() { failed = failed || b.Failed() }()
+				bm.run(b, d, dist)
+				b.StopTimer()
+				clearDatastore(b, d)
+			})
+			if res.N == 0 || failed {
+				err = fmt.Errorf("s3test: benchmark %s failed", name)
+				break
+			}
+			results = append(results, Result{
+				Name:        name,
+				N:           res.N,
+				NsPerOp:     res.NsPerOp(),
+				MBPerSec:    float64(res.Bytes) * float64(res.N) / 1e6 / res.T.Seconds(),
+				AllocsPerOp: res.AllocsPerOp(),
+				BytesPerOp:  res.AllocedBytesPerOp(),
+			})
+		}
+		if err != nil {
+			break
+		}
+	}
+	d.Close()
+	if cleanupErr := deleteRoot(conf); err == nil {
+		err = cleanupErr
+	}
+	return results, err
+}
@@ -0,0 +1,155 @@
+package s3test
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+
+	s3ds "github.com/ipfs-s3c-storj-plugin"
+)
+
+// Endpoint is a real gateway to run the subtests against.
+type Endpoint struct {
+	// Provider names the gateway in test names and environment
+	// variables.
+	Provider string
+
+	// Config opens a datastore on a bucket of the gateway that the tests
+	// may write to. Each run uses a RootDirectory of its own in it.
+	Config s3ds.Config
+
+	// Skip lists the subtests not to run, for known incompatibilities of
+	// the gateway.
+	Skip []string
+}
+
+// providerSkips are the subtests known to fail with a provider.
+var providerSkips = map[string][]string{
+	// The Storj gateway does not support conditional uploads, which is
+	// why its preset checks for blocks with SkipExistingHas.
+	"storj": {"ConditionalPut"},
+}
+
+// EndpointsFromEnv returns the endpoints configured through environment
+// variables, for each of the providers minio, aws and storj:
+//
+//	S3TEST_<PROVIDER>_BUCKET      bucket to test in; unset skips the provider
+//	S3TEST_<PROVIDER>_ENDPOINT    gateway URL, defaulting to the provider's
+//	S3TEST_<PROVIDER>_REGION      region, defaulting to the provider's
+//	S3TEST_<PROVIDER>_ACCESS_KEY  credentials, defaulting to the SDK's
+//	S3TEST_<PROVIDER>_SECRET_KEY
+//	S3TEST_<PROVIDER>_SKIP        comma-separated subtests to skip as well
+func EndpointsFromEnv() []Endpoint {
+	var endpoints []Endpoint
+	for _, provider := range []string{"minio", "aws", "storj"} {
+		env := func(name string) string {
+			return os.Getenv("S3TEST_" + strings.ToUpper(provider) + "_" + name)
+		}
+		if env("BUCKET") == "" {
+			continue
+		}
+		e := Endpoint{
+			Provider: provider,
+			Config: s3ds.Config{
+				Provider:  provider,
+				Bucket:    env("BUCKET"),
+				Endpoint:  env("ENDPOINT"),
+				Region:    env("REGION"),
+				AccessKey: env("ACCESS_KEY"),
+				SecretKey: env("SECRET_KEY"),
+			},
+			Skip: append([]string(nil), providerSkips[provider]...),
+		}
+		for _, name := range strings.Split(env("SKIP"), ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				e.Skip = append(e.Skip, name)
+			}
+		}
+		endpoints = append(endpoints, e)
+	}
+	return endpoints
+}
+
+// SubtestEndpoints runs every subtest against each endpoint from
+// EndpointsFromEnv, and skips if there are none. Integration tests call
+// it from a test file behind a build tag.
+func SubtestEndpoints(t *testing.T) {
+	endpoints := EndpointsFromEnv()
+	if len(endpoints) == 0 {
+		t.Skip("no endpoints configured; set S3TEST_<PROVIDER>_BUCKET")
+	}
+	for _, e := range endpoints {
+		t.Run(e.Provider, func(t *testing.T) {
+			SubtestEndpoint(t, e)
+		})
+	}
+}
+
+// SubtestEndpoint runs the subtests not skipped for e under a new
+// RootDirectory of e's bucket, and deletes everything under it afterwards.
+func SubtestEndpoint(t *testing.T, e Endpoint) {
+	conf := scratch(e.Config, "s3test")
+	skip := make(map[string]bool)
+	for _, name := range e.Skip {
+		skip[name] = true
+	}
+	defer func() {
+		if err := deleteRoot(conf); err != nil {
+			t.Error(err)
+		}
+	}()
+	runSubtests(t, conf, skip)
+}
+
+// scratch returns conf with a new RootDirectory inside its own, named
+// after what uses it, for deleteRoot to delete afterwards.
+func scratch(conf s3ds.Config, name string) s3ds.Config {
+	root := fmt.Sprintf("%s-%d-%08x", name, time.Now().Unix(), rand.Uint32())
+	if conf.RootDirectory != "" {
+		root = strings.TrimSuffix(conf.RootDirectory, "/") + "/" + root
+	}
+	conf.RootDirectory = root
+	return conf
+}
+
+// deleteRoot deletes every object under conf's RootDirectory, the
+// manifest included.
+func deleteRoot(conf s3ds.Config) error {
+	conf.SkipManifestCheck = true
+	d, err := s3ds.NewS3Datastore(conf)
+	if err != nil {
+		return fmt.Errorf("s3test: cleaning up %s: %w", conf.RootDirectory, err)
+	}
+	defer d.Close()
+
+	ctx := context.Background()
+	var objs []*s3.ObjectIdentifier
+	err = d.S3.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(conf.Bucket),
+		Prefix: aws.String(conf.RootDirectory + "/"),
+	}, func(out *s3.ListObjectsV2Output, _ bool) bool {
+		for _, obj := range out.Contents {
+			objs = append(objs, &s3.ObjectIdentifier{Key: obj.Key})
+		}
+		return true
+	})
+	for len(objs) > 0 && err == nil {
+		n := min(len(objs), 1000)
+		_, err = d.S3.DeleteObjectsWithContext(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(conf.Bucket),
+			Delete: &s3.Delete{Objects: objs[:n], Quiet: aws.Bool(true)},
+		})
+		objs = objs[n:]
+	}
+	if err != nil {
+		return fmt.Errorf("s3test: cleaning up %s: %w", conf.RootDirectory, err)
+	}
+	return nil
+}
@@ -0,0 +1,841 @@
+// Package s3test provides an in-memory S3 for testing the datastore, and
+// code built on it, without a gateway or network access, and a harness
+// running the same tests against real gateways.
+package s3test
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+
+	s3ds "github.com/ipfs-s3c-storj-plugin"
+)
+
+// listMax is the most keys S3 returns per page.
+const listMax = 1000
+
+// Fake is an in-memory S3 implementing s3ds.S3Client. Buckets are not
+// versioned, and objects in archive storage classes need a restore, which
+// completes at once, before they can be read. Presigned URLs are signed
+// for an endpoint that does not exist.
+type Fake struct {
+	// MaxKeys caps the pages of listings, to exercise pagination with
+	// few objects. Defaults to S3's 1000.
+	MaxKeys int
+
+	// FailDelete, if set, makes DeleteObjects fail for the keys it
+	// returns true for and leave them in place, as gateways report
+	// partial failures of a batch delete.
+	FailDelete func(bucket, key string) bool
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	uploads map[string]*upload
+	nextID  int
+
+	// sdk presigns URLs.
+	sdk *s3.S3
+}
+
+type bucket struct {
+	objects   map[string]*object
+	lifecycle *s3.BucketLifecycleConfiguration
+}
+
+type object struct {
+	data         []byte
+	metadata     map[string]*string
+	etag         string
+	sha256       string
+	storageClass string
+	tagging      string
+	restored     bool
+	modified     time.Time
+}
+
+type upload struct {
+	bucket string
+	key    string
+	create s3.CreateMultipartUploadInput
+	parts  map[int64][]byte
+}
+
+var _ s3ds.S3Client = (*Fake)(nil)
+
+// New returns a Fake holding the named, empty buckets.
+func New(buckets ...string) *Fake {
+	sess := session.Must(session.NewSession(&aws.Config{
+		Credentials:      credentials.NewStaticCredentials("s3test", "s3test", ""),
+		Endpoint:         aws.String("http://s3test.invalid"),
+		Region:           aws.String("us-east-1"),
+		S3ForcePathStyle: aws.Bool(true),
+	}))
+	f := &Fake{
+		buckets: make(map[string]*bucket),
+		uploads: make(map[string]*upload),
+		sdk:     s3.New(sess),
+	}
+	for _, name := range buckets {
+		f.CreateBucket(name)
+	}
+	return f
+}
+
+// CreateBucket adds an empty bucket, unless it exists.
+func (f *Fake) CreateBucket(name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.buckets[name]; !ok {
+		f.buckets[name] = &bucket{objects: make(map[string]*object)}
+	}
+}
+
+// Config returns the Config of a datastore in bucket, which is created if
+// missing.
+func (f *Fake) Config(bucket string) s3ds.Config {
+	f.CreateBucket(bucket)
+	return s3ds.Config{
+		Bucket: bucket,
+		Region: "us-east-1",
+		Client: f,
+	}
+}
+
+// Keys returns the names of the objects in bucket, sorted.
+func (f *Fake) Keys(bucket string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	b, ok := f.buckets[bucket]
+	if !ok {
+		return nil
+	}
+	return b.sortedKeys("")
+}
+
+func (b *bucket) sortedKeys(prefix string) []string {
+	keys := make([]string, 0, len(b.objects))
+	for k := range b.objects {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func failure(code, message string, status int) error {
+	return awserr.NewRequestFailure(awserr.New(code, message, nil), status, "s3test")
+}
+
+func noSuchKey() error {
+	return failure(s3.ErrCodeNoSuchKey, "The specified key does not exist.", http.StatusNotFound)
+}
+
+// bucket returns the named bucket. f.mu must be held.
+func (f *Fake) bucket(name *string) (*bucket, error) {
+	b, ok := f.buckets[aws.StringValue(name)]
+	if !ok {
+		return nil, failure(s3.ErrCodeNoSuchBucket, "The specified bucket does not exist.", http.StatusNotFound)
+	}
+	return b, nil
+}
+
+func readBody(body io.ReadSeeker) ([]byte, error) {
+	if body == nil {
+		return []byte{}, nil
+	}
+	return ioutil.ReadAll(body)
+}
+
+func etagOf(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// checkMD5 verifies a Content-MD5 header.
+func checkMD5(data []byte, contentMD5 *string) error {
+	if contentMD5 == nil {
+		return nil
+	}
+	sum := md5.Sum(data)
+	if base64.StdEncoding.EncodeToString(sum[:]) != *contentMD5 {
+		return failure("BadDigest", "The Content-MD5 you specified did not match what we received.", http.StatusBadRequest)
+	}
+	return nil
+}
+
+func copyMetadata(meta map[string]*string) map[string]*string {
+	if meta == nil {
+		return nil
+	}
+	m := make(map[string]*string, len(meta))
+	for k, v := range meta {
+		m[k] = aws.String(aws.StringValue(v))
+	}
+	return m
+}
+
+func archived(class string) bool {
+	return class == s3.StorageClassGlacier || class == s3.StorageClassDeepArchive
+}
+
+// parseRange parses a "bytes=first-last" range of an object of size
+// bytes.
+func parseRange(spec string, size int64) (int64, int64, error) {
+	invalid := failure("InvalidRange", "The requested range is not satisfiable", http.StatusRequestedRangeNotSatisfiable)
+	first, last, ok := strings.Cut(strings.TrimPrefix(spec, "bytes="), "-")
+	if !ok {
+		return 0, 0, invalid
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start >= size {
+		return 0, 0, invalid
+	}
+	end := size - 1
+	if last != "" {
+		if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+			return 0, 0, invalid
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	return start, end, nil
+}
+
+// parseCopySource splits a CopySource into bucket and key.
+func parseCopySource(src string) (string, string, error) {
+	src, _, _ = strings.Cut(src, "?")
+	src, err := url.PathUnescape(strings.TrimPrefix(src, "/"))
+	if err != nil {
+		return "", "", err
+	}
+	bucket, key, ok := strings.Cut(src, "/")
+	if !ok {
+		return "", "", failure("InvalidArgument", "Invalid copy source", http.StatusBadRequest)
+	}
+	return bucket, key, nil
+}
+
+// source returns the object a CopySource names. f.mu must be held.
+func (f *Fake) source(src *string) (*object, error) {
+	bucket, key, err := parseCopySource(aws.StringValue(src))
+	if err != nil {
+		return nil, err
+	}
+	b, err := f.bucket(aws.String(bucket))
+	if err != nil {
+		return nil, err
+	}
+	obj, ok := b.objects[key]
+	if !ok {
+		return nil, noSuchKey()
+	}
+	return obj, nil
+}
+
+func (f *Fake) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	return f.GetObjectWithContext(aws.BackgroundContext(), input)
+}
+
+func (f *Fake) GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, _ ...request.Option) (*s3.GetObjectOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	b, err := f.bucket(input.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	obj, ok := b.objects[aws.StringValue(input.Key)]
+	if !ok {
+		return nil, noSuchKey()
+	}
+	if archived(obj.storageClass) && !obj.restored {
+		return nil, failure("InvalidObjectState", "The operation is not valid for the object's storage class", http.StatusForbidden)
+	}
+	data := obj.data
+	out := &s3.GetObjectOutput{
+		ETag:         aws.String(obj.etag),
+		LastModified: aws.Time(obj.modified),
+		Metadata:     copyMetadata(obj.metadata),
+	}
+	if obj.storageClass != "" {
+		out.StorageClass = aws.String(obj.storageClass)
+	}
+	if input.Range != nil {
+		start, end, err := parseRange(*input.Range, int64(len(data)))
+		if err != nil {
+			return nil, err
+		}
+		data = data[start : end+1]
+		out.ContentRange = aws.String(fmt.Sprintf("bytes %d-%d/%d", start, end, len(obj.data)))
+	} else if aws.StringValue(input.ChecksumMode) == s3.ChecksumModeEnabled && obj.sha256 != "" {
+		out.ChecksumSHA256 = aws.String(obj.sha256)
+	}
+	out.ContentLength = aws.Int64(int64(len(data)))
+	out.Body = ioutil.NopCloser(bytes.NewReader(append([]byte(nil), data...)))
+	return out, nil
+}
+
+func (f *Fake) HeadObjectWithContext(ctx aws.Context, input *s3.HeadObjectInput, _ ...request.Option) (*s3.HeadObjectOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	b, err := f.bucket(input.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	obj, ok := b.objects[aws.StringValue(input.Key)]
+	if !ok {
+		return nil, failure("NotFound", "Not Found", http.StatusNotFound)
+	}
+	out := &s3.HeadObjectOutput{
+		ContentLength: aws.Int64(int64(len(obj.data))),
+		ETag:          aws.String(obj.etag),
+		LastModified:  aws.Time(obj.modified),
+		Metadata:      copyMetadata(obj.metadata),
+	}
+	if obj.storageClass != "" {
+		out.StorageClass = aws.String(obj.storageClass)
+	}
+	if archived(obj.storageClass) && obj.restored {
+		out.Restore = aws.String(`ongoing-request="false"`)
+	}
+	return out, nil
+}
+
+// PresignGetObject returns a URL for an endpoint that does not exist.
+func (f *Fake) PresignGetObject(input *s3.GetObjectInput, expiry time.Duration) (string, error) {
+	req, _ := f.sdk.GetObjectRequest(input)
+	return req.Presign(expiry)
+}
+
+func (f *Fake) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	return f.PutObjectWithContext(aws.BackgroundContext(), input)
+}
+
+func (f *Fake) PutObjectWithContext(ctx aws.Context, input *s3.PutObjectInput, _ ...request.Option) (*s3.PutObjectOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return f.putObject(input, false)
+}
+
+// putObject stores an upload, failing with PreconditionFailed if
+// ifAbsent is set and the object exists.
+func (f *Fake) putObject(input *s3.PutObjectInput, ifAbsent bool) (*s3.PutObjectOutput, error) {
+	data, err := readBody(input.Body)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkMD5(data, input.ContentMD5); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	b, err := f.bucket(input.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := b.objects[aws.StringValue(input.Key)]; ok && ifAbsent {
+		return nil, failure("PreconditionFailed", "At least one of the pre-conditions you specified did not hold", http.StatusPreconditionFailed)
+	}
+	obj := &object{
+		data:         data,
+		metadata:     copyMetadata(input.Metadata),
+		etag:         etagOf(data),
+		sha256:       aws.StringValue(input.ChecksumSHA256),
+		storageClass: aws.StringValue(input.StorageClass),
+		tagging:      aws.StringValue(input.Tagging),
+		modified:     time.Now(),
+	}
+	b.objects[aws.StringValue(input.Key)] = obj
+	return &s3.PutObjectOutput{ETag: aws.String(obj.etag)}, nil
+}
+
+func (f *Fake) PutObjectIfAbsentWithContext(ctx aws.Context, input *s3.PutObjectInput, _ ...request.Option) (*s3.PutObjectOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return f.putObject(input, true)
+}
+
+func (f *Fake) PutObjectAclWithContext(ctx aws.Context, input *s3.PutObjectAclInput, _ ...request.Option) (*s3.PutObjectAclOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	b, err := f.bucket(input.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := b.objects[aws.StringValue(input.Key)]; !ok {
+		return nil, noSuchKey()
+	}
+	return &s3.PutObjectAclOutput{}, nil
+}
+
+func (f *Fake) RestoreObjectWithContext(ctx aws.Context, input *s3.RestoreObjectInput, _ ...request.Option) (*s3.RestoreObjectOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	b, err := f.bucket(input.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	obj, ok := b.objects[aws.StringValue(input.Key)]
+	if !ok {
+		return nil, noSuchKey()
+	}
+	if !archived(obj.storageClass) {
+		return nil, failure("InvalidObjectState", "Restore is not allowed for the object's current storage class", http.StatusForbidden)
+	}
+	obj.restored = true
+	return &s3.RestoreObjectOutput{}, nil
+}
+
+func (f *Fake) CopyObjectWithContext(ctx aws.Context, input *s3.CopyObjectInput, _ ...request.Option) (*s3.CopyObjectOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	src, err := f.source(input.CopySource)
+	if err != nil {
+		return nil, err
+	}
+	b, err := f.bucket(input.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	obj := *src
+	obj.modified = time.Now()
+	obj.restored = false
+	if aws.StringValue(input.MetadataDirective) == s3.MetadataDirectiveReplace {
+		obj.metadata = copyMetadata(input.Metadata)
+	} else {
+		obj.metadata = copyMetadata(src.metadata)
+	}
+	if aws.StringValue(input.TaggingDirective) == s3.TaggingDirectiveReplace {
+		obj.tagging = aws.StringValue(input.Tagging)
+	}
+	obj.storageClass = aws.StringValue(input.StorageClass)
+	b.objects[aws.StringValue(input.Key)] = &obj
+	return &s3.CopyObjectOutput{
+		CopyObjectResult: &s3.CopyObjectResult{ETag: aws.String(obj.etag), LastModified: aws.Time(obj.modified)},
+	}, nil
+}
+
+func (f *Fake) CreateMultipartUploadWithContext(ctx aws.Context, input *s3.CreateMultipartUploadInput, _ ...request.Option) (*s3.CreateMultipartUploadOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, err := f.bucket(input.Bucket); err != nil {
+		return nil, err
+	}
+	f.nextID++
+	id := strconv.Itoa(f.nextID)
+	f.uploads[id] = &upload{
+		bucket: aws.StringValue(input.Bucket),
+		key:    aws.StringValue(input.Key),
+		create: *input,
+		parts:  make(map[int64][]byte),
+	}
+	return &s3.CreateMultipartUploadOutput{Bucket: input.Bucket, Key: input.Key, UploadId: aws.String(id)}, nil
+}
+
+// upload returns the multipart upload id. f.mu must be held.
+func (f *Fake) upload(id *string) (*upload, error) {
+	u, ok := f.uploads[aws.StringValue(id)]
+	if !ok {
+		return nil, failure(s3.ErrCodeNoSuchUpload, "The specified upload does not exist.", http.StatusNotFound)
+	}
+	return u, nil
+}
+
+func (f *Fake) UploadPartWithContext(ctx aws.Context, input *s3.UploadPartInput, _ ...request.Option) (*s3.UploadPartOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	data, err := readBody(input.Body)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkMD5(data, input.ContentMD5); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	u, err := f.upload(input.UploadId)
+	if err != nil {
+		return nil, err
+	}
+	u.parts[aws.Int64Value(input.PartNumber)] = data
+	return &s3.UploadPartOutput{ETag: aws.String(etagOf(data))}, nil
+}
+
+func (f *Fake) UploadPartCopyWithContext(ctx aws.Context, input *s3.UploadPartCopyInput, _ ...request.Option) (*s3.UploadPartCopyOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	u, err := f.upload(input.UploadId)
+	if err != nil {
+		return nil, err
+	}
+	src, err := f.source(input.CopySource)
+	if err != nil {
+		return nil, err
+	}
+	data := src.data
+	if input.CopySourceRange != nil {
+		start, end, err := parseRange(*input.CopySourceRange, int64(len(data)))
+		if err != nil {
+			return nil, err
+		}
+		data = data[start : end+1]
+	}
+	u.parts[aws.Int64Value(input.PartNumber)] = append([]byte(nil), data...)
+	return &s3.UploadPartCopyOutput{
+		CopyPartResult: &s3.CopyPartResult{ETag: aws.String(etagOf(data)), LastModified: aws.Time(time.Now())},
+	}, nil
+}
+
+func (f *Fake) CompleteMultipartUploadWithContext(ctx aws.Context, input *s3.CompleteMultipartUploadInput, _ ...request.Option) (*s3.CompleteMultipartUploadOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	u, err := f.upload(input.UploadId)
+	if err != nil {
+		return nil, err
+	}
+	b, err := f.bucket(input.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		data []byte
+		sums []byte
+	)
+	if input.MultipartUpload == nil || len(input.MultipartUpload.Parts) == 0 {
+		return nil, failure("MalformedXML", "The XML you provided was not well-formed", http.StatusBadRequest)
+	}
+	for _, p := range input.MultipartUpload.Parts {
+		part, ok := u.parts[aws.Int64Value(p.PartNumber)]
+		if !ok || aws.StringValue(p.ETag) != etagOf(part) {
+			return nil, failure("InvalidPart", "One or more of the specified parts could not be found.", http.StatusBadRequest)
+		}
+		data = append(data, part...)
+		sum := md5.Sum(part)
+		sums = append(sums, sum[:]...)
+	}
+	sum := md5.Sum(sums)
+	obj := &object{
+		data:         data,
+		metadata:     copyMetadata(u.create.Metadata),
+		etag:         fmt.Sprintf(`"%s-%d"`, hex.EncodeToString(sum[:]), len(input.MultipartUpload.Parts)),
+		storageClass: aws.StringValue(u.create.StorageClass),
+		tagging:      aws.StringValue(u.create.Tagging),
+		modified:     time.Now(),
+	}
+	b.objects[u.key] = obj
+	delete(f.uploads, aws.StringValue(input.UploadId))
+	return &s3.CompleteMultipartUploadOutput{Bucket: input.Bucket, Key: input.Key, ETag: aws.String(obj.etag)}, nil
+}
+
+func (f *Fake) AbortMultipartUploadWithContext(ctx aws.Context, input *s3.AbortMultipartUploadInput, _ ...request.Option) (*s3.AbortMultipartUploadOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, err := f.upload(input.UploadId); err != nil {
+		return nil, err
+	}
+	delete(f.uploads, aws.StringValue(input.UploadId))
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+// Uploads returns the number of multipart uploads neither completed nor
+// aborted.
+func (f *Fake) Uploads() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.uploads)
+}
+
+func (f *Fake) DeleteObject(input *s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error) {
+	return f.DeleteObjectWithContext(aws.BackgroundContext(), input)
+}
+
+func (f *Fake) DeleteObjectWithContext(ctx aws.Context, input *s3.DeleteObjectInput, _ ...request.Option) (*s3.DeleteObjectOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	b, err := f.bucket(input.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	delete(b.objects, aws.StringValue(input.Key))
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func (f *Fake) DeleteObjectsWithContext(ctx aws.Context, input *s3.DeleteObjectsInput, _ ...request.Option) (*s3.DeleteObjectsOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if input.Delete == nil || len(input.Delete.Objects) > listMax {
+		return nil, failure("MalformedXML", "The XML you provided was not well-formed", http.StatusBadRequest)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	b, err := f.bucket(input.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	out := &s3.DeleteObjectsOutput{}
+	for _, id := range input.Delete.Objects {
+		key := aws.StringValue(id.Key)
+		if f.FailDelete != nil && f.FailDelete(aws.StringValue(input.Bucket), key) {
+			out.Errors = append(out.Errors, &s3.Error{
+				Key:     id.Key,
+				Code:    aws.String("InternalError"),
+				Message: aws.String("We encountered an internal error. Please try again."),
+			})
+			continue
+		}
+		delete(b.objects, key)
+		if !aws.BoolValue(input.Delete.Quiet) {
+			out.Deleted = append(out.Deleted, &s3.DeletedObject{Key: id.Key, VersionId: id.VersionId})
+		}
+	}
+	return out, nil
+}
+
+func (f *Fake) ListObjectsV2(input *s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, error) {
+	return f.ListObjectsV2WithContext(aws.BackgroundContext(), input)
+}
+
+// ListObjectsV2WithContext lists a page of objects. Continuation tokens
+// are the base64 encoded key to resume after.
+func (f *Fake) ListObjectsV2WithContext(ctx aws.Context, input *s3.ListObjectsV2Input, _ ...request.Option) (*s3.ListObjectsV2Output, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	b, err := f.bucket(input.Bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	max := listMax
+	if f.MaxKeys > 0 && f.MaxKeys < max {
+		max = f.MaxKeys
+	}
+	if input.MaxKeys != nil && int(*input.MaxKeys) < max {
+		max = int(*input.MaxKeys)
+	}
+	after := aws.StringValue(input.StartAfter)
+	if input.ContinuationToken != nil {
+		token, err := base64.RawURLEncoding.DecodeString(*input.ContinuationToken)
+		if err != nil {
+			return nil, failure("InvalidArgument", "The continuation token provided is incorrect", http.StatusBadRequest)
+		}
+		after = string(token)
+	}
+
+	prefix := aws.StringValue(input.Prefix)
+	delimiter := aws.StringValue(input.Delimiter)
+	out := &s3.ListObjectsV2Output{
+		Name:              input.Bucket,
+		Prefix:            input.Prefix,
+		Delimiter:         input.Delimiter,
+		MaxKeys:           aws.Int64(int64(max)),
+		ContinuationToken: input.ContinuationToken,
+		StartAfter:        input.StartAfter,
+		IsTruncated:       aws.Bool(false),
+	}
+	var (
+		count      int
+		last       string
+		lastPrefix string
+	)
+	for _, key := range b.sortedKeys(prefix) {
+		if key <= after {
+			continue
+		}
+		common := ""
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				common = key[:len(prefix)+i+len(delimiter)]
+			}
+		}
+		if common != "" && common == lastPrefix {
+			// Rolled up into the common prefix already returned.
+			continue
+		}
+		if count == max {
+			out.IsTruncated = aws.Bool(true)
+			out.NextContinuationToken = aws.String(base64.RawURLEncoding.EncodeToString([]byte(last)))
+			break
+		}
+		count++
+		last = key
+		if common != "" {
+			// Resume after every key under the common prefix.
+			lastPrefix = common
+			last = common + string(utf8.MaxRune)
+			out.CommonPrefixes = append(out.CommonPrefixes, &s3.CommonPrefix{Prefix: aws.String(common)})
+			continue
+		}
+		obj := b.objects[key]
+		class := obj.storageClass
+		if class == "" {
+			class = s3.ObjectStorageClassStandard
+		}
+		out.Contents = append(out.Contents, &s3.Object{
+			Key:          aws.String(key),
+			Size:         aws.Int64(int64(len(obj.data))),
+			ETag:         aws.String(obj.etag),
+			LastModified: aws.Time(obj.modified),
+			StorageClass: aws.String(class),
+		})
+	}
+	out.KeyCount = aws.Int64(int64(count))
+	return out, nil
+}
+
+func (f *Fake) ListObjectsV2PagesWithContext(ctx aws.Context, input *s3.ListObjectsV2Input, fn func(*s3.ListObjectsV2Output, bool) bool, opts ...request.Option) error {
+	page := *input
+	for {
+		out, err := f.ListObjectsV2WithContext(ctx, &page, opts...)
+		if err != nil {
+			return err
+		}
+		last := !aws.BoolValue(out.IsTruncated)
+		if !fn(out, last) || last {
+			return nil
+		}
+		page.ContinuationToken = out.NextContinuationToken
+	}
+}
+
+// ListObjectVersionsPagesWithContext lists the objects as the only,
+// "null" versions of an unversioned bucket, in a single page.
+func (f *Fake) ListObjectVersionsPagesWithContext(ctx aws.Context, input *s3.ListObjectVersionsInput, fn func(*s3.ListObjectVersionsOutput, bool) bool, _ ...request.Option) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	b, err := f.bucket(input.Bucket)
+	if err != nil {
+		f.mu.Unlock()
+		return err
+	}
+	out := &s3.ListObjectVersionsOutput{Name: input.Bucket, Prefix: input.Prefix, IsTruncated: aws.Bool(false)}
+	for _, key := range b.sortedKeys(aws.StringValue(input.Prefix)) {
+		obj := b.objects[key]
+		out.Versions = append(out.Versions, &s3.ObjectVersion{
+			Key:          aws.String(key),
+			VersionId:    aws.String("null"),
+			IsLatest:     aws.Bool(true),
+			Size:         aws.Int64(int64(len(obj.data))),
+			ETag:         aws.String(obj.etag),
+			LastModified: aws.Time(obj.modified),
+		})
+	}
+	f.mu.Unlock()
+	fn(out, true)
+	return nil
+}
+
+func (f *Fake) GetBucketLifecycleConfigurationWithContext(ctx aws.Context, input *s3.GetBucketLifecycleConfigurationInput, _ ...request.Option) (*s3.GetBucketLifecycleConfigurationOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	b, err := f.bucket(input.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	if b.lifecycle == nil {
+		return nil, failure("NoSuchLifecycleConfiguration", "The lifecycle configuration does not exist", http.StatusNotFound)
+	}
+	return &s3.GetBucketLifecycleConfigurationOutput{Rules: b.lifecycle.Rules}, nil
+}
+
+func (f *Fake) PutBucketLifecycleConfigurationWithContext(ctx aws.Context, input *s3.PutBucketLifecycleConfigurationInput, _ ...request.Option) (*s3.PutBucketLifecycleConfigurationOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	b, err := f.bucket(input.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	b.lifecycle = input.LifecycleConfiguration
+	return &s3.PutBucketLifecycleConfigurationOutput{}, nil
+}
+
+func (f *Fake) DeleteBucketLifecycleWithContext(ctx aws.Context, input *s3.DeleteBucketLifecycleInput, _ ...request.Option) (*s3.DeleteBucketLifecycleOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	b, err := f.bucket(input.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	b.lifecycle = nil
+	return &s3.DeleteBucketLifecycleOutput{}, nil
+}
+
+// GetBucketVersioningWithContext reports every bucket as never versioned.
+func (f *Fake) GetBucketVersioningWithContext(ctx aws.Context, input *s3.GetBucketVersioningInput, _ ...request.Option) (*s3.GetBucketVersioningOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, err := f.bucket(input.Bucket); err != nil {
+		return nil, err
+	}
+	return &s3.GetBucketVersioningOutput{}, nil
+}
@@ -0,0 +1,286 @@
+package s3test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+
+	blocks "github.com/ipfs/go-block-format"
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	dstest "github.com/ipfs/go-datastore/test"
+
+	s3ds "github.com/ipfs-s3c-storj-plugin"
+)
+
+// subtests are the tests SubtestAll runs, by name: the tests of the
+// go-datastore suite that apply, and the datastore's own. Like go-ds-s3,
+// the datastore refuses queries with filters or orders, which leaves out
+// SubtestOrder, SubtestLimit, SubtestFilter and SubtestCombinations.
+var subtests = []struct {
+	name string
+	test func(t *testing.T, d *s3ds.S3Bucket, conf s3ds.Config)
+}{
+	{"BasicPutGet", basic(dstest.SubtestBasicPutGet)},
+	{"NotFounds", basic(dstest.SubtestNotFounds)},
+	{"ManyKeysAndQuery", basic(dstest.SubtestManyKeysAndQuery)},
+	{"BasicSync", basic(dstest.SubtestBasicSync)},
+	{"ReturnSizes", basic(dstest.SubtestReturnSizes)},
+	{"Prefix", basic(dstest.SubtestPrefix)},
+	{"Batch", batching(dstest.RunBatchTest)},
+	{"BatchDelete", batching(dstest.RunBatchDeleteTest)},
+	{"BatchPutAndDelete", batching(dstest.RunBatchPutAndDeleteTest)},
+	{"BatchLastOpWins", subtestBatchLastOpWins},
+	{"LargeObject", subtestLargeObject},
+	{"ConditionalPut", subtestConditionalPut},
+}
+
+func basic(test func(t *testing.T, d ds.Datastore)) func(*testing.T, *s3ds.S3Bucket, s3ds.Config) {
+	return func(t *testing.T, d *s3ds.S3Bucket, _ s3ds.Config) {
+		test(t, suiteDatastore{d})
+	}
+}
+
+func batching(test func(t *testing.T, d ds.Batching)) func(*testing.T, *s3ds.S3Bucket, s3ds.Config) {
+	return func(t *testing.T, d *s3ds.S3Bucket, _ s3ds.Config) {
+		test(t, suiteDatastore{d})
+	}
+}
+
+// suiteDatastore is the datastore under test as the go-datastore suite
+// sees it. The suite cleans up after testing query cancellation with the
+// context it cancelled, which the datastore would honour.
+type suiteDatastore struct {
+	*s3ds.S3Bucket
+}
+
+func (d suiteDatastore) Delete(ctx context.Context, k ds.Key) error {
+	return d.S3Bucket.Delete(context.WithoutCancel(ctx), k)
+}
+
+// SubtestAll runs every subtest against a datastore opened with conf,
+// such as one from Fake.Config with the settings under test added.
+func SubtestAll(t *testing.T, conf s3ds.Config) {
+	runSubtests(t, conf, nil)
+}
+
+// runSubtests runs the subtests not in skip.
+func runSubtests(t *testing.T, conf s3ds.Config, skip map[string]bool) {
+	d, err := s3ds.NewS3Datastore(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := d.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	for _, st := range subtests {
+		t.Run(st.name, func(t *testing.T) {
+			if skip[st.name] {
+				t.Skip("skipped for this endpoint")
+			}
+			st.test(t, d, conf)
+			clearDatastore(t, d)
+		})
+	}
+}
+
+// clearDatastore deletes every key, so that subtests start from an empty
+// datastore.
+func clearDatastore(t testing.TB, d ds.Datastore) {
+	ctx := context.Background()
+	res, err := d.Query(ctx, dsq.Query{KeysOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if err := d.Delete(ctx, ds.RawKey(e.Key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// subtestBatchLastOpWins checks that a batch applies nothing before it is
+// committed, and then the last operation on each key, whatever came
+// before it.
+func subtestBatchLastOpWins(t *testing.T, d *s3ds.S3Bucket, _ s3ds.Config) {
+	ctx := context.Background()
+	cases := []struct {
+		name string
+		old  string // put before the batch, unless empty
+		ops  []string
+		want string // empty if deleted
+	}{
+		{name: "put then deleted", ops: []string{"first", ""}},
+		{name: "deleted then put", old: "old", ops: []string{"", "new"}, want: "new"},
+		{name: "put, deleted and put again", ops: []string{"first", "", "second"}, want: "second"},
+		{name: "put twice then deleted", old: "old", ops: []string{"first", "second", ""}},
+		{name: "put twice", old: "old", ops: []string{"first", "second"}, want: "second"},
+	}
+	key := func(i int) ds.Key {
+		return ds.NewKey(fmt.Sprintf("/batch/%d", i))
+	}
+	for i, c := range cases {
+		if c.old != "" {
+			if err := d.Put(ctx, key(i), []byte(c.old)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	batch, err := d.Batch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Interleaved across keys, as a caller pinning a DAG would.
+	for step := 0; ; step++ {
+		more := false
+		for i, c := range cases {
+			if step >= len(c.ops) {
+				continue
+			}
+			more = true
+			if v := c.ops[step]; v == "" {
+				err = batch.Delete(ctx, key(i))
+			} else {
+				err = batch.Put(ctx, key(i), []byte(v))
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if !more {
+			break
+		}
+	}
+	for i, c := range cases {
+		v, err := d.Get(ctx, key(i))
+		if c.old == "" && err != ds.ErrNotFound || c.old != "" && (err != nil || string(v) != c.old) {
+			t.Fatalf("%s: batch applied before commit: got %q, %v", c.name, v, err)
+		}
+	}
+	if err := batch.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, c := range cases {
+		v, err := d.Get(ctx, key(i))
+		switch {
+		case c.want == "" && err != ds.ErrNotFound:
+			t.Errorf("%s in a batch: got %q, %v, want %v", c.name, v, err, ds.ErrNotFound)
+		case c.want != "" && (err != nil || string(v) != c.want):
+			t.Errorf("%s in a batch: got %q, %v, want %q", c.name, v, err, c.want)
+		}
+	}
+}
+
+// subtestLargeObject round-trips a value uploaded in three parts, 5MiB
+// each unless the gateway needs larger ones.
+func subtestLargeObject(t *testing.T, _ *s3ds.S3Bucket, conf s3ds.Config) {
+	ctx := context.Background()
+	if conf.PartSize == 0 {
+		conf.PartSize = 5 << 20
+	}
+	conf.SkipManifestCheck = true
+	d, err := s3ds.NewS3Datastore(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	partSize := d.PartSize
+	value := make([]byte, 2*partSize+1)
+	for i := range value {
+		value[i] = byte(i * 7)
+	}
+	k, dst := ds.NewKey("/large/value"), ds.NewKey("/large/copy")
+	if err := d.Put(ctx, k, value); err != nil {
+		t.Fatal(err)
+	}
+	if size, err := d.GetSize(ctx, k); err != nil || size != len(value) {
+		t.Fatalf("GetSize: got %d, %v, want %d", size, err, len(value))
+	}
+	got, err := d.Get(ctx, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, value) {
+		t.Fatal("large value came back different")
+	}
+
+	// A range across the boundary between the first two parts.
+	off := int64(partSize) - 10
+	if got, err = d.GetRange(ctx, k, off, 20); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, value[off:off+20]) {
+		t.Error("range across parts came back different")
+	}
+
+	if err := d.Copy(ctx, k, dst); err != nil {
+		t.Fatal(err)
+	}
+	if got, err = d.Get(ctx, dst); err != nil || !bytes.Equal(got, value) {
+		t.Errorf("copy of a large value came back different: %v", err)
+	}
+}
+
+// subtestConditionalPut writes a block twice through a datastore skipping
+// existing blocks with conditional uploads.
+func subtestConditionalPut(t *testing.T, _ *s3ds.S3Bucket, conf s3ds.Config) {
+	ctx := context.Background()
+	conf.SkipExisting = true
+	conf.SkipExistingCheck = s3ds.SkipExistingConditional
+	// The manifest is the one of the datastore under test.
+	conf.SkipManifestCheck = true
+	d, err := s3ds.NewS3Datastore(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	bs := d.Blockstore()
+	block := blocks.NewBlock([]byte("s3test conditional put"))
+	for i := 0; i < 2; i++ {
+		if err := bs.Put(ctx, block); err != nil {
+			t.Fatalf("put %d: %s", i, err)
+		}
+	}
+	got, err := bs.Get(ctx, block.Cid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.RawData(), block.RawData()) {
+		t.Error("block came back different")
+	}
+	if err := bs.DeleteBlock(ctx, block.Cid()); err != nil {
+		t.Error(err)
+	}
+}
+
+// SubtestFake runs SubtestAll against a new Fake, once with the settings
+// of conf and once more with listings cut into pages of a few keys.
+func SubtestFake(t *testing.T, conf s3ds.Config) {
+	for _, maxKeys := range []int{0, 7} {
+		f := New()
+		f.MaxKeys = maxKeys
+		c := f.Config("s3test")
+		conf.Bucket, conf.Client = c.Bucket, c.Client
+		if conf.Region == "" {
+			conf.Region = c.Region
+		}
+		name := "pages"
+		if maxKeys == 0 {
+			name = "default"
+		}
+		t.Run(name, func(t *testing.T) {
+			SubtestAll(t, conf)
+		})
+	}
+}
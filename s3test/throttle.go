@@ -0,0 +1,157 @@
+// Package s3test contains helpers for exercising the datastore against
+// simulated S3 gateways.
+package s3test
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// StorjLimits describes the throttling behaviour of a Storj S3 gateway.
+type StorjLimits struct {
+	// RequestsPerSecond is the sustained request rate allowed per access
+	// key. Zero disables rate limiting.
+	RequestsPerSecond float64
+
+	// Burst is how many requests may be made at once before the rate limit
+	// applies. Defaults to RequestsPerSecond.
+	Burst int
+
+	// MaxConcurrent caps the number of requests in flight. Zero disables
+	// the cap.
+	MaxConcurrent int
+
+	// RetryAfter is advertised in the Retry-After header of throttled
+	// responses. Zero omits the header, as the hosted gateway does.
+	RetryAfter time.Duration
+
+	// StatusCode is the HTTP status of throttled responses. Defaults to 503
+	// with the SlowDown error code; 429 is used by some gateway versions.
+	StatusCode int
+}
+
+// DefaultStorjLimits approximates the limits of the hosted Storj gateway
+// for a free-tier project.
+var DefaultStorjLimits = StorjLimits{
+	RequestsPerSecond: 100,
+	Burst:             100,
+	MaxConcurrent:     50,
+}
+
+// Throttle wraps an S3 handler and rejects requests exceeding limits with
+// the error document Storj returns, so retry and backoff logic can be
+// exercised without hitting the real service.
+type Throttle struct {
+	next   http.Handler
+	limits StorjLimits
+
+	mu       sync.Mutex
+	tokens   float64
+	last     time.Time
+	inFlight int
+	rejected int
+	served   int
+}
+
+// NewThrottle returns a Throttle in front of next.
+func NewThrottle(next http.Handler, limits StorjLimits) *Throttle {
+	if limits.Burst <= 0 {
+		// At least one request, or rates below one a second admit none.
+		limits.Burst = max(1, int(math.Ceil(limits.RequestsPerSecond)))
+	}
+	if limits.StatusCode == 0 {
+		limits.StatusCode = http.StatusServiceUnavailable
+	}
+	return &Throttle{
+		next:   next,
+		limits: limits,
+		tokens: float64(limits.Burst),
+		last:   time.Now(),
+	}
+}
+
+func (t *Throttle) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !t.admit() {
+		t.reject(w, r)
+		return
+	}
+	defer t.release()
+	t.next.ServeHTTP(w, r)
+}
+
+// Stats returns how many requests were served and rejected so far.
+func (t *Throttle) Stats() (served, rejected int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.served, t.rejected
+}
+
+func (t *Throttle) admit() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.limits.RequestsPerSecond > 0 {
+		now := time.Now()
+		t.tokens += now.Sub(t.last).Seconds() * t.limits.RequestsPerSecond
+		if max := float64(t.limits.Burst); t.tokens > max {
+			t.tokens = max
+		}
+		t.last = now
+		if t.tokens < 1 {
+			t.rejected++
+			return false
+		}
+	}
+	if t.limits.MaxConcurrent > 0 && t.inFlight >= t.limits.MaxConcurrent {
+		t.rejected++
+		return false
+	}
+
+	if t.limits.RequestsPerSecond > 0 {
+		t.tokens--
+	}
+	t.inFlight++
+	t.served++
+	return true
+}
+
+func (t *Throttle) release() {
+	t.mu.Lock()
+	t.inFlight--
+	t.mu.Unlock()
+}
+
+func (t *Throttle) reject(w http.ResponseWriter, r *http.Request) {
+	code, message := "SlowDown", "Please reduce your request rate."
+	if t.limits.StatusCode == http.StatusTooManyRequests {
+		code, message = "TooManyRequests", "You have reached your request limit."
+	}
+	if t.limits.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(t.limits.RetryAfter.Seconds()+0.5)))
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(t.limits.StatusCode)
+	if r.Method == http.MethodHead {
+		return
+	}
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>`+"\n"+
+		`<Error><Code>%s</Code><Message>%s</Message><Resource>%s</Resource></Error>`,
+		code, message, r.URL.Path)
+}
+
+// NewThrottledProxy returns a Throttle forwarding to the S3 endpoint at
+// rawurl, typically a local MinIO started by CI. Point Config.Endpoint at
+// an httptest.Server serving the returned handler.
+func NewThrottledProxy(rawurl string, limits StorjLimits) (*Throttle, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	return NewThrottle(httputil.NewSingleHostReverseProxy(u), limits), nil
+}
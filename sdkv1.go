@@ -0,0 +1,313 @@
+//go:build s3v1
+
+package s3
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/corehandlers"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	ds "github.com/ipfs/go-datastore"
+)
+
+// ClientOption customizes the aws-sdk-go v1 configuration of the client
+// built from the connection settings, after they are applied.
+type ClientOption = func(*aws.Config)
+
+// v1Client is S3Client on an aws-sdk-go v1 client.
+type v1Client struct {
+	*s3.S3
+}
+
+var _ S3Client = v1Client{}
+
+func (c v1Client) PresignGetObject(input *s3.GetObjectInput, expiry time.Duration) (string, error) {
+	req, _ := c.GetObjectRequest(input)
+	return req.Presign(expiry)
+}
+
+func (c v1Client) PutObjectIfAbsentWithContext(ctx aws.Context, input *s3.PutObjectInput, opts ...request.Option) (*s3.PutObjectOutput, error) {
+	req, out := c.PutObjectRequest(input)
+	req.SetContext(ctx)
+	req.ApplyOptions(opts...)
+	req.Handlers.Build.PushBack(func(r *request.Request) {
+		r.HTTPRequest.Header.Set("If-None-Match", "*")
+	})
+	return out, req.Send()
+}
+
+// newClient builds the SDK client from the connection settings of conf,
+// on the transport stack of newClientTransport. It returns the adaptive
+// limiter and the DNS watcher if there are any.
+func newClient(conf *Config, log *subLogger, costs *costCounter) (S3Client, *aimdLimiter, *dnsWatcher, error) {
+	t, err := newClientTransport(conf, log, costs)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	s3Config := &aws.Config{
+		// TODO: determine if we need session token
+		Credentials:      credentials.NewStaticCredentials(conf.AccessKey, conf.SecretKey, ""),
+		Endpoint:         aws.String(conf.Endpoint),
+		Region:           aws.String(conf.Region),
+		DisableSSL:       aws.Bool(conf.Secure),
+		S3ForcePathStyle: aws.Bool(conf.Addressing != AddressingVirtualHosted),
+		HTTPClient:       &http.Client{Transport: t.rt},
+		Logger:           sdkLogger{log},
+		LogLevel:         aws.LogLevel(sdkLogLevel(log.level)),
+		Retryer:          retryer{client.DefaultRetryer{NumMaxRetries: maxRetries(conf)}},
+	}
+	for _, opt := range conf.ClientOptions {
+		opt(s3Config)
+	}
+	s3Session, err := session.NewSession(s3Config)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	bc, err := prepareBucket(v1Bucket{s3Session, s3.New(s3Session)}, conf, log)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	svc := bc.(v1Bucket).svc
+	svc.Handlers.AfterRetry.SwapNamed(afterRetry(log))
+	if t.endpoints != nil {
+		t.endpoints.install(&svc.Handlers)
+	}
+	if conf.SlowRequestThreshold > 0 {
+		logSlowRequests(&svc.Handlers, conf.SlowRequestThreshold, log)
+	}
+	if len(conf.Interceptors) > 0 {
+		svc.Handlers.Build.PushBack(func(r *request.Request) {
+			addCallHeader(r.Context(), r.HTTPRequest.Header)
+		})
+	}
+	return v1Client{svc}, t.adaptive, watchDNS(conf, svc.Endpoint, t, log), nil
+}
+
+// logSlowRequests warns of requests taking longer than threshold, from the
+// first attempt until the last one completes.
+func logSlowRequests(handlers *request.Handlers, threshold time.Duration, log *subLogger) {
+	handlers.Complete.PushBack(func(r *request.Request) {
+		logSlowRequest(log, threshold, r.Operation.Name, r.HTTPRequest.URL.Path, time.Since(r.Time), r.RetryCount)
+	})
+}
+
+// install hooks the set into the client's request handlers.
+func (es *endpointSet) install(h *request.Handlers) {
+	h.Sign.PushFrontNamed(request.NamedHandler{
+		Name: "s3ds.endpoint.pick",
+		Fn: func(r *request.Request) {
+			es.direct(r.HTTPRequest)
+		},
+	})
+	h.CompleteAttempt.PushBackNamed(request.NamedHandler{
+		Name: "s3ds.endpoint.observe",
+		Fn: func(r *request.Request) {
+			var status int
+			if r.HTTPResponse != nil {
+				status = r.HTTPResponse.StatusCode
+			}
+			es.done(r.HTTPRequest, endpointDown(r.Error, status), time.Since(r.AttemptTime))
+		},
+	})
+}
+
+// v1Bucket is bucketClient on an aws-sdk-go v1 client.
+type v1Bucket struct {
+	sess *session.Session
+	svc  *s3.S3
+}
+
+func (c v1Bucket) headBucket(ctx context.Context, bucket string) (bool, string, error) {
+	req, _ := c.svc.HeadBucketRequest(&s3.HeadBucketInput{
+		Bucket: aws.String(bucket),
+	})
+	req.SetContext(ctx)
+	err := req.Send()
+
+	var region string
+	if req.HTTPResponse != nil {
+		region = req.HTTPResponse.Header.Get("X-Amz-Bucket-Region")
+	}
+	var status int
+	if rerr, ok := err.(awserr.RequestFailure); ok {
+		status = rerr.StatusCode()
+	}
+	return bucketStatus(status, region, err)
+}
+
+func (c v1Bucket) inRegion(region string) bucketClient {
+	return v1Bucket{c.sess, s3.New(c.sess, aws.NewConfig().WithRegion(region))}
+}
+
+func (c v1Bucket) createBucket(ctx context.Context, conf *Config) error {
+	input := &s3.CreateBucketInput{
+		Bucket: aws.String(conf.Bucket),
+	}
+	// us-east-1 is the default and refuses to be named explicitly.
+	if conf.Region != "" && conf.Region != "us-east-1" {
+		input.CreateBucketConfiguration = &s3.CreateBucketConfiguration{
+			LocationConstraint: aws.String(conf.Region),
+		}
+	}
+	_, err := c.svc.CreateBucketWithContext(ctx, input)
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeBucketAlreadyOwnedByYou {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if conf.BucketVersioning {
+		_, err := c.svc.PutBucketVersioningWithContext(ctx, &s3.PutBucketVersioningInput{
+			Bucket: aws.String(conf.Bucket),
+			VersioningConfiguration: &s3.VersioningConfiguration{
+				Status: aws.String(s3.BucketVersioningStatusEnabled),
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("enabling versioning: %s", err)
+		}
+	}
+	if conf.BucketEncryption != "" {
+		_, err := c.svc.PutBucketEncryptionWithContext(ctx, &s3.PutBucketEncryptionInput{
+			Bucket: aws.String(conf.Bucket),
+			ServerSideEncryptionConfiguration: &s3.ServerSideEncryptionConfiguration{
+				Rules: []*s3.ServerSideEncryptionRule{{
+					ApplyServerSideEncryptionByDefault: &s3.ServerSideEncryptionByDefault{
+						SSEAlgorithm: aws.String(conf.BucketEncryption),
+					},
+				}},
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("enabling encryption: %s", err)
+		}
+	}
+	return nil
+}
+
+// sdkLogger adapts a subsystem logger to the SDK's logger, which only
+// logs at the level set in aws.Config.LogLevel.
+type sdkLogger struct {
+	l *subLogger
+}
+
+func (s sdkLogger) Log(args ...interface{}) {
+	s.l.Debugf("%s", fmt.Sprint(args...))
+}
+
+// sdkLogLevel maps the s3 subsystem level to the SDK's request logging.
+func sdkLogLevel(level LogLevel) aws.LogLevelType {
+	if level <= LevelDebug {
+		return aws.LogDebugWithRequestRetries | aws.LogDebugWithRequestErrors
+	}
+	return aws.LogOff
+}
+
+// retryer is the SDK's default retryer, except that it gives up at once
+// on errors retrying cannot fix and always retries throttling and
+// timeouts, whatever status code the gateway chose for them.
+type retryer struct {
+	client.DefaultRetryer
+}
+
+func (r retryer) ShouldRetry(req *request.Request) bool {
+	if req.Retryable != nil {
+		return *req.Retryable
+	}
+	var status int
+	if req.HTTPResponse != nil {
+		status = req.HTTPResponse.StatusCode
+	}
+	switch classify(req.Error, status) {
+	case ErrAuth, ErrBucketMissing, ds.ErrNotFound:
+		return false
+	case ErrThrottled, ErrChecksumMismatch:
+		// The body was corrupted on the way; sending it again may work.
+		return true
+	case ErrTimeout:
+		// A request cancelled by its context's deadline cannot succeed.
+		return req.Context().Err() == nil
+	}
+	return r.DefaultRetryer.ShouldRetry(req)
+}
+
+// afterRetry replaces the SDK's core.AfterRetryHandler, which waits out
+// the retry delay even when the deadline of the request's context falls
+// within it, only to fail with the cancellation. A retry that cannot
+// start before the deadline is not waited for, and a request retried
+// until its deadline ran out fails with a *DeadlineError. Every retry is
+// logged, throttling as a warning.
+func afterRetry(log *subLogger) request.NamedHandler {
+	return request.NamedHandler{
+		Name: corehandlers.AfterRetryHandler.Name,
+		Fn: func(r *request.Request) {
+			if r.Retryable == nil || aws.BoolValue(r.Config.EnforceShouldRetryCheck) {
+				r.Retryable = aws.Bool(r.ShouldRetry(r))
+			}
+			ctx := r.Context()
+			if !r.WillRetry() {
+				if r.Error != nil && r.RetryCount > 0 && ctx.Err() == context.DeadlineExceeded {
+					r.Error = deadlineError(r)
+				}
+				return
+			}
+
+			r.RetryDelay = r.RetryRules(r)
+			if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < r.RetryDelay {
+				log.Infof("%s %s failed: %s; not retrying, the deadline is in %s",
+					r.Operation.Name, r.HTTPRequest.URL.Path, r.Error, time.Until(deadline).Round(time.Millisecond))
+				r.Error = deadlineError(r)
+				r.Retryable = aws.Bool(false)
+				return
+			}
+			var status int
+			if r.HTTPResponse != nil {
+				status = r.HTTPResponse.StatusCode
+			}
+			if classify(r.Error, status) == ErrThrottled {
+				log.Warnf("throttled: %s %s, retry %d in %s",
+					r.Operation.Name, r.HTTPRequest.URL.Path, r.RetryCount+1, r.RetryDelay)
+			} else {
+				log.Infof("%s %s failed: %s; retry %d in %s",
+					r.Operation.Name, r.HTTPRequest.URL.Path, r.Error, r.RetryCount+1, r.RetryDelay)
+			}
+
+			if err := aws.SleepWithContext(ctx, r.RetryDelay); err != nil {
+				if ctx.Err() == context.DeadlineExceeded {
+					r.Error = deadlineError(r)
+				} else {
+					r.Error = awserr.New(request.CanceledErrorCode, "request context canceled", err)
+				}
+				r.Retryable = aws.Bool(false)
+				return
+			}
+			// An expired token is fetched again on the retry.
+			if r.IsErrorExpired() {
+				r.Config.Credentials.Expire()
+			}
+			r.RetryCount++
+			r.Error = nil
+		},
+	}
+}
+
+// deadlineError wraps the error of the last attempt of r.
+func deadlineError(r *request.Request) *DeadlineError {
+	return &DeadlineError{
+		Operation: r.Operation.Name,
+		Attempts:  r.RetryCount + 1,
+		Elapsed:   time.Since(r.Time),
+		Err:       r.Error,
+	}
+}
@@ -0,0 +1,653 @@
+//go:build !s3v1
+
+package s3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"reflect"
+	"strconv"
+	"time"
+
+	awsv2 "github.com/aws/aws-sdk-go-v2/aws"
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	s3v2 "github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/smithy-go"
+	"github.com/aws/smithy-go/logging"
+	"github.com/aws/smithy-go/middleware"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	ds "github.com/ipfs/go-datastore"
+)
+
+// ClientOption customizes the aws-sdk-go-v2 options of the client built
+// from the connection settings, after they are applied. Retries are the
+// datastore's own, after MaxRetries, whatever the Retryer.
+type ClientOption = func(*s3v2.Options)
+
+// newClient builds the SDK client from the connection settings of conf,
+// on the transport stack of newClientTransport. It returns the adaptive
+// limiter and the DNS watcher if there are any.
+func newClient(conf *Config, log *subLogger, costs *costCounter) (S3Client, *aimdLimiter, *dnsWatcher, error) {
+	t, err := newClientTransport(conf, log, costs)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	retries := &retryLoop{maxRetries: maxRetries(conf), slow: conf.SlowRequestThreshold, log: log}
+	opts := s3v2.Options{
+		Credentials:  credentials.NewStaticCredentialsProvider(conf.AccessKey, conf.SecretKey, ""),
+		Region:       conf.Region,
+		UsePathStyle: conf.Addressing != AddressingVirtualHosted,
+		HTTPClient:   &http.Client{Transport: t.rt},
+		Logger:       sdkLogger{log},
+		APIOptions:   []func(*middleware.Stack) error{retries.add},
+
+		// Gateways other than S3 itself reject the checksums the SDK
+		// otherwise adds to every upload.
+		RequestChecksumCalculation: awsv2.RequestChecksumCalculationWhenRequired,
+		ResponseChecksumValidation: awsv2.ResponseChecksumValidationWhenRequired,
+	}
+	endpoint := endpointURL(conf.Endpoint, conf.Secure)
+	if endpoint != "" {
+		opts.BaseEndpoint = awsv2.String(endpoint)
+	} else {
+		endpoint = "https://s3." + conf.Region + ".amazonaws.com"
+	}
+	if log.level <= LevelDebug {
+		opts.ClientLogMode = awsv2.LogRetries
+	}
+	if t.endpoints != nil {
+		opts.APIOptions = append(opts.APIOptions, endpointMiddleware{t.endpoints}.add)
+	}
+	if len(conf.Interceptors) > 0 {
+		opts.APIOptions = append(opts.APIOptions, addCallHeaderMiddleware)
+	}
+	for _, opt := range conf.ClientOptions {
+		opt(&opts)
+	}
+
+	bc, err := prepareBucket(v2Bucket{s3v2.New(opts)}, conf, log)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	client := bc.(v2Bucket).client
+	return &v2Client{client: client, presign: s3v2.NewPresignClient(client)}, t.adaptive, watchDNS(conf, endpoint, t, log), nil
+}
+
+// v2Client is S3Client on an aws-sdk-go-v2 client. Requests and responses
+// are converted field by field; options of v1 requests do not apply and
+// are ignored.
+type v2Client struct {
+	client  *s3v2.Client
+	presign *s3v2.PresignClient
+}
+
+var _ S3Client = (*v2Client)(nil)
+
+// call converts in to the input of op, calls it, and converts its output,
+// or its error, back.
+func call[Out, In, In2, Out2 any](ctx context.Context, op func(context.Context, *In2, ...func(*s3v2.Options)) (*Out2, error), in *In) (*Out, error) {
+	in2 := new(In2)
+	convert(in2, in)
+	out2, err := op(ctx, in2)
+	if err != nil {
+		return nil, sdkError(err)
+	}
+	out := new(Out)
+	convert(out, out2)
+	return out, nil
+}
+
+func (c *v2Client) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	return c.GetObjectWithContext(context.Background(), input)
+}
+
+func (c *v2Client) GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, _ ...request.Option) (*s3.GetObjectOutput, error) {
+	return call[s3.GetObjectOutput](ctx, c.client.GetObject, input)
+}
+
+func (c *v2Client) HeadObjectWithContext(ctx aws.Context, input *s3.HeadObjectInput, _ ...request.Option) (*s3.HeadObjectOutput, error) {
+	return call[s3.HeadObjectOutput](ctx, c.client.HeadObject, input)
+}
+
+func (c *v2Client) PresignGetObject(input *s3.GetObjectInput, expiry time.Duration) (string, error) {
+	in := new(s3v2.GetObjectInput)
+	convert(in, input)
+	req, err := c.presign.PresignGetObject(context.Background(), in, s3v2.WithPresignExpires(expiry))
+	if err != nil {
+		return "", sdkError(err)
+	}
+	return req.URL, nil
+}
+
+func (c *v2Client) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	return c.PutObjectWithContext(context.Background(), input)
+}
+
+func (c *v2Client) PutObjectWithContext(ctx aws.Context, input *s3.PutObjectInput, _ ...request.Option) (*s3.PutObjectOutput, error) {
+	return call[s3.PutObjectOutput](ctx, c.client.PutObject, input)
+}
+
+func (c *v2Client) PutObjectIfAbsentWithContext(ctx aws.Context, input *s3.PutObjectInput, _ ...request.Option) (*s3.PutObjectOutput, error) {
+	put := func(ctx context.Context, in *s3v2.PutObjectInput, opts ...func(*s3v2.Options)) (*s3v2.PutObjectOutput, error) {
+		in.IfNoneMatch = awsv2.String("*")
+		return c.client.PutObject(ctx, in, opts...)
+	}
+	return call[s3.PutObjectOutput](ctx, put, input)
+}
+
+func (c *v2Client) PutObjectAclWithContext(ctx aws.Context, input *s3.PutObjectAclInput, _ ...request.Option) (*s3.PutObjectAclOutput, error) {
+	return call[s3.PutObjectAclOutput](ctx, c.client.PutObjectAcl, input)
+}
+
+func (c *v2Client) RestoreObjectWithContext(ctx aws.Context, input *s3.RestoreObjectInput, _ ...request.Option) (*s3.RestoreObjectOutput, error) {
+	return call[s3.RestoreObjectOutput](ctx, c.client.RestoreObject, input)
+}
+
+func (c *v2Client) CopyObjectWithContext(ctx aws.Context, input *s3.CopyObjectInput, _ ...request.Option) (*s3.CopyObjectOutput, error) {
+	return call[s3.CopyObjectOutput](ctx, c.client.CopyObject, input)
+}
+
+func (c *v2Client) CreateMultipartUploadWithContext(ctx aws.Context, input *s3.CreateMultipartUploadInput, _ ...request.Option) (*s3.CreateMultipartUploadOutput, error) {
+	return call[s3.CreateMultipartUploadOutput](ctx, c.client.CreateMultipartUpload, input)
+}
+
+func (c *v2Client) UploadPartWithContext(ctx aws.Context, input *s3.UploadPartInput, _ ...request.Option) (*s3.UploadPartOutput, error) {
+	return call[s3.UploadPartOutput](ctx, c.client.UploadPart, input)
+}
+
+func (c *v2Client) UploadPartCopyWithContext(ctx aws.Context, input *s3.UploadPartCopyInput, _ ...request.Option) (*s3.UploadPartCopyOutput, error) {
+	return call[s3.UploadPartCopyOutput](ctx, c.client.UploadPartCopy, input)
+}
+
+func (c *v2Client) CompleteMultipartUploadWithContext(ctx aws.Context, input *s3.CompleteMultipartUploadInput, _ ...request.Option) (*s3.CompleteMultipartUploadOutput, error) {
+	return call[s3.CompleteMultipartUploadOutput](ctx, c.client.CompleteMultipartUpload, input)
+}
+
+func (c *v2Client) AbortMultipartUploadWithContext(ctx aws.Context, input *s3.AbortMultipartUploadInput, _ ...request.Option) (*s3.AbortMultipartUploadOutput, error) {
+	return call[s3.AbortMultipartUploadOutput](ctx, c.client.AbortMultipartUpload, input)
+}
+
+func (c *v2Client) DeleteObject(input *s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error) {
+	return c.DeleteObjectWithContext(context.Background(), input)
+}
+
+func (c *v2Client) DeleteObjectWithContext(ctx aws.Context, input *s3.DeleteObjectInput, _ ...request.Option) (*s3.DeleteObjectOutput, error) {
+	return call[s3.DeleteObjectOutput](ctx, c.client.DeleteObject, input)
+}
+
+func (c *v2Client) DeleteObjectsWithContext(ctx aws.Context, input *s3.DeleteObjectsInput, _ ...request.Option) (*s3.DeleteObjectsOutput, error) {
+	return call[s3.DeleteObjectsOutput](ctx, c.client.DeleteObjects, input)
+}
+
+func (c *v2Client) ListObjectsV2(input *s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, error) {
+	return c.ListObjectsV2WithContext(context.Background(), input)
+}
+
+func (c *v2Client) ListObjectsV2WithContext(ctx aws.Context, input *s3.ListObjectsV2Input, _ ...request.Option) (*s3.ListObjectsV2Output, error) {
+	return call[s3.ListObjectsV2Output](ctx, c.client.ListObjectsV2, input)
+}
+
+func (c *v2Client) ListObjectsV2PagesWithContext(ctx aws.Context, input *s3.ListObjectsV2Input, fn func(*s3.ListObjectsV2Output, bool) bool, _ ...request.Option) error {
+	page := *input
+	for {
+		out, err := c.ListObjectsV2WithContext(ctx, &page)
+		if err != nil {
+			return err
+		}
+		last := aws.StringValue(out.NextContinuationToken) == ""
+		if !fn(out, last) || last {
+			return nil
+		}
+		page.ContinuationToken = out.NextContinuationToken
+	}
+}
+
+func (c *v2Client) ListObjectVersionsPagesWithContext(ctx aws.Context, input *s3.ListObjectVersionsInput, fn func(*s3.ListObjectVersionsOutput, bool) bool, _ ...request.Option) error {
+	page := *input
+	for {
+		out, err := call[s3.ListObjectVersionsOutput](ctx, c.client.ListObjectVersions, &page)
+		if err != nil {
+			return err
+		}
+		last := !aws.BoolValue(out.IsTruncated)
+		if !fn(out, last) || last {
+			return nil
+		}
+		page.KeyMarker, page.VersionIdMarker = out.NextKeyMarker, out.NextVersionIdMarker
+	}
+}
+
+func (c *v2Client) GetBucketLifecycleConfigurationWithContext(ctx aws.Context, input *s3.GetBucketLifecycleConfigurationInput, _ ...request.Option) (*s3.GetBucketLifecycleConfigurationOutput, error) {
+	return call[s3.GetBucketLifecycleConfigurationOutput](ctx, c.client.GetBucketLifecycleConfiguration, input)
+}
+
+func (c *v2Client) PutBucketLifecycleConfigurationWithContext(ctx aws.Context, input *s3.PutBucketLifecycleConfigurationInput, _ ...request.Option) (*s3.PutBucketLifecycleConfigurationOutput, error) {
+	return call[s3.PutBucketLifecycleConfigurationOutput](ctx, c.client.PutBucketLifecycleConfiguration, input)
+}
+
+func (c *v2Client) DeleteBucketLifecycleWithContext(ctx aws.Context, input *s3.DeleteBucketLifecycleInput, _ ...request.Option) (*s3.DeleteBucketLifecycleOutput, error) {
+	return call[s3.DeleteBucketLifecycleOutput](ctx, c.client.DeleteBucketLifecycle, input)
+}
+
+func (c *v2Client) GetBucketVersioningWithContext(ctx aws.Context, input *s3.GetBucketVersioningInput, _ ...request.Option) (*s3.GetBucketVersioningOutput, error) {
+	return call[s3.GetBucketVersioningOutput](ctx, c.client.GetBucketVersioning, input)
+}
+
+// v2Bucket is bucketClient on an aws-sdk-go-v2 client.
+type v2Bucket struct {
+	client *s3v2.Client
+}
+
+func (c v2Bucket) headBucket(ctx context.Context, bucket string) (bool, string, error) {
+	out, err := c.client.HeadBucket(ctx, &s3v2.HeadBucketInput{
+		Bucket: awsv2.String(bucket),
+	})
+	if err == nil {
+		return true, awsv2.ToString(out.BucketRegion), nil
+	}
+	var region string
+	var rerr interface{ HTTPResponse() *smithyhttp.Response }
+	if errors.As(err, &rerr) {
+		region = rerr.HTTPResponse().Header.Get("X-Amz-Bucket-Region")
+	}
+	return bucketStatus(responseStatus(err), region, sdkError(err))
+}
+
+func (c v2Bucket) inRegion(region string) bucketClient {
+	return v2Bucket{s3v2.New(c.client.Options(), func(o *s3v2.Options) {
+		o.Region = region
+	})}
+}
+
+func (c v2Bucket) createBucket(ctx context.Context, conf *Config) error {
+	input := &s3v2.CreateBucketInput{
+		Bucket: awsv2.String(conf.Bucket),
+	}
+	// us-east-1 is the default and refuses to be named explicitly.
+	if conf.Region != "" && conf.Region != "us-east-1" {
+		input.CreateBucketConfiguration = &s3types.CreateBucketConfiguration{
+			LocationConstraint: s3types.BucketLocationConstraint(conf.Region),
+		}
+	}
+	_, err := c.client.CreateBucket(ctx, input)
+	var owned *s3types.BucketAlreadyOwnedByYou
+	if errors.As(err, &owned) {
+		err = nil
+	}
+	if err != nil {
+		return sdkError(err)
+	}
+
+	if conf.BucketVersioning {
+		_, err := c.client.PutBucketVersioning(ctx, &s3v2.PutBucketVersioningInput{
+			Bucket: awsv2.String(conf.Bucket),
+			VersioningConfiguration: &s3types.VersioningConfiguration{
+				Status: s3types.BucketVersioningStatusEnabled,
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("enabling versioning: %s", sdkError(err))
+		}
+	}
+	if conf.BucketEncryption != "" {
+		_, err := c.client.PutBucketEncryption(ctx, &s3v2.PutBucketEncryptionInput{
+			Bucket: awsv2.String(conf.Bucket),
+			ServerSideEncryptionConfiguration: &s3types.ServerSideEncryptionConfiguration{
+				Rules: []s3types.ServerSideEncryptionRule{{
+					ApplyServerSideEncryptionByDefault: &s3types.ServerSideEncryptionByDefault{
+						SSEAlgorithm: s3types.ServerSideEncryption(conf.BucketEncryption),
+					},
+				}},
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("enabling encryption: %s", sdkError(err))
+		}
+	}
+	return nil
+}
+
+// sdkLogger adapts a subsystem logger to the SDK's logger, which only
+// logs what Options.ClientLogMode asks for.
+type sdkLogger struct {
+	l *subLogger
+}
+
+func (s sdkLogger) Logf(_ logging.Classification, format string, v ...interface{}) {
+	s.l.Debugf(format, v...)
+}
+
+// sdkError converts an error of aws-sdk-go-v2 to the aws-sdk-go v1 error
+// the rest of the datastore classifies: an awserr.RequestFailure with the
+// code and status of an error response, a cancellation, or a request
+// error wrapping a transport failure. A *DeadlineError is returned as is.
+func sdkError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var derr *DeadlineError
+	if errors.As(err, &derr) {
+		return derr
+	}
+	var reqID string
+	var ierr interface{ ServiceRequestID() string }
+	if errors.As(err, &ierr) {
+		reqID = ierr.ServiceRequestID()
+	}
+	status := responseStatus(err)
+
+	var aerr smithy.APIError
+	switch {
+	case errors.As(err, &aerr):
+		e := awserr.New(aerr.ErrorCode(), aerr.ErrorMessage(), nil)
+		if status != 0 {
+			return awserr.NewRequestFailure(e, status, reqID)
+		}
+		return e
+	case errors.Is(err, context.DeadlineExceeded):
+		return awserr.New(request.CanceledErrorCode, "request context canceled", context.DeadlineExceeded)
+	case errors.Is(err, context.Canceled):
+		return awserr.New(request.CanceledErrorCode, "request context canceled", context.Canceled)
+	}
+	if status != 0 {
+		return awserr.NewRequestFailure(awserr.New(http.StatusText(status), err.Error(), nil), status, reqID)
+	}
+	var nerr net.Error
+	if errors.As(err, &nerr) {
+		return awserr.New(request.ErrCodeRequestError, "send request failed", nerr)
+	}
+	return err
+}
+
+// responseStatus is the HTTP status of the response err is about, or 0.
+func responseStatus(err error) int {
+	var rerr interface{ HTTPStatusCode() int }
+	if errors.As(err, &rerr) {
+		return rerr.HTTPStatusCode()
+	}
+	return 0
+}
+
+// convert copies src, a request or response of one SDK, to dst, a pointer
+// to its counterpart in the other. Both are generated from the same model,
+// so fields match by name; they differ in pointers, integer widths, enums
+// and maps of pointers. Fields only one SDK has are left out.
+func convert(dst, src interface{}) {
+	convertValue(reflect.ValueOf(dst).Elem(), reflect.ValueOf(src))
+}
+
+// convertValue sets dst to src and reports whether it did.
+func convertValue(dst, src reflect.Value) bool {
+	if !src.IsValid() {
+		return false
+	}
+	if src.Type().AssignableTo(dst.Type()) {
+		dst.Set(src)
+		return true
+	}
+	if src.Kind() == reflect.Ptr || src.Kind() == reflect.Interface {
+		return !src.IsNil() && convertValue(dst, src.Elem())
+	}
+	if dst.Kind() == reflect.Ptr {
+		// An unset enum of v2 is the empty string; in v1, a nil pointer.
+		if src.Kind() == reflect.String && src.Len() == 0 && src.Type() != reflect.TypeOf("") {
+			return false
+		}
+		v := reflect.New(dst.Type().Elem())
+		if !convertValue(v.Elem(), src) {
+			return false
+		}
+		dst.Set(v)
+		return true
+	}
+
+	switch dst.Kind() {
+	case reflect.Struct:
+		if src.Kind() != reflect.Struct {
+			return false
+		}
+		for i := 0; i < dst.NumField(); i++ {
+			f := dst.Type().Field(i)
+			if f.PkgPath != "" {
+				continue
+			}
+			convertValue(dst.Field(i), src.FieldByName(f.Name))
+		}
+		return true
+	case reflect.String:
+		if src.Kind() != reflect.String {
+			return false
+		}
+		dst.SetString(src.String())
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		if src.Kind() != reflect.Int && src.Kind() != reflect.Int32 && src.Kind() != reflect.Int64 {
+			return false
+		}
+		dst.SetInt(src.Int())
+	case reflect.Bool:
+		if src.Kind() != reflect.Bool {
+			return false
+		}
+		dst.SetBool(src.Bool())
+	case reflect.Slice:
+		if src.Kind() != reflect.Slice || src.IsNil() {
+			return false
+		}
+		s := reflect.MakeSlice(dst.Type(), src.Len(), src.Len())
+		for i := 0; i < src.Len(); i++ {
+			convertValue(s.Index(i), src.Index(i))
+		}
+		dst.Set(s)
+	case reflect.Map:
+		if src.Kind() != reflect.Map || src.IsNil() || src.Type().Key() != dst.Type().Key() {
+			return false
+		}
+		m := reflect.MakeMapWithSize(dst.Type(), src.Len())
+		for iter := src.MapRange(); iter.Next(); {
+			v := reflect.New(dst.Type().Elem()).Elem()
+			if convertValue(v, iter.Value()) {
+				m.SetMapIndex(iter.Key(), v)
+			}
+		}
+		dst.Set(m)
+	default:
+		return false
+	}
+	return true
+}
+
+// retryLoop replaces the SDK's retry middleware with the retrying of the
+// v1 client: it gives up at once on errors retrying cannot fix, always
+// retries throttling and timeouts, backs off as the v1 SDK does, and
+// does not wait out a delay that ends past the deadline of the request's
+// context, failing with a *DeadlineError instead. Every retry is logged,
+// throttling as a warning.
+type retryLoop struct {
+	maxRetries int
+	slow       time.Duration
+	log        *subLogger
+}
+
+func (l *retryLoop) ID() string {
+	return "Retry"
+}
+
+// add swaps the loop for the SDK's. Presigned requests have none.
+func (l *retryLoop) add(stack *middleware.Stack) error {
+	if _, ok := stack.Finalize.Get(l.ID()); !ok {
+		return nil
+	}
+	_, err := stack.Finalize.Swap(l.ID(), l)
+	return err
+}
+
+func (l *retryLoop) HandleFinalize(ctx context.Context, in middleware.FinalizeInput, next middleware.FinalizeHandler) (middleware.FinalizeOutput, middleware.Metadata, error) {
+	req, ok := in.Request.(*smithyhttp.Request)
+	if !ok {
+		return next.HandleFinalize(ctx, in)
+	}
+	op := awsmiddleware.GetOperationName(ctx)
+	start := time.Now()
+	for retries := 0; ; retries++ {
+		if retries > 0 {
+			if err := req.RewindStream(); err != nil {
+				return middleware.FinalizeOutput{}, middleware.Metadata{}, err
+			}
+		}
+		attempt := req.Clone()
+		in.Request = attempt
+		out, md, err := next.HandleFinalize(ctx, in)
+		path := attempt.URL.Path
+		if err == nil {
+			if l.slow > 0 {
+				logSlowRequest(l.log, l.slow, op, path, time.Since(start), retries)
+			}
+			return out, md, nil
+		}
+
+		deadlineErr := func() error {
+			return &DeadlineError{Operation: op, Attempts: retries + 1, Elapsed: time.Since(start), Err: sdkError(err)}
+		}
+		status := responseStatus(err)
+		if retries >= l.maxRetries || !l.shouldRetry(ctx, err, status) {
+			if retries > 0 && ctx.Err() == context.DeadlineExceeded {
+				err = deadlineErr()
+			}
+			if l.slow > 0 {
+				logSlowRequest(l.log, l.slow, op, path, time.Since(start), retries)
+			}
+			return out, md, err
+		}
+
+		throttled := classify(sdkError(err), status) == ErrThrottled
+		delay := retryDelay(err, retries, throttled)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			l.log.Infof("%s %s failed: %s; not retrying, the deadline is in %s",
+				op, path, sdkError(err), time.Until(deadline).Round(time.Millisecond))
+			return out, md, deadlineErr()
+		}
+		if throttled {
+			l.log.Warnf("throttled: %s %s, retry %d in %s", op, path, retries+1, delay)
+		} else {
+			l.log.Infof("%s %s failed: %s; retry %d in %s", op, path, sdkError(err), retries+1, delay)
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			if ctx.Err() == context.DeadlineExceeded {
+				return out, md, deadlineErr()
+			}
+			return out, md, &awsv2.RequestCanceledError{Err: ctx.Err()}
+		}
+	}
+}
+
+// shouldRetry reports whether the attempt that failed with err and the
+// response status is worth sending again.
+func (l *retryLoop) shouldRetry(ctx context.Context, err error, status int) bool {
+	// A request cancelled by its context cannot succeed.
+	if ctx.Err() != nil {
+		return false
+	}
+	switch classify(sdkError(err), status) {
+	case ErrAuth, ErrBucketMissing, ds.ErrNotFound:
+		return false
+	case ErrThrottled, ErrChecksumMismatch, ErrTimeout:
+		// The body was corrupted on the way; sending it again may work.
+		return true
+	}
+	return retry.IsErrorRetryables(retry.DefaultRetryables).IsErrorRetryable(err) == awsv2.TrueTernary
+}
+
+// retryDelay is the backoff of the v1 SDK's default retryer before retry
+// retries+1: exponential from a random 30ms to 60ms, or from 500ms to 1s
+// when throttled, unless the response says when to retry, and at most
+// five minutes.
+func retryDelay(err error, retries int, throttled bool) time.Duration {
+	const maxDelay = 300 * time.Second
+	min := 30 * time.Millisecond
+	if throttled {
+		var rerr interface{ HTTPResponse() *smithyhttp.Response }
+		if errors.As(err, &rerr) {
+			if secs, err := strconv.Atoi(rerr.HTTPResponse().Header.Get("Retry-After")); err == nil && secs >= 0 {
+				return time.Duration(secs) * time.Second
+			}
+		}
+		min = 500 * time.Millisecond
+		if retries > 8 {
+			retries = 8
+		}
+	}
+	if retries > 13 {
+		retries = 13
+	}
+	delay := time.Duration(1<<uint(retries)) * (min + time.Duration(rand.Int63n(int64(min))))
+	if delay > maxDelay {
+		return maxDelay
+	}
+	return delay
+}
+
+// endpointMiddleware points each attempt at the endpoint of the set to use
+// for it, after the SDK resolved the endpoint and before it signs, and
+// records the outcome.
+type endpointMiddleware struct {
+	es *endpointSet
+}
+
+func (endpointMiddleware) ID() string {
+	return "s3ds.endpoint"
+}
+
+func (m endpointMiddleware) add(stack *middleware.Stack) error {
+	if _, ok := stack.Finalize.Get("Signing"); !ok {
+		return nil
+	}
+	return stack.Finalize.Insert(m, "Signing", middleware.Before)
+}
+
+func (m endpointMiddleware) HandleFinalize(ctx context.Context, in middleware.FinalizeInput, next middleware.FinalizeHandler) (middleware.FinalizeOutput, middleware.Metadata, error) {
+	req, ok := in.Request.(*smithyhttp.Request)
+	if !ok {
+		return next.HandleFinalize(ctx, in)
+	}
+	m.es.direct(req.Request)
+	start := time.Now()
+	out, md, err := next.HandleFinalize(ctx, in)
+	resp, _ := awsmiddleware.GetRawResponse(md).(*smithyhttp.Response)
+	if resp == nil && err == nil {
+		// Presigned, not sent.
+		return out, md, err
+	}
+	status := responseStatus(err)
+	if resp != nil {
+		status = resp.StatusCode
+	}
+	m.es.done(req.Request, endpointDown(sdkError(err), status), time.Since(start))
+	return out, md, err
+}
+
+// addCallHeaderMiddleware marks requests of intercepted calls.
+func addCallHeaderMiddleware(stack *middleware.Stack) error {
+	return stack.Build.Add(middleware.BuildMiddlewareFunc("s3ds.callHeader",
+		func(ctx context.Context, in middleware.BuildInput, next middleware.BuildHandler) (middleware.BuildOutput, middleware.Metadata, error) {
+			if req, ok := in.Request.(*smithyhttp.Request); ok {
+				addCallHeader(ctx, req.Header)
+			}
+			return next.HandleBuild(ctx, in)
+		}), middleware.After)
+}
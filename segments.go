@@ -0,0 +1,98 @@
+package s3
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// SegmentStats counts the segments the objects uploaded since startup
+// occupy on Storj, which bills every segment, however little of it is
+// filled.
+type SegmentStats struct {
+	Objects  int64 `json:"objects"`
+	Segments int64 `json:"segments"`
+	Bytes    int64 `json:"bytes"`
+
+	// Utilization is Bytes over the capacity of Segments. Values much
+	// smaller than a segment keep it low; Packing raises it.
+	Utilization float64 `json:"utilization"`
+}
+
+// segmentCounter counts the segments of uploads, given how the store
+// splits them into parts.
+type segmentCounter struct {
+	segmentSize int64
+	partSize    int64
+
+	objects  int64
+	segments int64
+	bytes    int64
+}
+
+func newSegmentCounter(segmentSize, partSize int) *segmentCounter {
+	return &segmentCounter{segmentSize: int64(segmentSize), partSize: int64(partSize)}
+}
+
+// add counts an object of size bytes. Every part of a multipart upload
+// starts a new segment.
+func (c *segmentCounter) add(size int64) {
+	var segments int64
+	if c.partSize > 0 && size > c.partSize {
+		full := size / c.partSize
+		segments = full * c.segmentsOf(c.partSize)
+		if rest := size % c.partSize; rest > 0 {
+			segments += c.segmentsOf(rest)
+		}
+	} else {
+		segments = c.segmentsOf(size)
+	}
+	atomic.AddInt64(&c.objects, 1)
+	atomic.AddInt64(&c.segments, segments)
+	atomic.AddInt64(&c.bytes, size)
+}
+
+func (c *segmentCounter) segmentsOf(size int64) int64 {
+	if size <= c.segmentSize {
+		return 1
+	}
+	return (size + c.segmentSize - 1) / c.segmentSize
+}
+
+func (c *segmentCounter) snapshot() SegmentStats {
+	st := SegmentStats{
+		Objects:  atomic.LoadInt64(&c.objects),
+		Segments: atomic.LoadInt64(&c.segments),
+		Bytes:    atomic.LoadInt64(&c.bytes),
+	}
+	if st.Segments > 0 {
+		st.Utilization = float64(st.Bytes) / float64(st.Segments*c.segmentSize)
+	}
+	return st
+}
+
+// segmentStore counts the segments of the objects written to an
+// ObjectStore.
+type segmentStore struct {
+	ObjectStore
+	counter *segmentCounter
+}
+
+func (t *segmentStore) PutObject(ctx context.Context, name string, body []byte, opts PutOptions) error {
+	err := t.ObjectStore.PutObject(ctx, name, body, opts)
+	if err == nil {
+		t.counter.add(int64(len(body)))
+	}
+	return err
+}
+
+func (t *segmentStore) CopyObject(ctx context.Context, src, dst string, size int64, opts PutOptions) error {
+	err := copyObject(ctx, t.ObjectStore, src, dst, size, opts)
+	if err == nil {
+		t.counter.add(size)
+	}
+	return err
+}
+
+func (t *segmentStore) GetObjectRange(ctx context.Context, name string, offset, length int64) ([]byte, ObjectInfo, error) {
+	return getObjectRange(ctx, t.ObjectStore, name, offset, length)
+}
@@ -0,0 +1,91 @@
+package s3
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// defaultShutdownTimeout is how long Close waits for outstanding writes
+// when ShutdownTimeout is not set.
+const defaultShutdownTimeout = 30 * time.Second
+
+// ShutdownError reports the writes Close gave up on.
+type ShutdownError struct {
+	// Batches is the number of batch commits cancelled by Close.
+	Batches int
+
+	// Uploads is the error of the background uploads that failed or were
+	// cancelled, or nil.
+	Uploads error
+}
+
+func (e *ShutdownError) Error() string {
+	var msgs []string
+	if e.Batches > 0 {
+		msgs = append(msgs, fmt.Sprintf("%d batch commits cancelled", e.Batches))
+	}
+	if e.Uploads != nil {
+		msgs = append(msgs, e.Uploads.Error())
+	}
+	return fmt.Sprintf("s3ds: writes dropped on shutdown: %s", strings.Join(msgs, "; "))
+}
+
+// beginWrite registers a write that Close waits for. The returned context
+// is ctx, also cancelled once Close gives up waiting; the function ends
+// the write.
+func (s *S3Bucket) beginWrite(ctx context.Context) (context.Context, func()) {
+	s.inflight.Add(1)
+	ctx, cancel := context.WithCancel(ctx)
+	stop := context.AfterFunc(s.ctx, cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+		s.inflight.Done()
+	}
+}
+
+// drain waits up to ShutdownTimeout for batch commits, background uploads
+// and async replication to finish, then cancels whatever is left.
+func (s *S3Bucket) drain() error {
+	timeout := s.ShutdownTimeout
+	if timeout <= 0 {
+		timeout = defaultShutdownTimeout
+	}
+
+	var uploads error
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		s.inflight.Wait()
+		if s.writeBehind != nil {
+			uploads = s.writeBehind.wait(context.Background(), ds.NewKey("/"))
+		}
+		if s.replica != nil {
+			s.replica.drain()
+		}
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-drained:
+	case <-timer.C:
+		s.logs.get(LogBatch).Warnf("writes still running after %s; cancelling them", timeout)
+	}
+	s.cancel()
+	if s.replica != nil {
+		// Writes not mirrored stay in the journal, if any.
+		s.replica.cancel()
+	}
+	<-drained
+
+	if batches := atomic.LoadInt64(&s.cancelledBatches); batches > 0 || uploads != nil {
+		return &ShutdownError{Batches: int(batches), Uploads: uploads}
+	}
+	return nil
+}
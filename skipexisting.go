@@ -0,0 +1,63 @@
+package s3
+
+import (
+	"context"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+const (
+	// SkipExistingHas checks for the object before uploading it.
+	SkipExistingHas = "has"
+
+	// SkipExistingConditional uploads with If-None-Match: *, which the
+	// gateway rejects when the object exists, saving the extra request.
+	// The body is still sent.
+	SkipExistingConditional = "conditional"
+)
+
+// immutable reports whether k names a content-addressed block, whose
+// value cannot change once written.
+func immutable(k ds.Key) bool {
+	_, err := keyToCid(k)
+	return err == nil
+}
+
+// exists checks for k in the bucket itself, ignoring queued writes.
+func (s *S3Bucket) exists(ctx context.Context, k ds.Key) (bool, error) {
+	if s.packs != nil {
+		if _, ok := s.packs.lookup(k); ok {
+			return true, nil
+		}
+	}
+	if s.ExistenceCheck == ExistenceCheckList {
+		return s.hasByList(ctx, k)
+	}
+	_, err := s.getSize(ctx, k)
+	switch err {
+	case nil:
+		return true, nil
+	case ds.ErrNotFound:
+		return false, nil
+	}
+	return false, err
+}
+
+// putIfAbsent uploads body unless the object exists. It reports whether
+// the upload was skipped.
+func (s *S3Bucket) putIfAbsent(ctx context.Context, k ds.Key, body []byte, opts PutOptions) (bool, error) {
+	if s.SkipExistingCheck == SkipExistingHas {
+		exists, err := s.exists(ctx, k)
+		if err != nil || exists {
+			return exists, err
+		}
+		return false, s.store.PutObject(ctx, s.s3Path(k), body, opts)
+	}
+
+	opts.IfAbsent = true
+	err := s.store.PutObject(ctx, s.s3Path(k), body, opts)
+	if err == ErrObjectExists {
+		return true, nil
+	}
+	return false, err
+}
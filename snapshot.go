@@ -0,0 +1,220 @@
+package s3
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	ds "github.com/ipfs/go-datastore"
+)
+
+// SnapshotResult reports what Snapshot or RestoreSnapshot did.
+type SnapshotResult struct {
+	// Keys is the number of keys in the snapshot.
+	Keys int
+
+	// Copied is the number of objects copied: into the snapshot by
+	// Snapshot on an unversioned bucket, back into place by
+	// RestoreSnapshot.
+	Copied int
+
+	// Deleted is the number of keys RestoreSnapshot deleted because they
+	// were written after the snapshot.
+	Deleted int
+}
+
+func (s *S3Bucket) snapshotPath(label string) string {
+	return s.metaPath(path.Join("snapshots", label))
+}
+
+// snapshotCopy returns the object the snapshot label keeps its copy of k
+// in on unversioned buckets.
+func (s *S3Bucket) snapshotCopy(label string, k ds.Key) string {
+	return path.Join(s.snapshotPath(label), "objects", s.keys.objectName(k))
+}
+
+func checkSnapshotLabel(label string) error {
+	if label == "" || strings.ContainsAny(label, "/\\") || label == "." || label == ".." {
+		return fmt.Errorf("s3ds: invalid snapshot label %q", label)
+	}
+	return nil
+}
+
+// copySource returns the CopySource of an object version.
+func copySource(bucket, name, versionID string) string {
+	src := strings.ReplaceAll(url.PathEscape(bucket+"/"+name), "%2F", "/")
+	if versionID != "" {
+		src += "?versionId=" + url.QueryEscape(versionID)
+	}
+	return src
+}
+
+// Snapshot records the current state of the datastore as label, to be
+// rolled back to with RestoreSnapshot, e.g. before a risky GC or
+// migration. On versioned buckets it only records the current version of
+// every object; otherwise it copies every object below the bookkeeping
+// directory, which costs a request and the storage of a copy per object.
+// It does not support Packing.
+func (s *S3Bucket) Snapshot(ctx context.Context, label string) (SnapshotResult, error) {
+	var res SnapshotResult
+	if err := s.needS3(); err != nil {
+		return res, err
+	}
+	if err := checkSnapshotLabel(label); err != nil {
+		return res, err
+	}
+	if s.readOnly() {
+		return res, ErrReadOnly
+	}
+	if s.packs != nil {
+		return res, fmt.Errorf("s3ds: snapshots do not support packing")
+	}
+	if err := s.auditMaintenance("Snapshot", "snapshot", ""); err != nil {
+		return res, err
+	}
+
+	entries, versioned, err := s.listManifest(ctx)
+	if err != nil {
+		return res, err
+	}
+	res.Keys = len(entries)
+	if !versioned {
+		err = forEach(ctx, len(entries), s.Workers, func(ctx context.Context, i int) error {
+			k := ds.NewKey(entries[i].Key)
+			input := &s3.CopyObjectInput{
+				Bucket:     aws.String(s.Bucket),
+				Key:        aws.String(s.snapshotCopy(label, k)),
+				CopySource: aws.String(copySource(s.Bucket, s.s3Path(k), "")),
+			}
+			s.Grants.applyCopy(input)
+			resp, err := s.S3.CopyObjectWithContext(ctx, input)
+			if err != nil {
+				return fmt.Errorf("s3ds: copying %s: %s", k, parseError(err))
+			}
+			// The object may have changed since it was listed; the copy
+			// is what the snapshot holds.
+			entries[i].ETag = aws.StringValue(resp.CopyObjectResult.ETag)
+			return nil
+		})
+		if err != nil {
+			return res, err
+		}
+		res.Copied = len(entries)
+	}
+
+	err = s.writeManifest(ctx, path.Join(s.snapshotPath(label), "manifest.jsonl"), entries, true)
+	if err == ErrObjectExists {
+		return res, fmt.Errorf("s3ds: snapshot %q exists", label)
+	}
+	return res, err
+}
+
+// RestoreSnapshot rolls the datastore back to the snapshot label: keys
+// changed since are rewritten with their value then, by a server-side
+// copy, and keys written since are deleted. It needs the writer lease if
+// LeaseTTL is set, and other nodes should not write meanwhile.
+func (s *S3Bucket) RestoreSnapshot(ctx context.Context, label string) (SnapshotResult, error) {
+	var res SnapshotResult
+	if err := s.needS3(); err != nil {
+		return res, err
+	}
+	if err := checkSnapshotLabel(label); err != nil {
+		return res, err
+	}
+	if s.readOnly() {
+		return res, ErrReadOnly
+	}
+	if s.packs != nil {
+		return res, fmt.Errorf("s3ds: snapshots do not support packing")
+	}
+	if err := s.requireLease(); err != nil {
+		return res, err
+	}
+	if err := s.auditMaintenance("RestoreSnapshot", "restore", ""); err != nil {
+		return res, err
+	}
+
+	entries, err := s.readManifest(ctx, path.Join(s.snapshotPath(label), "manifest.jsonl"))
+	if err == ds.ErrNotFound {
+		return res, fmt.Errorf("s3ds: no snapshot %q", label)
+	}
+	if err != nil {
+		return res, fmt.Errorf("s3ds: loading snapshot %q: %s", label, err)
+	}
+	res.Keys = len(entries)
+
+	current, _, err := s.listManifest(ctx)
+	if err != nil {
+		return res, err
+	}
+	etags := make(map[string]string, len(current))
+	for _, e := range current {
+		etags[e.Key] = e.ETag
+	}
+
+	// What is left in etags afterwards was written after the snapshot.
+	var changed []manifestEntry
+	for _, e := range entries {
+		etag, exists := etags[e.Key]
+		delete(etags, e.Key)
+		if !exists || etag != e.ETag {
+			changed = append(changed, e)
+		}
+	}
+
+	var mu sync.Mutex
+	restored := make([]ds.Key, 0, len(changed))
+	err = forEach(ctx, len(changed), s.Workers, func(ctx context.Context, i int) error {
+		e := changed[i]
+		k := ds.NewKey(e.Key)
+		src := copySource(s.Bucket, s.s3Path(k), e.VersionID)
+		if e.VersionID == "" {
+			src = copySource(s.Bucket, s.snapshotCopy(label, k), "")
+		}
+		input := &s3.CopyObjectInput{
+			Bucket:     aws.String(s.Bucket),
+			Key:        aws.String(s.s3Path(k)),
+			CopySource: aws.String(src),
+		}
+		s.Grants.applyCopy(input)
+		if _, err := s.S3.CopyObjectWithContext(ctx, input); err != nil {
+			return fmt.Errorf("s3ds: restoring %s: %s", k, parseError(err))
+		}
+		mu.Lock()
+		res.Copied++
+		restored = append(restored, k)
+		mu.Unlock()
+		s.events.emit(EventPut, k, -1)
+		return nil
+	})
+	if err != nil {
+		return res, err
+	}
+	s.forgetMissing(restored...)
+
+	var (
+		keys  []ds.Key
+		names []string
+	)
+	for key := range etags {
+		keys = append(keys, ds.NewKey(key))
+		names = append(names, s.s3Path(ds.NewKey(key)))
+	}
+	if err := s.writeTombstones(ctx, "RestoreSnapshot", keys); err != nil {
+		return res, err
+	}
+	if err := s.store.DeleteMany(ctx, names); err != nil {
+		return res, err
+	}
+	for _, k := range keys {
+		s.events.emit(EventDelete, k, 0)
+	}
+	s.forgetUnverified(keys...)
+	res.Deleted = len(names)
+	return res, nil
+}
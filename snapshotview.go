@@ -0,0 +1,247 @@
+package s3
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+// manifestEntry records one object of a listing manifest.
+type manifestEntry struct {
+	Key       string `json:"key"`
+	VersionID string `json:"versionId,omitempty"`
+	ETag      string `json:"etag"`
+	Size      int64  `json:"size"`
+}
+
+func (s *S3Bucket) manifestPath(name string) string {
+	return s.metaPath(path.Join("manifests", name+".jsonl"))
+}
+
+// CaptureManifest records every key currently in the datastore, with its
+// version when the bucket is versioned, as the manifest name. Opening the
+// datastore with SnapshotManifest set to name later serves exactly these
+// objects. It returns the number of keys recorded.
+func (s *S3Bucket) CaptureManifest(ctx context.Context, name string) (int, error) {
+	if err := s.needS3(); err != nil {
+		return 0, err
+	}
+	if err := s.auditMaintenance("CaptureManifest", "manifest", ""); err != nil {
+		return 0, err
+	}
+	entries, _, err := s.listManifest(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return len(entries), s.writeManifest(ctx, s.manifestPath(name), entries, false)
+}
+
+// listManifest lists every object of the datastore, with its version if
+// the bucket is versioned, which it also reports.
+func (s *S3Bucket) listManifest(ctx context.Context) ([]manifestEntry, bool, error) {
+	versioning, err := s.S3.GetBucketVersioningWithContext(ctx, &s3.GetBucketVersioningInput{
+		Bucket: aws.String(s.Bucket),
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	versioned := aws.StringValue(versioning.Status) == s3.BucketVersioningStatusEnabled
+
+	var entries []manifestEntry
+	add := func(obj string, versionID, etag *string, size *int64) {
+		if s.isMetaPath(obj) {
+			return
+		}
+		entries = append(entries, manifestEntry{
+			Key:       s.fromS3Path(obj).String(),
+			VersionID: aws.StringValue(versionID),
+			ETag:      aws.StringValue(etag),
+			Size:      aws.Int64Value(size),
+		})
+	}
+
+	listPrefix, _ := s.keys.listPrefix("/")
+	prefix := path.Join(s.RootDirectory, listPrefix)
+	if versioned {
+		err = s.S3.ListObjectVersionsPagesWithContext(ctx, &s3.ListObjectVersionsInput{
+			Bucket: aws.String(s.Bucket),
+			Prefix: aws.String(prefix),
+		}, func(page *s3.ListObjectVersionsOutput, last bool) bool {
+			for _, v := range page.Versions {
+				if aws.BoolValue(v.IsLatest) {
+					add(*v.Key, v.VersionId, v.ETag, v.Size)
+				}
+			}
+			return true
+		})
+	} else {
+		err = s.S3.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+			Bucket: aws.String(s.Bucket),
+			Prefix: aws.String(prefix),
+		}, func(page *s3.ListObjectsV2Output, last bool) bool {
+			for _, obj := range page.Contents {
+				add(*obj.Key, nil, obj.ETag, obj.Size)
+			}
+			return true
+		})
+	}
+	return entries, versioned, err
+}
+
+// writeManifest uploads entries as the manifest object name. With
+// ifAbsent it fails with ErrObjectExists instead of replacing one.
+func (s *S3Bucket) writeManifest(ctx context.Context, name string, entries []manifestEntry, ifAbsent bool) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, e := range entries {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	if ifAbsent {
+		return s.store.PutObject(ctx, name, buf.Bytes(), PutOptions{IfAbsent: true})
+	}
+	_, err := s.S3.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(s.Bucket),
+		Key:         aws.String(name),
+		Body:        bytes.NewReader(buf.Bytes()),
+		ContentType: aws.String("application/x-ndjson"),
+	})
+	return err
+}
+
+// readManifest parses the manifest object name.
+func (s *S3Bucket) readManifest(ctx context.Context, name string) ([]manifestEntry, error) {
+	resp, err := s.S3.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(name),
+	})
+	if err != nil {
+		return nil, parseError(err)
+	}
+	defer resp.Body.Close()
+
+	var entries []manifestEntry
+	sc := bufio.NewScanner(resp.Body)
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		var e manifestEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("invalid manifest: %s", err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, sc.Err()
+}
+
+// snapshotView serves reads from a manifest.
+type snapshotView struct {
+	entries map[string]manifestEntry
+	keys    []string
+}
+
+func (s *S3Bucket) loadSnapshotView(name string) (*snapshotView, error) {
+	entries, err := s.readManifest(context.Background(), s.manifestPath(name))
+	if err != nil {
+		return nil, fmt.Errorf("s3ds: loading manifest %q: %s", name, err)
+	}
+	v := &snapshotView{entries: make(map[string]manifestEntry, len(entries))}
+	for _, e := range entries {
+		v.entries[e.Key] = e
+		v.keys = append(v.keys, e.Key)
+	}
+	sort.Strings(v.keys)
+	return v, nil
+}
+
+// snapshotGet fetches k as recorded in the manifest: by version when one
+// was recorded, otherwise only if the object is unchanged.
+func (s *S3Bucket) snapshotGet(ctx context.Context, k ds.Key) ([]byte, error) {
+	e, ok := s.snapshot.entries[k.String()]
+	if !ok {
+		return nil, ds.ErrNotFound
+	}
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(s.s3Path(k)),
+	}
+	if e.VersionID != "" {
+		input.VersionId = aws.String(e.VersionID)
+	} else {
+		input.IfMatch = aws.String(e.ETag)
+	}
+	resp, err := s.S3.GetObjectWithContext(ctx, input)
+	if err != nil {
+		return nil, fmt.Errorf("s3ds: %s no longer matches the snapshot: %s", k, err)
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return s.decodeValue(data, objectMetadata(resp.Metadata))
+}
+
+func (s *S3Bucket) snapshotGetSize(ctx context.Context, k ds.Key) (int, error) {
+	e, ok := s.snapshot.entries[k.String()]
+	if !ok {
+		return -1, ds.ErrNotFound
+	}
+	if s.storesValues() {
+		return int(e.Size), nil
+	}
+	value, err := s.snapshotGet(ctx, k)
+	if err != nil {
+		return -1, err
+	}
+	return len(value), nil
+}
+
+func (s *S3Bucket) snapshotQuery(ctx context.Context, q dsq.Query) (dsq.Results, error) {
+	keys := s.snapshot.keys
+	index := 0
+	skip := q.Offset
+	sent := 0
+	next := func() (dsq.Result, bool) {
+		for index < len(keys) {
+			k := ds.NewKey(keys[index])
+			index++
+			if !inQuery(k, q.Prefix) {
+				continue
+			}
+			if skip > 0 {
+				skip--
+				continue
+			}
+			if q.Limit > 0 && sent >= q.Limit {
+				return dsq.Result{}, false
+			}
+			entry := dsq.Entry{Key: k.String(), Size: -1}
+			if q.KeysOnly && q.ReturnsSizes {
+				size, err := s.snapshotGetSize(ctx, k)
+				if err != nil {
+					return dsq.Result{Error: err}, false
+				}
+				entry.Size = size
+			}
+			sent++
+			return dsq.Result{Entry: entry}, true
+		}
+		return dsq.Result{}, false
+	}
+	if !q.KeysOnly {
+		return dsq.ResultsFromIterator(q, pipelineValues(ctx, next, s.snapshotGet, s.Workers)), nil
+	}
+	return dsq.ResultsFromIterator(q, dsq.Iterator{Next: next}), nil
+}
@@ -0,0 +1,235 @@
+package s3
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	ds "github.com/ipfs/go-datastore"
+)
+
+// purgeInterval is how often the purge job runs with SoftDeleteRetention
+// set.
+const purgeInterval = time.Hour
+
+// PurgeResult reports what Purge deleted.
+type PurgeResult struct {
+	// Versions is the number of object versions and delete markers
+	// deleted for good.
+	Versions int
+
+	// Keys is the number of deleted keys no version is left of.
+	Keys int
+}
+
+// checkVersioning fails unless the bucket is versioned, which SoftDelete
+// depends on.
+func (s *S3Bucket) checkVersioning(ctx context.Context) error {
+	resp, err := s.S3.GetBucketVersioningWithContext(ctx, &s3.GetBucketVersioningInput{
+		Bucket: aws.String(s.Bucket),
+	})
+	if err != nil {
+		return fmt.Errorf("s3ds: checking bucket versioning: %s", parseError(err))
+	}
+	if aws.StringValue(resp.Status) != s3.BucketVersioningStatusEnabled {
+		return fmt.Errorf("s3ds: softDelete needs versioning enabled on bucket %s", s.Bucket)
+	}
+	return nil
+}
+
+// objectVersion is a version or delete marker of an object.
+type objectVersion struct {
+	id       string
+	modified time.Time
+	marker   bool
+	latest   bool
+}
+
+// listVersions calls fn with the versions of every object below prefix,
+// newest first.
+func (s *S3Bucket) listVersions(ctx context.Context, prefix string, fn func(name string, versions []objectVersion)) error {
+	byName := make(map[string][]objectVersion)
+	var names []string
+	add := func(name string, v objectVersion) {
+		if _, ok := byName[name]; !ok {
+			names = append(names, name)
+		}
+		byName[name] = append(byName[name], v)
+	}
+	err := s.S3.ListObjectVersionsPagesWithContext(ctx, &s3.ListObjectVersionsInput{
+		Bucket: aws.String(s.Bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectVersionsOutput, last bool) bool {
+		for _, v := range page.Versions {
+			add(aws.StringValue(v.Key), objectVersion{
+				id:       aws.StringValue(v.VersionId),
+				modified: aws.TimeValue(v.LastModified),
+				latest:   aws.BoolValue(v.IsLatest),
+			})
+		}
+		for _, m := range page.DeleteMarkers {
+			add(aws.StringValue(m.Key), objectVersion{
+				id:       aws.StringValue(m.VersionId),
+				modified: aws.TimeValue(m.LastModified),
+				marker:   true,
+				latest:   aws.BoolValue(m.IsLatest),
+			})
+		}
+		return true
+	})
+	if err != nil {
+		return parseError(err)
+	}
+	for _, name := range names {
+		versions := byName[name]
+		sort.SliceStable(versions, func(i, j int) bool {
+			if versions[i].latest != versions[j].latest {
+				return versions[i].latest
+			}
+			return versions[i].modified.After(versions[j].modified)
+		})
+		fn(name, versions)
+	}
+	return nil
+}
+
+// deleteVersions deletes object versions for good.
+func (s *S3Bucket) deleteVersions(ctx context.Context, objs []*s3.ObjectIdentifier) error {
+	for i := 0; i < len(objs); i += deleteMax {
+		end := i + deleteMax
+		if end > len(objs) {
+			end = len(objs)
+		}
+		resp, err := s.S3.DeleteObjectsWithContext(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(s.Bucket),
+			Delete: &s3.Delete{Objects: objs[i:end]},
+		})
+		if err != nil {
+			return parseError(err)
+		}
+		if len(resp.Errors) > 0 {
+			return fmt.Errorf("s3ds: failed to delete versions: %s", resp.Errors)
+		}
+	}
+	return nil
+}
+
+// Undelete brings back a key deleted with SoftDelete on, with the value
+// it had when it was deleted. It fails with ds.ErrNotFound if no version
+// of k is left, and does nothing if k exists.
+func (s *S3Bucket) Undelete(ctx context.Context, k ds.Key) error {
+	if !s.SoftDelete {
+		return fmt.Errorf("s3ds: undelete requires softDelete")
+	}
+	if s.readOnly() {
+		return ErrReadOnly
+	}
+	if r := s.route(k); r != s {
+		return r.Undelete(ctx, k)
+	}
+	if err := s.auditMaintenance("Undelete", "undelete", k.String()); err != nil {
+		return err
+	}
+
+	name := s.s3Path(k)
+	var markers []*s3.ObjectIdentifier
+	found := false
+	err := s.listVersions(ctx, name, func(obj string, versions []objectVersion) {
+		if obj != name {
+			return
+		}
+		// Delete markers newer than the newest version hide it.
+		for _, v := range versions {
+			if !v.marker {
+				found = true
+				return
+			}
+			markers = append(markers, &s3.ObjectIdentifier{Key: aws.String(name), VersionId: aws.String(v.id)})
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if !found {
+		return ds.ErrNotFound
+	}
+	if err := s.deleteVersions(ctx, markers); err != nil {
+		return err
+	}
+	s.forgetMissing(k)
+	return nil
+}
+
+// Purge deletes for good the versions of objects that were overwritten or
+// deleted more than retention ago, and the delete markers of keys deleted
+// that long ago. Snapshots of versioned buckets taken before that cannot
+// be fully restored afterwards.
+func (s *S3Bucket) Purge(ctx context.Context, retention time.Duration) (PurgeResult, error) {
+	var res PurgeResult
+	if !s.SoftDelete {
+		return res, fmt.Errorf("s3ds: purge requires softDelete")
+	}
+	if s.readOnly() {
+		return res, ErrReadOnly
+	}
+	if err := s.requireLease(); err != nil {
+		return res, err
+	}
+	if err := s.auditMaintenance("Purge", "purge", ""); err != nil {
+		return res, err
+	}
+
+	cutoff := time.Now().Add(-retention)
+	var objs []*s3.ObjectIdentifier
+	listPrefix, _ := s.keys.listPrefix("/")
+	err := s.listVersions(ctx, path.Join(s.RootDirectory, listPrefix), func(name string, versions []objectVersion) {
+		if s.isMetaPath(name) {
+			return
+		}
+		gone := 0
+		for i, v := range versions {
+			// A version stopped being current when the next one was
+			// written; the current one is kept unless it is a marker.
+			expired := i > 0 && versions[i-1].modified.Before(cutoff) ||
+				i == 0 && v.marker && v.modified.Before(cutoff)
+			if expired {
+				objs = append(objs, &s3.ObjectIdentifier{Key: aws.String(name), VersionId: aws.String(v.id)})
+				gone++
+			}
+		}
+		if gone == len(versions) {
+			res.Keys++
+		}
+	})
+	if err != nil {
+		return res, err
+	}
+	if err := s.deleteVersions(ctx, objs); err != nil {
+		return res, err
+	}
+	res.Versions = len(objs)
+	return res, nil
+}
+
+// purgeLoop runs Purge with SoftDeleteRetention until the datastore is
+// closed.
+func (s *S3Bucket) purgeLoop() {
+	defer s.RecoverAndDump()
+
+	t := time.NewTicker(purgeInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-s.done:
+			return
+		}
+		if _, err := s.Purge(context.Background(), s.SoftDeleteRetention); err != nil && err != ErrLeaseHeld {
+			s.logs.get(LogS3).Warnf("purge: %s", err)
+		}
+	}
+}
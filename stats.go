@@ -0,0 +1,252 @@
+package s3
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+const (
+	defaultStatsWindow = time.Minute
+
+	// latencySamples bounds the latencies kept per operation; under heavy
+	// load the window effectively shrinks to the most recent ones.
+	latencySamples = 4096
+
+	// hotPrefixes is how many shards Stats reports in HotPrefixes.
+	hotPrefixes = 10
+)
+
+// Cache names used in statistics.
+const (
+	cacheNegative    = "negative"
+	cacheWriteBehind = "writeBehind"
+	cacheCoalesced   = "coalesced"
+	cacheWriteDedup  = "writeDedup"
+)
+
+// OpStats counts the calls of one operation since startup and reports
+// their latencies over the last StatsWindow.
+type OpStats struct {
+	Count  int64 `json:"count"`
+	Errors int64 `json:"errors"`
+
+	// P50 and P99 are zero when there were no calls in the window.
+	P50 time.Duration `json:"p50"`
+	P99 time.Duration `json:"p99"`
+}
+
+// CacheStats counts the lookups a cache answered and those it passed on.
+type CacheStats struct {
+	Hits     int64   `json:"hits"`
+	Misses   int64   `json:"misses"`
+	HitRatio float64 `json:"hitRatio"`
+}
+
+// HotPrefix is a shard of the key space and its operations since startup.
+type HotPrefix struct {
+	Prefix string `json:"prefix"`
+	PrefixStats
+}
+
+// Stats is a snapshot of the datastore's access statistics.
+type Stats struct {
+	Since  time.Time     `json:"since"`
+	Window time.Duration `json:"window"`
+
+	// Ops is keyed by "get", "put", "has", "getSize" and "delete".
+	Ops map[string]OpStats `json:"ops"`
+
+	// Caches is keyed by "negative" (misses answered by the negative
+	// cache), "writeBehind" (reads of values queued for upload),
+	// "coalesced" (gets sharing a download with another) and "writeDedup"
+	// (puts of blocks dropped as written recently).
+	Caches map[string]CacheStats `json:"caches"`
+
+	// HotPrefixes are the busiest shards of the heatmap, if HeatmapFile or
+	// StatsAddr is set.
+	HotPrefixes []HotPrefix `json:"hotPrefixes,omitempty"`
+
+	// Segments counts the Storj segments of uploads, with provider
+	// "storj".
+	Segments *SegmentStats `json:"segments,omitempty"`
+
+	// Quota is the usage counted against MaxBytes and MaxObjects, if
+	// either is set.
+	Quota *QuotaStats `json:"quota,omitempty"`
+}
+
+// latency is one sample of an operation's latency.
+type latency struct {
+	at   time.Time
+	took time.Duration
+}
+
+type opCounter struct {
+	count  int64
+	errors int64
+
+	mu      sync.Mutex
+	samples [latencySamples]latency
+	next    int
+}
+
+type cacheCounter struct {
+	hits   int64
+	misses int64
+}
+
+// accessStats counts operations and cache lookups for Stats.
+type accessStats struct {
+	since  time.Time
+	window time.Duration
+	ops    map[string]*opCounter
+	caches map[string]*cacheCounter
+}
+
+func newAccessStats(window time.Duration) *accessStats {
+	if window <= 0 {
+		window = defaultStatsWindow
+	}
+	st := &accessStats{
+		since:  time.Now(),
+		window: window,
+		ops:    make(map[string]*opCounter),
+		caches: make(map[string]*cacheCounter),
+	}
+	for _, op := range []string{opGet, opPut, opHas, opGetSize, opDelete} {
+		st.ops[op] = &opCounter{}
+	}
+	for _, c := range []string{cacheNegative, cacheWriteBehind, cacheCoalesced, cacheWriteDedup} {
+		st.caches[c] = &cacheCounter{}
+	}
+	return st
+}
+
+// done records a call of op started at start; it is deferred with a
+// pointer to the call's error. Missing keys are not errors.
+func (st *accessStats) done(op string, start time.Time, err *error) {
+	c := st.ops[op]
+	now := time.Now()
+	atomic.AddInt64(&c.count, 1)
+	if *err != nil && *err != ds.ErrNotFound {
+		atomic.AddInt64(&c.errors, 1)
+	}
+	c.mu.Lock()
+	c.samples[c.next] = latency{at: now, took: now.Sub(start)}
+	c.next = (c.next + 1) % latencySamples
+	c.mu.Unlock()
+}
+
+func (st *accessStats) lookup(cache string, hit bool) {
+	c := st.caches[cache]
+	if hit {
+		atomic.AddInt64(&c.hits, 1)
+	} else {
+		atomic.AddInt64(&c.misses, 1)
+	}
+}
+
+// percentiles returns the median and 99th percentile of the latencies
+// since cutoff.
+func (c *opCounter) percentiles(cutoff time.Time) (p50, p99 time.Duration) {
+	c.mu.Lock()
+	var took []time.Duration
+	for _, l := range c.samples {
+		if l.at.After(cutoff) {
+			took = append(took, l.took)
+		}
+	}
+	c.mu.Unlock()
+	if len(took) == 0 {
+		return 0, 0
+	}
+	sort.Slice(took, func(i, j int) bool { return took[i] < took[j] })
+	return took[len(took)*50/100], took[len(took)*99/100]
+}
+
+// Stats returns operation counts, cache hit ratios, latency percentiles
+// over the last StatsWindow and the busiest key shards.
+func (s *S3Bucket) Stats() Stats {
+	st := s.stats
+	out := Stats{
+		Since:  st.since,
+		Window: st.window,
+		Ops:    make(map[string]OpStats, len(st.ops)),
+		Caches: make(map[string]CacheStats, len(st.caches)),
+	}
+	cutoff := time.Now().Add(-st.window)
+	for op, c := range st.ops {
+		o := OpStats{
+			Count:  atomic.LoadInt64(&c.count),
+			Errors: atomic.LoadInt64(&c.errors),
+		}
+		o.P50, o.P99 = c.percentiles(cutoff)
+		out.Ops[op] = o
+	}
+	for name, c := range st.caches {
+		cs := CacheStats{
+			Hits:   atomic.LoadInt64(&c.hits),
+			Misses: atomic.LoadInt64(&c.misses),
+		}
+		if total := cs.Hits + cs.Misses; total > 0 {
+			cs.HitRatio = float64(cs.Hits) / float64(total)
+		}
+		out.Caches[name] = cs
+	}
+	if s.segments != nil {
+		segments := s.segments.snapshot()
+		out.Segments = &segments
+	}
+	if s.quota != nil {
+		quota := s.quota.snapshot()
+		out.Quota = &quota
+	}
+	if s.heat != nil {
+		for prefix, ps := range s.heat.snapshot() {
+			out.HotPrefixes = append(out.HotPrefixes, HotPrefix{Prefix: prefix, PrefixStats: ps})
+		}
+		total := func(p HotPrefix) int64 { return p.Gets + p.Puts + p.Has + p.Deletes }
+		sort.Slice(out.HotPrefixes, func(i, j int) bool {
+			a, b := out.HotPrefixes[i], out.HotPrefixes[j]
+			if total(a) != total(b) {
+				return total(a) > total(b)
+			}
+			return a.Prefix < b.Prefix
+		})
+		if len(out.HotPrefixes) > hotPrefixes {
+			out.HotPrefixes = out.HotPrefixes[:hotPrefixes]
+		}
+	}
+	return out
+}
+
+// serveStats serves Stats as JSON on addr at /debug/s3ds/stats until the
+// datastore is closed.
+func (s *S3Bucket) serveStats(addr string) (*http.Server, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/s3ds/stats", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(s.Stats())
+	})
+	srv := &http.Server{Handler: mux}
+	go func() {
+		defer s.RecoverAndDump()
+		if err := srv.Serve(l); err != http.ErrServerClosed {
+			s.logs.get(LogS3).Warnf("stats endpoint: %s", err)
+		}
+	}()
+	return srv, nil
+}
@@ -0,0 +1,32 @@
+package s3_test
+
+import (
+	"testing"
+	"time"
+
+	s3ds "github.com/ipfs-s3c-storj-plugin"
+	"github.com/ipfs-s3c-storj-plugin/s3test"
+)
+
+// TestSuite runs the go-datastore suite and the datastore's own subtests
+// against the fake, with the settings that change how keys and values
+// are stored.
+func TestSuite(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		conf s3ds.Config
+	}{
+		{"default", s3ds.Config{}},
+		{"rootDirectory", s3ds.Config{RootDirectory: "ipfs"}},
+		{"flatfs", s3ds.Config{RootDirectory: "ipfs", KeyTransform: s3ds.KeyTransformFlatfs}},
+		{"packing", s3ds.Config{Packing: true}},
+		{"pipelinedBatches", s3ds.Config{PipelinedBatches: true}},
+		{"compression", s3ds.Config{Compression: s3ds.CompressionGzip}},
+		{"caches", s3ds.Config{NegativeCacheTTL: time.Minute, WriteDedupWindow: time.Minute}},
+		{"writeBehind", s3ds.Config{WriteBehind: true}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			s3test.SubtestFake(t, c.conf)
+		})
+	}
+}
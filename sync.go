@@ -0,0 +1,133 @@
+package s3
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+const (
+	defaultSyncVerifyTimeout = 30 * time.Second
+
+	// maxUnverifiedWrites bounds the writes SyncVerify remembers between
+	// Syncs; later ones are not checked.
+	maxUnverifiedWrites = 100000
+)
+
+// unverifiedWrites remembers the keys written since their prefix was last
+// synced, for the read-after-write check of SyncVerify. Deleted keys are
+// dropped.
+type unverifiedWrites struct {
+	mu      sync.Mutex
+	keys    map[string]struct{}
+	dropped int
+}
+
+func (u *unverifiedWrites) add(k ds.Key) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if _, ok := u.keys[k.String()]; !ok && len(u.keys) >= maxUnverifiedWrites {
+		u.dropped++
+		return
+	}
+	u.keys[k.String()] = struct{}{}
+}
+
+func (u *unverifiedWrites) forget(keys ...ds.Key) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for _, k := range keys {
+		delete(u.keys, k.String())
+	}
+}
+
+// forgetUnverified drops deleted keys from the writes SyncVerify checks.
+func (s *S3Bucket) forgetUnverified(keys ...ds.Key) {
+	if s.unverified != nil {
+		s.unverified.forget(keys...)
+	}
+}
+
+// take returns the writes under prefix to check, and the number of writes
+// not remembered since the last take.
+func (u *unverifiedWrites) take(prefix ds.Key) ([]ds.Key, int) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	dropped := u.dropped
+	u.dropped = 0
+	var keys []ds.Key
+	for key := range u.keys {
+		k := ds.NewKey(key)
+		if hasKeyPrefix(k, prefix.String()) {
+			keys = append(keys, k)
+			delete(u.keys, key)
+		}
+	}
+	return keys, dropped
+}
+
+// Sync blocks until every write under prefix is durable. With WriteBehind
+// it waits for queued uploads; with SyncVerify it additionally polls each
+// key written since the last Sync until the gateway serves it, so that
+// eventually consistent backends are readable once Sync returns.
+func (s *S3Bucket) Sync(ctx context.Context, prefix ds.Key) error {
+	if s.writeBehind != nil {
+		if err := s.writeBehind.wait(ctx, prefix); err != nil {
+			return err
+		}
+	}
+	if s.unverified == nil {
+		return nil
+	}
+
+	timeout := s.SyncVerifyTimeout
+	if timeout <= 0 {
+		timeout = defaultSyncVerifyTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	keys, dropped := s.unverified.take(prefix)
+	if dropped > 0 {
+		s.logs.get(LogS3).Warnf("sync: %d writes since the last Sync not verified; sync more often", dropped)
+	}
+	var (
+		mu      sync.Mutex
+		missing []string
+	)
+	err := forEach(ctx, len(keys), s.Workers, func(ctx context.Context, i int) error {
+		if !s.awaitVisible(ctx, keys[i]) {
+			mu.Lock()
+			missing = append(missing, keys[i].String())
+			mu.Unlock()
+		}
+		return nil
+	})
+	if len(missing) > 0 {
+		return fmt.Errorf("s3ds: writes not visible after %s:\n%s", timeout, strings.Join(missing, "\n"))
+	}
+	return err
+}
+
+// awaitVisible polls k with exponential backoff until it exists or ctx is
+// done.
+func (s *S3Bucket) awaitVisible(ctx context.Context, k ds.Key) bool {
+	delay := 50 * time.Millisecond
+	for {
+		if _, err := s.getSize(ctx, k); err == nil {
+			return true
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return false
+		}
+		if delay < 2*time.Second {
+			delay *= 2
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package s3
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/url"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// Tags written with Tagging. S3 allows 10 tags per object, which leaves
+// maxTagLabels for TagLabels.
+const (
+	tagCodec     = "s3ds-codec"
+	tagSizeClass = "s3ds-size-class"
+	tagNamespace = "s3ds-namespace"
+
+	maxTagLabels = 7
+)
+
+var codecNames = map[uint64]string{
+	0x55:   "raw",
+	0x70:   "dag-pb",
+	0x71:   "dag-cbor",
+	0x78:   "git-raw",
+	0x0129: "dag-json",
+}
+
+// blockCodec returns the codec of the block stored under k. Blocks keyed
+// by multihash do not record one.
+func blockCodec(k ds.Key) (string, bool) {
+	b, err := blockKeyEncoding.DecodeString(k.BaseNamespace())
+	switch {
+	case err != nil:
+		return "", false
+	case isCidV0(b):
+		return "dag-pb", true
+	case isCidV1(b):
+		_, n := binary.Uvarint(b)
+		codec, _ := binary.Uvarint(b[n:])
+		if name, ok := codecNames[codec]; ok {
+			return name, true
+		}
+		return fmt.Sprintf("0x%x", codec), true
+	}
+	return "", false
+}
+
+// sizeClass buckets value sizes coarsely enough for lifecycle rules.
+func sizeClass(size int) string {
+	switch {
+	case size < 1<<10:
+		return "tiny"
+	case size < 16<<10:
+		return "small"
+	case size < 256<<10:
+		return "medium"
+	}
+	return "large"
+}
+
+// storageClass returns the storage class to write k with: the one of its
+// namespace in StorageClasses, or else StorageClass.
+func (s *S3Bucket) storageClass(k ds.Key) string {
+	if ns := k.List(); len(ns) > 1 {
+		if class, ok := s.StorageClasses[ns[0]]; ok {
+			return class
+		}
+	}
+	return s.StorageClass
+}
+
+// objectTags returns the Tagging header for a Put of size bytes under k,
+// or "" without Tagging.
+func (s *S3Bucket) objectTags(k ds.Key, size int) string {
+	if !s.Tagging {
+		return ""
+	}
+	tags := url.Values{}
+	for name, value := range s.TagLabels {
+		tags.Set(name, value)
+	}
+	if ns := k.List(); len(ns) > 1 {
+		tags.Set(tagNamespace, ns[0])
+	}
+	if codec, ok := blockCodec(k); ok {
+		tags.Set(tagCodec, codec)
+	}
+	tags.Set(tagSizeClass, sizeClass(size))
+	return tags.Encode()
+}
@@ -0,0 +1,106 @@
+package s3
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// TenantConfig is a logical repository kept in the datastore's bucket
+// under a root directory of its own, reached with its own credentials.
+// Empty credentials default to the datastore's.
+type TenantConfig struct {
+	// RootDirectory is where the tenant's keys are stored. It must not
+	// contain or lie inside the datastore's or another tenant's root
+	// directory, so that no tenant lists the keys of another.
+	RootDirectory string
+
+	// AccessKey and SecretKey should be scoped to RootDirectory, so that
+	// a tenant cannot reach the others' keys even through a bug.
+	AccessKey string
+	SecretKey string
+
+	// ReadOnly refuses writes to the tenant, as ReadOnly does for the
+	// datastore.
+	ReadOnly bool
+
+	// MaxBytes and MaxObjects are the tenant's quota, as they are for the
+	// datastore. Tenants do not share the datastore's quota.
+	MaxBytes   int64
+	MaxObjects int64
+}
+
+func newTenants(conf Config) (map[string]*S3Bucket, error) {
+	names := make([]string, 0, len(conf.Tenants))
+	for name := range conf.Tenants {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	roots := map[string]string{"": conf.RootDirectory}
+	for _, name := range names {
+		if name == "" {
+			return nil, fmt.Errorf("s3ds: tenant without a name")
+		}
+		root := conf.Tenants[name].RootDirectory
+		for other, otherRoot := range roots {
+			if rootsOverlap(root, otherRoot) {
+				if other == "" {
+					return nil, fmt.Errorf("s3ds: tenant %s: root directory %q overlaps that of the datastore", name, root)
+				}
+				return nil, fmt.Errorf("s3ds: tenant %s: root directory %q overlaps that of tenant %s", name, root, other)
+			}
+		}
+		roots[name] = root
+	}
+
+	tenants := make(map[string]*S3Bucket, len(names))
+	for _, name := range names {
+		tc := conf.Tenants[name]
+		c := secondaryConfig(conf, "", "", "", tc.AccessKey, tc.SecretKey)
+		c.RootDirectory = tc.RootDirectory
+		c.ReadOnly = conf.ReadOnly || tc.ReadOnly
+		c.MaxBytes, c.MaxObjects = tc.MaxBytes, tc.MaxObjects
+		d, err := NewS3Datastore(c)
+		if err != nil {
+			for _, t := range tenants {
+				t.Close()
+			}
+			return nil, fmt.Errorf("s3ds: tenant %s: %s", name, err)
+		}
+		tenants[name] = d
+	}
+	return tenants, nil
+}
+
+// rootsOverlap reports whether one of two root directories contains the
+// other. The bucket root contains every other.
+func rootsOverlap(a, b string) bool {
+	a, b = cleanRoot(a), cleanRoot(b)
+	return a == "" || b == "" || a == b || strings.HasPrefix(a, b+"/") || strings.HasPrefix(b, a+"/")
+}
+
+func cleanRoot(root string) string {
+	return strings.Trim(path.Clean("/"+root), "/")
+}
+
+// Tenant returns the datastore of the tenant called name. It is closed
+// with the datastore.
+func (s *S3Bucket) Tenant(name string) (*S3Bucket, error) {
+	t, ok := s.tenants[name]
+	if !ok {
+		return nil, fmt.Errorf("s3ds: unknown tenant %q", name)
+	}
+	return t, nil
+}
+
+func (s *S3Bucket) closeTenants() error {
+	var err error
+	for _, t := range s.tenants {
+		if cerr := t.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
@@ -0,0 +1,95 @@
+package s3
+
+import (
+	"sync"
+	"time"
+)
+
+// Bounds and starting point of the small value threshold.
+const (
+	defaultSmallValueThreshold = 16 << 10
+	minSmallValueThreshold     = 1 << 10
+	maxSmallValueThreshold     = 4 << 20
+
+	// thresholdDecay weighs down older uploads so the fit follows the
+	// provider as its latency changes.
+	thresholdDecay = 0.999
+
+	// thresholdMinSamples is the effective number of uploads needed
+	// before the fitted threshold replaces the configured one.
+	thresholdMinSamples = 100
+)
+
+// thresholdTuner fits upload time as overhead + size*perByte over recent
+// uploads. The size at which the payload takes as long to send as the
+// per-request overhead is the break-even point: below it, most of the
+// cost of storing a value on its own is the request itself, so packing
+// it with others pays.
+type thresholdTuner struct {
+	initial int
+
+	mu                  sync.Mutex
+	n, sx, sy, sxx, sxy float64
+}
+
+func newThresholdTuner(initial int) *thresholdTuner {
+	if initial <= 0 {
+		initial = defaultSmallValueThreshold
+	}
+	return &thresholdTuner{initial: initial}
+}
+
+// observe records an upload of size bytes that took d.
+func (t *thresholdTuner) observe(size int, d time.Duration) {
+	x, y := float64(size), d.Seconds()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.n = t.n*thresholdDecay + 1
+	t.sx = t.sx*thresholdDecay + x
+	t.sy = t.sy*thresholdDecay + y
+	t.sxx = t.sxx*thresholdDecay + x*x
+	t.sxy = t.sxy*thresholdDecay + x*y
+}
+
+// threshold returns the current cutoff in bytes.
+func (t *thresholdTuner) threshold() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.n < thresholdMinSamples {
+		return t.initial
+	}
+	denom := t.n*t.sxx - t.sx*t.sx
+	if denom <= 0 {
+		// All uploads had the same size; there is nothing to fit.
+		return t.initial
+	}
+	perByte := (t.n*t.sxy - t.sx*t.sy) / denom
+	overhead := (t.sy - perByte*t.sx) / t.n
+	if perByte <= 0 || overhead <= 0 {
+		return t.initial
+	}
+
+	cutoff := int(overhead / perByte)
+	switch {
+	case cutoff < minSmallValueThreshold:
+		return minSmallValueThreshold
+	case cutoff > maxSmallValueThreshold:
+		return maxSmallValueThreshold
+	}
+	return cutoff
+}
+
+// SmallValueThreshold returns the size below which values count as small
+// and are candidates for packing. With SmallValueAutoTune it follows the
+// observed upload costs, otherwise it is SmallValueThreshold.
+func (s *S3Bucket) SmallValueThreshold() int {
+	if s.tuner == nil {
+		if s.Config.SmallValueThreshold > 0 {
+			return s.Config.SmallValueThreshold
+		}
+		return defaultSmallValueThreshold
+	}
+	return s.tuner.threshold()
+}
@@ -0,0 +1,541 @@
+package s3
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	ds "github.com/ipfs/go-datastore"
+)
+
+const (
+	defaultTieringInterval = time.Hour
+	defaultRestoreDays     = 1
+	defaultTieringBlocks   = 1 << 20
+
+	// restorePoll is how often a Get waiting for a restore checks on it.
+	restorePoll = 5 * time.Second
+
+	// tierGenerations is how many filters split ColdAfter. Reads are
+	// remembered in one more, so that a block is demoted after going
+	// unread for ColdAfter and up to an eighth of it more.
+	tierGenerations = 8
+
+	// tierBitsPerBlock and tierHashes size the filters so that about one
+	// block in two hundred unread for ColdAfter looks read and stays.
+	tierBitsPerBlock = 16
+	tierHashes       = 8
+)
+
+// TieringConfig moves blocks nobody reads to cheaper storage and brings
+// them back when they are read again. Only blocks are tiered: their values
+// never change, so moving one cannot lose a concurrent write.
+type TieringConfig struct {
+	// ColdAfter is how long a block has to go unread before it is
+	// demoted. Reads are only tracked from when tiering is first
+	// enabled, so no block is demoted before ColdAfter has passed since.
+	ColdAfter time.Duration
+
+	// StorageClass rewrites demoted blocks in place in this class, e.g.
+	// "GLACIER_IR", and reads move them back to the default class. Gets
+	// of blocks in classes that need a restore, such as "GLACIER", start
+	// one and wait up to RestoreWait for it.
+	StorageClass string
+
+	// Bucket, instead of StorageClass, moves demoted blocks to this
+	// bucket, reached with the same endpoint and credentials. They no
+	// longer show up in queries until they are read again.
+	Bucket string
+
+	// StateFile is where the blocks read recently, and which blocks are
+	// demoted, are kept across restarts.
+	StateFile string
+
+	// Blocks is about how many blocks the datastore holds, and sizes the
+	// filters that track reads at 2 bytes per block each. Past it, more
+	// and more unread blocks look read and are not demoted. Defaults to
+	// about a million.
+	Blocks int
+
+	// Interval is the time between demotion passes, which also save
+	// StateFile. Defaults to an hour.
+	Interval time.Duration
+
+	// RestoreWait is how long a Get waits for the restore of an archived
+	// block before failing with ErrArchived. Restores from GLACIER take
+	// minutes to hours; the restore goes on and a later Get succeeds.
+	RestoreWait time.Duration
+
+	// RestoreDays is how long a restored copy is kept. Defaults to a day,
+	// which is plenty to move the block back.
+	RestoreDays int
+}
+
+// readFilters remembers which blocks were read lately in a fixed amount of
+// memory: one Bloom filter per period of ColdAfter/tierGenerations, the
+// oldest dropped as a new one starts.
+type readFilters struct {
+	period time.Duration
+
+	// Since is when tracking started, Start when Gens[0] did.
+	Since time.Time `json:"since"`
+	Start time.Time `json:"start"`
+	Gens  [][]byte  `json:"gens"`
+}
+
+func newReadFilters(coldAfter time.Duration, blocks int, now time.Time) *readFilters {
+	f := &readFilters{
+		period: coldAfter / tierGenerations,
+		Since:  now,
+		Start:  now,
+		Gens:   make([][]byte, tierGenerations+1),
+	}
+	if f.period <= 0 {
+		f.period = 1
+	}
+	for i := range f.Gens {
+		f.Gens[i] = make([]byte, blocks*tierBitsPerBlock/8)
+	}
+	return f
+}
+
+// fits reports whether loaded filters have the shape of g.
+func (f *readFilters) fits(g *readFilters) bool {
+	if len(f.Gens) != len(g.Gens) {
+		return false
+	}
+	for i := range f.Gens {
+		if len(f.Gens[i]) != len(g.Gens[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// rotate starts the filters of the periods since Start.
+func (f *readFilters) rotate(now time.Time) {
+	n := int(now.Sub(f.Start) / f.period)
+	if n <= 0 {
+		return
+	}
+	if n > len(f.Gens) {
+		n = len(f.Gens)
+	}
+	old := append([][]byte(nil), f.Gens[len(f.Gens)-n:]...)
+	copy(f.Gens[n:], f.Gens[:len(f.Gens)-n])
+	for i := range old {
+		for j := range old[i] {
+			old[i][j] = 0
+		}
+	}
+	copy(f.Gens, old)
+	f.Start = f.Start.Add(now.Sub(f.Start).Truncate(f.period))
+}
+
+// bits calls fn with the bits of name, stopping when it returns false.
+func (f *readFilters) bits(name string, fn func(i uint64) bool) {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	a := h.Sum64()
+	h = fnv.New64()
+	h.Write([]byte(name))
+	b := h.Sum64() | 1
+	m := uint64(len(f.Gens[0])) * 8
+	for i := uint64(0); i < tierHashes; i++ {
+		if !fn((a + i*b) % m) {
+			return
+		}
+	}
+}
+
+func (f *readFilters) add(name string, now time.Time) {
+	f.rotate(now)
+	gen := f.Gens[0]
+	f.bits(name, func(i uint64) bool {
+		gen[i/8] |= 1 << (i % 8)
+		return true
+	})
+}
+
+// read reports whether name was read in the last ColdAfter or so, or
+// tracking started too recently to tell.
+func (f *readFilters) read(name string, now time.Time) bool {
+	if now.Sub(f.Since) < f.period*tierGenerations {
+		return true
+	}
+	f.rotate(now)
+	for _, gen := range f.Gens {
+		found := true
+		f.bits(name, func(i uint64) bool {
+			found = gen[i/8]&(1<<(i%8)) != 0
+			return found
+		})
+		if found {
+			return true
+		}
+	}
+	return false
+}
+
+// tierState is what tiering saves in StateFile.
+type tierState struct {
+	Reads   *readFilters `json:"reads"`
+	Demoted []string     `json:"demoted"`
+}
+
+// tiering tracks reads of blocks and demotes and promotes them.
+type tiering struct {
+	s    *S3Bucket
+	conf TieringConfig
+
+	// cold is where demoted blocks live with Bucket set.
+	cold ObjectStore
+
+	mu      sync.Mutex
+	reads   *readFilters
+	demoted map[string]bool
+
+	// moving holds the blocks being moved, true once they are deleted
+	// meanwhile.
+	moving map[string]bool
+}
+
+func newTiering(s *S3Bucket, conf TieringConfig) (*tiering, error) {
+	if conf.Interval <= 0 {
+		conf.Interval = defaultTieringInterval
+	}
+	if conf.RestoreDays <= 0 {
+		conf.RestoreDays = defaultRestoreDays
+	}
+	if conf.Blocks <= 0 {
+		conf.Blocks = defaultTieringBlocks
+	}
+	t := &tiering{
+		s:       s,
+		conf:    conf,
+		reads:   newReadFilters(conf.ColdAfter, conf.Blocks, time.Now()),
+		demoted: make(map[string]bool),
+		moving:  make(map[string]bool),
+	}
+	if conf.Bucket != "" {
+		coldConf := s.Config
+		coldConf.Bucket = conf.Bucket
+		coldConf.PartSize = 0
+		t.cold = newS3Store(s.S3, &coldConf)
+	}
+
+	data, err := ioutil.ReadFile(conf.StateFile)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("s3ds: loading tiering state: %s", err)
+	}
+	if err == nil {
+		var st tierState
+		if err := json.Unmarshal(data, &st); err != nil {
+			return nil, fmt.Errorf("s3ds: invalid tiering state %s: %s", conf.StateFile, err)
+		}
+		// Filters of another size, after Blocks changed, start over.
+		if st.Reads != nil && st.Reads.fits(t.reads) {
+			st.Reads.period = t.reads.period
+			t.reads = st.Reads
+		}
+		for _, k := range st.Demoted {
+			t.demoted[k] = true
+		}
+	}
+	return t, nil
+}
+
+func (t *tiering) save() error {
+	t.mu.Lock()
+	st := tierState{Reads: t.reads, Demoted: make([]string, 0, len(t.demoted))}
+	for k := range t.demoted {
+		st.Demoted = append(st.Demoted, k)
+	}
+	data, err := json.Marshal(st)
+	t.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(t.conf.StateFile, data)
+}
+
+// touch records a read or write of k and reports whether it is demoted.
+func (t *tiering) touch(k ds.Key) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.reads.add(k.String(), time.Now())
+	return t.demoted[k.String()]
+}
+
+// elsewhere reports whether k was moved to the cold bucket.
+func (t *tiering) elsewhere(k ds.Key) bool {
+	if t.cold == nil {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.demoted[k.String()]
+}
+
+// get is called with the result of every read of a block from the bucket.
+// It finds blocks demoted to the cold bucket, restores archived ones, and
+// moves demoted blocks back.
+func (t *tiering) get(ctx context.Context, k ds.Key, data []byte, info ObjectInfo, err error) ([]byte, ObjectInfo, error) {
+	if !immutable(k) {
+		return data, info, err
+	}
+	switch {
+	case err == ds.ErrNotFound && t.elsewhere(k):
+		data, info, err = t.cold.GetObject(ctx, t.s.s3Path(k))
+	case ErrorClass(err) == ErrArchived:
+		if err = t.restore(ctx, k); err == nil {
+			data, info, err = t.s.store.GetObject(ctx, t.s.s3Path(k))
+		}
+	}
+	if err == nil && t.touch(k) {
+		t.promote(ObjectInfo{Name: t.s.s3Path(k), Size: info.Size})
+	}
+	return data, info, err
+}
+
+// head is Head of k in the cold bucket, if it was moved there.
+func (t *tiering) head(ctx context.Context, k ds.Key) (ObjectInfo, error) {
+	if !t.elsewhere(k) {
+		return ObjectInfo{}, ds.ErrNotFound
+	}
+	return t.cold.Head(ctx, t.s.s3Path(k))
+}
+
+// restore starts a restore of the archived block k and waits up to
+// RestoreWait for it to complete.
+func (t *tiering) restore(ctx context.Context, k ds.Key) error {
+	name := t.s.s3Path(k)
+	_, err := t.s.S3.RestoreObjectWithContext(ctx, &s3.RestoreObjectInput{
+		Bucket: aws.String(t.s.Bucket),
+		Key:    aws.String(name),
+		RestoreRequest: &s3.RestoreRequest{
+			Days: aws.Int64(int64(t.conf.RestoreDays)),
+		},
+	})
+	if err != nil && !isRestoreInProgress(err) {
+		return fmt.Errorf("s3ds: restoring %s: %s", k, parseError(err))
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, t.conf.RestoreWait)
+	defer cancel()
+	for {
+		resp, err := t.s.S3.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+			Bucket: aws.String(t.s.Bucket),
+			Key:    aws.String(name),
+		})
+		if err == nil && strings.Contains(aws.StringValue(resp.Restore), `ongoing-request="false"`) {
+			return nil
+		}
+		select {
+		case <-time.After(restorePoll):
+		case <-ctx.Done():
+			return &Error{Class: ErrArchived, Err: fmt.Errorf("restore of %s in progress", k)}
+		}
+	}
+}
+
+func isRestoreInProgress(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == "RestoreAlreadyInProgress"
+}
+
+// promote moves the demoted block obj back in the background.
+func (t *tiering) promote(obj ObjectInfo) {
+	go func() {
+		defer t.s.RecoverAndDump()
+		if _, err := t.move(t.s.ctx, []ObjectInfo{obj}, false); err != nil {
+			t.s.logs.get(LogS3).Warnf("tiering: %s", err)
+		}
+	}()
+}
+
+// move copies objs to cold storage, or back with cold false, then deletes
+// them where they were. Blocks already being moved are skipped, and those
+// deleted while being copied are not moved, their copies deleted instead.
+// The state is saved once, before any block leaves the bucket.
+func (t *tiering) move(ctx context.Context, objs []ObjectInfo, cold bool) (int, error) {
+	t.mu.Lock()
+	var todo []ObjectInfo
+	for _, obj := range objs {
+		k := t.s.fromS3Path(obj.Name).String()
+		if _, ok := t.moving[k]; !ok {
+			t.moving[k] = false
+			todo = append(todo, obj)
+		}
+	}
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		for _, obj := range todo {
+			delete(t.moving, t.s.fromS3Path(obj.Name).String())
+		}
+		t.mu.Unlock()
+	}()
+
+	copied := make([]bool, len(todo))
+	err := forEach(ctx, len(todo), t.s.Workers, func(ctx context.Context, i int) error {
+		if err := t.copy(ctx, todo[i], cold); err != nil {
+			return fmt.Errorf("moving %s: %s", t.s.fromS3Path(todo[i].Name), err)
+		}
+		copied[i] = true
+		return nil
+	})
+
+	var moved, orphans []ObjectInfo
+	t.mu.Lock()
+	for i, obj := range todo {
+		k := t.s.fromS3Path(obj.Name).String()
+		switch {
+		case !copied[i]:
+		case t.moving[k]:
+			orphans = append(orphans, obj)
+		case cold:
+			t.demoted[k] = true
+			moved = append(moved, obj)
+		default:
+			delete(t.demoted, k)
+			moved = append(moved, obj)
+		}
+	}
+	t.mu.Unlock()
+	if t.cold == nil {
+		// Blocks rewritten in place have no other copy.
+		return len(moved), err
+	}
+
+	// from is where the blocks leave, to where they arrived.
+	from, to := t.cold, t.s.store
+	if cold {
+		from, to = to, from
+	}
+	if len(orphans) > 0 {
+		if derr := deleteObjects(ctx, to, orphans); err == nil {
+			err = derr
+		}
+	}
+	if len(moved) == 0 {
+		return 0, err
+	}
+	if cold {
+		// Saved before the blocks leave the bucket, so that a crash
+		// cannot lose track of them.
+		if serr := t.save(); serr != nil {
+			return 0, serr
+		}
+	}
+	if derr := deleteObjects(ctx, from, moved); err == nil {
+		err = derr
+	}
+	return len(moved), err
+}
+
+// copy copies obj to cold storage, or back with cold false.
+func (t *tiering) copy(ctx context.Context, obj ObjectInfo, cold bool) error {
+	store, opts := t.s.store, PutOptions{}
+	switch {
+	case t.cold != nil && cold:
+		store, opts.SourceBucket = t.cold, t.s.Bucket
+	case t.cold != nil:
+		opts.SourceBucket = t.conf.Bucket
+	case cold:
+		opts.StorageClass = t.conf.StorageClass
+	default:
+		opts.StorageClass = t.s.storageClass(t.s.fromS3Path(obj.Name))
+		if opts.StorageClass == "" {
+			opts.StorageClass = s3.StorageClassStandard
+		}
+	}
+	return copyObject(ctx, store, obj.Name, obj.Name, obj.Size, opts)
+}
+
+// deleted drops k from cold storage after it was deleted.
+func (t *tiering) deleted(ctx context.Context, k ds.Key) error {
+	t.mu.Lock()
+	if _, ok := t.moving[k.String()]; ok {
+		t.moving[k.String()] = true
+	}
+	elsewhere := t.cold != nil && t.demoted[k.String()]
+	delete(t.demoted, k.String())
+	t.mu.Unlock()
+	if elsewhere {
+		return t.cold.DeleteMany(ctx, []string{t.s.s3Path(k)})
+	}
+	return nil
+}
+
+// demote moves every block unread for ColdAfter to cold storage.
+func (t *tiering) demote(ctx context.Context) (int, error) {
+	now := time.Now()
+	listPrefix, _ := t.s.keys.listPrefix("/")
+	prefix := path.Join(t.s.RootDirectory, listPrefix)
+
+	var candidates []ObjectInfo
+	token := ""
+	for {
+		objs, next, err := t.s.store.List(ctx, prefix, token, 0)
+		if err != nil {
+			return 0, err
+		}
+		t.mu.Lock()
+		for _, obj := range objs {
+			if t.s.isMetaPath(obj.Name) {
+				continue
+			}
+			k := t.s.fromS3Path(obj.Name)
+			if immutable(k) && !t.demoted[k.String()] && !t.reads.read(k.String(), now) {
+				candidates = append(candidates, obj)
+			}
+		}
+		t.mu.Unlock()
+		if next == "" {
+			break
+		}
+		token = next
+	}
+
+	// move saved the state if it moved blocks to the cold bucket.
+	moved, err := t.move(ctx, candidates, true)
+	if t.cold == nil || moved == 0 {
+		if serr := t.save(); err == nil {
+			err = serr
+		}
+	}
+	return moved, err
+}
+
+// tieringLoop runs demotion passes until the datastore is closed.
+func (s *S3Bucket) tieringLoop() {
+	defer s.RecoverAndDump()
+
+	t := time.NewTicker(s.tiering.conf.Interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-s.done:
+			return
+		}
+		if err := s.requireLease(); err != nil {
+			s.tiering.save()
+			continue
+		}
+		if _, err := s.tiering.demote(s.ctx); err != nil {
+			s.logs.get(LogS3).Warnf("tiering: %s", err)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package s3
+
+import (
+	"context"
+	"time"
+)
+
+// OpTimeouts bound each call to the bucket by the kind of operation, retries
+// included. Zero leaves calls of that kind unbounded, apart from the
+// transport's own timeouts.
+type OpTimeouts struct {
+	// Get bounds downloads of values.
+	Get time.Duration
+
+	// Has bounds the HEAD requests of Has and GetSize, which callers
+	// usually want to fail fast.
+	Has time.Duration
+
+	// Put bounds uploads, all parts of a multipart upload together.
+	Put time.Duration
+
+	// List bounds each page of a listing.
+	List time.Duration
+
+	// Delete bounds each deletion, of one object or, in batches, of up
+	// to 1000.
+	Delete time.Duration
+}
+
+func (t OpTimeouts) enabled() bool {
+	return t.Get > 0 || t.Has > 0 || t.Put > 0 || t.List > 0 || t.Delete > 0
+}
+
+// timeoutStore runs every call to an ObjectStore under a context with the
+// timeout of its kind, so a slow call fails with ErrTimeout without
+// holding up its caller past it.
+type timeoutStore struct {
+	ObjectStore
+	timeouts OpTimeouts
+}
+
+func withTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if d <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, d)
+}
+
+func (t *timeoutStore) PutObject(ctx context.Context, name string, body []byte, opts PutOptions) error {
+	ctx, cancel := withTimeout(ctx, t.timeouts.Put)
+	defer cancel()
+	return t.ObjectStore.PutObject(ctx, name, body, opts)
+}
+
+func (t *timeoutStore) GetObject(ctx context.Context, name string) ([]byte, ObjectInfo, error) {
+	ctx, cancel := withTimeout(ctx, t.timeouts.Get)
+	defer cancel()
+	return t.ObjectStore.GetObject(ctx, name)
+}
+
+func (t *timeoutStore) Head(ctx context.Context, name string) (ObjectInfo, error) {
+	ctx, cancel := withTimeout(ctx, t.timeouts.Has)
+	defer cancel()
+	return t.ObjectStore.Head(ctx, name)
+}
+
+func (t *timeoutStore) List(ctx context.Context, prefix, token string, max int) ([]ObjectInfo, string, error) {
+	ctx, cancel := withTimeout(ctx, t.timeouts.List)
+	defer cancel()
+	return t.ObjectStore.List(ctx, prefix, token, max)
+}
+
+func (t *timeoutStore) DeleteMany(ctx context.Context, names []string) error {
+	ctx, cancel := withTimeout(ctx, t.timeouts.Delete)
+	defer cancel()
+	return t.ObjectStore.DeleteMany(ctx, names)
+}
@@ -0,0 +1,107 @@
+package s3
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// tombstoneDirectory holds the tombstones under the metadata directory.
+const tombstoneDirectory = "tombstones"
+
+// Tombstone records the deletion of a key, written before its object is
+// deleted when Config.Tombstones is set.
+type Tombstone struct {
+	Key     string    `json:"key"`
+	Deleted time.Time `json:"deleted"`
+
+	// Reason is the call that deleted the key: "Delete", "Batch",
+	// "DeletePrefix" or "RestoreSnapshot".
+	Reason string `json:"reason"`
+
+	// Host is the host name of the node that deleted the key.
+	Host string `json:"host,omitempty"`
+
+	// Multihash is the multihash of a block, hex encoded, so the block
+	// deleted can be told even under a key that does not name it.
+	Multihash string `json:"multihash,omitempty"`
+}
+
+// tombstonePath returns the name of the tombstone of k deleted at t. The
+// tombstones of a key sort by time under a directory named after it.
+func (s *S3Bucket) tombstonePath(k ds.Key, t time.Time) string {
+	return s.metaPath(path.Join(tombstoneDirectory, strings.TrimPrefix(k.String(), "/"),
+		fmt.Sprintf("%016x.json", t.UnixNano())))
+}
+
+// writeTombstones records the deletion of keys for reason, with up to
+// Workers uploads in flight. Nothing is recorded unless Tombstones is set.
+// Callers delete the keys only once it succeeded, so that no key is gone
+// without a record.
+func (s *S3Bucket) writeTombstones(ctx context.Context, reason string, keys []ds.Key) error {
+	if !s.Tombstones || len(keys) == 0 {
+		return nil
+	}
+	host, _ := os.Hostname()
+	now := time.Now().UTC()
+	return forEach(ctx, len(keys), s.Workers, func(ctx context.Context, i int) error {
+		k := keys[i]
+		t := Tombstone{Key: k.String(), Deleted: now, Reason: reason, Host: host}
+		if mh := blockMultihash(k); mh != nil {
+			t.Multihash = hex.EncodeToString(mh)
+		}
+		body, err := json.Marshal(t)
+		if err != nil {
+			return err
+		}
+		if err := s.store.PutObject(ctx, s.tombstonePath(k, now), body, PutOptions{}); err != nil {
+			return fmt.Errorf("s3ds: writing tombstone of %s: %s", k, err)
+		}
+		return nil
+	})
+}
+
+// ListTombstones returns the tombstones of the keys under prefix, by key
+// and then oldest first. They are kept until deleted from the bucket,
+// e.g. by a lifecycle rule on the tombstones directory.
+func (s *S3Bucket) ListTombstones(ctx context.Context, prefix string) ([]Tombstone, error) {
+	dir := s.metaPath(tombstoneDirectory) + "/"
+	if p := strings.Trim(ds.NewKey(prefix).String(), "/"); p != "" {
+		dir += p + "/"
+	}
+	var (
+		tombstones []Tombstone
+		token      string
+	)
+	for {
+		objs, next, err := s.store.List(ctx, dir, token, listMax)
+		if err != nil {
+			return tombstones, err
+		}
+		for _, obj := range objs {
+			data, _, err := s.store.GetObject(ctx, obj.Name)
+			if err == ds.ErrNotFound {
+				continue
+			}
+			if err != nil {
+				return tombstones, err
+			}
+			var t Tombstone
+			if err := json.Unmarshal(data, &t); err != nil {
+				return tombstones, fmt.Errorf("s3ds: reading tombstone %s: %s", obj.Name, err)
+			}
+			tombstones = append(tombstones, t)
+		}
+		if next == "" {
+			return tombstones, nil
+		}
+		token = next
+	}
+}
@@ -0,0 +1,185 @@
+package s3
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Transport defaults, tuned for gateways that are far away and slow to
+// answer rather than for the SDK's AWS-in-the-same-region defaults.
+const (
+	defaultDialTimeout           = 30 * time.Second
+	defaultResponseHeaderTimeout = 2 * time.Minute
+	defaultIdleConnTimeout       = 90 * time.Second
+
+	// Through a SOCKS proxy such as Tor, building a circuit and every
+	// round trip over it take seconds.
+	defaultSOCKSDialTimeout           = 2 * time.Minute
+	defaultSOCKSResponseHeaderTimeout = 5 * time.Minute
+)
+
+// TransportConfig tunes the HTTP client talking to the endpoint. Zero
+// values select the defaults.
+type TransportConfig struct {
+	DialTimeout           time.Duration
+	ResponseHeaderTimeout time.Duration
+	IdleConnTimeout       time.Duration
+
+	// MaxIdleConns is the size of the idle connection pool. It defaults to
+	// Workers so that a full worker pool reuses its connections.
+	MaxIdleConns int
+
+	// TLSMinVersion is "1.0", "1.1", "1.2" (the default) or "1.3".
+	TLSMinVersion string
+
+	// TLSCAFile is a PEM file of CA certificates trusted in addition to
+	// the system's, for gateways with certificates from a private CA.
+	TLSCAFile string
+
+	// TLSCertFile and TLSKeyFile are the PEM files of a client
+	// certificate and its key, for gateways requiring mutual TLS.
+	TLSCertFile string
+	TLSKeyFile  string
+
+	// TLSInsecureSkipVerify accepts any certificate the gateway presents.
+	// It is meant for lab deployments with self-signed certificates and
+	// makes the connection open to interception.
+	TLSInsecureSkipVerify bool
+
+	// Proxy is the URL of an HTTP, HTTPS or SOCKS5 proxy, e.g.
+	// socks5://127.0.0.1:9050 for Tor, which then also resolves the
+	// endpoint's host name. Defaults to the HTTP_PROXY, HTTPS_PROXY and
+	// NO_PROXY environment variables. Through a SOCKS5 proxy the default
+	// DialTimeout and ResponseHeaderTimeout are longer, and ResolveInterval
+	// does not apply.
+	Proxy string
+
+	// ResolveInterval re-resolves the endpoint's host name this often and
+	// reconnects when an address it resolved to before is gone, for
+	// gateways that rotate their frontends. Defaults to a minute for
+	// provider "storj" and to never otherwise; negative disables it.
+	ResolveInterval time.Duration
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func newHTTPTransport(conf TransportConfig, workers int) (*http.Transport, error) {
+	proxy := http.ProxyFromEnvironment
+	if conf.Proxy != "" {
+		u, err := parseProxy(conf.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		proxy = http.ProxyURL(u)
+	}
+
+	dialTimeout, responseHeaderTimeout := defaultDialTimeout, defaultResponseHeaderTimeout
+	if conf.socks() {
+		dialTimeout, responseHeaderTimeout = defaultSOCKSDialTimeout, defaultSOCKSResponseHeaderTimeout
+	}
+	if conf.DialTimeout <= 0 {
+		conf.DialTimeout = dialTimeout
+	}
+	if conf.ResponseHeaderTimeout <= 0 {
+		conf.ResponseHeaderTimeout = responseHeaderTimeout
+	}
+	if conf.IdleConnTimeout <= 0 {
+		conf.IdleConnTimeout = defaultIdleConnTimeout
+	}
+	if conf.MaxIdleConns <= 0 {
+		conf.MaxIdleConns = workers
+	}
+	if conf.TLSMinVersion == "" {
+		conf.TLSMinVersion = "1.2"
+	}
+
+	minVersion, ok := tlsVersions[conf.TLSMinVersion]
+	if !ok {
+		return nil, fmt.Errorf("s3ds: unknown TLS version %q", conf.TLSMinVersion)
+	}
+
+	tlsConfig, err := newTLSConfig(conf, minVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	return &http.Transport{
+		Proxy: proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   conf.DialTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   conf.DialTimeout,
+		ResponseHeaderTimeout: conf.ResponseHeaderTimeout,
+		IdleConnTimeout:       conf.IdleConnTimeout,
+		MaxIdleConns:          conf.MaxIdleConns,
+		MaxIdleConnsPerHost:   conf.MaxIdleConns,
+		ExpectContinueTimeout: time.Second,
+	}, nil
+}
+
+// parseProxy parses the URL of a proxy of a scheme http.Transport
+// supports.
+func parseProxy(proxy string) (*url.URL, error) {
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return nil, fmt.Errorf("s3ds: invalid proxy: %s", err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("s3ds: unsupported proxy scheme %q", u.Scheme)
+	}
+	return u, nil
+}
+
+// socks reports whether the proxy is a SOCKS5 proxy.
+func (conf TransportConfig) socks() bool {
+	return strings.HasPrefix(conf.Proxy, "socks5://") || strings.HasPrefix(conf.Proxy, "socks5h://")
+}
+
+// newTLSConfig loads the certificates conf names.
+func newTLSConfig(conf TransportConfig, minVersion uint16) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion:         minVersion,
+		InsecureSkipVerify: conf.TLSInsecureSkipVerify,
+	}
+	if conf.TLSCAFile != "" {
+		pem, err := ioutil.ReadFile(conf.TLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("s3ds: TLS CA file: %s", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("s3ds: TLS CA file %s holds no PEM certificates", conf.TLSCAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if (conf.TLSCertFile == "") != (conf.TLSKeyFile == "") {
+		return nil, fmt.Errorf("s3ds: a TLS client certificate needs both a certificate and a key file")
+	}
+	if conf.TLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(conf.TLSCertFile, conf.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("s3ds: TLS client certificate: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
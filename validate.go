@@ -0,0 +1,322 @@
+package s3
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// configRule rejects a combination of settings that would otherwise be
+// accepted and silently misbehave.
+type configRule struct {
+	unsafe func(c *Config) bool
+	reason string
+}
+
+// archiveClasses are storage classes whose objects have to be restored
+// before a GET succeeds.
+var archiveClasses = map[string]bool{
+	"GLACIER":      true,
+	"DEEP_ARCHIVE": true,
+	"Archive":      true,
+}
+
+// configRules is the support matrix: every entry is a combination the
+// datastore refuses to run with. Subsystems whose settings interact add
+// their rules here.
+var configRules = []configRule{
+	{
+		unsafe: func(c *Config) bool { return c.WriteBehindQueue != 0 && !c.WriteBehind },
+		reason: "writeBehindQueue is set but writeBehind is off",
+	},
+	{
+		unsafe: func(c *Config) bool {
+			return c.Notifications != nil && c.NegativeCacheTTL == 0 && c.WriteDedupWindow == 0
+		},
+		reason: "notifications is set but neither negativeCacheTTL nor writeDedupWindow is",
+	},
+	{
+		unsafe: func(c *Config) bool { return c.SyncVerifyTimeout != 0 && !c.SyncVerify },
+		reason: "syncVerifyTimeout is set but syncVerify is off",
+	},
+	{
+		unsafe: func(c *Config) bool { return c.CompressionLevel != 0 && c.Compression == "" },
+		reason: "compressionLevel is set but compression is off",
+	},
+	{
+		unsafe: func(c *Config) bool {
+			return (c.HeatmapInterval != 0 || c.HeatmapShard != "" && c.StatsAddr == "") && c.HeatmapFile == ""
+		},
+		reason: "heatmapInterval or heatmapShard is set but heatmapFile is not",
+	},
+	{
+		unsafe: func(c *Config) bool { return c.MinConcurrency != 0 && !c.AdaptiveConcurrency },
+		reason: "minConcurrency is set but adaptiveConcurrency is off",
+	},
+	{
+		unsafe: func(c *Config) bool { return c.CrashDumpInterval != 0 && c.CrashDumpFile == "" },
+		reason: "crashDumpInterval is set but crashDumpFile is not",
+	},
+	{
+		unsafe: func(c *Config) bool { return c.EndpointPolicy != "" && len(c.Endpoints) == 0 },
+		reason: "endpointPolicy is set but endpoints is empty",
+	},
+	{
+		unsafe: func(c *Config) bool { return c.Replica != nil && c.Replica.Bucket == "" },
+		reason: "replica.bucket is required",
+	},
+	{
+		unsafe: func(c *Config) bool { return c.Replica != nil && c.Replica.Journal != "" && !c.Replica.Async },
+		reason: "replica.journal is set but replica.async is off",
+	},
+	{
+		unsafe: func(c *Config) bool { return c.ReadOnly && (c.WriteBehind || c.Replica != nil) },
+		reason: "readOnly cannot be combined with writeBehind or replica",
+	},
+	{
+		unsafe: func(c *Config) bool { return c.NegativeCacheSize != 0 && c.NegativeCacheTTL == 0 },
+		reason: "negativeCacheSize is set but negativeCacheTTL is not",
+	},
+	{
+		unsafe: func(c *Config) bool { return c.WriteDedupSize != 0 && c.WriteDedupWindow == 0 },
+		reason: "writeDedupSize is set but writeDedupWindow is not",
+	},
+	{
+		unsafe: func(c *Config) bool {
+			return c.PipelinedBatches && (c.Packing || c.DryRun || c.AuditLog != "" || c.AuditToBucket)
+		},
+		reason: "pipelinedBatches uploads before Commit and cannot be combined with packing, dryRun or an audit log, which act at Commit",
+	},
+	{
+		unsafe: func(c *Config) bool { return c.LeaseTTL != 0 && c.LeaseTTL < time.Second },
+		reason: "leaseTTL is shorter than a second, too short to renew",
+	},
+	{
+		unsafe: func(c *Config) bool { return c.PackSize != 0 && !c.Packing },
+		reason: "packSize is set but packing is off",
+	},
+	{
+		unsafe: func(c *Config) bool { return (c.CompactInterval != 0 || c.CompactUtilization != 0) && !c.Packing },
+		reason: "compactInterval or compactUtilization is set but packing is off",
+	},
+	{
+		unsafe: func(c *Config) bool { return c.CompactUtilization < 0 || c.CompactUtilization > 1 },
+		reason: "compactUtilization not within 0-1",
+	},
+	{
+		unsafe: func(c *Config) bool { return len(c.TagLabels) != 0 && !c.Tagging },
+		reason: "tagLabels is set but tagging is off",
+	},
+	{
+		unsafe: func(c *Config) bool { return len(c.TagLabels) > maxTagLabels },
+		reason: fmt.Sprintf("tagLabels has more than %d labels", maxTagLabels),
+	},
+	{
+		unsafe: func(c *Config) bool { _, ok := c.Routes["/"]; return ok },
+		reason: "routes cannot route the root namespace",
+	},
+	{
+		unsafe: func(c *Config) bool { return len(c.Routes) > 0 && c.SnapshotManifest != "" },
+		reason: "snapshotManifest cannot be combined with routes",
+	},
+	{
+		unsafe: func(c *Config) bool { return (len(c.CodecNames) > 0 || len(c.Codecs) > 0) && c.Packing },
+		reason: "codecs cannot be combined with packing, which would store values unencoded",
+	},
+	{
+		unsafe: func(c *Config) bool { return c.Replica != nil && c.Replica.RepairInterval != 0 && c.Packing },
+		reason: "replica.repairInterval cannot be combined with packing",
+	},
+	{
+		unsafe: func(c *Config) bool { return c.AuditInterval != 0 && !c.AuditToBucket },
+		reason: "auditInterval is set but auditToBucket is off",
+	},
+	{
+		// A dry run must not leave anything behind in the bucket.
+		unsafe: func(c *Config) bool { return c.DryRun && (c.AuditToBucket || c.CompactInterval != 0) },
+		reason: "dryRun cannot be combined with auditToBucket or compactInterval",
+	},
+	{
+		unsafe: func(c *Config) bool {
+			return (c.BucketVersioning || c.BucketEncryption != "") && !c.CreateBucketIfMissing
+		},
+		reason: "bucketVersioning or bucketEncryption is set but createBucketIfMissing is off",
+	},
+	{
+		unsafe: func(c *Config) bool {
+			return c.BucketEncryption != "" && c.BucketEncryption != BucketEncryptionAES256 && c.BucketEncryption != BucketEncryptionKMS
+		},
+		reason: fmt.Sprintf("bucketEncryption must be %q or %q", BucketEncryptionAES256, BucketEncryptionKMS),
+	},
+	{
+		unsafe: func(c *Config) bool {
+			return c.CreateBucketIfMissing && (c.ReadOnly || c.DryRun || c.SnapshotManifest != "")
+		},
+		reason: "createBucketIfMissing cannot be combined with readOnly, dryRun or snapshotManifest",
+	},
+	{
+		// Runs after applyProvider, which fills in the endpoint of hosted
+		// services.
+		unsafe: func(c *Config) bool {
+			return (c.Provider == "" || c.Provider == "minio") && c.Endpoint == "" && len(c.Endpoints) == 0 && c.Client == nil
+		},
+		reason: "endpoint is required",
+	},
+	{
+		unsafe: func(c *Config) bool {
+			return c.Provider != providerGCS && c.Provider != providerAzure && c.Client == nil &&
+				(c.AccessKey == "" || c.SecretKey == "")
+		},
+		reason: "accessKey and secretKey are required",
+	},
+	{
+		unsafe: func(c *Config) bool { return c.GCSCredentials != "" && c.Provider != providerGCS },
+		reason: "gcsCredentials is set but provider is not gcs",
+	},
+	{
+		unsafe: func(c *Config) bool {
+			return (c.AzureAccount != "" || c.AzureKey != "" || c.AzureClientID != "") && c.Provider != providerAzure
+		},
+		reason: "azureAccount, azureKey or azureClientID is set but provider is not azure",
+	},
+	{
+		unsafe: func(c *Config) bool { return c.Provider == providerAzure && c.AzureAccount == "" },
+		reason: "provider azure requires azureAccount",
+	},
+	{
+		unsafe: func(c *Config) bool { return c.AzureKey != "" && c.AzureClientID != "" },
+		reason: "azureClientID selects a managed identity and cannot be combined with azureKey",
+	},
+	{
+		// These are built on S3 requests that ObjectStore has no
+		// equivalent for.
+		unsafe: func(c *Config) bool {
+			return (c.Provider == providerGCS || c.Provider == providerAzure) && (c.Packing || c.SnapshotManifest != "" ||
+				!c.Grants.empty() || c.AuditToBucket || c.CrashDumpToBucket || c.AutoDetectRegion || c.CreateBucketIfMissing ||
+				c.Lifecycle != nil)
+		},
+		reason: "provider gcs or azure cannot be combined with packing, snapshotManifest, grants, auditToBucket, crashDumpToBucket, autoDetectRegion, createBucketIfMissing or lifecycle",
+	},
+	{
+		unsafe: func(c *Config) bool {
+			return (c.Provider == providerGCS || c.Provider == providerAzure) && (c.UploadRate != 0 || c.DownloadRate != 0)
+		},
+		reason: "uploadRate and downloadRate limit the S3 HTTP client and cannot be combined with provider gcs or azure",
+	},
+	{
+		unsafe: func(c *Config) bool {
+			return (c.Provider == providerGCS || c.Provider == providerAzure) && c.Chaos != nil
+		},
+		reason: "chaos injects faults into the S3 HTTP client and cannot be combined with provider gcs or azure",
+	},
+	{
+		unsafe: func(c *Config) bool {
+			return (c.Provider == providerGCS || c.Provider == providerAzure) && c.Addressing == AddressingVirtualHosted
+		},
+		reason: "addressing applies to S3 requests and cannot be combined with provider gcs or azure",
+	},
+	{
+		unsafe: func(c *Config) bool {
+			t := c.Transport
+			return (c.Provider == providerGCS || c.Provider == providerAzure) &&
+				(t.TLSCAFile != "" || t.TLSCertFile != "" || t.TLSKeyFile != "" || t.TLSInsecureSkipVerify)
+		},
+		reason: "TLS options configure the S3 HTTP client and cannot be combined with provider gcs or azure",
+	},
+	{
+		unsafe: func(c *Config) bool {
+			return (c.Provider == providerGCS || c.Provider == providerAzure) && c.Transport.Proxy != ""
+		},
+		reason: "proxy configures the S3 HTTP client and cannot be combined with provider gcs or azure, whose traffic would bypass it",
+	},
+	{
+		unsafe: func(c *Config) bool { return c.UploadRate < 0 || c.DownloadRate < 0 },
+		reason: "uploadRate or downloadRate is negative",
+	},
+	{
+		unsafe: func(c *Config) bool {
+			return c.SoftDelete && (c.Provider == providerGCS || c.Provider == providerAzure || c.Packing)
+		},
+		reason: "softDelete needs S3 object versions and cannot be combined with provider gcs or azure, or packing",
+	},
+	{
+		// In a versioned bucket an expiration only adds a delete marker:
+		// the expired values are kept as old versions and Undelete would
+		// bring back what the rules meant to drop.
+		unsafe: func(c *Config) bool {
+			return c.SoftDelete && c.Lifecycle != nil && len(c.Lifecycle.ExpirePrefixes) > 0
+		},
+		reason: "softDelete cannot be combined with lifecycle expirePrefixes",
+	},
+	{
+		// Notifications and the change log mean other nodes write to the
+		// bucket; without the lease each compacts and deletes the packs
+		// of the others.
+		unsafe: func(c *Config) bool {
+			return c.Packing && c.LeaseTTL == 0 && (c.Notifications != nil || c.ChangeLogInterval != 0)
+		},
+		reason: "packing in a bucket shared through notifications or changeLogInterval requires leaseTTL",
+	},
+	{
+		unsafe: func(c *Config) bool { return c.SoftDeleteRetention != 0 && !c.SoftDelete },
+		reason: "softDeleteRetention is set but softDelete is not",
+	},
+	{
+		unsafe: func(c *Config) bool {
+			if archiveClasses[c.StorageClass] {
+				return true
+			}
+			for _, class := range c.StorageClasses {
+				if archiveClasses[class] {
+					return true
+				}
+			}
+			return false
+		},
+		reason: "storageClass is an archive class whose objects cannot be read without a restore",
+	},
+	{
+		unsafe: func(c *Config) bool {
+			return c.Tiering != nil && (c.Tiering.ColdAfter <= 0 || c.Tiering.StateFile == "" ||
+				(c.Tiering.StorageClass == "") == (c.Tiering.Bucket == ""))
+		},
+		reason: "tiering needs coldAfter, stateFile, and either storageClass or bucket",
+	},
+	{
+		unsafe: func(c *Config) bool {
+			return c.Tiering != nil && (c.Provider == providerGCS || c.Provider == providerAzure || c.Packing)
+		},
+		reason: "tiering moves objects with S3 requests and cannot be combined with provider gcs or azure, or packing",
+	},
+	{
+		unsafe: func(c *Config) bool { return c.Provider == providerGCS && c.Tagging },
+		reason: "provider gcs does not support tagging",
+	},
+	{
+		// A snapshot view never writes, so queued writes would be lost.
+		unsafe: func(c *Config) bool { return c.SnapshotManifest != "" && c.WriteBehind },
+		reason: "snapshotManifest is read-only and cannot be combined with writeBehind",
+	},
+	{
+		// Without a root directory the flatfs layout has no prefix to
+		// list, so every unrelated object in the bucket would show up in
+		// queries and be eligible for garbage collection.
+		unsafe: func(c *Config) bool { return c.KeyTransform == KeyTransformFlatfs && c.RootDirectory == "" },
+		reason: "keyTransform flatfs requires a rootDirectory",
+	},
+}
+
+// validateConfig checks conf against the support matrix and reports every
+// violated rule at once.
+func validateConfig(conf *Config) error {
+	var reasons []string
+	for _, rule := range configRules {
+		if rule.unsafe(conf) {
+			reasons = append(reasons, rule.reason)
+		}
+	}
+	if len(reasons) > 0 {
+		return fmt.Errorf("s3ds: unsupported configuration:\n%s", strings.Join(reasons, "\n"))
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package s3_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	s3ds "github.com/ipfs-s3c-storj-plugin"
+	"github.com/ipfs-s3c-storj-plugin/s3test"
+)
+
+// TestUnsafeCombinations checks that the combinations known to lose data
+// are refused, and that their safe counterparts are not.
+func TestUnsafeCombinations(t *testing.T) {
+	expiry := &s3ds.LifecycleConfig{ExpirePrefixes: []string{"/tmp"}, ExpireDays: 1}
+	for _, test := range []struct {
+		name   string
+		conf   s3ds.Config
+		reason string
+	}{
+		{"packing shared without lease", s3ds.Config{Packing: true, ChangeLogInterval: time.Minute}, "requires leaseTTL"},
+		{"packing shared with lease", s3ds.Config{Packing: true, ChangeLogInterval: time.Minute, LeaseTTL: time.Minute}, ""},
+		{"softDelete with expiry", s3ds.Config{SoftDelete: true, Lifecycle: expiry}, "lifecycle expirePrefixes"},
+		{"softDelete without expiry", s3ds.Config{SoftDelete: true, SoftDeleteRetention: time.Hour}, ""},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := openFakeDatastore(t, s3test.New(), test.conf)
+			switch {
+			// The fake is not versioned, so softDelete fails past
+			// validation.
+			case test.reason == "" && err != nil && strings.Contains(err.Error(), "unsupported configuration"):
+				t.Fatalf("configuration refused: %s", err)
+			case test.reason != "" && err == nil:
+				t.Fatal("configuration accepted")
+			case test.reason != "" && !strings.Contains(err.Error(), test.reason):
+				t.Fatalf("got %q, want %q", err, test.reason)
+			}
+		})
+	}
+}
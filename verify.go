@@ -0,0 +1,113 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sync"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+const mhIdentity = 0x00
+
+// VerifyResult reports what Verify found.
+type VerifyResult struct {
+	// Checked is the number of blocks whose value was hashed.
+	Checked int
+
+	// Unverifiable is the number of keys that are not blocks, or whose
+	// hash function is not supported.
+	Unverifiable int
+
+	// Corrupt lists the blocks whose value does not match their key.
+	Corrupt []string
+}
+
+// Verify reads every block under prefix and checks that its value hashes
+// to the multihash in its key. Only sha2-256 and identity hashes, which
+// is what go-ipfs writes by default, are checked.
+func (s *S3Bucket) Verify(ctx context.Context, prefix string) (VerifyResult, error) {
+	var res VerifyResult
+	q, err := s.Query(ctx, dsq.Query{Prefix: prefix, KeysOnly: true})
+	if err != nil {
+		return res, err
+	}
+	entries, err := q.Rest()
+	if err != nil {
+		return res, err
+	}
+
+	var mu sync.Mutex
+	err = forEach(ctx, len(entries), s.Workers, func(ctx context.Context, i int) error {
+		k := ds.NewKey(entries[i].Key)
+		c, err := keyToCid(k)
+		var mh []byte
+		if err == nil {
+			mh = cidMultihash(c)
+		}
+		if mh == nil || !verifiable(mh) {
+			mu.Lock()
+			res.Unverifiable++
+			mu.Unlock()
+			return nil
+		}
+
+		value, err := s.route(k).get(ctx, k)
+		if err == ds.ErrNotFound {
+			// Deleted since it was listed.
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("s3ds: reading %s: %s", k, err)
+		}
+		ok := digestMatches(mh, value)
+		mu.Lock()
+		res.Checked++
+		if !ok {
+			res.Corrupt = append(res.Corrupt, k.String())
+		}
+		mu.Unlock()
+		return nil
+	})
+	return res, err
+}
+
+// cidMultihash returns the multihash of a binary CID.
+func cidMultihash(c []byte) []byte {
+	if isCidV0(c) {
+		return c
+	}
+	_, n := binary.Uvarint(c)
+	if n <= 0 {
+		return nil
+	}
+	_, m := binary.Uvarint(c[n:])
+	if m <= 0 {
+		return nil
+	}
+	return c[n+m:]
+}
+
+func verifiable(mh []byte) bool {
+	code, _ := binary.Uvarint(mh)
+	return code == mhSha2256 || code == mhIdentity
+}
+
+// digestMatches reports whether value hashes to mh, which must be
+// verifiable.
+func digestMatches(mh []byte, value []byte) bool {
+	code, n := binary.Uvarint(mh)
+	_, m := binary.Uvarint(mh[n:])
+	digest := mh[n+m:]
+	switch code {
+	case mhSha2256:
+		sum := sha256.Sum256(value)
+		return bytes.Equal(digest, sum[:])
+	default:
+		return bytes.Equal(digest, value)
+	}
+}
@@ -0,0 +1,217 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"sync"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+const defaultWriteBehindQueue = 1000
+
+// ErrClosed is returned by Puts that WriteBehind could not queue because
+// the datastore was closed.
+var ErrClosed = errors.New("s3ds: datastore is closed")
+
+// writeBehind uploads Puts in the background. Values stay readable from
+// memory until their upload finished, so readers of the datastore see
+// their own writes. Each key is uploaded by the same worker, so the puts
+// of a key land in order.
+type writeBehind struct {
+	s      *S3Bucket
+	queues []chan *pendingPut
+
+	// sending is held by puts while they queue, and by close while it
+	// closes the queues.
+	sending sync.RWMutex
+	closed  bool
+
+	mu      sync.Mutex
+	pending map[string]*pendingPut
+	failed  map[string]error
+	wg      sync.WaitGroup
+}
+
+type pendingPut struct {
+	key   ds.Key
+	value []byte
+	done  chan struct{}
+}
+
+func newWriteBehind(s *S3Bucket, size int) *writeBehind {
+	if size <= 0 {
+		size = defaultWriteBehindQueue
+	}
+	wb := &writeBehind{
+		s:       s,
+		queues:  make([]chan *pendingPut, s.Workers),
+		pending: make(map[string]*pendingPut),
+		failed:  make(map[string]error),
+	}
+	wb.wg.Add(s.Workers)
+	for w := range wb.queues {
+		wb.queues[w] = make(chan *pendingPut, max(1, size/s.Workers))
+		go wb.upload(wb.queues[w])
+	}
+	return wb
+}
+
+// put queues an upload, blocking while the queue of its worker is full,
+// until ctx is done or the datastore closed.
+func (wb *writeBehind) put(ctx context.Context, k ds.Key, value []byte) error {
+	wb.sending.RLock()
+	defer wb.sending.RUnlock()
+	if wb.closed {
+		return ErrClosed
+	}
+	p := &pendingPut{key: k, value: value, done: make(chan struct{})}
+	h := fnv.New32a()
+	h.Write([]byte(k.String()))
+	queue := wb.queues[h.Sum32()%uint32(len(wb.queues))]
+
+	wb.mu.Lock()
+	prev := wb.pending[k.String()]
+	wb.pending[k.String()] = p
+	delete(wb.failed, k.String())
+	wb.mu.Unlock()
+
+	var err error
+	select {
+	case queue <- p:
+		return nil
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-wb.s.done:
+		err = ErrClosed
+	}
+	// Not queued: a put of k still uploading is pending again.
+	wb.mu.Lock()
+	if wb.pending[k.String()] == p {
+		delete(wb.pending, k.String())
+		if prev != nil && !isDone(prev.done) {
+			wb.pending[k.String()] = prev
+		}
+	}
+	wb.mu.Unlock()
+	close(p.done)
+	return err
+}
+
+// get returns a value that is still being uploaded.
+func (wb *writeBehind) get(k ds.Key) ([]byte, bool) {
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+	p, ok := wb.pending[k.String()]
+	wb.s.stats.lookup(cacheWriteBehind, ok)
+	if !ok {
+		return nil, false
+	}
+	return p.value, true
+}
+
+func (wb *writeBehind) upload(queue <-chan *pendingPut) {
+	defer wb.wg.Done()
+	defer wb.s.RecoverAndDump()
+	for p := range queue {
+		err := wb.s.put(wb.s.ctx, p.key, p.value)
+		if err != nil {
+			wb.s.logs.get(LogWriteBehind).Warnf("upload of %s failed: %s", p.key, err)
+		}
+
+		wb.mu.Lock()
+		// A later Put of the same key replaces the entry; leave it alone.
+		if wb.pending[p.key.String()] == p {
+			delete(wb.pending, p.key.String())
+			if err != nil {
+				wb.failed[p.key.String()] = err
+			}
+		}
+		// Closed under mu, for put to tell whether p is still uploading.
+		close(p.done)
+		wb.mu.Unlock()
+	}
+}
+
+func isDone(done <-chan struct{}) bool {
+	select {
+	case <-done:
+		return true
+	default:
+		return false
+	}
+}
+
+// wait blocks until every upload queued under prefix has finished and
+// returns, once, the errors of those that failed.
+func (wb *writeBehind) wait(ctx context.Context, prefix ds.Key) error {
+	return wb.waitFor(ctx, func(k ds.Key) bool { return hasKeyPrefix(k, prefix.String()) })
+}
+
+// waitKeys is wait for the uploads of keys.
+func (wb *writeBehind) waitKeys(ctx context.Context, keys []ds.Key) error {
+	set := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		set[k.String()] = true
+	}
+	return wb.waitFor(ctx, func(k ds.Key) bool { return set[k.String()] })
+}
+
+// waitFor is wait for the uploads of the keys match reports.
+func (wb *writeBehind) waitFor(ctx context.Context, match func(ds.Key) bool) error {
+	var waiting []chan struct{}
+	wb.mu.Lock()
+	for _, p := range wb.pending {
+		if match(p.key) {
+			waiting = append(waiting, p.done)
+		}
+	}
+	wb.mu.Unlock()
+
+	for _, done := range waiting {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	var errs []string
+	wb.mu.Lock()
+	for key, err := range wb.failed {
+		if match(ds.NewKey(key)) {
+			errs = append(errs, fmt.Sprintf("%s: %s", key, err))
+			delete(wb.failed, key)
+		}
+	}
+	wb.mu.Unlock()
+
+	if len(errs) > 0 {
+		return fmt.Errorf("s3ds: failed background uploads:\n%s", strings.Join(errs, "\n"))
+	}
+	return nil
+}
+
+// close stops the upload workers, which must be idle: the datastore drains
+// them first. Puts from then on fail with ErrClosed.
+func (wb *writeBehind) close() {
+	wb.sending.Lock()
+	wb.closed = true
+	for _, queue := range wb.queues {
+		close(queue)
+	}
+	wb.sending.Unlock()
+	wb.wg.Wait()
+}
+
+// Flush blocks until every Put accepted so far is durable in the bucket.
+// It is a no-op unless WriteBehind is enabled.
+func (s *S3Bucket) Flush() error {
+	if s.writeBehind == nil {
+		return nil
+	}
+	return s.writeBehind.wait(context.Background(), ds.NewKey("/"))
+}
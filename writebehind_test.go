@@ -0,0 +1,34 @@
+package s3_test
+
+import (
+	"context"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+
+	s3ds "github.com/ipfs-s3c-storj-plugin"
+)
+
+// TestWriteBehindOrder checks that the last Put of a key is the one that
+// lands, and that Puts after Close fail instead of being queued.
+func TestWriteBehindOrder(t *testing.T) {
+	ctx := context.Background()
+	d := newFakeDatastore(t, s3ds.Config{WriteBehind: true, Workers: 4})
+	k := ds.NewKey("/a")
+	for _, v := range []string{"1", "2", "3", "4", "5", "6", "7", "8"} {
+		if err := d.Put(ctx, k, []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	checkValue(t, d, k, []byte("8"))
+
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Put(ctx, k, []byte("9")); err != s3ds.ErrClosed {
+		t.Errorf("Put after Close: got %v, want ErrClosed", err)
+	}
+}